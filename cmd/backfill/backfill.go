@@ -0,0 +1,228 @@
+// Copyright 2021 The Conprof Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/conprof/db/tsdb"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/google/pprof/profile"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+const profileExt = ".pb.gz"
+
+// profileFile is a profile to backfill and the series it is appended to.
+// It is also the format of a manifest line.
+type profileFile struct {
+	Path   string            `json:"path"`
+	Labels map[string]string `json:"labels"`
+	// Timestamp in milliseconds. If it is zero, the time of the profile is used.
+	Timestamp int64 `json:"timestamp,omitempty"`
+}
+
+// readManifest reads profiles from a file with one JSON encoded profileFile per line.
+// Relative paths are resolved against the directory of the manifest.
+func readManifest(fn string) ([]profileFile, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var (
+		pfs  []profileFile
+		line int
+	)
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 1024*1024)
+	for s.Scan() {
+		line++
+		if strings.TrimSpace(s.Text()) == "" {
+			continue
+		}
+		var pf profileFile
+		if err := json.Unmarshal(s.Bytes(), &pf); err != nil {
+			return nil, errors.Wrapf(err, "parse manifest line %d", line)
+		}
+		if pf.Path == "" {
+			return nil, errors.Errorf("manifest line %d: missing path", line)
+		}
+		if !filepath.IsAbs(pf.Path) {
+			pf.Path = filepath.Join(filepath.Dir(fn), pf.Path)
+		}
+		pfs = append(pfs, pf)
+	}
+	if err := s.Err(); err != nil {
+		return nil, errors.Wrap(err, "read manifest")
+	}
+	return pfs, nil
+}
+
+// walkDir returns all profiles below dir. Directories named "<name>=<value>"
+// add the label to the profiles below them, e.g. a profile at
+// job=api/instance=a:8080/__name__=heap/1.pb.gz has three labels.
+func walkDir(dir string) ([]profileFile, error) {
+	var pfs []profileFile
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(info.Name(), profileExt) {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		pf := profileFile{Path: path, Labels: map[string]string{}}
+		for _, seg := range strings.Split(filepath.ToSlash(rel), "/") {
+			if i := strings.Index(seg, "="); i > 0 {
+				pf.Labels[seg[:i]] = seg[i+1:]
+			}
+		}
+		pfs = append(pfs, pf)
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "walk profiles")
+	}
+	return pfs, nil
+}
+
+// backfillProfile is a profile with its series and time resolved.
+type backfillProfile struct {
+	path string
+	lset labels.Labels
+	t    int64
+}
+
+// resolve determines the labels and timestamps of the profiles and sorts them by time.
+// Labels of the profile take precedence over the external labels.
+func resolve(pfs []profileFile, external labels.Labels) ([]backfillProfile, error) {
+	bps := make([]backfillProfile, 0, len(pfs))
+	for _, pf := range pfs {
+		b := labels.NewBuilder(external)
+		for n, v := range pf.Labels {
+			b.Set(n, v)
+		}
+		lset := b.Labels()
+		if len(lset) == 0 {
+			return nil, errors.Errorf("profile %s has no labels", pf.Path)
+		}
+
+		t := pf.Timestamp
+		if t == 0 {
+			data, err := ioutil.ReadFile(pf.Path)
+			if err != nil {
+				return nil, err
+			}
+			p, err := profile.ParseData(data)
+			if err != nil {
+				return nil, errors.Wrapf(err, "parse profile %s", pf.Path)
+			}
+			if p.TimeNanos == 0 {
+				return nil, errors.Errorf("profile %s has no timestamp", pf.Path)
+			}
+			t = p.TimeNanos / 1e6
+		}
+		bps = append(bps, backfillProfile{path: pf.Path, lset: lset, t: t})
+	}
+	// The head of a block writer only accepts samples within half a block
+	// of the latest one, so profiles are appended in time order.
+	sort.SliceStable(bps, func(i, j int) bool { return bps[i].t < bps[j].t })
+	return bps, nil
+}
+
+// backfill writes the profiles into blocks in the data directory dir.
+// Each block holds the profiles of one range of blockDuration, aligned as
+// the blocks of the DB are, and appends are committed every batchSize profiles.
+// The profiles must be sorted by time.
+func backfill(logger log.Logger, bps []backfillProfile, dir string, blockDuration int64, batchSize int) ([]ulid.ULID, error) {
+	if blockDuration <= 0 {
+		return nil, errors.Errorf("invalid block duration %d", blockDuration)
+	}
+	if batchSize <= 0 {
+		return nil, errors.Errorf("invalid batch size %d", batchSize)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+
+	var ids []ulid.ULID
+	for len(bps) > 0 {
+		mint := bps[0].t - bps[0].t%blockDuration
+		if bps[0].t < 0 && bps[0].t%blockDuration != 0 {
+			mint -= blockDuration
+		}
+		n := sort.Search(len(bps), func(i int) bool { return bps[i].t >= mint+blockDuration })
+
+		id, err := writeBlock(logger, bps[:n], dir, blockDuration, batchSize)
+		if err != nil {
+			return ids, errors.Wrapf(err, "write block for range [%d, %d)", mint, mint+blockDuration)
+		}
+		level.Info(logger).Log("msg", "Wrote block", "ulid", id, "profiles", n, "mint", mint, "maxt", mint+blockDuration)
+		ids = append(ids, id)
+		bps = bps[n:]
+	}
+	return ids, nil
+}
+
+// writeBlock writes a single block from profiles that lie within one block range.
+func writeBlock(logger log.Logger, bps []backfillProfile, dir string, blockDuration int64, batchSize int) (_ ulid.ULID, err error) {
+	w, err := tsdb.NewBlockWriter(logger, dir, blockDuration)
+	if err != nil {
+		return ulid.ULID{}, err
+	}
+	defer func() {
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+	}()
+
+	ctx := context.Background()
+	app := w.Appender(ctx)
+	for i, bp := range bps {
+		b, err := ioutil.ReadFile(bp.path)
+		if err != nil {
+			app.Rollback()
+			return ulid.ULID{}, err
+		}
+		if _, err := app.Add(bp.lset, bp.t, b); err != nil {
+			app.Rollback()
+			return ulid.ULID{}, errors.Wrapf(err, "add profile %s", bp.path)
+		}
+		if (i+1)%batchSize == 0 {
+			if err := app.Commit(); err != nil {
+				return ulid.ULID{}, errors.Wrap(err, "commit")
+			}
+			app = w.Appender(ctx)
+		}
+	}
+	if err := app.Commit(); err != nil {
+		return ulid.ULID{}, errors.Wrap(err, "commit")
+	}
+	return w.Flush(ctx)
+}
@@ -0,0 +1,149 @@
+// Copyright 2021 The Conprof Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/conprof/db/tsdb"
+	"github.com/go-kit/kit/log"
+	"github.com/google/pprof/profile"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/stretchr/testify/require"
+)
+
+func writeProfile(t *testing.T, fn string, ts int64, value int64) {
+	fun := &profile.Function{ID: 1, Name: "runtime.mallocgc"}
+	loc := &profile.Location{ID: 1, Line: []profile.Line{{Function: fun}}}
+	p := &profile.Profile{
+		SampleType: []*profile.ValueType{{Type: "alloc_space", Unit: "bytes"}},
+		Sample:     []*profile.Sample{{Location: []*profile.Location{loc}, Value: []int64{value}}},
+		Location:   []*profile.Location{loc},
+		Function:   []*profile.Function{fun},
+		TimeNanos:  ts * int64(time.Millisecond),
+	}
+	var buf bytes.Buffer
+	require.NoError(t, p.Write(&buf))
+	require.NoError(t, os.MkdirAll(filepath.Dir(fn), 0777))
+	require.NoError(t, ioutil.WriteFile(fn, buf.Bytes(), 0666))
+}
+
+// queryProfiles returns the values of the first sample of all profiles by series.
+func queryProfiles(t *testing.T, db *tsdb.DB) map[string][]int64 {
+	q, err := db.Querier(context.Background(), 0, 10*tsdb.DefaultBlockDuration)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, q.Close()) }()
+
+	res := map[string][]int64{}
+	ss := q.Select(false, nil, labels.MustNewMatcher(labels.MatchRegexp, "job", ".+"))
+	for ss.Next() {
+		it := ss.At().Iterator()
+		for it.Next() {
+			_, v := it.At()
+			p, err := profile.ParseData(v)
+			require.NoError(t, err)
+			res[ss.At().Labels().String()] = append(res[ss.At().Labels().String()], p.Sample[0].Value[0])
+		}
+		require.NoError(t, it.Err())
+	}
+	require.NoError(t, ss.Err())
+	return res
+}
+
+func TestBackfillDir(t *testing.T) {
+	in, err := ioutil.TempDir("", "backfill_in")
+	require.NoError(t, err)
+	defer func() { require.NoError(t, os.RemoveAll(in)) }()
+	out, err := ioutil.TempDir("", "backfill_out")
+	require.NoError(t, err)
+	defer func() { require.NoError(t, os.RemoveAll(out)) }()
+
+	d := tsdb.DefaultBlockDuration
+	// Profiles of two series spread over three block ranges, written out of order.
+	writeProfile(t, filepath.Join(in, "job=api", "__name__=heap", "3.pb.gz"), 2*d+10, 3)
+	writeProfile(t, filepath.Join(in, "job=api", "__name__=heap", "1.pb.gz"), 10, 1)
+	writeProfile(t, filepath.Join(in, "job=api", "__name__=heap", "2.pb.gz"), d-1, 2)
+	writeProfile(t, filepath.Join(in, "job=db", "__name__=heap", "1.pb.gz"), d, 4)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(in, "README"), []byte("not a profile"), 0666))
+
+	require.NoError(t, run(log.NewNopLogger(), in, "", out, labels.FromStrings("env", "prod"), time.Duration(d)*time.Millisecond, 1))
+
+	db, err := tsdb.Open(out, nil, nil, tsdb.DefaultOptions())
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+
+	blocks := db.Blocks()
+	require.Equal(t, 3, len(blocks))
+	for i, b := range blocks {
+		require.Equal(t, int64(i)*d, b.Meta().MinTime-b.Meta().MinTime%d)
+		require.LessOrEqual(t, b.Meta().MaxTime, int64(i+1)*d)
+	}
+	require.Equal(t, map[string][]int64{
+		`{__name__="heap", env="prod", job="api"}`: {1, 2, 3},
+		`{__name__="heap", env="prod", job="db"}`:  {4},
+	}, queryProfiles(t, db))
+}
+
+func TestBackfillManifest(t *testing.T) {
+	in, err := ioutil.TempDir("", "backfill_in")
+	require.NoError(t, err)
+	defer func() { require.NoError(t, os.RemoveAll(in)) }()
+	out, err := ioutil.TempDir("", "backfill_out")
+	require.NoError(t, err)
+	defer func() { require.NoError(t, os.RemoveAll(out)) }()
+
+	// The timestamp of the manifest takes precedence over the one of the profile.
+	writeProfile(t, filepath.Join(in, "a.pb.gz"), 0, 1)
+	writeProfile(t, filepath.Join(in, "b.pb.gz"), 500, 2)
+	manifest := `{"path": "b.pb.gz", "labels": {"job": "api", "env": "dev"}}
+
+{"path": "a.pb.gz", "labels": {"job": "api"}, "timestamp": 100}
+`
+	require.NoError(t, ioutil.WriteFile(filepath.Join(in, "manifest.jsonl"), []byte(manifest), 0666))
+
+	require.NoError(t, run(log.NewNopLogger(), "", filepath.Join(in, "manifest.jsonl"), out, labels.FromStrings("env", "prod"), 2*time.Hour, 1000))
+
+	db, err := tsdb.Open(out, nil, nil, tsdb.DefaultOptions())
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+
+	require.Equal(t, 1, len(db.Blocks()))
+	require.Equal(t, map[string][]int64{
+		`{env="dev", job="api"}`:  {2},
+		`{env="prod", job="api"}`: {1},
+	}, queryProfiles(t, db))
+}
+
+func TestBackfillErrors(t *testing.T) {
+	in, err := ioutil.TempDir("", "backfill_in")
+	require.NoError(t, err)
+	defer func() { require.NoError(t, os.RemoveAll(in)) }()
+
+	writeProfile(t, filepath.Join(in, "a.pb.gz"), 0, 1)
+
+	// Neither labels nor a timestamp can be determined.
+	_, err = resolve([]profileFile{{Path: filepath.Join(in, "a.pb.gz")}}, labels.FromStrings("job", "api"))
+	require.Error(t, err)
+	_, err = resolve([]profileFile{{Path: filepath.Join(in, "a.pb.gz"), Timestamp: 1}}, nil)
+	require.Error(t, err)
+
+	require.Error(t, run(log.NewNopLogger(), "", "", in, nil, 2*time.Hour, 1))
+	require.Error(t, run(log.NewNopLogger(), in, in, in, nil, 2*time.Hour, 1))
+}
@@ -0,0 +1,107 @@
+// Copyright 2021 The Conprof Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command backfill writes historic profiles into blocks of a DB data directory.
+//
+// Profiles are read from a directory of .pb.gz files or from a manifest with one
+// JSON object per line:
+//
+//	{"path": "heap/1.pb.gz", "labels": {"__name__": "heap", "job": "api"}, "timestamp": 1609459200000}
+//
+// Within a directory, the labels of a profile are taken from the names of its
+// parent directories of the form "<name>=<value>" and its timestamp is the time
+// of the profile. The written blocks are loaded by the DB on its next start.
+// They must not overlap blocks already in the data directory, unless the DB
+// allows overlapping blocks.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/conprof/db/tsdb"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+// labelFlags collects repeated "<name>=<value>" flags.
+type labelFlags labels.Labels
+
+func (f *labelFlags) String() string {
+	return labels.Labels(*f).String()
+}
+
+func (f *labelFlags) Set(s string) error {
+	i := strings.Index(s, "=")
+	if i <= 0 {
+		return fmt.Errorf("label %q is not of the form <name>=<value>", s)
+	}
+	*f = labelFlags(labels.NewBuilder(labels.Labels(*f)).Set(s[:i], s[i+1:]).Labels())
+	return nil
+}
+
+func main() {
+	var (
+		input         = flag.String("input", "", "Directory of .pb.gz profiles to backfill.")
+		manifest      = flag.String("manifest", "", "File listing the profiles to backfill, one JSON object per line.")
+		output        = flag.String("output", "data/", "Data directory of the DB to write the blocks to.")
+		blockDuration = flag.Duration("block-duration", time.Duration(tsdb.DefaultBlockDuration)*time.Millisecond, "Range of the written blocks. It should be the minimum block duration of the DB.")
+		batchSize     = flag.Int("batch-size", 1000, "Number of profiles to append before committing.")
+		external      labelFlags
+	)
+	flag.Var(&external, "label", "Label added to all profiles, as <name>=<value>. May be repeated.")
+	flag.Parse()
+
+	logger := log.NewLogfmtLogger(log.NewSyncWriter(os.Stderr))
+	logger = log.With(logger, "ts", log.DefaultTimestampUTC)
+
+	if err := run(logger, *input, *manifest, *output, labels.Labels(external), *blockDuration, *batchSize); err != nil {
+		level.Error(logger).Log("msg", "Backfill failed", "err", err)
+		os.Exit(1)
+	}
+}
+
+func run(logger log.Logger, input, manifest, output string, external labels.Labels, blockDuration time.Duration, batchSize int) error {
+	var (
+		pfs []profileFile
+		err error
+	)
+	switch {
+	case input != "" && manifest != "":
+		return fmt.Errorf("only one of -input and -manifest may be set")
+	case input != "":
+		pfs, err = walkDir(input)
+	case manifest != "":
+		pfs, err = readManifest(manifest)
+	default:
+		return fmt.Errorf("one of -input and -manifest must be set")
+	}
+	if err != nil {
+		return err
+	}
+
+	bps, err := resolve(pfs, external)
+	if err != nil {
+		return err
+	}
+	ids, err := backfill(logger, bps, output, blockDuration.Milliseconds(), batchSize)
+	if err != nil {
+		return err
+	}
+	level.Info(logger).Log("msg", "Backfill completed", "profiles", len(bps), "blocks", len(ids))
+	return nil
+}
@@ -15,7 +15,8 @@ require (
 	github.com/go-kit/kit v0.10.0
 	github.com/gogo/protobuf v1.3.1
 	github.com/golang/snappy v0.0.2
-	github.com/klauspost/compress v1.9.5
+	github.com/google/pprof v0.0.0-20210407192527-94a9f03dee38
+	github.com/klauspost/compress v1.17.9
 	github.com/oklog/ulid v1.3.1
 	github.com/opentracing-contrib/go-stdlib v1.0.0
 	github.com/opentracing/opentracing-go v1.2.0
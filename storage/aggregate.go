@@ -0,0 +1,196 @@
+// Copyright 2021 The Conprof Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"sort"
+
+	"github.com/conprof/db/tsdb/chunkenc"
+	"github.com/google/pprof/profile"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+// AggregatedProfile is the merge of the profiles of a group of series.
+type AggregatedProfile struct {
+	// Labels are the labels the series of the group have in common
+	// according to the grouping.
+	Labels  labels.Labels
+	Profile *profile.Profile
+	// NumProfiles is the number of profiles that were merged.
+	NumProfiles int
+}
+
+// AggregateProfiles merges the pprof profiles of the series matching the matchers
+// between hints.Start and hints.End, which must be set, into one profile per group.
+// With hints.By the series are grouped by the labels in hints.Grouping, otherwise
+// by all their labels except those in hints.Grouping. Unlike PromQL, the metric
+// name is only dropped if it is listed, as profiles of different types can not be
+// merged.
+//
+// Series are read one chunk at a time and the profiles of every chunk are merged
+// into the profile of their group right away, so memory is bounded by the size
+// of the merged profiles rather than the number of profiles.
+// Numeric series are skipped and values that are not pprof profiles are
+// reported as warnings.
+func AggregateProfiles(q ChunkQuerier, hints *SelectHints, ms ...*labels.Matcher) ([]AggregatedProfile, Warnings, error) {
+	if hints == nil {
+		return nil, nil, errors.New("aggregating profiles requires select hints")
+	}
+	var (
+		groups = map[string]*AggregatedProfile{}
+		ws     Warnings
+		batch  []*profile.Profile
+	)
+	set := q.Select(false, hints, ms...)
+	for set.Next() {
+		s := set.At()
+		lset := groupLabels(s.Labels(), hints)
+		key := lset.String()
+		g, ok := groups[key]
+		if !ok {
+			g = &AggregatedProfile{Labels: lset}
+		}
+
+		chks := s.Iterator()
+		for chks.Next() {
+			chk := chks.At()
+			if chk.Chunk.Encoding() == chunkenc.EncXOR || chk.MaxTime < hints.Start || chk.MinTime > hints.End {
+				continue
+			}
+			batch = batch[:0]
+			if g.Profile != nil {
+				batch = append(batch, g.Profile)
+			}
+			it := chk.Chunk.Iterator(nil)
+			for it.Next() {
+				t, v := it.At()
+				if t < hints.Start || t > hints.End {
+					continue
+				}
+				p, err := profile.ParseData(v)
+				if err != nil {
+					ws = append(ws, errors.Wrapf(err, "parse profile of %s at %d", s.Labels(), t))
+					continue
+				}
+				batch = append(batch, p)
+				g.NumProfiles++
+			}
+			if it.Err() != nil {
+				return nil, ws, errors.Wrapf(it.Err(), "iterate chunk of %s", s.Labels())
+			}
+			if len(batch) == 0 || len(batch) == 1 && g.Profile != nil {
+				continue
+			}
+			p, err := profile.Merge(batch)
+			if err != nil {
+				return nil, ws, errors.Wrapf(err, "merge profiles of %s into %s", s.Labels(), lset)
+			}
+			g.Profile = p
+		}
+		if chks.Err() != nil {
+			return nil, ws, errors.Wrapf(chks.Err(), "iterate chunks of %s", s.Labels())
+		}
+		if !ok && g.Profile != nil {
+			groups[key] = g
+		}
+	}
+	ws = append(ws, set.Warnings()...)
+	if set.Err() != nil {
+		return nil, ws, set.Err()
+	}
+
+	res := make([]AggregatedProfile, 0, len(groups))
+	for _, g := range groups {
+		res = append(res, *g)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return labels.Compare(res[i].Labels, res[j].Labels) < 0
+	})
+	return res, ws, nil
+}
+
+// groupLabels returns the labels of the group of a series.
+func groupLabels(lset labels.Labels, hints *SelectHints) labels.Labels {
+	if hints.By {
+		return lset.WithLabels(hints.Grouping...)
+	}
+	res := make(labels.Labels, 0, len(lset))
+Outer:
+	for _, l := range lset {
+		for _, n := range hints.Grouping {
+			if l.Name == n {
+				continue Outer
+			}
+		}
+		res = append(res, l)
+	}
+	return res
+}
+
+// ProfileSelection selects the profiles of the series matching Matchers
+// between Start and End.
+type ProfileSelection struct {
+	Start, End int64
+	Matchers   []*labels.Matcher
+}
+
+// DiffProfiles merges the profiles of both selections and returns the comparison
+// profile merged with the negated base profile, like pprof's -diff_base option.
+// Samples of the base are labeled pprof::base=true. The profile is nil if
+// neither selection has profiles.
+// Every selection is read with its own querier covering only its time range.
+func DiffProfiles(ctx context.Context, q ChunkQueryable, base, comparison ProfileSelection) (*profile.Profile, Warnings, error) {
+	b, ws, err := mergeSelection(ctx, q, base)
+	if err != nil {
+		return nil, ws, errors.Wrap(err, "base")
+	}
+	c, cws, err := mergeSelection(ctx, q, comparison)
+	ws = append(ws, cws...)
+	if err != nil {
+		return nil, ws, errors.Wrap(err, "comparison")
+	}
+	if b == nil {
+		return c, ws, nil
+	}
+	b.SetLabel("pprof::base", []string{"true"})
+	b.Scale(-1)
+	if c == nil {
+		return b, ws, nil
+	}
+	p, err := profile.Merge([]*profile.Profile{c, b})
+	if err != nil {
+		return nil, ws, errors.Wrap(err, "merge base into comparison")
+	}
+	return p, ws, nil
+}
+
+// mergeSelection merges all profiles of a selection into one.
+func mergeSelection(ctx context.Context, q ChunkQueryable, sel ProfileSelection) (_ *profile.Profile, ws Warnings, err error) {
+	cq, err := q.ChunkQuerier(ctx, sel.Start, sel.End)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		if cerr := cq.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	res, ws, err := AggregateProfiles(cq, &SelectHints{Start: sel.Start, End: sel.End, By: true}, sel.Matchers...)
+	if err != nil || len(res) == 0 {
+		return nil, ws, err
+	}
+	return res[0].Profile, ws, nil
+}
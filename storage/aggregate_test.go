@@ -0,0 +1,153 @@
+// Copyright 2021 The Conprof Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/conprof/db/tsdb/tsdbutil"
+	"github.com/google/pprof/profile"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/stretchr/testify/require"
+)
+
+// testProfile returns a serialized profile with one sample of value v per function.
+func testProfile(t *testing.T, v int64, fns ...string) []byte {
+	p := &profile.Profile{
+		SampleType: []*profile.ValueType{{Type: "samples", Unit: "count"}},
+		PeriodType: &profile.ValueType{Type: "cpu", Unit: "nanoseconds"},
+		Period:     1,
+	}
+	for i, name := range fns {
+		fn := &profile.Function{ID: uint64(i + 1), Name: name}
+		loc := &profile.Location{ID: uint64(i + 1), Line: []profile.Line{{Function: fn}}}
+		p.Function = append(p.Function, fn)
+		p.Location = append(p.Location, loc)
+		p.Sample = append(p.Sample, &profile.Sample{Location: []*profile.Location{loc}, Value: []int64{v}})
+	}
+	var buf bytes.Buffer
+	require.NoError(t, p.Write(&buf))
+	return buf.Bytes()
+}
+
+// totals returns the sum of the values of every function of p.
+func totals(p *profile.Profile) map[string]int64 {
+	res := map[string]int64{}
+	for _, s := range p.Sample {
+		res[s.Location[0].Line[0].Function.Name] += s.Value[0]
+	}
+	return res
+}
+
+func TestAggregateProfiles(t *testing.T) {
+	q := &mockChunkQurier{toReturn: []ChunkSeries{
+		NewListChunkSeriesFromSamples(labels.FromStrings("__name__", "cpu", "job", "a", "pod", "1"),
+			[]tsdbutil.Sample{sample{t: 1, v: testProfile(t, 1, "main", "run")}, sample{t: 2, v: testProfile(t, 2, "main")}},
+			[]tsdbutil.Sample{sample{t: 10, v: testProfile(t, 5, "main")}, sample{t: 20, v: testProfile(t, 100, "main")}},
+		),
+		NewListChunkSeriesFromSamples(labels.FromStrings("__name__", "cpu", "job", "a", "pod", "2"),
+			[]tsdbutil.Sample{sample{t: 3, v: testProfile(t, 3, "run")}, sample{t: 4, v: []byte("not a profile")}},
+		),
+		NewListChunkSeriesFromSamples(labels.FromStrings("__name__", "cpu", "job", "b", "pod", "1"),
+			[]tsdbutil.Sample{sample{t: 5, v: testProfile(t, 7, "gc")}},
+		),
+	}}
+
+	_, _, err := AggregateProfiles(q, nil)
+	require.Error(t, err)
+
+	res, ws, err := AggregateProfiles(q, &SelectHints{Start: 0, End: 10, Grouping: []string{"__name__", "job"}, By: true})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(ws))
+	require.Equal(t, 2, len(res))
+	require.Equal(t, labels.FromStrings("__name__", "cpu", "job", "a"), res[0].Labels)
+	require.Equal(t, 4, res[0].NumProfiles)
+	require.Equal(t, map[string]int64{"main": 8, "run": 4}, totals(res[0].Profile))
+	require.Equal(t, labels.FromStrings("__name__", "cpu", "job", "b"), res[1].Labels)
+	require.Equal(t, 1, res[1].NumProfiles)
+	require.Equal(t, map[string]int64{"gc": 7}, totals(res[1].Profile))
+
+	// Without pod, the metric name is kept.
+	res, _, err = AggregateProfiles(q, &SelectHints{Start: 0, End: 10, Grouping: []string{"pod"}})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res))
+	require.Equal(t, labels.FromStrings("__name__", "cpu", "job", "a"), res[0].Labels)
+	require.Equal(t, map[string]int64{"main": 8, "run": 4}, totals(res[0].Profile))
+}
+
+func TestDiffProfiles(t *testing.T) {
+	q := &selectionQueryable{t: t, series: []ChunkSeries{
+		NewListChunkSeriesFromSamples(labels.FromStrings("__name__", "cpu", "pod", "1"),
+			[]tsdbutil.Sample{sample{t: 1, v: testProfile(t, 10, "main", "run")}, sample{t: 2, v: testProfile(t, 20, "main")}},
+			[]tsdbutil.Sample{sample{t: 10, v: testProfile(t, 5, "main", "gc")}},
+		),
+	}}
+
+	// Comparison minus base per function.
+	diff := func(p *profile.Profile) map[string]int64 {
+		res := map[string]int64{}
+		for _, s := range p.Sample {
+			v := s.Value[0]
+			if s.HasLabel("pprof::base", "true") {
+				require.Less(t, v, int64(1))
+			}
+			res[s.Location[0].Line[0].Function.Name] += v
+		}
+		return res
+	}
+
+	p, ws, err := DiffProfiles(context.Background(), q, ProfileSelection{Start: 0, End: 5}, ProfileSelection{Start: 6, End: 15})
+	require.NoError(t, err)
+	require.Empty(t, ws)
+	require.Equal(t, [][2]int64{{0, 5}, {6, 15}}, q.ranges)
+	require.Equal(t, map[string]int64{"main": 5 - 30, "run": -10, "gc": 5}, diff(p))
+
+	p, _, err = DiffProfiles(context.Background(), q, ProfileSelection{Start: 6, End: 15}, ProfileSelection{Start: 100, End: 200})
+	require.NoError(t, err)
+	require.Equal(t, map[string]int64{"main": -5, "gc": -5}, diff(p))
+
+	p, _, err = DiffProfiles(context.Background(), q, ProfileSelection{Start: 100, End: 200}, ProfileSelection{Start: 100, End: 200})
+	require.NoError(t, err)
+	require.Nil(t, p)
+}
+
+// selectionQueryable returns a querier over its series for every call and fails
+// the test if a querier is selected from more than once.
+type selectionQueryable struct {
+	t      *testing.T
+	series []ChunkSeries
+	ranges [][2]int64
+}
+
+func (q *selectionQueryable) ChunkQuerier(_ context.Context, mint, maxt int64) (ChunkQuerier, error) {
+	q.ranges = append(q.ranges, [2]int64{mint, maxt})
+	return &onceChunkQuerier{t: q.t, mockChunkQurier: mockChunkQurier{toReturn: q.series}}, nil
+}
+
+type onceChunkQuerier struct {
+	mockChunkQurier
+
+	t        *testing.T
+	selected bool
+}
+
+func (q *onceChunkQuerier) Select(sortSeries bool, hints *SelectHints, ms ...*labels.Matcher) ChunkSeriesSet {
+	require.False(q.t, q.selected, "select called twice on the same querier")
+	q.selected = true
+	return q.mockChunkQurier.Select(sortSeries, hints, ms...)
+}
+
+func (q *onceChunkQuerier) Close() error { return nil }
@@ -13,233 +13,389 @@
 
 package storage_test
 
-//import (
-//	"context"
-//	"testing"
-//
-//	"github.com/pkg/errors"
-//	"github.com/prometheus/common/model"
-//	"github.com/stretchr/testify/require"
-//
-//	"github.com/prometheus/prometheus/pkg/labels"
-//	"github.com/prometheus/prometheus/storage"
-//	"github.com/prometheus/prometheus/util/teststorage"
-//)
-//
-//func TestFanout_SelectSorted(t *testing.T) {
-//	inputLabel := labels.FromStrings(model.MetricNameLabel, "a")
-//	outputLabel := labels.FromStrings(model.MetricNameLabel, "a")
-//
-//	inputTotalSize := 0
-//	ctx := context.Background()
-//
-//	priStorage := teststorage.New(t)
-//	defer priStorage.Close()
-//	app1 := priStorage.Appender(ctx)
-//	app1.Add(inputLabel, 0, 0)
-//	inputTotalSize++
-//	app1.Add(inputLabel, 1000, 1)
-//	inputTotalSize++
-//	app1.Add(inputLabel, 2000, 2)
-//	inputTotalSize++
-//	err := app1.Commit()
-//	require.NoError(t, err)
-//
-//	remoteStorage1 := teststorage.New(t)
-//	defer remoteStorage1.Close()
-//	app2 := remoteStorage1.Appender(ctx)
-//	app2.Add(inputLabel, 3000, 3)
-//	inputTotalSize++
-//	app2.Add(inputLabel, 4000, 4)
-//	inputTotalSize++
-//	app2.Add(inputLabel, 5000, 5)
-//	inputTotalSize++
-//	err = app2.Commit()
-//	require.NoError(t, err)
-//
-//	remoteStorage2 := teststorage.New(t)
-//	defer remoteStorage2.Close()
-//
-//	app3 := remoteStorage2.Appender(ctx)
-//	app3.Add(inputLabel, 6000, 6)
-//	inputTotalSize++
-//	app3.Add(inputLabel, 7000, 7)
-//	inputTotalSize++
-//	app3.Add(inputLabel, 8000, 8)
-//	inputTotalSize++
-//
-//	err = app3.Commit()
-//	require.NoError(t, err)
-//
-//	fanoutStorage := storage.NewFanout(nil, priStorage, remoteStorage1, remoteStorage2)
-//
-//	t.Run("querier", func(t *testing.T) {
-//		querier, err := fanoutStorage.Querier(context.Background(), 0, 8000)
-//		require.NoError(t, err)
-//		defer querier.Close()
-//
-//		matcher, err := labels.NewMatcher(labels.MatchEqual, model.MetricNameLabel, "a")
-//		require.NoError(t, err)
-//
-//		seriesSet := querier.Select(true, nil, matcher)
-//
-//		result := make(map[int64]float64)
-//		var labelsResult labels.Labels
-//		for seriesSet.Next() {
-//			series := seriesSet.At()
-//			seriesLabels := series.Labels()
-//			labelsResult = seriesLabels
-//			iterator := series.Iterator()
-//			for iterator.Next() {
-//				timestamp, value := iterator.At()
-//				result[timestamp] = value
-//			}
-//		}
-//
-//		require.Equal(t, labelsResult, outputLabel)
-//		require.Equal(t, inputTotalSize, len(result))
-//	})
-//	t.Run("chunk querier", func(t *testing.T) {
-//		querier, err := fanoutStorage.ChunkQuerier(ctx, 0, 8000)
-//		require.NoError(t, err)
-//		defer querier.Close()
-//
-//		matcher, err := labels.NewMatcher(labels.MatchEqual, model.MetricNameLabel, "a")
-//		require.NoError(t, err)
-//
-//		seriesSet := storage.NewSeriesSetFromChunkSeriesSet(querier.Select(true, nil, matcher))
-//
-//		result := make(map[int64]float64)
-//		var labelsResult labels.Labels
-//		for seriesSet.Next() {
-//			series := seriesSet.At()
-//			seriesLabels := series.Labels()
-//			labelsResult = seriesLabels
-//			iterator := series.Iterator()
-//			for iterator.Next() {
-//				timestamp, value := iterator.At()
-//				result[timestamp] = value
-//			}
-//		}
-//
-//		require.NoError(t, seriesSet.Err())
-//		require.Equal(t, labelsResult, outputLabel)
-//		require.Equal(t, inputTotalSize, len(result))
-//	})
-//}
-//
-//func TestFanoutErrors(t *testing.T) {
-//	workingStorage := teststorage.New(t)
-//	defer workingStorage.Close()
-//
-//	cases := []struct {
-//		primary   storage.Storage
-//		secondary storage.Storage
-//		warning   error
-//		err       error
-//	}{
-//		{
-//			primary:   workingStorage,
-//			secondary: errStorage{},
-//			warning:   errSelect,
-//			err:       nil,
-//		},
-//		{
-//			primary:   errStorage{},
-//			secondary: workingStorage,
-//			warning:   nil,
-//			err:       errSelect,
-//		},
-//	}
-//
-//	for _, tc := range cases {
-//		fanoutStorage := storage.NewFanout(nil, tc.primary, tc.secondary)
-//
-//		t.Run("samples", func(t *testing.T) {
-//			querier, err := fanoutStorage.Querier(context.Background(), 0, 8000)
-//			require.NoError(t, err)
-//			defer querier.Close()
-//
-//			matcher := labels.MustNewMatcher(labels.MatchEqual, "a", "b")
-//			ss := querier.Select(true, nil, matcher)
-//
-//			// Exhaust.
-//			for ss.Next() {
-//				ss.At()
-//			}
-//
-//			if tc.err != nil {
-//				require.Error(t, ss.Err())
-//				require.Equal(t, tc.err.Error(), ss.Err().Error())
-//			}
-//
-//			if tc.warning != nil {
-//				require.Greater(t, len(ss.Warnings()), 0, "warnings expected")
-//				require.Error(t, ss.Warnings()[0])
-//				require.Equal(t, tc.warning.Error(), ss.Warnings()[0].Error())
-//			}
-//		})
-//		t.Run("chunks", func(t *testing.T) {
-//			t.Skip("enable once TestStorage and TSDB implements ChunkQuerier")
-//			querier, err := fanoutStorage.ChunkQuerier(context.Background(), 0, 8000)
-//			require.NoError(t, err)
-//			defer querier.Close()
-//
-//			matcher := labels.MustNewMatcher(labels.MatchEqual, "a", "b")
-//			ss := querier.Select(true, nil, matcher)
-//
-//			// Exhaust.
-//			for ss.Next() {
-//				ss.At()
-//			}
-//
-//			if tc.err != nil {
-//				require.Error(t, ss.Err())
-//				require.Equal(t, tc.err.Error(), ss.Err().Error())
-//			}
-//
-//			if tc.warning != nil {
-//				require.Greater(t, len(ss.Warnings()), 0, "warnings expected")
-//				require.Error(t, ss.Warnings()[0])
-//				require.Equal(t, tc.warning.Error(), ss.Warnings()[0].Error())
-//			}
-//		})
-//	}
-//}
-//
-//var errSelect = errors.New("select error")
-//
-//type errStorage struct{}
-//
-//type errQuerier struct{}
-//
-//func (errStorage) Querier(_ context.Context, _, _ int64) (storage.Querier, error) {
-//	return errQuerier{}, nil
-//}
-//
-//type errChunkQuerier struct{ errQuerier }
-//
-//func (errStorage) ChunkQuerier(_ context.Context, _, _ int64) (storage.ChunkQuerier, error) {
-//	return errChunkQuerier{}, nil
-//}
-//func (errStorage) Appender(_ context.Context) storage.Appender { return nil }
-//func (errStorage) StartTime() (int64, error)                   { return 0, nil }
-//func (errStorage) Close() error                                { return nil }
-//
-//func (errQuerier) Select(bool, *storage.SelectHints, ...*labels.Matcher) storage.SeriesSet {
-//	return storage.ErrSeriesSet(errSelect)
-//}
-//
-//func (errQuerier) LabelValues(name string) ([]string, storage.Warnings, error) {
-//	return nil, nil, errors.New("label values error")
-//}
-//
-//func (errQuerier) LabelNames() ([]string, storage.Warnings, error) {
-//	return nil, nil, errors.New("label names error")
-//}
-//
-//func (errQuerier) Close() error { return nil }
-//
-//func (errChunkQuerier) Select(bool, *storage.SelectHints, ...*labels.Matcher) storage.ChunkSeriesSet {
-//	return storage.ErrChunkSeriesSet(errSelect)
-//}
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/stretchr/testify/require"
+
+	"github.com/conprof/db/storage"
+	"github.com/conprof/db/tsdb"
+)
+
+// newTestStorage returns a TSDB in a temporary directory that is removed on Close.
+func newTestStorage(t *testing.T) storage.Storage {
+	dir, err := ioutil.TempDir("", "fanout_test")
+	require.NoError(t, err)
+
+	db, err := tsdb.Open(dir, nil, nil, tsdb.DefaultOptions())
+	require.NoError(t, err)
+	return testStorage{DB: db, dir: dir}
+}
+
+type testStorage struct {
+	*tsdb.DB
+	dir string
+}
+
+func (s testStorage) Close() error {
+	if err := s.DB.Close(); err != nil {
+		return err
+	}
+	return os.RemoveAll(s.dir)
+}
+
+func TestFanout_SelectSorted(t *testing.T) {
+	inputLabel := labels.FromStrings(model.MetricNameLabel, "a")
+	outputLabel := labels.FromStrings(model.MetricNameLabel, "a")
+
+	inputTotalSize := 0
+	ctx := context.Background()
+
+	priStorage := newTestStorage(t)
+	defer priStorage.Close()
+	app1 := priStorage.Appender(ctx)
+	app1.Add(inputLabel, 0, []byte("0"))
+	inputTotalSize++
+	app1.Add(inputLabel, 1000, []byte("1"))
+	inputTotalSize++
+	app1.Add(inputLabel, 2000, []byte("2"))
+	inputTotalSize++
+	err := app1.Commit()
+	require.NoError(t, err)
+
+	remoteStorage1 := newTestStorage(t)
+	defer remoteStorage1.Close()
+	app2 := remoteStorage1.Appender(ctx)
+	app2.Add(inputLabel, 3000, []byte("3"))
+	inputTotalSize++
+	app2.Add(inputLabel, 4000, []byte("4"))
+	inputTotalSize++
+	app2.Add(inputLabel, 5000, []byte("5"))
+	inputTotalSize++
+	err = app2.Commit()
+	require.NoError(t, err)
+
+	remoteStorage2 := newTestStorage(t)
+	defer remoteStorage2.Close()
+
+	app3 := remoteStorage2.Appender(ctx)
+	app3.Add(inputLabel, 6000, []byte("6"))
+	inputTotalSize++
+	app3.Add(inputLabel, 7000, []byte("7"))
+	inputTotalSize++
+	app3.Add(inputLabel, 8000, []byte("8"))
+	inputTotalSize++
+
+	err = app3.Commit()
+	require.NoError(t, err)
+
+	fanoutStorage := storage.NewFanout(nil, priStorage, remoteStorage1, remoteStorage2)
+
+	t.Run("querier", func(t *testing.T) {
+		querier, err := fanoutStorage.Querier(context.Background(), 0, 8000)
+		require.NoError(t, err)
+		defer querier.Close()
+
+		matcher, err := labels.NewMatcher(labels.MatchEqual, model.MetricNameLabel, "a")
+		require.NoError(t, err)
+
+		seriesSet := querier.Select(true, nil, matcher)
+
+		result := make(map[int64][]byte)
+		var labelsResult labels.Labels
+		for seriesSet.Next() {
+			series := seriesSet.At()
+			seriesLabels := series.Labels()
+			labelsResult = seriesLabels
+			iterator := series.Iterator()
+			for iterator.Next() {
+				timestamp, value := iterator.At()
+				result[timestamp] = append([]byte(nil), value...)
+			}
+		}
+
+		require.Equal(t, labelsResult, outputLabel)
+		require.Equal(t, inputTotalSize, len(result))
+		require.Equal(t, []byte("5"), result[5000])
+	})
+	t.Run("chunk querier", func(t *testing.T) {
+		querier, err := fanoutStorage.ChunkQuerier(ctx, 0, 8000)
+		require.NoError(t, err)
+		defer querier.Close()
+
+		matcher, err := labels.NewMatcher(labels.MatchEqual, model.MetricNameLabel, "a")
+		require.NoError(t, err)
+
+		seriesSet := storage.NewSeriesSetFromChunkSeriesSet(querier.Select(true, nil, matcher))
+
+		result := make(map[int64][]byte)
+		var labelsResult labels.Labels
+		for seriesSet.Next() {
+			series := seriesSet.At()
+			seriesLabels := series.Labels()
+			labelsResult = seriesLabels
+			iterator := series.Iterator()
+			for iterator.Next() {
+				timestamp, value := iterator.At()
+				result[timestamp] = append([]byte(nil), value...)
+			}
+		}
+
+		require.NoError(t, seriesSet.Err())
+		require.Equal(t, labelsResult, outputLabel)
+		require.Equal(t, inputTotalSize, len(result))
+		require.Equal(t, []byte("5"), result[5000])
+	})
+}
+
+func TestFanoutErrors(t *testing.T) {
+	workingStorage := newTestStorage(t)
+	defer workingStorage.Close()
+
+	cases := []struct {
+		primary   storage.Storage
+		secondary storage.Storage
+		warning   error
+		err       error
+	}{
+		{
+			primary:   workingStorage,
+			secondary: errStorage{},
+			warning:   errSelect,
+			err:       nil,
+		},
+		{
+			primary:   errStorage{},
+			secondary: workingStorage,
+			warning:   nil,
+			err:       errSelect,
+		},
+	}
+
+	for _, tc := range cases {
+		fanoutStorage := storage.NewFanout(nil, tc.primary, tc.secondary)
+
+		t.Run("samples", func(t *testing.T) {
+			querier, err := fanoutStorage.Querier(context.Background(), 0, 8000)
+			require.NoError(t, err)
+			defer querier.Close()
+
+			matcher := labels.MustNewMatcher(labels.MatchEqual, "a", "b")
+			ss := querier.Select(true, nil, matcher)
+
+			// Exhaust.
+			for ss.Next() {
+				ss.At()
+			}
+
+			if tc.err != nil {
+				require.Error(t, ss.Err())
+				require.Equal(t, tc.err.Error(), ss.Err().Error())
+			}
+
+			if tc.warning != nil {
+				require.Greater(t, len(ss.Warnings()), 0, "warnings expected")
+				require.Error(t, ss.Warnings()[0])
+				require.Equal(t, tc.warning.Error(), ss.Warnings()[0].Error())
+			}
+		})
+		t.Run("chunks", func(t *testing.T) {
+			querier, err := fanoutStorage.ChunkQuerier(context.Background(), 0, 8000)
+			require.NoError(t, err)
+			defer querier.Close()
+
+			matcher := labels.MustNewMatcher(labels.MatchEqual, "a", "b")
+			ss := querier.Select(true, nil, matcher)
+
+			// Exhaust.
+			for ss.Next() {
+				ss.At()
+			}
+
+			if tc.err != nil {
+				require.Error(t, ss.Err())
+				require.Equal(t, tc.err.Error(), ss.Err().Error())
+			}
+
+			if tc.warning != nil {
+				require.Greater(t, len(ss.Warnings()), 0, "warnings expected")
+				require.Error(t, ss.Warnings()[0])
+				require.Equal(t, tc.warning.Error(), ss.Warnings()[0].Error())
+			}
+		})
+	}
+}
+
+func TestFanoutAppender(t *testing.T) {
+	lbls := labels.FromStrings(model.MetricNameLabel, "heap")
+
+	t.Run("commit", func(t *testing.T) {
+		primary, secondary := &recordingStorage{}, &recordingStorage{}
+		app := storage.NewFanout(nil, primary, secondary).Appender(context.Background())
+
+		ref, err := app.Add(lbls, 0, []byte("a"))
+		require.NoError(t, err)
+		require.NoError(t, app.AddFast(ref, 1, []byte("b")))
+		ref, err = app.AddFloat(lbls, 0, 1.5)
+		require.NoError(t, err)
+		require.NoError(t, app.AddFloatFast(ref, 1, 2))
+		require.NoError(t, app.Commit())
+
+		for _, s := range []*recordingStorage{primary, secondary} {
+			require.Equal(t, []string{"add 0 a", "add 1 b", "add 0 1.5", "add 1 2", "commit"}, s.app.calls)
+		}
+	})
+	t.Run("failing primary commit", func(t *testing.T) {
+		primary := &recordingStorage{app: recordingAppender{commitErr: errCommit}}
+		secondary, other := &recordingStorage{}, &recordingStorage{}
+		app := storage.NewFanout(nil, primary, secondary, other).Appender(context.Background())
+
+		_, err := app.Add(lbls, 0, []byte("a"))
+		require.NoError(t, err)
+		require.Equal(t, errCommit, app.Commit())
+
+		// Secondaries must not persist samples the primary rejected.
+		require.Equal(t, []string{"add 0 a", "commit"}, primary.app.calls)
+		require.Equal(t, []string{"add 0 a", "rollback"}, secondary.app.calls)
+		require.Equal(t, []string{"add 0 a", "rollback"}, other.app.calls)
+	})
+	t.Run("failing secondary commit", func(t *testing.T) {
+		primary, other := &recordingStorage{}, &recordingStorage{}
+		secondary := &recordingStorage{app: recordingAppender{commitErr: errCommit}}
+		app := storage.NewFanout(nil, primary, secondary, other).Appender(context.Background())
+
+		_, err := app.Add(lbls, 0, []byte("a"))
+		require.NoError(t, err)
+		require.Equal(t, errCommit, app.Commit())
+
+		require.Equal(t, []string{"add 0 a", "commit"}, primary.app.calls)
+		require.Equal(t, []string{"add 0 a", "commit"}, secondary.app.calls)
+		require.Equal(t, []string{"add 0 a", "rollback"}, other.app.calls)
+	})
+	t.Run("failing secondary add", func(t *testing.T) {
+		primary := &recordingStorage{}
+		secondary := &recordingStorage{app: recordingAppender{addErr: errAdd}}
+		app := storage.NewFanout(nil, primary, secondary).Appender(context.Background())
+
+		_, err := app.Add(lbls, 0, []byte("a"))
+		require.Equal(t, errAdd, err)
+		require.NoError(t, app.Rollback())
+
+		require.Equal(t, []string{"add 0 a", "rollback"}, primary.app.calls)
+		require.Equal(t, []string{"rollback"}, secondary.app.calls)
+	})
+	t.Run("failing rollback", func(t *testing.T) {
+		primary := &recordingStorage{}
+		secondary := &recordingStorage{app: recordingAppender{rollbackErr: errRollback}}
+		other := &recordingStorage{app: recordingAppender{rollbackErr: fmt.Errorf("squashed")}}
+		app := storage.NewFanout(nil, primary, secondary, other).Appender(context.Background())
+
+		require.Equal(t, errRollback, app.Rollback())
+		require.Equal(t, []string{"rollback"}, other.app.calls)
+	})
+}
+
+var (
+	errSelect   = errors.New("select error")
+	errAdd      = errors.New("add error")
+	errCommit   = errors.New("commit error")
+	errRollback = errors.New("rollback error")
+)
+
+type errStorage struct{}
+
+type errQuerier struct{}
+
+func (errStorage) Querier(_ context.Context, _, _ int64) (storage.Querier, error) {
+	return errQuerier{}, nil
+}
+
+type errChunkQuerier struct{ errQuerier }
+
+func (errStorage) ChunkQuerier(_ context.Context, _, _ int64) (storage.ChunkQuerier, error) {
+	return errChunkQuerier{}, nil
+}
+func (errStorage) Appender(_ context.Context) storage.Appender { return nil }
+func (errStorage) StartTime() (int64, error)                   { return 0, nil }
+func (errStorage) Close() error                                { return nil }
+
+func (errQuerier) Select(bool, *storage.SelectHints, ...*labels.Matcher) storage.SeriesSet {
+	return storage.ErrSeriesSet(errSelect)
+}
+
+func (errQuerier) LabelValues(name string) ([]string, storage.Warnings, error) {
+	return nil, nil, errors.New("label values error")
+}
+
+func (errQuerier) LabelNames() ([]string, storage.Warnings, error) {
+	return nil, nil, errors.New("label names error")
+}
+
+func (errQuerier) Close() error { return nil }
+
+func (errChunkQuerier) Select(bool, *storage.SelectHints, ...*labels.Matcher) storage.ChunkSeriesSet {
+	return storage.ErrChunkSeriesSet(errSelect)
+}
+
+// recordingStorage is a storage whose appender records the calls it receives.
+type recordingStorage struct {
+	errStorage
+	app recordingAppender
+}
+
+func (s *recordingStorage) Appender(_ context.Context) storage.Appender { return &s.app }
+
+type recordingAppender struct {
+	calls []string
+
+	addErr, commitErr, rollbackErr error
+}
+
+func (a *recordingAppender) Add(_ labels.Labels, t int64, v []byte) (uint64, error) {
+	if a.addErr != nil {
+		return 0, a.addErr
+	}
+	a.calls = append(a.calls, fmt.Sprintf("add %d %s", t, v))
+	return 1, nil
+}
+
+func (a *recordingAppender) AddFast(_ uint64, t int64, v []byte) error {
+	if a.addErr != nil {
+		return a.addErr
+	}
+	a.calls = append(a.calls, fmt.Sprintf("add %d %s", t, v))
+	return nil
+}
+
+func (a *recordingAppender) AddFloat(_ labels.Labels, t int64, v float64) (uint64, error) {
+	if a.addErr != nil {
+		return 0, a.addErr
+	}
+	a.calls = append(a.calls, fmt.Sprintf("add %d %g", t, v))
+	return 1, nil
+}
+
+func (a *recordingAppender) AddFloatFast(_ uint64, t int64, v float64) error {
+	if a.addErr != nil {
+		return a.addErr
+	}
+	a.calls = append(a.calls, fmt.Sprintf("add %d %g", t, v))
+	return nil
+}
+
+func (a *recordingAppender) Commit() error {
+	a.calls = append(a.calls, "commit")
+	return a.commitErr
+}
+
+func (a *recordingAppender) Rollback() error {
+	a.calls = append(a.calls, "rollback")
+	return a.rollbackErr
+}
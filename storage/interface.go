@@ -28,6 +28,11 @@ var (
 	ErrOutOfOrderSample            = errors.New("out of order sample")
 	ErrDuplicateSampleForTimestamp = errors.New("duplicate sample for timestamp")
 	ErrOutOfBounds                 = errors.New("out of bounds")
+	ErrSampleTypeMismatch          = errors.New("sample type does not match series")
+	ErrTooManySeries               = errors.New("too many series")
+	ErrTooManyNewSeries            = errors.New("too many new series in one commit")
+	ErrSampleTooLarge              = errors.New("sample too large")
+	ErrIngestionRateLimited        = errors.New("ingestion rate limit exceeded")
 )
 
 // Appendable allows creating appenders.
@@ -116,8 +121,49 @@ type SelectHints struct {
 	Grouping []string // List of label names used in aggregation.
 	By       bool     // Indicate whether it is without or by.
 	Range    int64    // Range vector selector range in milliseconds.
+
+	// Projection selects the parts of the samples to return. For ProjectionFull,
+	// the Funcs "series" and "timestamps" select ProjectionLabels and
+	// ProjectionTimestamps as they did before projections were added.
+	Projection Projection
+
+	Limit       int    // Maximum number of series to return, 0 for no limit.
+	SampleLimit int    // Maximum number of samples to return per series, 0 for no limit.
+	Order       Order  // Order in which SampleLimit and After pick samples, which are still returned oldest first.
+	After       string // Continuation token to resume from, see Continuation.
 }
 
+// Order selects from which end of the requested time range samples are picked
+// when the number of samples is limited. Iterators always return samples in
+// increasing time order.
+type Order int
+
+const (
+	// OrderOldestFirst picks the oldest samples first.
+	OrderOldestFirst Order = iota
+	// OrderNewestFirst picks the newest samples first, e.g. to list the latest profiles.
+	// The picked samples are still returned oldest first.
+	OrderNewestFirst
+)
+
+// Projection selects which parts of the samples of the selected series are read.
+type Projection int
+
+const (
+	// ProjectionFull returns the samples with their values.
+	ProjectionFull Projection = iota
+	// ProjectionLabels returns the series without reading any chunks,
+	// e.g. for the series API. Their iterators return no samples.
+	ProjectionLabels
+	// ProjectionTimestamps returns the timestamps of the samples. Values are nil.
+	ProjectionTimestamps
+	// ProjectionTimestampsAndSizes returns the timestamps of the samples and the
+	// uncompressed sizes of their values, which sample iterators return with
+	// chunkenc.AtSize. Values are nil. Overlapping chunks that a chunk querier
+	// merges into one only keep their timestamps.
+	ProjectionTimestampsAndSizes
+)
+
 // TODO(bwplotka): Move to promql/engine_test.go?
 // QueryableFunc is an adapter to allow the use of ordinary functions as
 // Queryables. It follows the idea of http.HandlerFunc.
@@ -146,6 +192,15 @@ type Appender interface {
 	// faster than adding a sample by providing its full label set.
 	AddFast(ref uint64, t int64, v []byte) error
 
+	// AddFloat adds a numeric sample pair for the given series, such as a
+	// value derived from a profile. A series holds either profiles or numeric
+	// samples, adding the other kind fails with ErrSampleTypeMismatch.
+	// Returned reference numbers behave like those of Add.
+	AddFloat(l labels.Labels, t int64, v float64) (uint64, error)
+
+	// AddFloatFast adds a numeric sample pair for the referenced series.
+	AddFloatFast(ref uint64, t int64, v float64) error
+
 	// Commit submits the collected samples and purges the batch. If Commit
 	// returns a non-nil error, it also rolls back all modifications made in
 	// the appender so far, as Rollback would do. In any case, an Appender
@@ -105,6 +105,21 @@ func (q *mergeGenericQuerier) Select(sortSeries bool, hints *SelectHints, matche
 		return q.queriers[0].Select(sortSeries, hints, matchers...)
 	}
 
+	// Every querier applies the limits of the hints itself, the merge applies
+	// them again to the merged series.
+	var (
+		limit   int
+		mergeFn = q.mergeFn
+	)
+	if hints != nil {
+		limit = hints.Limit
+		if hints.SampleLimit > 0 {
+			mergeFn = func(s ...Labels) Labels {
+				return limitSamples(q.mergeFn(s...), hints)
+			}
+		}
+	}
+
 	var seriesSets = make([]genericSeriesSet, 0, len(q.queriers))
 	if !q.concurrentSelect {
 		for _, querier := range q.queriers {
@@ -112,7 +127,7 @@ func (q *mergeGenericQuerier) Select(sortSeries bool, hints *SelectHints, matche
 			seriesSets = append(seriesSets, querier.Select(true, hints, matchers...))
 		}
 		return &lazyGenericSeriesSet{init: func() (genericSeriesSet, bool) {
-			s := newGenericMergeSeriesSet(seriesSets, q.mergeFn)
+			s := newLimitedGenericMergeSeriesSet(seriesSets, mergeFn, limit)
 			return s, s.Next()
 		}}
 	}
@@ -140,7 +155,7 @@ func (q *mergeGenericQuerier) Select(sortSeries bool, hints *SelectHints, matche
 		seriesSets = append(seriesSets, r)
 	}
 	return &lazyGenericSeriesSet{init: func() (genericSeriesSet, bool) {
-		s := newGenericMergeSeriesSet(seriesSets, q.mergeFn)
+		s := newLimitedGenericMergeSeriesSet(seriesSets, mergeFn, limit)
 		return s, s.Next()
 	}}
 }
@@ -295,6 +310,9 @@ type genericMergeSeriesSet struct {
 	heap        genericSeriesSetHeap
 	sets        []genericSeriesSet
 	currentSets []genericSeriesSet
+
+	// limit is the maximum number of series to return, 0 for no limit.
+	limit, n int
 }
 
 // newGenericMergeSeriesSet returns a new genericSeriesSet that merges (and deduplicates)
@@ -303,7 +321,13 @@ type genericMergeSeriesSet struct {
 // merged series set will be incorrect.
 // Overlapped situations are merged using provided mergeFunc.
 func newGenericMergeSeriesSet(sets []genericSeriesSet, mergeFunc genericSeriesMergeFunc) genericSeriesSet {
-	if len(sets) == 1 {
+	return newLimitedGenericMergeSeriesSet(sets, mergeFunc, 0)
+}
+
+// newLimitedGenericMergeSeriesSet returns a merged series set that stops after
+// limit series, or never if limit is 0.
+func newLimitedGenericMergeSeriesSet(sets []genericSeriesSet, mergeFunc genericSeriesMergeFunc, limit int) genericSeriesSet {
+	if len(sets) == 1 && limit == 0 {
 		return sets[0]
 	}
 
@@ -325,10 +349,14 @@ func newGenericMergeSeriesSet(sets []genericSeriesSet, mergeFunc genericSeriesMe
 		mergeFunc: mergeFunc,
 		sets:      sets,
 		heap:      h,
+		limit:     limit,
 	}
 }
 
 func (c *genericMergeSeriesSet) Next() bool {
+	if c.limit > 0 && c.n >= c.limit {
+		return false
+	}
 	// Run in a loop because the "next" series sets may not be valid anymore.
 	// If, for the current label set, all the next series sets come from
 	// failed remote storage sources, we want to keep trying with the next label set.
@@ -359,6 +387,7 @@ func (c *genericMergeSeriesSet) Next() bool {
 			break
 		}
 	}
+	c.n++
 	return true
 }
 
@@ -478,6 +507,13 @@ func (c *chainSampleIterator) At() (t int64, v []byte) {
 	return c.curr.At()
 }
 
+func (c *chainSampleIterator) AtSize() (int64, int) {
+	if c.curr == nil {
+		panic("chainSampleIterator.AtSize() called before first .Next() or after .Next() returned false.")
+	}
+	return chunkenc.AtSize(c.curr)
+}
+
 func (c *chainSampleIterator) Next() bool {
 	if c.h == nil {
 		c.h = samplesIteratorHeap{}
@@ -675,7 +711,10 @@ func (c *compactChunkIterator) Next() bool {
 	}
 
 	// Add last as it's not yet included in overlap. We operate on same series, so labels does not matter here.
-	iter = (&seriesToChunkEncoder{Series: c.mergeFunc(append(overlapping, newChunkToSeriesDecoder(nil, c.curr))...)}).Iterator()
+	iter = (&seriesToChunkEncoder{
+		Series: c.mergeFunc(append(overlapping, newChunkToSeriesDecoder(nil, c.curr))...),
+		float:  c.curr.Chunk.Encoding() == chunkenc.EncXOR,
+	}).Iterator()
 	if !iter.Next() {
 		if c.err = iter.Err(); c.err != nil {
 			return false
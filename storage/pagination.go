@@ -0,0 +1,222 @@
+// Copyright 2021 The Conprof Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"math"
+
+	"github.com/conprof/db/tsdb/chunkenc"
+	"github.com/conprof/db/tsdb/chunks"
+	"github.com/conprof/db/tsdb/encoding"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+// Continuation is the position of the last series, or sample of a series,
+// a client has read. Selects with its token in SelectHints.After return the
+// series sorted by labels and skip everything up to and including that position.
+type Continuation struct {
+	// Labels are the labels of the last series that was read.
+	Labels labels.Labels
+	// Partial is set if the series was not read entirely, e.g. because of
+	// SelectHints.SampleLimit. The series is then returned again with the
+	// samples after T in the order of the select.
+	Partial bool
+	// T is the timestamp of the last sample of the series that was read.
+	T int64
+}
+
+// Token returns the opaque continuation token of c.
+func (c Continuation) Token() string {
+	e := encoding.Encbuf{B: make([]byte, 0, 64)}
+	if c.Partial {
+		e.PutByte(1)
+		e.PutVarint64(c.T)
+	} else {
+		e.PutByte(0)
+	}
+	e.PutUvarint(len(c.Labels))
+	for _, l := range c.Labels {
+		e.PutUvarintStr(l.Name)
+		e.PutUvarintStr(l.Value)
+	}
+	return base64.RawURLEncoding.EncodeToString(e.Get())
+}
+
+// ParseContinuationToken parses a token returned by Continuation.Token.
+// It returns nil for an empty token.
+func ParseContinuationToken(token string) (*Continuation, error) {
+	if token == "" {
+		return nil, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, errors.Wrap(err, "decode continuation token")
+	}
+	invalid := errors.New("invalid continuation token")
+	if len(b) == 0 || b[0] > 1 {
+		return nil, invalid
+	}
+	c := &Continuation{Partial: b[0] == 1}
+	b = b[1:]
+	if c.Partial {
+		t, n := binary.Varint(b)
+		if n <= 0 {
+			return nil, invalid
+		}
+		c.T, b = t, b[n:]
+	}
+	num, n := binary.Uvarint(b)
+	if n <= 0 || num > uint64(len(b)) {
+		return nil, invalid
+	}
+	b = b[n:]
+	str := func() (string, bool) {
+		l, n := binary.Uvarint(b)
+		if n <= 0 || uint64(len(b)-n) < l {
+			return "", false
+		}
+		s := string(b[n : n+int(l)])
+		b = b[n+int(l):]
+		return s, true
+	}
+	c.Labels = make(labels.Labels, 0, num)
+	for i := uint64(0); i < num; i++ {
+		name, ok := str()
+		if !ok {
+			return nil, invalid
+		}
+		value, ok := str()
+		if !ok {
+			return nil, invalid
+		}
+		c.Labels = append(c.Labels, labels.Label{Name: name, Value: value})
+	}
+	if len(b) != 0 {
+		return nil, invalid
+	}
+	return c, nil
+}
+
+// limitSamples applies the sample limit of hints to a merged series, as the
+// series it was merged from were limited separately. The samples are read
+// twice: once to find the bounds of the limited samples and once to return them.
+func limitSamples(s Labels, hints *SelectHints) Labels {
+	switch s := s.(type) {
+	case Series:
+		return &SeriesEntry{
+			Lset: s.Labels(),
+			SampleIteratorFn: func() chunkenc.Iterator {
+				return newLimitedSampleIterator(s.Iterator, hints.SampleLimit, hints.Order)
+			},
+		}
+	case ChunkSeries:
+		return &ChunkSeriesEntry{
+			Lset: s.Labels(),
+			ChunkIteratorFn: func() chunks.Iterator {
+				chks, err := ExpandChunks(s.Iterator())
+				if err != nil {
+					return errChunksIterator{err: err}
+				}
+				if len(chks) == 0 {
+					return NewListChunkSeriesIterator()
+				}
+				iteratorFn := func() chunkenc.Iterator {
+					its := make([]chunkenc.Iterator, 0, len(chks))
+					for _, chk := range chks {
+						its = append(its, chk.Chunk.Iterator(nil))
+					}
+					return newChainSampleIterator(its)
+				}
+				return (&seriesToChunkEncoder{
+					Series: &SeriesEntry{
+						Lset: s.Labels(),
+						SampleIteratorFn: func() chunkenc.Iterator {
+							return newLimitedSampleIterator(iteratorFn, hints.SampleLimit, hints.Order)
+						},
+					},
+					float: chks[0].Chunk.Encoding() == chunkenc.EncXOR,
+				}).Iterator()
+			},
+		}
+	}
+	return s
+}
+
+// newLimitedSampleIterator returns an iterator over the first n samples in
+// the given order of the iterators returned by iteratorFn, in increasing
+// time order either way.
+func newLimitedSampleIterator(iteratorFn func() chunkenc.Iterator, n int, order Order) chunkenc.Iterator {
+	it := iteratorFn()
+	mint, maxt := int64(math.MinInt64), int64(math.MaxInt64)
+	if order == OrderNewestFirst {
+		// Keep the timestamps of the last n samples in a ring.
+		ring := make([]int64, 0, n)
+		var i int
+		for ; it.Next(); i++ {
+			t, _ := it.At()
+			if len(ring) < n {
+				ring = append(ring, t)
+			} else {
+				ring[i%n] = t
+			}
+		}
+		if i > n {
+			mint = ring[i%n]
+		}
+	} else {
+		for i := 0; i < n && it.Next(); i++ {
+			maxt, _ = it.At()
+		}
+		if !it.Next() {
+			maxt = math.MaxInt64
+		}
+	}
+	if it.Err() != nil {
+		return it
+	}
+	return &boundedIterator{Iterator: iteratorFn(), mint: mint, maxt: maxt}
+}
+
+// boundedIterator returns the samples of an iterator between mint and maxt.
+type boundedIterator struct {
+	chunkenc.Iterator
+	mint, maxt int64
+}
+
+func (it *boundedIterator) Next() bool {
+	if !it.Iterator.Next() {
+		return false
+	}
+	if t, _ := it.Iterator.At(); t < it.mint {
+		return it.Seek(it.mint)
+	}
+	return it.inBounds()
+}
+
+func (it *boundedIterator) Seek(t int64) bool {
+	if t < it.mint {
+		t = it.mint
+	}
+	return it.Iterator.Seek(t) && it.inBounds()
+}
+
+func (it *boundedIterator) inBounds() bool {
+	t, _ := it.Iterator.At()
+	return t <= it.maxt
+}
+
+func (it *boundedIterator) AtSize() (int64, int) { return chunkenc.AtSize(it.Iterator) }
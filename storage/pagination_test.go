@@ -0,0 +1,118 @@
+// Copyright 2021 The Conprof Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"math"
+	"testing"
+
+	"github.com/conprof/db/tsdb/tsdbutil"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContinuationToken(t *testing.T) {
+	c, err := ParseContinuationToken("")
+	require.NoError(t, err)
+	require.Nil(t, c)
+
+	for _, exp := range []Continuation{
+		{Labels: labels.FromStrings("__name__", "heap", "pod", "1")},
+		{Labels: labels.FromStrings("a", ""), Partial: true, T: -5},
+		{Labels: labels.Labels{}, Partial: true, T: math.MaxInt64},
+	} {
+		c, err := ParseContinuationToken(exp.Token())
+		require.NoError(t, err)
+		require.Equal(t, exp, *c)
+	}
+
+	for _, token := range []string{"!", "Ag", "AAU", Continuation{Labels: labels.FromStrings("a", "b")}.Token() + "AA"} {
+		_, err := ParseContinuationToken(token)
+		require.Error(t, err, token)
+	}
+}
+
+func TestMergeQuerierLimits(t *testing.T) {
+	s := func(ts ...int64) []tsdbutil.Sample {
+		res := make([]tsdbutil.Sample, 0, len(ts))
+		for _, t := range ts {
+			res = append(res, sample{t: t, v: []byte{byte(t)}})
+		}
+		return res
+	}
+	a, b, c := labels.FromStrings("a", "a"), labels.FromStrings("a", "b"), labels.FromStrings("a", "c")
+
+	// The mocks ignore the hints, so the limits are only applied by the merge.
+	q := NewMergeQuerier([]Querier{
+		&mockQuerier{toReturn: []Series{NewListSeries(a, s(1, 2, 3)), NewListSeries(b, s(1))}},
+		&mockQuerier{toReturn: []Series{NewListSeries(a, s(3, 4, 5)), NewListSeries(c, s(1))}},
+	}, nil, ChainedSeriesMerge)
+	cq := NewMergeChunkQuerier([]ChunkQuerier{
+		&mockChunkQurier{toReturn: []ChunkSeries{NewListChunkSeriesFromSamples(a, s(1, 2), s(3)), NewListChunkSeriesFromSamples(b, s(1))}},
+		&mockChunkQurier{toReturn: []ChunkSeries{NewListChunkSeriesFromSamples(a, s(3, 4, 5)), NewListChunkSeriesFromSamples(c, s(1))}},
+	}, nil, NewCompactingChunkSeriesMerger(ChainedSeriesMerge))
+
+	for _, tc := range []struct {
+		hints *SelectHints
+		exp   []Series
+	}{
+		{
+			hints: &SelectHints{Limit: 2, SampleLimit: 2},
+			exp:   []Series{NewListSeries(a, s(1, 2)), NewListSeries(b, s(1))},
+		},
+		{
+			hints: &SelectHints{Limit: 1, SampleLimit: 2, Order: OrderNewestFirst},
+			exp:   []Series{NewListSeries(a, s(4, 5))},
+		},
+		{
+			hints: &SelectHints{SampleLimit: 10, Order: OrderNewestFirst},
+			exp:   []Series{NewListSeries(a, s(1, 2, 3, 4, 5)), NewListSeries(b, s(1)), NewListSeries(c, s(1))},
+		},
+	} {
+		ss := q.Select(false, tc.hints)
+		var got []Series
+		for ss.Next() {
+			got = append(got, ss.At())
+		}
+		require.NoError(t, ss.Err())
+		require.Equal(t, len(tc.exp), len(got))
+		for i, exp := range tc.exp {
+			require.Equal(t, exp.Labels(), got[i].Labels())
+			expSmpls, err := ExpandSamples(exp.Iterator(), nil)
+			require.NoError(t, err)
+			smpls, err := ExpandSamples(got[i].Iterator(), nil)
+			require.NoError(t, err)
+			require.Equal(t, expSmpls, smpls)
+		}
+
+		css := cq.Select(false, tc.hints)
+		i := 0
+		for ; css.Next(); i++ {
+			require.Equal(t, tc.exp[i].Labels(), css.At().Labels())
+			expSmpls, err := ExpandSamples(tc.exp[i].Iterator(), nil)
+			require.NoError(t, err)
+			var smpls []tsdbutil.Sample
+			chks := css.At().Iterator()
+			for chks.Next() {
+				s, err := ExpandSamples(chks.At().Chunk.Iterator(nil), nil)
+				require.NoError(t, err)
+				smpls = append(smpls, s...)
+			}
+			require.NoError(t, chks.Err())
+			require.Equal(t, expSmpls, smpls)
+		}
+		require.NoError(t, css.Err())
+		require.Equal(t, len(tc.exp), i)
+	}
+}
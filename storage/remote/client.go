@@ -35,7 +35,7 @@ import (
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/common/version"
 
-	"github.com/prometheus/prometheus/prompb"
+	"github.com/conprof/db/profpb"
 )
 
 const maxErrMsgLen = 512
@@ -99,7 +99,7 @@ type ClientConfig struct {
 // ReadClient uses the SAMPLES method of remote read to read series samples from remote server.
 // TODO(bwplotka): Add streamed chunked remote read method as well (https://github.com/prometheus/prometheus/issues/5926).
 type ReadClient interface {
-	Read(ctx context.Context, query *prompb.Query) (*prompb.QueryResult, error)
+	Read(ctx context.Context, query *profpb.Query) (*profpb.QueryResult, error)
 }
 
 // NewReadClient creates a new client for remote read.
@@ -214,14 +214,14 @@ func (c Client) Endpoint() string {
 }
 
 // Read reads from a remote endpoint.
-func (c *Client) Read(ctx context.Context, query *prompb.Query) (*prompb.QueryResult, error) {
+func (c *Client) Read(ctx context.Context, query *profpb.Query) (*profpb.QueryResult, error) {
 	c.readQueries.Inc()
 	defer c.readQueries.Dec()
 
-	req := &prompb.ReadRequest{
+	req := &profpb.ReadRequest{
 		// TODO: Support batching multiple queries into one read request,
 		// as the protobuf interface allows for it.
-		Queries: []*prompb.Query{
+		Queries: []*profpb.Query{
 			query,
 		},
 	}
@@ -283,7 +283,7 @@ func (c *Client) Read(ctx context.Context, query *prompb.Query) (*prompb.QueryRe
 		return nil, errors.Wrap(err, "error reading response")
 	}
 
-	var resp prompb.ReadResponse
+	var resp profpb.ReadResponse
 	err = proto.Unmarshal(uncompressed, &resp)
 	if err != nil {
 		return nil, errors.Wrap(err, "unable to unmarshal response body")
@@ -25,12 +25,12 @@ import (
 	"github.com/golang/snappy"
 	"github.com/pkg/errors"
 	"github.com/prometheus/common/model"
-
 	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/pkg/textparse"
-	"github.com/prometheus/prometheus/prompb"
-	"github.com/prometheus/prometheus/storage"
-	"github.com/prometheus/prometheus/tsdb/chunkenc"
+
+	"github.com/conprof/db/profpb"
+	"github.com/conprof/db/storage"
+	"github.com/conprof/db/tsdb/chunkenc"
 )
 
 // decodeReadLimit is the maximum size of a read request body in bytes.
@@ -50,7 +50,7 @@ func (e HTTPError) Status() int {
 }
 
 // DecodeReadRequest reads a remote.Request from a http.Request.
-func DecodeReadRequest(r *http.Request) (*prompb.ReadRequest, error) {
+func DecodeReadRequest(r *http.Request) (*profpb.ReadRequest, error) {
 	compressed, err := ioutil.ReadAll(io.LimitReader(r.Body, decodeReadLimit))
 	if err != nil {
 		return nil, err
@@ -61,7 +61,7 @@ func DecodeReadRequest(r *http.Request) (*prompb.ReadRequest, error) {
 		return nil, err
 	}
 
-	var req prompb.ReadRequest
+	var req profpb.ReadRequest
 	if err := proto.Unmarshal(reqBuf, &req); err != nil {
 		return nil, err
 	}
@@ -70,7 +70,7 @@ func DecodeReadRequest(r *http.Request) (*prompb.ReadRequest, error) {
 }
 
 // EncodeReadResponse writes a remote.Response to a http.ResponseWriter.
-func EncodeReadResponse(resp *prompb.ReadResponse, w http.ResponseWriter) error {
+func EncodeReadResponse(resp *profpb.ReadResponse, w http.ResponseWriter) error {
 	data, err := proto.Marshal(resp)
 	if err != nil {
 		return err
@@ -81,16 +81,37 @@ func EncodeReadResponse(resp *prompb.ReadResponse, w http.ResponseWriter) error
 	return err
 }
 
+// DecodeWriteRequest from an io.Reader into a profpb.WriteRequest, handling
+// snappy decompression.
+func DecodeWriteRequest(r io.Reader) (*profpb.WriteRequest, error) {
+	compressed, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	reqBuf, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return nil, err
+	}
+
+	var req profpb.WriteRequest
+	if err := proto.Unmarshal(reqBuf, &req); err != nil {
+		return nil, err
+	}
+
+	return &req, nil
+}
+
 // ToQuery builds a Query proto.
-func ToQuery(from, to int64, matchers []*labels.Matcher, hints *storage.SelectHints) (*prompb.Query, error) {
+func ToQuery(from, to int64, matchers []*labels.Matcher, hints *storage.SelectHints) (*profpb.Query, error) {
 	ms, err := toLabelMatchers(matchers)
 	if err != nil {
 		return nil, err
 	}
 
-	var rp *prompb.ReadHints
+	var rp *profpb.ReadHints
 	if hints != nil {
-		rp = &prompb.ReadHints{
+		rp = &profpb.ReadHints{
 			StartMs:  hints.Start,
 			EndMs:    hints.End,
 			StepMs:   hints.Step,
@@ -101,7 +122,7 @@ func ToQuery(from, to int64, matchers []*labels.Matcher, hints *storage.SelectHi
 		}
 	}
 
-	return &prompb.Query{
+	return &profpb.Query{
 		StartTimestampMs: from,
 		EndTimestampMs:   to,
 		Matchers:         ms,
@@ -110,13 +131,13 @@ func ToQuery(from, to int64, matchers []*labels.Matcher, hints *storage.SelectHi
 }
 
 // ToQueryResult builds a QueryResult proto.
-func ToQueryResult(ss storage.SeriesSet, sampleLimit int) (*prompb.QueryResult, storage.Warnings, error) {
+func ToQueryResult(ss storage.SeriesSet, sampleLimit int) (*profpb.QueryResult, storage.Warnings, error) {
 	numSamples := 0
-	resp := &prompb.QueryResult{}
+	resp := &profpb.QueryResult{}
 	for ss.Next() {
 		series := ss.At()
 		iter := series.Iterator()
-		samples := []prompb.Sample{}
+		samples := []profpb.Sample{}
 
 		for iter.Next() {
 			numSamples++
@@ -127,7 +148,7 @@ func ToQueryResult(ss storage.SeriesSet, sampleLimit int) (*prompb.QueryResult,
 				}
 			}
 			ts, val := iter.At()
-			samples = append(samples, prompb.Sample{
+			samples = append(samples, profpb.Sample{
 				Timestamp: ts,
 				Value:     val,
 			})
@@ -136,7 +157,7 @@ func ToQueryResult(ss storage.SeriesSet, sampleLimit int) (*prompb.QueryResult,
 			return nil, ss.Warnings(), err
 		}
 
-		resp.Timeseries = append(resp.Timeseries, &prompb.TimeSeries{
+		resp.Timeseries = append(resp.Timeseries, &profpb.TimeSeries{
 			Labels:  labelsToLabelsProto(series.Labels(), nil),
 			Samples: samples,
 		})
@@ -145,7 +166,7 @@ func ToQueryResult(ss storage.SeriesSet, sampleLimit int) (*prompb.QueryResult,
 }
 
 // FromQueryResult unpacks and sorts a QueryResult proto.
-func FromQueryResult(sortSeries bool, res *prompb.QueryResult) storage.SeriesSet {
+func FromQueryResult(sortSeries bool, res *profpb.QueryResult) storage.SeriesSet {
 	series := make([]storage.Series, 0, len(res.Timeseries))
 	for _, ts := range res.Timeseries {
 		lbls := labelProtosToLabels(ts.Labels)
@@ -165,14 +186,14 @@ func FromQueryResult(sortSeries bool, res *prompb.QueryResult) storage.SeriesSet
 
 // NegotiateResponseType returns first accepted response type that this server supports.
 // On the empty accepted list we assume that the SAMPLES response type was requested. This is to maintain backward compatibility.
-func NegotiateResponseType(accepted []prompb.ReadRequest_ResponseType) (prompb.ReadRequest_ResponseType, error) {
+func NegotiateResponseType(accepted []profpb.ReadRequest_ResponseType) (profpb.ReadRequest_ResponseType, error) {
 	if len(accepted) == 0 {
-		accepted = []prompb.ReadRequest_ResponseType{prompb.ReadRequest_SAMPLES}
+		accepted = []profpb.ReadRequest_ResponseType{profpb.ReadRequest_SAMPLES}
 	}
 
-	supported := map[prompb.ReadRequest_ResponseType]struct{}{
-		prompb.ReadRequest_SAMPLES:             {},
-		prompb.ReadRequest_STREAMED_XOR_CHUNKS: {},
+	supported := map[profpb.ReadRequest_ResponseType]struct{}{
+		profpb.ReadRequest_SAMPLES:               {},
+		profpb.ReadRequest_STREAMED_BYTES_CHUNKS: {},
 	}
 
 	for _, resType := range accepted {
@@ -189,12 +210,12 @@ func StreamChunkedReadResponses(
 	stream io.Writer,
 	queryIndex int64,
 	ss storage.ChunkSeriesSet,
-	sortedExternalLabels []prompb.Label,
+	sortedExternalLabels []profpb.Label,
 	maxBytesInFrame int,
 ) (storage.Warnings, error) {
 	var (
-		chks []prompb.Chunk
-		lbls []prompb.Label
+		chks []profpb.Chunk
+		lbls []profpb.Label
 	)
 
 	for ss.Next() {
@@ -217,12 +238,21 @@ func StreamChunkedReadResponses(
 				return ss.Warnings(), errors.Errorf("StreamChunkedReadResponses: found not populated chunk returned by SeriesSet at ref: %v", chk.Ref)
 			}
 
+			c, err := streamableChunk(chk.Chunk)
+			if err != nil {
+				return ss.Warnings(), errors.Wrapf(err, "StreamChunkedReadResponses: recode chunk at ref: %v", chk.Ref)
+			}
+			data, err := c.Bytes()
+			if err != nil {
+				return ss.Warnings(), errors.Wrapf(err, "StreamChunkedReadResponses: get bytes of chunk at ref: %v", chk.Ref)
+			}
+
 			// Cut the chunk.
-			chks = append(chks, prompb.Chunk{
+			chks = append(chks, profpb.Chunk{
 				MinTimeMs: chk.MinTime,
 				MaxTimeMs: chk.MaxTime,
-				Type:      prompb.Chunk_Encoding(chk.Chunk.Encoding()),
-				Data:      chk.Chunk.Bytes(),
+				Type:      profpb.Chunk_Encoding(c.Encoding()),
+				Data:      data,
 			})
 			frameBytesLeft -= chks[len(chks)-1].Size()
 
@@ -232,8 +262,8 @@ func StreamChunkedReadResponses(
 				continue
 			}
 
-			b, err := proto.Marshal(&prompb.ChunkedReadResponse{
-				ChunkedSeries: []*prompb.ChunkedSeries{
+			b, err := proto.Marshal(&profpb.ChunkedReadResponse{
+				ChunkedSeries: []*profpb.ChunkedSeries{
 					{Labels: lbls, Chunks: chks},
 				},
 				QueryIndex: queryIndex,
@@ -254,10 +284,31 @@ func StreamChunkedReadResponses(
 	return ss.Warnings(), ss.Err()
 }
 
+// streamableChunk returns c in an encoding that clients can decode. Chunks
+// compressed with the dictionary of their block are recoded, as dictionaries
+// are not streamed.
+func streamableChunk(c chunkenc.Chunk) (chunkenc.Chunk, error) {
+	switch c.Encoding() {
+	case chunkenc.EncBytesDict, chunkenc.EncBytesFramed:
+	default:
+		return c, nil
+	}
+	recoded := chunkenc.NewBytesChunk()
+	app, err := recoded.Appender()
+	if err != nil {
+		return nil, err
+	}
+	it := c.Iterator(nil)
+	for it.Next() {
+		app.Append(it.At())
+	}
+	return recoded, it.Err()
+}
+
 // MergeLabels merges two sets of sorted proto labels, preferring those in
 // primary to those in secondary when there is an overlap.
-func MergeLabels(primary, secondary []prompb.Label) []prompb.Label {
-	result := make([]prompb.Label, 0, len(primary)+len(secondary))
+func MergeLabels(primary, secondary []profpb.Label) []profpb.Label {
+	result := make([]profpb.Label, 0, len(primary)+len(secondary))
 	i, j := 0, 0
 	for i < len(primary) && j < len(secondary) {
 		if primary[i].Name < secondary[j].Name {
@@ -330,7 +381,7 @@ func (c *concreteSeriesSet) Warnings() storage.Warnings { return nil }
 // concreteSeries implements storage.Series.
 type concreteSeries struct {
 	labels  labels.Labels
-	samples []prompb.Sample
+	samples []profpb.Sample
 }
 
 func (c *concreteSeries) Labels() labels.Labels {
@@ -363,7 +414,7 @@ func (c *concreteSeriesIterator) Seek(t int64) bool {
 }
 
 // At implements storage.SeriesIterator.
-func (c *concreteSeriesIterator) At() (t int64, v float64) {
+func (c *concreteSeriesIterator) At() (t int64, v []byte) {
 	s := c.series.samples[c.cur]
 	return s.Timestamp, s.Value
 }
@@ -399,23 +450,23 @@ func validateLabelsAndMetricName(ls labels.Labels) error {
 	return nil
 }
 
-func toLabelMatchers(matchers []*labels.Matcher) ([]*prompb.LabelMatcher, error) {
-	pbMatchers := make([]*prompb.LabelMatcher, 0, len(matchers))
+func toLabelMatchers(matchers []*labels.Matcher) ([]*profpb.LabelMatcher, error) {
+	pbMatchers := make([]*profpb.LabelMatcher, 0, len(matchers))
 	for _, m := range matchers {
-		var mType prompb.LabelMatcher_Type
+		var mType profpb.LabelMatcher_Type
 		switch m.Type {
 		case labels.MatchEqual:
-			mType = prompb.LabelMatcher_EQ
+			mType = profpb.LabelMatcher_EQ
 		case labels.MatchNotEqual:
-			mType = prompb.LabelMatcher_NEQ
+			mType = profpb.LabelMatcher_NEQ
 		case labels.MatchRegexp:
-			mType = prompb.LabelMatcher_RE
+			mType = profpb.LabelMatcher_RE
 		case labels.MatchNotRegexp:
-			mType = prompb.LabelMatcher_NRE
+			mType = profpb.LabelMatcher_NRE
 		default:
 			return nil, errors.New("invalid matcher type")
 		}
-		pbMatchers = append(pbMatchers, &prompb.LabelMatcher{
+		pbMatchers = append(pbMatchers, &profpb.LabelMatcher{
 			Type:  mType,
 			Name:  m.Name,
 			Value: m.Value,
@@ -425,18 +476,18 @@ func toLabelMatchers(matchers []*labels.Matcher) ([]*prompb.LabelMatcher, error)
 }
 
 // FromLabelMatchers parses protobuf label matchers to Prometheus label matchers.
-func FromLabelMatchers(matchers []*prompb.LabelMatcher) ([]*labels.Matcher, error) {
+func FromLabelMatchers(matchers []*profpb.LabelMatcher) ([]*labels.Matcher, error) {
 	result := make([]*labels.Matcher, 0, len(matchers))
 	for _, matcher := range matchers {
 		var mtype labels.MatchType
 		switch matcher.Type {
-		case prompb.LabelMatcher_EQ:
+		case profpb.LabelMatcher_EQ:
 			mtype = labels.MatchEqual
-		case prompb.LabelMatcher_NEQ:
+		case profpb.LabelMatcher_NEQ:
 			mtype = labels.MatchNotEqual
-		case prompb.LabelMatcher_RE:
+		case profpb.LabelMatcher_RE:
 			mtype = labels.MatchRegexp
-		case prompb.LabelMatcher_NRE:
+		case profpb.LabelMatcher_NRE:
 			mtype = labels.MatchNotRegexp
 		default:
 			return nil, errors.New("invalid matcher type")
@@ -450,8 +501,8 @@ func FromLabelMatchers(matchers []*prompb.LabelMatcher) ([]*labels.Matcher, erro
 	return result, nil
 }
 
-// LabelProtosToMetric unpack a []*prompb.Label to a model.Metric.
-func LabelProtosToMetric(labelPairs []*prompb.Label) model.Metric {
+// LabelProtosToMetric unpack a []*profpb.Label to a model.Metric.
+func LabelProtosToMetric(labelPairs []*profpb.Label) model.Metric {
 	metric := make(model.Metric, len(labelPairs))
 	for _, l := range labelPairs {
 		metric[model.LabelName(l.Name)] = model.LabelValue(l.Value)
@@ -459,7 +510,7 @@ func LabelProtosToMetric(labelPairs []*prompb.Label) model.Metric {
 	return metric
 }
 
-func labelProtosToLabels(labelPairs []prompb.Label) labels.Labels {
+func labelProtosToLabels(labelPairs []profpb.Label) labels.Labels {
 	result := make(labels.Labels, 0, len(labelPairs))
 	for _, l := range labelPairs {
 		result = append(result, labels.Label{
@@ -471,15 +522,15 @@ func labelProtosToLabels(labelPairs []prompb.Label) labels.Labels {
 	return result
 }
 
-// labelsToLabelsProto transforms labels into prompb labels. The buffer slice
+// labelsToLabelsProto transforms labels into profpb labels. The buffer slice
 // will be used to avoid allocations if it is big enough to store the labels.
-func labelsToLabelsProto(labels labels.Labels, buf []prompb.Label) []prompb.Label {
+func labelsToLabelsProto(labels labels.Labels, buf []profpb.Label) []profpb.Label {
 	result := buf[:0]
 	if cap(buf) < len(labels) {
-		result = make([]prompb.Label, 0, len(labels))
+		result = make([]profpb.Label, 0, len(labels))
 	}
 	for _, l := range labels {
-		result = append(result, prompb.Label{
+		result = append(result, profpb.Label{
 			Name:  l.Name,
 			Value: l.Value,
 		})
@@ -487,13 +538,13 @@ func labelsToLabelsProto(labels labels.Labels, buf []prompb.Label) []prompb.Labe
 	return result
 }
 
-// metricTypeToMetricTypeProto transforms a Prometheus metricType into prompb metricType. Since the former is a string we need to transform it to an enum.
-func metricTypeToMetricTypeProto(t textparse.MetricType) prompb.MetricMetadata_MetricType {
+// metricTypeToMetricTypeProto transforms a Prometheus metricType into profpb metricType. Since the former is a string we need to transform it to an enum.
+func metricTypeToMetricTypeProto(t textparse.MetricType) profpb.MetricMetadata_MetricType {
 	mt := strings.ToUpper(string(t))
-	v, ok := prompb.MetricMetadata_MetricType_value[mt]
+	v, ok := profpb.MetricMetadata_MetricType_value[mt]
 	if !ok {
-		return prompb.MetricMetadata_UNKNOWN
+		return profpb.MetricMetadata_UNKNOWN
 	}
 
-	return prompb.MetricMetadata_MetricType(v)
+	return profpb.MetricMetadata_MetricType(v)
 }
@@ -15,14 +15,20 @@ package remote
 
 import (
 	"fmt"
+	"io"
+	"net/http/httptest"
+	"strconv"
+	"strings"
 	"testing"
 
-	"github.com/stretchr/testify/require"
-
 	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/pkg/textparse"
-	"github.com/prometheus/prometheus/prompb"
-	"github.com/prometheus/prometheus/storage"
+	"github.com/stretchr/testify/require"
+
+	"github.com/conprof/db/profpb"
+	"github.com/conprof/db/storage"
+	"github.com/conprof/db/tsdb/chunkenc"
+	"github.com/conprof/db/tsdb/chunks"
 )
 
 func TestValidateLabelsAndMetricName(t *testing.T) {
@@ -128,11 +134,11 @@ func TestValidateLabelsAndMetricName(t *testing.T) {
 func TestConcreteSeriesSet(t *testing.T) {
 	series1 := &concreteSeries{
 		labels:  labels.FromStrings("foo", "bar"),
-		samples: []prompb.Sample{{Value: 1, Timestamp: 2}},
+		samples: []profpb.Sample{{Value: []byte("a"), Timestamp: 2}},
 	}
 	series2 := &concreteSeries{
 		labels:  labels.FromStrings("foo", "baz"),
-		samples: []prompb.Sample{{Value: 3, Timestamp: 4}},
+		samples: []profpb.Sample{{Value: []byte("b"), Timestamp: 4}},
 	}
 	c := &concreteSeriesSet{
 		series: []storage.Series{series1, series2},
@@ -164,18 +170,18 @@ func TestConcreteSeriesClonesLabels(t *testing.T) {
 }
 
 func TestFromQueryResultWithDuplicates(t *testing.T) {
-	ts1 := prompb.TimeSeries{
-		Labels: []prompb.Label{
+	ts1 := profpb.TimeSeries{
+		Labels: []profpb.Label{
 			{Name: "foo", Value: "bar"},
 			{Name: "foo", Value: "def"},
 		},
-		Samples: []prompb.Sample{
-			{Value: 0.0, Timestamp: 0},
+		Samples: []profpb.Sample{
+			{Value: []byte("a"), Timestamp: 0},
 		},
 	}
 
-	res := prompb.QueryResult{
-		Timeseries: []*prompb.TimeSeries{
+	res := profpb.QueryResult{
+		Timeseries: []*profpb.TimeSeries{
 			&ts1,
 		},
 	}
@@ -190,42 +196,119 @@ func TestFromQueryResultWithDuplicates(t *testing.T) {
 }
 
 func TestNegotiateResponseType(t *testing.T) {
-	r, err := NegotiateResponseType([]prompb.ReadRequest_ResponseType{
-		prompb.ReadRequest_STREAMED_XOR_CHUNKS,
-		prompb.ReadRequest_SAMPLES,
+	r, err := NegotiateResponseType([]profpb.ReadRequest_ResponseType{
+		profpb.ReadRequest_STREAMED_BYTES_CHUNKS,
+		profpb.ReadRequest_SAMPLES,
 	})
 	require.NoError(t, err)
-	require.Equal(t, prompb.ReadRequest_STREAMED_XOR_CHUNKS, r)
+	require.Equal(t, profpb.ReadRequest_STREAMED_BYTES_CHUNKS, r)
 
-	r2, err := NegotiateResponseType([]prompb.ReadRequest_ResponseType{
-		prompb.ReadRequest_SAMPLES,
-		prompb.ReadRequest_STREAMED_XOR_CHUNKS,
+	r2, err := NegotiateResponseType([]profpb.ReadRequest_ResponseType{
+		profpb.ReadRequest_SAMPLES,
+		profpb.ReadRequest_STREAMED_BYTES_CHUNKS,
 	})
 	require.NoError(t, err)
-	require.Equal(t, prompb.ReadRequest_SAMPLES, r2)
+	require.Equal(t, profpb.ReadRequest_SAMPLES, r2)
 
-	r3, err := NegotiateResponseType([]prompb.ReadRequest_ResponseType{})
+	r3, err := NegotiateResponseType([]profpb.ReadRequest_ResponseType{})
 	require.NoError(t, err)
-	require.Equal(t, prompb.ReadRequest_SAMPLES, r3)
+	require.Equal(t, profpb.ReadRequest_SAMPLES, r3)
 
-	_, err = NegotiateResponseType([]prompb.ReadRequest_ResponseType{20})
+	_, err = NegotiateResponseType([]profpb.ReadRequest_ResponseType{20})
 	require.Error(t, err, "expected error due to not supported requested response types")
-	require.Equal(t, "server does not support any of the requested response types: [20]; supported: map[SAMPLES:{} STREAMED_XOR_CHUNKS:{}]", err.Error())
+	require.Equal(t, "server does not support any of the requested response types: [20]; supported: map[SAMPLES:{} STREAMED_BYTES_CHUNKS:{}]", err.Error())
+}
+
+type chunkSeriesSet struct {
+	series []storage.ChunkSeries
+	idx    int
+}
+
+func (s *chunkSeriesSet) Next() bool                 { s.idx++; return s.idx <= len(s.series) }
+func (s *chunkSeriesSet) At() storage.ChunkSeries    { return s.series[s.idx-1] }
+func (s *chunkSeriesSet) Err() error                 { return nil }
+func (s *chunkSeriesSet) Warnings() storage.Warnings { return nil }
+
+func TestStreamChunkedReadResponses_DictionaryChunks(t *testing.T) {
+	var values [][]byte
+	for i := 0; i < 100; i++ {
+		var b strings.Builder
+		for j := 0; j < 100; j++ {
+			fmt.Fprintf(&b, "github.com/conprof/db/tsdb.(*Head).function%d\n", (i+j)%120)
+		}
+		values = append(values, []byte(b.String()))
+	}
+	dict, err := chunkenc.TrainDictionary(values, 4096)
+	require.NoError(t, err)
+
+	set := &chunkSeriesSet{}
+	for i, c := range []chunkenc.Chunk{
+		chunkenc.NewBytesDictChunk(dict),
+		chunkenc.NewBytesFramedChunk(dict),
+		chunkenc.NewBytesFramedChunk(nil),
+		chunkenc.NewBytesCodecChunk(chunkenc.Compression{Codec: chunkenc.CodecSnappy}),
+	} {
+		c := c
+		app, err := c.Appender()
+		require.NoError(t, err)
+		for ts, v := range values[:10] {
+			app.Append(int64(ts), v)
+		}
+		set.series = append(set.series, &storage.ChunkSeriesEntry{
+			Lset: labels.FromStrings("i", strconv.Itoa(i)),
+			ChunkIteratorFn: func() chunks.Iterator {
+				return storage.NewListChunkSeriesIterator(chunks.Meta{Chunk: c, MinTime: 0, MaxTime: 9})
+			},
+		})
+	}
+
+	recorder := httptest.NewRecorder()
+	_, err = StreamChunkedReadResponses(NewChunkedWriter(recorder, recorder), 0, set, nil, 1024*1024)
+	require.NoError(t, err)
+
+	stream := NewChunkedReader(recorder.Body, DefaultChunkedReadLimit, nil)
+	var encs []profpb.Chunk_Encoding
+	for {
+		res := &profpb.ChunkedReadResponse{}
+		err := stream.NextProto(res)
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		for _, series := range res.ChunkedSeries {
+			for _, c := range series.Chunks {
+				encs = append(encs, c.Type)
+				chk, err := chunkenc.FromData(chunkenc.Encoding(c.Type), c.Data)
+				require.NoError(t, err)
+
+				var got [][]byte
+				it := chk.Iterator(nil)
+				for it.Next() {
+					_, v := it.At()
+					got = append(got, v)
+				}
+				require.NoError(t, it.Err())
+				require.Equal(t, values[:10], got)
+			}
+		}
+	}
+	// Chunks with dictionaries are recoded, all others are streamed as is.
+	require.Equal(t, []profpb.Chunk_Encoding{profpb.Chunk_BYTES, profpb.Chunk_BYTES, profpb.Chunk_BYTES, profpb.Chunk_BYTES_CODEC}, encs)
 }
 
 func TestMergeLabels(t *testing.T) {
 	for _, tc := range []struct {
-		primary, secondary, expected []prompb.Label
+		primary, secondary, expected []profpb.Label
 	}{
 		{
-			primary:   []prompb.Label{{Name: "aaa", Value: "foo"}, {Name: "bbb", Value: "foo"}, {Name: "ddd", Value: "foo"}},
-			secondary: []prompb.Label{{Name: "bbb", Value: "bar"}, {Name: "ccc", Value: "bar"}},
-			expected:  []prompb.Label{{Name: "aaa", Value: "foo"}, {Name: "bbb", Value: "foo"}, {Name: "ccc", Value: "bar"}, {Name: "ddd", Value: "foo"}},
+			primary:   []profpb.Label{{Name: "aaa", Value: "foo"}, {Name: "bbb", Value: "foo"}, {Name: "ddd", Value: "foo"}},
+			secondary: []profpb.Label{{Name: "bbb", Value: "bar"}, {Name: "ccc", Value: "bar"}},
+			expected:  []profpb.Label{{Name: "aaa", Value: "foo"}, {Name: "bbb", Value: "foo"}, {Name: "ccc", Value: "bar"}, {Name: "ddd", Value: "foo"}},
 		},
 		{
-			primary:   []prompb.Label{{Name: "bbb", Value: "bar"}, {Name: "ccc", Value: "bar"}},
-			secondary: []prompb.Label{{Name: "aaa", Value: "foo"}, {Name: "bbb", Value: "foo"}, {Name: "ddd", Value: "foo"}},
-			expected:  []prompb.Label{{Name: "aaa", Value: "foo"}, {Name: "bbb", Value: "bar"}, {Name: "ccc", Value: "bar"}, {Name: "ddd", Value: "foo"}},
+			primary:   []profpb.Label{{Name: "bbb", Value: "bar"}, {Name: "ccc", Value: "bar"}},
+			secondary: []profpb.Label{{Name: "aaa", Value: "foo"}, {Name: "bbb", Value: "foo"}, {Name: "ddd", Value: "foo"}},
+			expected:  []profpb.Label{{Name: "aaa", Value: "foo"}, {Name: "bbb", Value: "bar"}, {Name: "ccc", Value: "bar"}, {Name: "ddd", Value: "foo"}},
 		},
 	} {
 		require.Equal(t, tc.expected, MergeLabels(tc.primary, tc.secondary))
@@ -236,22 +319,22 @@ func TestMetricTypeToMetricTypeProto(t *testing.T) {
 	tc := []struct {
 		desc     string
 		input    textparse.MetricType
-		expected prompb.MetricMetadata_MetricType
+		expected profpb.MetricMetadata_MetricType
 	}{
 		{
 			desc:     "with a single-word metric",
 			input:    textparse.MetricTypeCounter,
-			expected: prompb.MetricMetadata_COUNTER,
+			expected: profpb.MetricMetadata_COUNTER,
 		},
 		{
 			desc:     "with a two-word metric",
 			input:    textparse.MetricTypeStateset,
-			expected: prompb.MetricMetadata_STATESET,
+			expected: profpb.MetricMetadata_STATESET,
 		},
 		{
 			desc:     "with an unknown metric",
 			input:    "not-known",
-			expected: prompb.MetricMetadata_UNKNOWN,
+			expected: profpb.MetricMetadata_UNKNOWN,
 		},
 	}
 
@@ -32,10 +32,11 @@ import (
 	"github.com/prometheus/prometheus/config"
 	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/pkg/relabel"
-	"github.com/prometheus/prometheus/prompb"
 	"github.com/prometheus/prometheus/scrape"
-	"github.com/prometheus/prometheus/tsdb/record"
-	"github.com/prometheus/prometheus/tsdb/wal"
+
+	"github.com/conprof/db/profpb"
+	"github.com/conprof/db/tsdb/record"
+	"github.com/conprof/db/tsdb/wal"
 )
 
 const (
@@ -379,9 +380,9 @@ func NewQueueManager(
 
 // AppendMetadata sends metadata the remote storage. Metadata is sent all at once and is not parallelized.
 func (t *QueueManager) AppendMetadata(ctx context.Context, metadata []scrape.MetricMetadata) {
-	mm := make([]prompb.MetricMetadata, 0, len(metadata))
+	mm := make([]profpb.MetricMetadata, 0, len(metadata))
 	for _, entry := range metadata {
-		mm = append(mm, prompb.MetricMetadata{
+		mm = append(mm, profpb.MetricMetadata{
 			MetricFamilyName: entry.Metric,
 			Help:             entry.Help,
 			Type:             metricTypeToMetricTypeProto(entry.Type),
@@ -397,7 +398,7 @@ func (t *QueueManager) AppendMetadata(ctx context.Context, metadata []scrape.Met
 	}
 }
 
-func (t *QueueManager) sendMetadataWithBackoff(ctx context.Context, metadata []prompb.MetricMetadata) error {
+func (t *QueueManager) sendMetadataWithBackoff(ctx context.Context, metadata []profpb.MetricMetadata) error {
 	// Build the WriteRequest with no samples.
 	req, _, err := buildWriteRequest(nil, metadata, nil)
 	if err != nil {
@@ -785,7 +786,7 @@ func (t *QueueManager) newShards() *shards {
 type sample struct {
 	labels labels.Labels
 	t      int64
-	v      float64
+	v      []byte
 }
 
 type shards struct {
@@ -969,7 +970,7 @@ func (s *shards) runShard(ctx context.Context, shardID int, queue chan sample) {
 	}
 }
 
-func (s *shards) sendSamples(ctx context.Context, samples []prompb.TimeSeries, buf *[]byte) {
+func (s *shards) sendSamples(ctx context.Context, samples []profpb.TimeSeries, buf *[]byte) {
 	begin := time.Now()
 	err := s.sendSamplesWithBackoff(ctx, samples, buf)
 	if err != nil {
@@ -985,7 +986,7 @@ func (s *shards) sendSamples(ctx context.Context, samples []prompb.TimeSeries, b
 }
 
 // sendSamples to the remote storage with backoff for recoverable errors.
-func (s *shards) sendSamplesWithBackoff(ctx context.Context, samples []prompb.TimeSeries, buf *[]byte) error {
+func (s *shards) sendSamplesWithBackoff(ctx context.Context, samples []profpb.TimeSeries, buf *[]byte) error {
 	// Build the WriteRequest with no metadata.
 	req, highest, err := buildWriteRequest(samples, nil, *buf)
 	if err != nil {
@@ -1076,7 +1077,7 @@ func sendWriteRequestWithBackoff(ctx context.Context, cfg config.QueueConfig, _
 	}
 }
 
-func buildWriteRequest(samples []prompb.TimeSeries, metadata []prompb.MetricMetadata, buf []byte) ([]byte, int64, error) {
+func buildWriteRequest(samples []profpb.TimeSeries, metadata []profpb.MetricMetadata, buf []byte) ([]byte, int64, error) {
 	var highest int64
 	for _, ts := range samples {
 		// At the moment we only ever append a TimeSeries with a single sample in it.
@@ -1085,7 +1086,7 @@ func buildWriteRequest(samples []prompb.TimeSeries, metadata []prompb.MetricMeta
 		}
 	}
 
-	req := &prompb.WriteRequest{
+	req := &profpb.WriteRequest{
 		Timeseries: samples,
 		Metadata:   metadata,
 	}
@@ -1104,11 +1105,11 @@ func buildWriteRequest(samples []prompb.TimeSeries, metadata []prompb.MetricMeta
 	return compressed, highest, nil
 }
 
-func allocateTimeSeries(capacity int) []prompb.TimeSeries {
-	timeseries := make([]prompb.TimeSeries, capacity)
+func allocateTimeSeries(capacity int) []profpb.TimeSeries {
+	timeseries := make([]profpb.TimeSeries, capacity)
 	// We only ever send one sample per timeseries, so preallocate with length one.
 	for i := range timeseries {
-		timeseries[i].Samples = []prompb.Sample{{}}
+		timeseries[i].Samples = []profpb.Sample{{}}
 	}
 	return timeseries
 }
@@ -41,9 +41,12 @@ import (
 	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/pkg/textparse"
 	"github.com/prometheus/prometheus/pkg/timestamp"
-	"github.com/prometheus/prometheus/prompb"
 	"github.com/prometheus/prometheus/scrape"
-	"github.com/prometheus/prometheus/tsdb/record"
+
+	"github.com/conprof/db/profpb"
+	"github.com/conprof/db/tsdb"
+	"github.com/conprof/db/tsdb/record"
+	"github.com/conprof/db/tsdb/wal"
 )
 
 const defaultFlushDeadline = 1 * time.Minute
@@ -172,6 +175,55 @@ func TestSampleDeliveryTimeout(t *testing.T) {
 	c.waitForExpectedSamples(t)
 }
 
+func TestSampleDeliveryFromWAL(t *testing.T) {
+	c := NewTestWriteClient()
+
+	cfg := config.DefaultQueueConfig
+	mcfg := config.DefaultMetadataConfig
+	cfg.MaxShards = 1
+	cfg.BatchSendDeadline = model.Duration(100 * time.Millisecond)
+
+	dir, err := ioutil.TempDir("", "TestSampleDeliveryFromWAL")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	db, err := tsdb.Open(dir, nil, nil, tsdb.DefaultOptions())
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	metrics := newQueueManagerMetrics(nil, "", "")
+	m := NewQueueManager(metrics, wal.NewWatcherMetrics(nil), wal.NewLiveReaderMetrics(nil), nil, dir, newEWMARate(ewmaWeight, shardUpdateDuration), cfg, mcfg, nil, nil, c, defaultFlushDeadline, newPool(), newHighestTimestampMetric(), nil)
+	m.Start()
+	defer m.Stop()
+
+	// The watcher only forwards samples newer than the time it started at.
+	start := timestamp.FromTime(time.Now().Add(time.Minute))
+
+	var (
+		series  []record.RefSeries
+		samples []record.RefSample
+	)
+	app := db.Appender(context.Background())
+	for i, name := range []string{"heap", "goroutine"} {
+		lbls := labels.FromStrings("__name__", name)
+		series = append(series, record.RefSeries{Ref: uint64(i), Labels: lbls})
+		for j := int64(0); j < 3; j++ {
+			v := []byte(fmt.Sprintf("%s-%d", name, j))
+			samples = append(samples, record.RefSample{Ref: uint64(i), T: start + j, V: v})
+			_, err := app.Add(lbls, start+j, v)
+			require.NoError(t, err)
+		}
+	}
+
+	c.expectSamples(samples, series)
+	require.NoError(t, app.Commit())
+	c.waitForExpectedSamples(t)
+}
+
 func TestSampleDeliveryOrder(t *testing.T) {
 	ts := 10
 	n := config.DefaultQueueConfig.MaxSamplesPerSend * ts
@@ -182,7 +234,7 @@ func TestSampleDeliveryOrder(t *testing.T) {
 		samples = append(samples, record.RefSample{
 			Ref: uint64(i),
 			T:   int64(i),
-			V:   float64(i),
+			V:   []byte(strconv.Itoa(i)),
 		})
 		series = append(series, record.RefSeries{
 			Ref:    uint64(i),
@@ -434,7 +486,7 @@ func createTimeseries(numSamples, numSeries int) ([]record.RefSample, []record.R
 			samples = append(samples, record.RefSample{
 				Ref: uint64(i),
 				T:   int64(j),
-				V:   float64(i),
+				V:   []byte(strconv.Itoa(i)),
 			})
 
 		}
@@ -456,9 +508,9 @@ func getSeriesNameFromRef(r record.RefSeries) string {
 }
 
 type TestWriteClient struct {
-	receivedSamples  map[string][]prompb.Sample
-	expectedSamples  map[string][]prompb.Sample
-	receivedMetadata map[string][]prompb.MetricMetadata
+	receivedSamples  map[string][]profpb.Sample
+	expectedSamples  map[string][]profpb.Sample
+	receivedMetadata map[string][]profpb.MetricMetadata
 	withWaitGroup    bool
 	wg               sync.WaitGroup
 	mtx              sync.Mutex
@@ -468,9 +520,9 @@ type TestWriteClient struct {
 func NewTestWriteClient() *TestWriteClient {
 	return &TestWriteClient{
 		withWaitGroup:    true,
-		receivedSamples:  map[string][]prompb.Sample{},
-		expectedSamples:  map[string][]prompb.Sample{},
-		receivedMetadata: map[string][]prompb.MetricMetadata{},
+		receivedSamples:  map[string][]profpb.Sample{},
+		expectedSamples:  map[string][]profpb.Sample{},
+		receivedMetadata: map[string][]profpb.MetricMetadata{},
 	}
 }
 
@@ -481,12 +533,12 @@ func (c *TestWriteClient) expectSamples(ss []record.RefSample, series []record.R
 	c.mtx.Lock()
 	defer c.mtx.Unlock()
 
-	c.expectedSamples = map[string][]prompb.Sample{}
-	c.receivedSamples = map[string][]prompb.Sample{}
+	c.expectedSamples = map[string][]profpb.Sample{}
+	c.receivedSamples = map[string][]profpb.Sample{}
 
 	for _, s := range ss {
 		seriesName := getSeriesNameFromRef(series[s.Ref])
-		c.expectedSamples[seriesName] = append(c.expectedSamples[seriesName], prompb.Sample{
+		c.expectedSamples[seriesName] = append(c.expectedSamples[seriesName], profpb.Sample{
 			Timestamp: s.T,
 			Value:     s.V,
 		})
@@ -535,7 +587,7 @@ func (c *TestWriteClient) Store(_ context.Context, req []byte) error {
 		return err
 	}
 
-	var reqProto prompb.WriteRequest
+	var reqProto profpb.WriteRequest
 	if err := proto.Unmarshal(reqBuf, &reqProto); err != nil {
 		return err
 	}
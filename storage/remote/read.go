@@ -17,9 +17,9 @@ import (
 	"context"
 
 	"github.com/pkg/errors"
-
 	"github.com/prometheus/prometheus/pkg/labels"
-	"github.com/prometheus/prometheus/storage"
+
+	"github.com/conprof/db/storage"
 )
 
 type sampleAndChunkQueryableClient struct {
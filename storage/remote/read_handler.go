@@ -0,0 +1,172 @@
+// Copyright 2021 The Conprof Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+
+	"github.com/conprof/db/profpb"
+	"github.com/conprof/db/storage"
+)
+
+type readHandler struct {
+	logger                    log.Logger
+	queryable                 storage.SampleAndChunkQueryable
+	remoteReadSampleLimit     int
+	remoteReadMaxBytesInFrame int
+}
+
+// NewReadHandler creates a http.Handler that accepts remote read requests and
+// answers them with the profiles of the provided queryable.
+// Both the SAMPLES and the STREAMED_BYTES_CHUNKS response types are supported.
+func NewReadHandler(logger log.Logger, queryable storage.SampleAndChunkQueryable, remoteReadSampleLimit, remoteReadMaxBytesInFrame int) http.Handler {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	return &readHandler{
+		logger:                    logger,
+		queryable:                 queryable,
+		remoteReadSampleLimit:     remoteReadSampleLimit,
+		remoteReadMaxBytesInFrame: remoteReadMaxBytesInFrame,
+	}
+}
+
+func (h *readHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	req, err := DecodeReadRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	responseType, err := NegotiateResponseType(req.AcceptedResponseTypes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch responseType {
+	case profpb.ReadRequest_STREAMED_BYTES_CHUNKS:
+		h.remoteReadStreamedBytesChunks(r.Context(), w, req)
+	default:
+		// On empty or unknown types in req.AcceptedResponseTypes we default to non streamed, raw samples response.
+		h.remoteReadSamples(r.Context(), w, req)
+	}
+}
+
+func (h *readHandler) remoteReadSamples(ctx context.Context, w http.ResponseWriter, req *profpb.ReadRequest) {
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Header().Set("Content-Encoding", "snappy")
+
+	resp := profpb.ReadResponse{
+		Results: make([]*profpb.QueryResult, len(req.Queries)),
+	}
+	for i, query := range req.Queries {
+		if err := func() error {
+			matchers, err := FromLabelMatchers(query.Matchers)
+			if err != nil {
+				return err
+			}
+
+			querier, err := h.queryable.Querier(ctx, query.StartTimestampMs, query.EndTimestampMs)
+			if err != nil {
+				return err
+			}
+			defer querier.Close()
+
+			var ws storage.Warnings
+			resp.Results[i], ws, err = ToQueryResult(querier.Select(false, fromReadHints(query.Hints), matchers...), h.remoteReadSampleLimit)
+			for _, w := range ws {
+				level.Warn(h.logger).Log("msg", "Warnings on remote read query", "err", w.Error())
+			}
+			return err
+		}(); err != nil {
+			if httpErr, ok := err.(HTTPError); ok {
+				http.Error(w, httpErr.Error(), httpErr.Status())
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := EncodeReadResponse(&resp, w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (h *readHandler) remoteReadStreamedBytesChunks(ctx context.Context, w http.ResponseWriter, req *profpb.ReadRequest) {
+	w.Header().Set("Content-Type", "application/x-streamed-protobuf; proto=conprof.ChunkedReadResponse")
+
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "internal http.ResponseWriter does not implement http.Flusher interface", http.StatusInternalServerError)
+		return
+	}
+
+	for i, query := range req.Queries {
+		if err := func() error {
+			matchers, err := FromLabelMatchers(query.Matchers)
+			if err != nil {
+				return err
+			}
+
+			querier, err := h.queryable.ChunkQuerier(ctx, query.StartTimestampMs, query.EndTimestampMs)
+			if err != nil {
+				return err
+			}
+			defer querier.Close()
+
+			ws, err := StreamChunkedReadResponses(
+				NewChunkedWriter(w, f),
+				int64(i),
+				// The streaming API has to provide the series sorted.
+				querier.Select(true, fromReadHints(query.Hints), matchers...),
+				nil,
+				h.remoteReadMaxBytesInFrame,
+			)
+			for _, w := range ws {
+				level.Warn(h.logger).Log("msg", "Warnings on chunked remote read query", "warnings", w.Error())
+			}
+			return err
+		}(); err != nil {
+			if httpErr, ok := err.(HTTPError); ok {
+				http.Error(w, httpErr.Error(), httpErr.Status())
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// fromReadHints converts the hints of a remote read query back to storage.SelectHints.
+func fromReadHints(rh *profpb.ReadHints) *storage.SelectHints {
+	if rh == nil {
+		return nil
+	}
+	return &storage.SelectHints{
+		Start:    rh.StartMs,
+		End:      rh.EndMs,
+		Step:     rh.StepMs,
+		Func:     rh.Func,
+		Grouping: rh.Grouping,
+		By:       rh.By,
+		Range:    rh.RangeMs,
+	}
+}
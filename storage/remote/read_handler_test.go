@@ -0,0 +1,238 @@
+// Copyright 2021 The Conprof Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	config_util "github.com/prometheus/common/config"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/stretchr/testify/require"
+
+	"github.com/conprof/db/profpb"
+	"github.com/conprof/db/storage"
+	"github.com/conprof/db/tsdb"
+	"github.com/conprof/db/tsdb/chunkenc"
+)
+
+func openTestDB(t *testing.T) (*tsdb.DB, func()) {
+	dir, err := ioutil.TempDir("", "remote_test")
+	require.NoError(t, err)
+
+	db, err := tsdb.Open(dir, nil, nil, tsdb.DefaultOptions())
+	require.NoError(t, err)
+
+	return db, func() {
+		require.NoError(t, db.Close())
+		require.NoError(t, os.RemoveAll(dir))
+	}
+}
+
+func appendTestProfiles(t *testing.T, db *tsdb.DB) {
+	app := db.Appender(context.Background())
+	for _, name := range []string{"heap", "goroutine"} {
+		lbls := labels.FromStrings("__name__", name, "job", "conprof")
+		for ts := int64(0); ts < 3; ts++ {
+			_, err := app.Add(lbls, ts, []byte(fmt.Sprintf("%s-%d", name, ts)))
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, app.Commit())
+}
+
+func encodeReadRequest(t *testing.T, req *profpb.ReadRequest) io.Reader {
+	data, err := proto.Marshal(req)
+	require.NoError(t, err)
+	return bytes.NewBuffer(snappy.Encode(nil, data))
+}
+
+func TestSampledReadEndpoint(t *testing.T) {
+	db, closeFn := openTestDB(t)
+	defer closeFn()
+	appendTestProfiles(t, db)
+
+	h := NewReadHandler(nil, db, 1e6, 1*1024*1024)
+
+	matcher, err := labels.NewMatcher(labels.MatchEqual, "__name__", "heap")
+	require.NoError(t, err)
+	query, err := ToQuery(0, 1, []*labels.Matcher{matcher}, &storage.SelectHints{Start: 0, End: 1})
+	require.NoError(t, err)
+
+	request, err := http.NewRequest("POST", "", encodeReadRequest(t, &profpb.ReadRequest{Queries: []*profpb.Query{query}}))
+	require.NoError(t, err)
+
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, request)
+	require.Equal(t, 2, recorder.Code/100)
+	require.Equal(t, "application/x-protobuf", recorder.Result().Header.Get("Content-Type"))
+	require.Equal(t, "snappy", recorder.Result().Header.Get("Content-Encoding"))
+
+	uncompressed, err := snappy.Decode(nil, recorder.Body.Bytes())
+	require.NoError(t, err)
+
+	var resp profpb.ReadResponse
+	require.NoError(t, proto.Unmarshal(uncompressed, &resp))
+	require.Equal(t, 1, len(resp.Results), "Expected 1 result.")
+
+	require.Equal(t, &profpb.QueryResult{
+		Timeseries: []*profpb.TimeSeries{
+			{
+				Labels: []profpb.Label{
+					{Name: "__name__", Value: "heap"},
+					{Name: "job", Value: "conprof"},
+				},
+				Samples: []profpb.Sample{
+					{Value: []byte("heap-0"), Timestamp: 0},
+					{Value: []byte("heap-1"), Timestamp: 1},
+				},
+			},
+		},
+	}, resp.Results[0])
+}
+
+func TestStreamReadEndpoint(t *testing.T) {
+	db, closeFn := openTestDB(t)
+	defer closeFn()
+	appendTestProfiles(t, db)
+
+	h := NewReadHandler(nil, db, 1e6, 1*1024*1024)
+
+	matcher, err := labels.NewMatcher(labels.MatchRegexp, "__name__", "heap|goroutine")
+	require.NoError(t, err)
+	query, err := ToQuery(0, 2, []*labels.Matcher{matcher}, nil)
+	require.NoError(t, err)
+
+	request, err := http.NewRequest("POST", "", encodeReadRequest(t, &profpb.ReadRequest{
+		Queries:               []*profpb.Query{query},
+		AcceptedResponseTypes: []profpb.ReadRequest_ResponseType{profpb.ReadRequest_STREAMED_BYTES_CHUNKS},
+	}))
+	require.NoError(t, err)
+
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, request)
+	require.Equal(t, 2, recorder.Code/100)
+	require.Equal(t, "application/x-streamed-protobuf; proto=conprof.ChunkedReadResponse", recorder.Result().Header.Get("Content-Type"))
+
+	var results []*profpb.ChunkedReadResponse
+	stream := NewChunkedReader(recorder.Result().Body, DefaultChunkedReadLimit, nil)
+	for {
+		res := &profpb.ChunkedReadResponse{}
+		err := stream.NextProto(res)
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		results = append(results, res)
+	}
+
+	// Series are streamed sorted by their labels.
+	require.Equal(t, 2, len(results))
+	for i, name := range []string{"goroutine", "heap"} {
+		require.Equal(t, 1, len(results[i].ChunkedSeries))
+		series := results[i].ChunkedSeries[0]
+		require.Equal(t, []profpb.Label{
+			{Name: "__name__", Value: name},
+			{Name: "job", Value: "conprof"},
+		}, series.Labels)
+		require.Equal(t, 1, len(series.Chunks))
+		require.Equal(t, profpb.Chunk_BYTES, series.Chunks[0].Type)
+
+		chk, err := chunkenc.FromData(chunkenc.Encoding(series.Chunks[0].Type), series.Chunks[0].Data)
+		require.NoError(t, err)
+
+		var got [][]byte
+		it := chk.Iterator(nil)
+		for it.Next() {
+			_, v := it.At()
+			got = append(got, v)
+		}
+		require.NoError(t, it.Err())
+		require.Equal(t, [][]byte{
+			[]byte(name + "-0"),
+			[]byte(name + "-1"),
+			[]byte(name + "-2"),
+		}, got)
+	}
+}
+
+func TestRemoteWriteReadRoundTrip(t *testing.T) {
+	db, closeFn := openTestDB(t)
+	defer closeFn()
+
+	mux := http.NewServeMux()
+	mux.Handle("/write", NewWriteHandler(nil, db))
+	mux.Handle("/read", NewReadHandler(nil, db, 1e6, 1*1024*1024))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	serverURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+
+	writeURL := *serverURL
+	writeURL.Path = "/write"
+	wc, err := NewWriteClient("write", &ClientConfig{
+		URL:     &config_util.URL{URL: &writeURL},
+		Timeout: model.Duration(time.Second),
+	})
+	require.NoError(t, err)
+
+	req, _, err := buildWriteRequest(writeRequestFixture.Timeseries, nil, nil)
+	require.NoError(t, err)
+	require.NoError(t, wc.Store(context.Background(), req))
+
+	readURL := *serverURL
+	readURL.Path = "/read"
+	rc, err := NewReadClient("read", &ClientConfig{
+		URL:     &config_util.URL{URL: &readURL},
+		Timeout: model.Duration(time.Second),
+	})
+	require.NoError(t, err)
+
+	q, err := NewSampleAndChunkQueryableClient(rc, nil, nil, true, nil).Querier(context.Background(), 0, 1)
+	require.NoError(t, err)
+	defer q.Close()
+
+	ss := q.Select(true, nil, labels.MustNewMatcher(labels.MatchEqual, "__name__", "heap"))
+	require.True(t, ss.Next())
+	series := ss.At()
+	require.Equal(t, labels.FromStrings("__name__", "heap", "job", "conprof"), series.Labels())
+
+	var got []profpb.Sample
+	it := series.Iterator()
+	for it.Next() {
+		ts, v := it.At()
+		got = append(got, profpb.Sample{Timestamp: ts, Value: v})
+	}
+	require.NoError(t, it.Err())
+	require.Equal(t, []profpb.Sample{
+		{Value: []byte("profile-1"), Timestamp: 0},
+		{Value: []byte("profile-2"), Timestamp: 1},
+	}, got)
+
+	require.False(t, ss.Next())
+	require.NoError(t, ss.Err())
+}
@@ -24,12 +24,12 @@ import (
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	config_util "github.com/prometheus/common/config"
-	"github.com/stretchr/testify/require"
-
 	"github.com/prometheus/prometheus/config"
 	"github.com/prometheus/prometheus/pkg/labels"
-	"github.com/prometheus/prometheus/prompb"
-	"github.com/prometheus/prometheus/storage"
+	"github.com/stretchr/testify/require"
+
+	"github.com/conprof/db/profpb"
+	"github.com/conprof/db/storage"
 )
 
 func TestNoDuplicateReadConfigs(t *testing.T) {
@@ -177,21 +177,21 @@ func TestExternalLabelsQuerierAddExternalLabels(t *testing.T) {
 
 func TestSeriesSetFilter(t *testing.T) {
 	tests := []struct {
-		in       *prompb.QueryResult
+		in       *profpb.QueryResult
 		toRemove labels.Labels
 
-		expected *prompb.QueryResult
+		expected *profpb.QueryResult
 	}{
 		{
 			toRemove: labels.Labels{{Name: "foo", Value: "bar"}},
-			in: &prompb.QueryResult{
-				Timeseries: []*prompb.TimeSeries{
-					{Labels: labelsToLabelsProto(labels.FromStrings("foo", "bar", "a", "b"), nil), Samples: []prompb.Sample{}},
+			in: &profpb.QueryResult{
+				Timeseries: []*profpb.TimeSeries{
+					{Labels: labelsToLabelsProto(labels.FromStrings("foo", "bar", "a", "b"), nil), Samples: []profpb.Sample{}},
 				},
 			},
-			expected: &prompb.QueryResult{
-				Timeseries: []*prompb.TimeSeries{
-					{Labels: labelsToLabelsProto(labels.FromStrings("a", "b"), nil), Samples: []prompb.Sample{}},
+			expected: &profpb.QueryResult{
+				Timeseries: []*profpb.TimeSeries{
+					{Labels: labelsToLabelsProto(labels.FromStrings("a", "b"), nil), Samples: []profpb.Sample{}},
 				},
 			},
 		},
@@ -207,11 +207,11 @@ func TestSeriesSetFilter(t *testing.T) {
 }
 
 type mockedRemoteClient struct {
-	got   *prompb.Query
-	store []*prompb.TimeSeries
+	got   *profpb.Query
+	store []*profpb.TimeSeries
 }
 
-func (c *mockedRemoteClient) Read(_ context.Context, query *prompb.Query) (*prompb.QueryResult, error) {
+func (c *mockedRemoteClient) Read(_ context.Context, query *profpb.Query) (*profpb.QueryResult, error) {
 	if c.got != nil {
 		return nil, errors.Errorf("expected only one call to remote client got: %v", query)
 	}
@@ -222,7 +222,7 @@ func (c *mockedRemoteClient) Read(_ context.Context, query *prompb.Query) (*prom
 		return nil, err
 	}
 
-	q := &prompb.QueryResult{}
+	q := &profpb.QueryResult{}
 	for _, s := range c.store {
 		l := labelProtosToLabels(s.Labels)
 		var notMatch bool
@@ -237,7 +237,7 @@ func (c *mockedRemoteClient) Read(_ context.Context, query *prompb.Query) (*prom
 		}
 
 		if !notMatch {
-			q.Timeseries = append(q.Timeseries, &prompb.TimeSeries{Labels: s.Labels})
+			q.Timeseries = append(q.Timeseries, &profpb.TimeSeries{Labels: s.Labels})
 		}
 	}
 	return q, nil
@@ -251,10 +251,10 @@ func (c *mockedRemoteClient) reset() {
 func TestSampleAndChunkQueryableClient(t *testing.T) {
 	m := &mockedRemoteClient{
 		// Samples does not matter for below tests.
-		store: []*prompb.TimeSeries{
-			{Labels: []prompb.Label{{Name: "a", Value: "b"}}},
-			{Labels: []prompb.Label{{Name: "a", Value: "b3"}, {Name: "region", Value: "us"}}},
-			{Labels: []prompb.Label{{Name: "a", Value: "b2"}, {Name: "region", Value: "europe"}}},
+		store: []*profpb.TimeSeries{
+			{Labels: []profpb.Label{{Name: "a", Value: "b"}}},
+			{Labels: []profpb.Label{{Name: "a", Value: "b3"}, {Name: "region", Value: "us"}}},
+			{Labels: []profpb.Label{{Name: "a", Value: "b2"}, {Name: "region", Value: "europe"}}},
 		},
 	}
 
@@ -267,7 +267,7 @@ func TestSampleAndChunkQueryableClient(t *testing.T) {
 		readRecent       bool
 		callback         startTimeCallback
 
-		expectedQuery  *prompb.Query
+		expectedQuery  *profpb.Query
 		expectedSeries []labels.Labels
 	}{
 		{
@@ -278,11 +278,11 @@ func TestSampleAndChunkQueryableClient(t *testing.T) {
 			},
 			readRecent: true,
 
-			expectedQuery: &prompb.Query{
+			expectedQuery: &profpb.Query{
 				StartTimestampMs: 1,
 				EndTimestampMs:   2,
-				Matchers: []*prompb.LabelMatcher{
-					{Type: prompb.LabelMatcher_NEQ, Name: "a", Value: "something"},
+				Matchers: []*profpb.LabelMatcher{
+					{Type: profpb.LabelMatcher_NEQ, Name: "a", Value: "something"},
 				},
 			},
 			expectedSeries: []labels.Labels{
@@ -302,12 +302,12 @@ func TestSampleAndChunkQueryableClient(t *testing.T) {
 				{Name: "region", Value: "europe"},
 			},
 
-			expectedQuery: &prompb.Query{
+			expectedQuery: &profpb.Query{
 				StartTimestampMs: 1,
 				EndTimestampMs:   2,
-				Matchers: []*prompb.LabelMatcher{
-					{Type: prompb.LabelMatcher_NEQ, Name: "a", Value: "something"},
-					{Type: prompb.LabelMatcher_EQ, Name: "region", Value: "europe"},
+				Matchers: []*profpb.LabelMatcher{
+					{Type: profpb.LabelMatcher_NEQ, Name: "a", Value: "something"},
+					{Type: profpb.LabelMatcher_EQ, Name: "region", Value: "europe"},
 				},
 			},
 			expectedSeries: []labels.Labels{
@@ -327,12 +327,12 @@ func TestSampleAndChunkQueryableClient(t *testing.T) {
 				{Name: "region", Value: "europe"},
 			},
 
-			expectedQuery: &prompb.Query{
+			expectedQuery: &profpb.Query{
 				StartTimestampMs: 1,
 				EndTimestampMs:   2,
-				Matchers: []*prompb.LabelMatcher{
-					{Type: prompb.LabelMatcher_NEQ, Name: "a", Value: "something"},
-					{Type: prompb.LabelMatcher_EQ, Name: "region", Value: "europe"},
+				Matchers: []*profpb.LabelMatcher{
+					{Type: profpb.LabelMatcher_NEQ, Name: "a", Value: "something"},
+					{Type: profpb.LabelMatcher_EQ, Name: "region", Value: "europe"},
 				},
 			},
 			expectedSeries: []labels.Labels{
@@ -352,12 +352,12 @@ func TestSampleAndChunkQueryableClient(t *testing.T) {
 				{Name: "region", Value: "europe"},
 			},
 
-			expectedQuery: &prompb.Query{
+			expectedQuery: &profpb.Query{
 				StartTimestampMs: 1,
 				EndTimestampMs:   2,
-				Matchers: []*prompb.LabelMatcher{
-					{Type: prompb.LabelMatcher_NEQ, Name: "a", Value: "something"},
-					{Type: prompb.LabelMatcher_EQ, Name: "region", Value: "us"},
+				Matchers: []*profpb.LabelMatcher{
+					{Type: profpb.LabelMatcher_NEQ, Name: "a", Value: "something"},
+					{Type: profpb.LabelMatcher_EQ, Name: "region", Value: "us"},
 				},
 			},
 			expectedSeries: []labels.Labels{
@@ -371,10 +371,10 @@ func TestSampleAndChunkQueryableClient(t *testing.T) {
 			callback:   func() (i int64, err error) { return 100, nil },
 			readRecent: false,
 
-			expectedQuery: &prompb.Query{
+			expectedQuery: &profpb.Query{
 				StartTimestampMs: 0,
 				EndTimestampMs:   50,
-				Matchers:         []*prompb.LabelMatcher{},
+				Matchers:         []*profpb.LabelMatcher{},
 			},
 			expectedSeries: []labels.Labels{
 				labels.FromStrings("a", "b"),
@@ -388,10 +388,10 @@ func TestSampleAndChunkQueryableClient(t *testing.T) {
 			callback:   func() (i int64, err error) { return 20, nil },
 			readRecent: false,
 
-			expectedQuery: &prompb.Query{
+			expectedQuery: &profpb.Query{
 				StartTimestampMs: 0,
 				EndTimestampMs:   20,
-				Matchers:         []*prompb.LabelMatcher{},
+				Matchers:         []*profpb.LabelMatcher{},
 			},
 			expectedSeries: []labels.Labels{
 				labels.FromStrings("a", "b"),
@@ -419,11 +419,11 @@ func TestSampleAndChunkQueryableClient(t *testing.T) {
 				labels.MustNewMatcher(labels.MatchEqual, "a", "b2"),
 			},
 
-			expectedQuery: &prompb.Query{
+			expectedQuery: &profpb.Query{
 				StartTimestampMs: 1,
 				EndTimestampMs:   2,
-				Matchers: []*prompb.LabelMatcher{
-					{Type: prompb.LabelMatcher_EQ, Name: "a", Value: "b2"},
+				Matchers: []*profpb.LabelMatcher{
+					{Type: profpb.LabelMatcher_EQ, Name: "a", Value: "b2"},
 				},
 			},
 			expectedSeries: []labels.Labels{
@@ -441,11 +441,11 @@ func TestSampleAndChunkQueryableClient(t *testing.T) {
 				labels.MustNewMatcher(labels.MatchEqual, "a", "b2"),
 			},
 
-			expectedQuery: &prompb.Query{
+			expectedQuery: &profpb.Query{
 				StartTimestampMs: 1,
 				EndTimestampMs:   2,
-				Matchers: []*prompb.LabelMatcher{
-					{Type: prompb.LabelMatcher_EQ, Name: "a", Value: "b2"},
+				Matchers: []*profpb.LabelMatcher{
+					{Type: profpb.LabelMatcher_EQ, Name: "a", Value: "b2"},
 				},
 			},
 			expectedSeries: []labels.Labels{
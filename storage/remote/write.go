@@ -22,11 +22,11 @@ import (
 	"github.com/go-kit/kit/log"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
-
 	"github.com/prometheus/prometheus/config"
 	"github.com/prometheus/prometheus/pkg/labels"
-	"github.com/prometheus/prometheus/storage"
-	"github.com/prometheus/prometheus/tsdb/wal"
+
+	"github.com/conprof/db/storage"
+	"github.com/conprof/db/tsdb/wal"
 )
 
 var (
@@ -211,7 +211,7 @@ type timestampTracker struct {
 }
 
 // Add implements storage.Appender.
-func (t *timestampTracker) Add(_ labels.Labels, ts int64, _ float64) (uint64, error) {
+func (t *timestampTracker) Add(_ labels.Labels, ts int64, _ []byte) (uint64, error) {
 	t.samples++
 	if ts > t.highestTimestamp {
 		t.highestTimestamp = ts
@@ -220,11 +220,23 @@ func (t *timestampTracker) Add(_ labels.Labels, ts int64, _ float64) (uint64, er
 }
 
 // AddFast implements storage.Appender.
-func (t *timestampTracker) AddFast(_ uint64, ts int64, v float64) error {
+func (t *timestampTracker) AddFast(_ uint64, ts int64, v []byte) error {
 	_, err := t.Add(nil, ts, v)
 	return err
 }
 
+// AddFloat implements storage.Appender. Numeric samples cannot be sent to
+// remote storage. They are accepted so that numeric series keep working and
+// dropped by the WAL watchers of the queues, which count them.
+func (t *timestampTracker) AddFloat(_ labels.Labels, _ int64, _ float64) (uint64, error) {
+	return 0, nil
+}
+
+// AddFloatFast implements storage.Appender.
+func (t *timestampTracker) AddFloatFast(_ uint64, _ int64, _ float64) error {
+	return nil
+}
+
 // Commit implements storage.Appender.
 func (t *timestampTracker) Commit() error {
 	t.writeStorage.samplesIn.incr(t.samples)
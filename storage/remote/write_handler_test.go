@@ -0,0 +1,159 @@
+// Copyright 2021 The Conprof Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/stretchr/testify/require"
+
+	"github.com/conprof/db/profpb"
+	"github.com/conprof/db/storage"
+)
+
+var writeRequestFixture = &profpb.WriteRequest{
+	Timeseries: []profpb.TimeSeries{
+		{
+			Labels:  []profpb.Label{{Name: "__name__", Value: "heap"}, {Name: "job", Value: "conprof"}},
+			Samples: []profpb.Sample{{Value: []byte("profile-1"), Timestamp: 0}},
+		},
+		{
+			Labels:  []profpb.Label{{Name: "__name__", Value: "heap"}, {Name: "job", Value: "conprof"}},
+			Samples: []profpb.Sample{{Value: []byte("profile-2"), Timestamp: 1}},
+		},
+	},
+}
+
+func TestRemoteWriteHandler(t *testing.T) {
+	buf, _, err := buildWriteRequest(writeRequestFixture.Timeseries, nil, nil)
+	require.NoError(t, err)
+
+	req, err := http.NewRequest("", "", bytes.NewReader(buf))
+	require.NoError(t, err)
+
+	appendable := &mockAppendable{}
+	handler := NewWriteHandler(nil, appendable)
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	resp := recorder.Result()
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	i := 0
+	for _, ts := range writeRequestFixture.Timeseries {
+		lbls := labelProtosToLabels(ts.Labels)
+		for _, s := range ts.Samples {
+			require.Equal(t, mockSample{lbls, s.Timestamp, s.Value}, appendable.samples[i])
+			i++
+		}
+	}
+}
+
+func TestOutOfOrder(t *testing.T) {
+	buf, _, err := buildWriteRequest([]profpb.TimeSeries{{
+		Labels:  []profpb.Label{{Name: "__name__", Value: "heap"}},
+		Samples: []profpb.Sample{{Value: []byte("profile"), Timestamp: 0}},
+	}}, nil, nil)
+	require.NoError(t, err)
+
+	req, err := http.NewRequest("", "", bytes.NewReader(buf))
+	require.NoError(t, err)
+
+	appendable := &mockAppendable{
+		latest: 100,
+	}
+	handler := NewWriteHandler(nil, appendable)
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	resp := recorder.Result()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestCommitErr(t *testing.T) {
+	buf, _, err := buildWriteRequest(writeRequestFixture.Timeseries, nil, nil)
+	require.NoError(t, err)
+
+	req, err := http.NewRequest("", "", bytes.NewReader(buf))
+	require.NoError(t, err)
+
+	appendable := &mockAppendable{
+		commitErr: fmt.Errorf("commit error"),
+	}
+	handler := NewWriteHandler(nil, appendable)
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	resp := recorder.Result()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	require.Equal(t, "commit error\n", string(body))
+}
+
+type mockAppendable struct {
+	latest    int64
+	samples   []mockSample
+	commitErr error
+}
+
+type mockSample struct {
+	l labels.Labels
+	t int64
+	v []byte
+}
+
+func (m *mockAppendable) Appender(_ context.Context) storage.Appender {
+	return m
+}
+
+func (m *mockAppendable) Add(l labels.Labels, t int64, v []byte) (uint64, error) {
+	if t < m.latest {
+		return 0, storage.ErrOutOfOrderSample
+	}
+
+	m.latest = t
+	m.samples = append(m.samples, mockSample{l, t, v})
+	return 0, nil
+}
+
+func (m *mockAppendable) AddFast(_ uint64, _ int64, _ []byte) error {
+	return storage.ErrNotFound
+}
+
+func (m *mockAppendable) AddFloat(_ labels.Labels, _ int64, _ float64) (uint64, error) {
+	return 0, fmt.Errorf("not implemented")
+}
+
+func (m *mockAppendable) AddFloatFast(_ uint64, _ int64, _ float64) error {
+	return storage.ErrNotFound
+}
+
+func (m *mockAppendable) Commit() error {
+	return m.commitErr
+}
+
+func (*mockAppendable) Rollback() error {
+	return fmt.Errorf("not implemented")
+}
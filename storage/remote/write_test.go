@@ -14,6 +14,7 @@
 package remote
 
 import (
+	"context"
 	"io/ioutil"
 	"net/url"
 	"os"
@@ -225,6 +226,43 @@ func TestWriteStorageLifecycle(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestWriteStorageFloatSamples(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestWriteStorageFloatSamples")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	s := NewWriteStorage(nil, nil, dir, defaultFlushDeadline, nil)
+	lset := labels.FromStrings("__name__", "up")
+
+	// Numeric samples are accepted with and without remote write endpoints,
+	// the WAL watchers of the queues drop them.
+	for _, conf := range []*config.Config{
+		nil,
+		{
+			GlobalConfig: config.DefaultGlobalConfig,
+			RemoteWriteConfigs: []*config.RemoteWriteConfig{
+				&config.DefaultRemoteWriteConfig,
+			},
+		},
+	} {
+		if conf != nil {
+			require.NoError(t, s.ApplyConfig(conf))
+		}
+
+		app := s.Appender(context.Background())
+		_, err = app.Add(labels.FromStrings("__name__", "heap"), 2, []byte("profile"))
+		require.NoError(t, err)
+		_, err = app.AddFloat(lset, 2, 1)
+		require.NoError(t, err)
+		require.NoError(t, app.AddFloatFast(0, 3, 1))
+		require.NoError(t, app.Commit())
+	}
+
+	require.NoError(t, s.Close())
+}
+
 func TestUpdateExternalLabels(t *testing.T) {
 	dir, err := ioutil.TempDir("", "TestUpdateExternalLabels")
 	require.NoError(t, err)
@@ -215,11 +215,17 @@ func (c *seriesSetToChunkSet) Err() error {
 
 type seriesToChunkEncoder struct {
 	Series
+
+	// float encodes the samples into an EncXOR chunk.
+	float bool
 }
 
 // TODO(bwplotka): Currently encoder will just naively build one chunk, without limit. Split it: https://github.com/prometheus/tsdb/issues/670
 func (s *seriesToChunkEncoder) Iterator() chunks.Iterator {
-	chk := chunkenc.NewBytesChunk()
+	var chk chunkenc.Chunk = chunkenc.NewBytesChunk()
+	if s.float {
+		chk = chunkenc.NewXORChunk()
+	}
 	app, err := chk.Appender()
 	if err != nil {
 		return errChunksIterator{err: err}
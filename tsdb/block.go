@@ -146,6 +146,10 @@ type BlockMeta struct {
 	// Information on compactions the block was created from.
 	Compaction BlockMetaCompaction `json:"compaction"`
 
+	// Resolution of a downsampled block. Every series has at most one sample
+	// per aligned interval of this width. 0 means that no samples were dropped.
+	Resolution int64 `json:"resolution,omitempty"`
+
 	// Version of the index format.
 	Version int `json:"version"`
 }
@@ -156,6 +160,24 @@ type BlockStats struct {
 	NumSeries     uint64 `json:"numSeries,omitempty"`
 	NumChunks     uint64 `json:"numChunks,omitempty"`
 	NumTombstones uint64 `json:"numTombstones,omitempty"`
+	// NumDedupedSamples counts the samples stored as references to an identical
+	// earlier value of their chunk.
+	NumDedupedSamples uint64 `json:"numDedupedSamples,omitempty"`
+	// NumDedupedChunks counts the chunks that share the data of an identical chunk.
+	NumDedupedChunks uint64 `json:"numDedupedChunks,omitempty"`
+
+	// Sizes of the profiles, without numeric samples. ValueBytes are the
+	// uncompressed bytes of all values and ChunkBytes the size of the chunks
+	// that were written, so deduplicated chunks count once.
+	ValueBytes    uint64 `json:"valueBytes,omitempty"`
+	ChunkBytes    uint64 `json:"chunkBytes,omitempty"`
+	MinValueBytes uint64 `json:"minValueBytes,omitempty"`
+	AvgValueBytes uint64 `json:"avgValueBytes,omitempty"`
+	MaxValueBytes uint64 `json:"maxValueBytes,omitempty"`
+	// TopLabelValues are the values of TopLabel whose series have the most
+	// ValueBytes, largest first.
+	TopLabel       string           `json:"topLabel,omitempty"`
+	TopLabelValues []LabelValueSize `json:"topLabelValues,omitempty"`
 }
 
 // BlockDesc describes a block by ULID and time range.
@@ -264,11 +286,24 @@ type Block struct {
 	numBytesIndex     int64
 	numBytesTombstone int64
 	numBytesMeta      int64
+	numBytesDicts     int64
+}
+
+// BlockOptions configures how a block is opened.
+type BlockOptions struct {
+	// VerifyChunkChecksums checks the CRC32 of chunks before they are loaded.
+	// Corrupted chunks are reported with a chunks.ChunkCorruptionErr.
+	VerifyChunkChecksums bool
 }
 
 // OpenBlock opens the block in the directory. It can be passed a chunk pool, which is used
 // to instantiate chunk structs.
 func OpenBlock(logger log.Logger, dir string, pool chunkenc.Pool) (pb *Block, err error) {
+	return OpenBlockWithOptions(logger, dir, pool, BlockOptions{})
+}
+
+// OpenBlockWithOptions is like OpenBlock but allows to configure how the block is read.
+func OpenBlockWithOptions(logger log.Logger, dir string, pool chunkenc.Pool, opts BlockOptions) (pb *Block, err error) {
 	if logger == nil {
 		logger = log.NewNopLogger()
 	}
@@ -283,7 +318,15 @@ func OpenBlock(logger log.Logger, dir string, pool chunkenc.Pool) (pb *Block, er
 		return nil, err
 	}
 
-	cr, err := chunks.NewDirReader(chunkDir(dir), pool)
+	dicts, sizeDicts, err := chunks.ReadDictionaries(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "read dictionaries")
+	}
+	if len(dicts) > 0 {
+		pool = chunkenc.NewDictionaryPool(pool, dicts...)
+	}
+
+	cr, err := chunks.NewDirReaderWithOptions(chunkDir(dir), pool, chunks.ReaderOptions{VerifyChecksums: opts.VerifyChunkChecksums})
 	if err != nil {
 		return nil, err
 	}
@@ -313,6 +356,7 @@ func OpenBlock(logger log.Logger, dir string, pool chunkenc.Pool) (pb *Block, er
 		numBytesIndex:     ir.Size(),
 		numBytesTombstone: sizeTomb,
 		numBytesMeta:      sizeMeta,
+		numBytesDicts:     sizeDicts,
 	}
 	return pb, nil
 }
@@ -350,7 +394,7 @@ func (pb *Block) MaxTime() int64 { return pb.meta.MaxTime }
 
 // Size returns the number of bytes that the block takes up.
 func (pb *Block) Size() int64 {
-	return pb.numBytesChunks + pb.numBytesIndex + pb.numBytesTombstone + pb.numBytesMeta
+	return pb.numBytesChunks + pb.numBytesIndex + pb.numBytesTombstone + pb.numBytesMeta + pb.numBytesDicts
 }
 
 // ErrClosing is returned when a block is in the process of being closed.
@@ -468,6 +512,16 @@ type blockChunkReader struct {
 	b *Block
 }
 
+// Chunk returns the chunk with the given reference. Corruption errors name the block.
+func (r blockChunkReader) Chunk(ref uint64) (chunkenc.Chunk, error) {
+	chk, err := r.ChunkReader.Chunk(ref)
+	var cerr *chunks.ChunkCorruptionErr
+	if errors.As(err, &cerr) {
+		cerr.Block = r.b.meta.ULID
+	}
+	return chk, err
+}
+
 func (r blockChunkReader) Close() error {
 	r.b.pendingReaders.Done()
 	return nil
@@ -475,16 +529,23 @@ func (r blockChunkReader) Close() error {
 
 // Delete matching series between mint and maxt in the block.
 func (pb *Block) Delete(mint, maxt int64, ms ...*labels.Matcher) error {
+	_, err := pb.delete(mint, maxt, ms...)
+	return err
+}
+
+// delete is Delete, reporting whether any samples were deleted that the
+// tombstones of the block did not cover yet.
+func (pb *Block) delete(mint, maxt int64, ms ...*labels.Matcher) (bool, error) {
 	pb.mtx.Lock()
 	defer pb.mtx.Unlock()
 
 	if pb.closing {
-		return ErrClosing
+		return false, ErrClosing
 	}
 
 	p, err := PostingsForMatchers(pb.indexr, ms...)
 	if err != nil {
-		return errors.Wrap(err, "select series")
+		return false, errors.Wrap(err, "select series")
 	}
 
 	ir := pb.indexr
@@ -499,7 +560,7 @@ Outer:
 	for p.Next() {
 		err := ir.Series(p.At(), &lset, &chks)
 		if err != nil {
-			return err
+			return false, err
 		}
 
 		for _, chk := range chks {
@@ -513,7 +574,29 @@ Outer:
 	}
 
 	if p.Err() != nil {
-		return p.Err()
+		return false, p.Err()
+	}
+
+	added := false
+	err = stones.Iter(func(id uint64, ivs tombstones.Intervals) error {
+		existing, err := pb.tombstones.Get(id)
+		if err != nil {
+			return err
+		}
+		for _, iv := range ivs {
+			if !iv.IsSubrange(existing) {
+				added = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	if !added {
+		// Nothing new to delete, which is the common case for retention
+		// rules, so the tombstones on disk are not rewritten.
+		return false, nil
 	}
 
 	err = pb.tombstones.Iter(func(id uint64, ivs tombstones.Intervals) error {
@@ -523,26 +606,28 @@ Outer:
 		return nil
 	})
 	if err != nil {
-		return err
+		return false, err
 	}
 	pb.tombstones = stones
 	pb.meta.Stats.NumTombstones = pb.tombstones.Total()
 
 	n, err := tombstones.WriteFile(pb.logger, pb.dir, pb.tombstones)
 	if err != nil {
-		return err
+		return false, err
 	}
 	pb.numBytesTombstone = n
 	n, err = writeMetaFile(pb.logger, pb.dir, &pb.meta)
 	if err != nil {
-		return err
+		return false, err
 	}
 	pb.numBytesMeta = n
-	return nil
+	return true, nil
 }
 
 // CleanTombstones will remove the tombstones and rewrite the block (only if there are any tombstones).
 // If there was a rewrite, then it returns the ULID of the new block written, else nil.
+// A block without any samples left is marked deletable instead, as there is no
+// new block whose parents would replace it on reload.
 func (pb *Block) CleanTombstones(dest string, c Compactor) (*ulid.ULID, error) {
 	numStones := 0
 
@@ -562,6 +647,17 @@ func (pb *Block) CleanTombstones(dest string, c Compactor) (*ulid.ULID, error) {
 	if err != nil {
 		return nil, err
 	}
+	if uid == (ulid.ULID{}) {
+		pb.mtx.Lock()
+		defer pb.mtx.Unlock()
+		pb.meta.Compaction.Deletable = true
+		n, err := writeMetaFile(pb.logger, pb.dir, &pb.meta)
+		if err != nil {
+			return nil, err
+		}
+		pb.numBytesMeta = n
+		return nil, nil
+	}
 	return &uid, nil
 }
 
@@ -587,6 +683,11 @@ func (pb *Block) Snapshot(dir string) error {
 			return errors.Wrapf(err, "create snapshot %s", fname)
 		}
 	}
+	if pb.numBytesDicts > 0 {
+		if err := os.Link(filepath.Join(pb.dir, chunks.DictionariesFilename), filepath.Join(blockDir, chunks.DictionariesFilename)); err != nil {
+			return errors.Wrapf(err, "create snapshot %s", chunks.DictionariesFilename)
+		}
+	}
 
 	// Hardlink the chunks
 	curChunkDir := chunkDir(pb.dir)
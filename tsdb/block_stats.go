@@ -0,0 +1,155 @@
+// Copyright 2021 The Conprof Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"sort"
+
+	"github.com/conprof/db/tsdb/chunkenc"
+	"github.com/conprof/db/tsdb/chunks"
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+// DefaultProfileStatsTopValues is the number of label values whose sizes are
+// recorded in the stats of a block by default.
+const DefaultProfileStatsTopValues = 10
+
+// LabelValueSize is the size of the profiles of all series with a label value.
+type LabelValueSize struct {
+	Value       string `json:"value"`
+	NumProfiles uint64 `json:"numProfiles"`
+	ValueBytes  uint64 `json:"valueBytes"`
+	ChunkBytes  uint64 `json:"chunkBytes"`
+}
+
+// profileStats gathers the sizes of the profiles of a block while it is written.
+type profileStats struct {
+	label string
+	topN  int
+	it    chunkenc.BytesStreamingIterator
+	// infoIt reads the sizes of values from chunks that store them.
+	infoIt chunkenc.BytesTimestampOnlyIterator
+
+	numProfiles, valueBytes, chunkBytes uint64
+	minValueBytes, maxValueBytes        uint64
+	byValue                             map[string]*LabelValueSize
+}
+
+func newProfileStats(label string, topN int) *profileStats {
+	if topN <= 0 {
+		topN = DefaultProfileStatsTopValues
+	}
+	return &profileStats{label: label, topN: topN, byValue: map[string]*LabelValueSize{}}
+}
+
+// add adds the profiles of the chunks of a series. Numeric samples are skipped.
+// If written is not nil, only the chunks it reports as written count towards
+// the chunk bytes, see chunkDeduper.
+func (s *profileStats) add(lset labels.Labels, chks []chunks.Meta, written []bool) error {
+	var numProfiles, valueBytes, chunkBytes uint64
+	for i, chk := range chks {
+		if chk.Chunk.Encoding() == chunkenc.EncXOR {
+			continue
+		}
+		if written == nil || written[i] {
+			b, err := chk.Chunk.Bytes()
+			if err != nil {
+				return err
+			}
+			chunkBytes += uint64(len(b))
+		}
+
+		// Sizes are read from the infos of chunks that store them, so values are not read.
+		infos := chunkenc.HasSampleInfo(chk.Chunk)
+		var it chunkenc.Iterator
+		if infos {
+			it = chk.Chunk.Iterator(&s.infoIt)
+		} else {
+			it = chk.Chunk.Iterator(&s.it)
+		}
+		for it.Next() {
+			var n uint64
+			if infos {
+				_, info, _ := chunkenc.AtInfo(it)
+				n = uint64(info.Size)
+			} else {
+				_, v := it.At()
+				n = uint64(len(v))
+			}
+			if s.numProfiles+numProfiles == 0 || n < s.minValueBytes {
+				s.minValueBytes = n
+			}
+			if n > s.maxValueBytes {
+				s.maxValueBytes = n
+			}
+			numProfiles++
+			valueBytes += n
+		}
+		if it.Err() != nil {
+			return it.Err()
+		}
+	}
+	s.numProfiles += numProfiles
+	s.valueBytes += valueBytes
+	s.chunkBytes += chunkBytes
+
+	if s.label == "" || numProfiles == 0 {
+		return nil
+	}
+	v := lset.Get(s.label)
+	if v == "" {
+		return nil
+	}
+	lv, ok := s.byValue[v]
+	if !ok {
+		lv = &LabelValueSize{Value: v}
+		s.byValue[v] = lv
+	}
+	lv.NumProfiles += numProfiles
+	lv.ValueBytes += valueBytes
+	lv.ChunkBytes += chunkBytes
+	return nil
+}
+
+// apply records the gathered sizes in the stats of a block.
+func (s *profileStats) apply(stats *BlockStats) {
+	s.it.Close()
+	if s.numProfiles == 0 {
+		return
+	}
+	stats.ValueBytes = s.valueBytes
+	stats.ChunkBytes = s.chunkBytes
+	stats.MinValueBytes = s.minValueBytes
+	stats.AvgValueBytes = s.valueBytes / s.numProfiles
+	stats.MaxValueBytes = s.maxValueBytes
+
+	if len(s.byValue) == 0 {
+		return
+	}
+	top := make([]LabelValueSize, 0, len(s.byValue))
+	for _, lv := range s.byValue {
+		top = append(top, *lv)
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].ValueBytes != top[j].ValueBytes {
+			return top[i].ValueBytes > top[j].ValueBytes
+		}
+		return top[i].Value < top[j].Value
+	})
+	if len(top) > s.topN {
+		top = top[:s.topN]
+	}
+	stats.TopLabel = s.label
+	stats.TopLabelValues = top
+}
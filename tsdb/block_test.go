@@ -32,6 +32,7 @@ import (
 	"github.com/conprof/db/storage"
 	"github.com/conprof/db/tsdb/chunks"
 	"github.com/conprof/db/tsdb/fileutil"
+	"github.com/conprof/db/tsdb/tombstones"
 	"github.com/conprof/db/tsdb/tsdbutil"
 	"github.com/conprof/db/tsdb/wal"
 )
@@ -94,6 +95,8 @@ func TestCorruptedChunk(t *testing.T) {
 		corrFunc func(f *os.File) // Func that applies the corruption.
 		openErr  error
 		iterErr  error
+		// corrupted expects a chunks.ChunkCorruptionErr instead of iterErr.
+		corrupted bool
 	}{
 		{
 			name: "invalid header size",
@@ -149,7 +152,7 @@ func TestCorruptedChunk(t *testing.T) {
 				require.NoError(t, err)
 				require.NoError(t, f.Truncate(fi.Size()-1))
 			},
-			iterErr: errors.New("cannot populate chunk 8: segment doesn't include enough bytes to read the chunk - required:19, available:18"),
+			iterErr: errors.New("cannot populate chunk 8: segment doesn't include enough bytes to read the chunk - required:53, available:52"),
 		},
 		{
 			name: "checksum mismatch",
@@ -167,7 +170,7 @@ func TestCorruptedChunk(t *testing.T) {
 				require.NoError(t, err)
 				require.Equal(t, n, 1)
 			},
-			iterErr: errors.New("cannot populate chunk 8: checksum mismatch expected:11347d90, actual:28fdbbe0"),
+			corrupted: true,
 		},
 	} {
 		t.Run(tc.name, func(t *testing.T) {
@@ -191,7 +194,7 @@ func TestCorruptedChunk(t *testing.T) {
 			require.NoError(t, f.Close())
 
 			// Check open err.
-			b, err := OpenBlock(nil, blockDir, nil)
+			b, err := OpenBlockWithOptions(nil, blockDir, nil, BlockOptions{VerifyChunkChecksums: true})
 			if tc.openErr != nil {
 				require.Equal(t, tc.openErr.Error(), err.Error())
 				return
@@ -205,11 +208,17 @@ func TestCorruptedChunk(t *testing.T) {
 
 			// Check chunk errors during iter time.
 			require.True(t, set.Next())
-
-			// TODO(brancz): We only disabled CRC checks until we find a better solution, as this is currently causing a performance bottleneck.
-			//it := set.At().Iterator()
-			//require.Equal(t, false, it.Next())
-			//require.Equal(t, tc.iterErr.Error(), it.Err().Error())
+			it := set.At().Iterator()
+			require.Equal(t, false, it.Next())
+			if !tc.corrupted {
+				require.Equal(t, tc.iterErr.Error(), it.Err().Error())
+				return
+			}
+			var cerr *chunks.ChunkCorruptionErr
+			require.True(t, errors.As(it.Err(), &cerr))
+			require.Equal(t, b.Meta().ULID, cerr.Block)
+			require.Equal(t, uint64(8), cerr.Ref)
+			require.NotZero(t, cerr.Series)
 		})
 	}
 }
@@ -268,6 +277,58 @@ func TestBlockSize(t *testing.T) {
 	}
 }
 
+func TestBlockDelete(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "test_blockDelete")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(tmpdir))
+	}()
+
+	b, err := OpenBlock(nil, createBlock(t, tmpdir, genSeries(2, 1, 1, 100)), nil)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, b.Close())
+	}()
+	all := labels.MustNewMatcher(labels.MatchRegexp, "", ".*")
+
+	added, err := b.delete(10, 20, all)
+	require.NoError(t, err)
+	require.True(t, added)
+	require.Equal(t, uint64(2), b.Meta().Stats.NumTombstones)
+
+	// Deleting covered samples does not rewrite the tombstones.
+	require.NoError(t, os.Remove(filepath.Join(b.Dir(), tombstones.TombstonesFilename)))
+	added, err = b.delete(12, 18, all)
+	require.NoError(t, err)
+	require.False(t, added)
+	_, err = os.Stat(filepath.Join(b.Dir(), tombstones.TombstonesFilename))
+	require.True(t, os.IsNotExist(err))
+
+	// Extending a tombstone adds samples without adding intervals.
+	added, err = b.delete(15, 30, all)
+	require.NoError(t, err)
+	require.True(t, added)
+	require.Equal(t, uint64(2), b.Meta().Stats.NumTombstones)
+	stones, _, err := tombstones.ReadTombstones(b.Dir())
+	require.NoError(t, err)
+	require.NoError(t, stones.Iter(func(_ uint64, ivs tombstones.Intervals) error {
+		require.Equal(t, tombstones.Intervals{{Mint: 10, Maxt: 30}}, ivs)
+		return nil
+	}))
+
+	// Without any samples left, no block replaces it, so it is marked deletable.
+	require.NoError(t, b.Delete(0, 100, all))
+	c, err := NewLeveledCompactor(context.Background(), nil, log.NewNopLogger(), []int64{0}, nil)
+	require.NoError(t, err)
+	uid, err := b.CleanTombstones(tmpdir, c)
+	require.NoError(t, err)
+	require.Nil(t, uid)
+	require.True(t, b.Meta().Compaction.Deletable)
+	meta, _, err := readMetaFile(b.Dir())
+	require.NoError(t, err)
+	require.True(t, meta.Compaction.Deletable)
+}
+
 func TestReadIndexFormatV1(t *testing.T) {
 	// The block here was produced at the commit
 	// github.com/conprof/db @ 6f2106e7aba5c154d140322638fa269d31ad7257:
@@ -325,7 +386,7 @@ func createBlockFromHead(tb testing.TB, dir string, head *Head) string {
 }
 
 func createHead(tb testing.TB, w *wal.WAL, series []storage.Series, chunkDir string) *Head {
-	head, err := NewHead(nil, nil, w, DefaultBlockDuration, chunkDir, nil, chunks.DefaultWriteBufferSize, DefaultStripeSize, nil)
+	head, err := NewHead(nil, nil, w, &HeadOptions{ChunkRange: DefaultBlockDuration, ChunkDirRoot: chunkDir})
 	require.NoError(tb, err)
 
 	app := head.Appender(context.Background())
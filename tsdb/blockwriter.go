@@ -21,7 +21,6 @@ import (
 
 	"github.com/conprof/db/storage"
 	"github.com/conprof/db/tsdb/chunkenc"
-	"github.com/conprof/db/tsdb/chunks"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/oklog/ulid"
@@ -71,7 +70,7 @@ func (w *BlockWriter) initHead() error {
 	}
 	w.chunkDir = chunkDir
 
-	h, err := NewHead(nil, w.logger, nil, w.blockSize, w.chunkDir, nil, chunks.DefaultWriteBufferSize, DefaultStripeSize, nil)
+	h, err := NewHead(nil, w.logger, nil, &HeadOptions{ChunkRange: w.blockSize, ChunkDirRoot: w.chunkDir})
 	if err != nil {
 		return errors.Wrap(err, "tsdb.NewHead")
 	}
@@ -58,6 +58,11 @@ func (b *bstream) bytes() []byte {
 
 type bit bool
 
+const (
+	zero bit = false
+	one  bit = true
+)
+
 func (b *bstream) writeBit(bit bit) {
 	if b.count == 0 {
 		b.stream = append(b.stream, 0)
@@ -233,3 +238,27 @@ func (b *bstreamReader) loadNextBuffer(nbits uint8) bool {
 
 	return true
 }
+
+// appendUvarint appends the varint encoding of x to b.
+func appendUvarint(b []byte, x uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], x)]...)
+}
+
+// appendVarint appends the varint encoding of x to b.
+func appendVarint(b []byte, x int64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutVarint(buf[:], x)]...)
+}
+
+// appendUint16 appends the big-endian encoding of x to b.
+func appendUint16(b []byte, x uint16) []byte {
+	return append(b, byte(x>>8), byte(x))
+}
+
+// appendUint64 appends the big-endian encoding of x to b.
+func appendUint64(b []byte, x uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], x)
+	return append(b, buf[:]...)
+}
@@ -44,48 +44,123 @@
 package chunkenc
 
 import (
+	"bytes"
 	"encoding/binary"
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
 )
 
 const (
 	chunkCompactCapacityThreshold = 32
+
+	// bytesInfoFlag is set in the timestamps length of chunks that store
+	// the infos of their values. Their header holds the length of the infos
+	// after the length of the values and the infos follow the values.
+	bytesInfoFlag = 1 << 31
 )
 
 // BytesChunk combines the valueChunk and timestampChunk.
 // The Appender and Iterator work on both underlying chunks.
 // The reason the BytesChunk is split up, is to allow to iterate over chunks
 // and optionally disable reading values at all, when only timestamps are needed.
+//
+// New chunks also store the size and hash of every value next to the
+// timestamps, see SampleInfo. Chunks written before lack them.
 type BytesChunk struct {
 	tc *timestampChunk
 	vc *valueChunk
+	ic *infoChunk
 
 	b   []byte
 	num uint16
+
+	// dict is set for chunks with EncBytesDict encoding and optionally for EncBytesFramed.
+	dict *Dictionary
+	// framed is set for chunks with EncBytesFramed encoding.
+	framed bool
+	// comp is set for chunks with EncBytesCodec, EncBytesDelta and EncBytesDedup encoding.
+	comp *Compression
 }
 
 func NewBytesChunk() *BytesChunk {
 	return &BytesChunk{
 		tc: newTimestampChunk(),
 		vc: newValueChunk(),
+		ic: newInfoChunk(),
 	}
 }
 
 func LoadBytesChunk(b []byte) *BytesChunk {
-	num := binary.BigEndian.Uint16(b[0:2])               // first 16bit
-	timestampChunkLen := binary.BigEndian.Uint32(b[2:6]) // second 32bit
-	valueChunkLen := binary.BigEndian.Uint32(b[6:10])    // third 32bit
+	return loadBytesChunk(b, 0)
+}
 
-	timestampChunkStart := uint32(10) // after first 16bit + two 32bit (64bit)
+// NewBytesFramedChunk returns a new BytesChunk whose values are compressed one by one,
+// optionally with the given dictionary. Iterators of such chunks only decompress
+// the values they return, see BytesTimestampValuesIterator.Seek.
+func NewBytesFramedChunk(d *Dictionary) *BytesChunk {
+	c := NewBytesChunk()
+	c.dict = d
+	c.vc.dict = d
+	c.framed = true
+	c.vc.framed = true
+	return c
+}
+
+// LoadBytesFramedChunk loads a chunk with EncBytesFramed encoding.
+// The dictionary must be given if the chunk references one.
+func LoadBytesFramedChunk(b []byte, d *Dictionary) (*BytesChunk, error) {
+	id, err := DictionaryID(b)
+	if err != nil {
+		return nil, err
+	}
+	var want uint32
+	if d != nil {
+		want = d.ID()
+	} else if id != 0 {
+		return nil, &MissingDictionaryErr{ID: id}
+	}
+	if id != want {
+		return nil, errors.Errorf("chunk references dictionary %d, got %d", id, want)
+	}
+	c := loadBytesChunk(b, bytesDictHeaderSize)
+	c.dict = d
+	c.vc.dict = d
+	c.framed = true
+	c.vc.framed = true
+	return c, nil
+}
+
+// loadBytesChunk loads a BytesChunk whose layout starts at offset off of b.
+func loadBytesChunk(b []byte, off int) *BytesChunk {
+	h := b[off:]
+	num := binary.BigEndian.Uint16(h[0:2])               // first 16bit
+	timestampChunkLen := binary.BigEndian.Uint32(h[2:6]) // second 32bit
+	valueChunkLen := binary.BigEndian.Uint32(h[6:10])    // third 32bit
+
+	timestampChunkStart := uint32(off) + 10 // after first 16bit + two 32bit (64bit)
+	hasInfo := timestampChunkLen&bytesInfoFlag != 0
+	var infoChunkLen uint32
+	if hasInfo {
+		timestampChunkLen &^= bytesInfoFlag
+		infoChunkLen = binary.BigEndian.Uint32(h[10:14]) // fourth 32bit
+		timestampChunkStart += 4
+	}
 	timestampChunkEnd := timestampChunkStart + timestampChunkLen
 	valueChunkStart := timestampChunkEnd
 	valueChunkEnd := valueChunkStart + valueChunkLen
 
-	return &BytesChunk{
+	c := &BytesChunk{
 		b:   b,
 		num: num,
 		tc:  &timestampChunk{b: b[timestampChunkStart:timestampChunkEnd], num: num},
 		vc:  &valueChunk{compressed: b[valueChunkStart:valueChunkEnd], num: num},
 	}
+	if hasInfo {
+		c.ic = &infoChunk{b: b[valueChunkEnd : valueChunkEnd+infoChunkLen]}
+	}
+	return c
 }
 
 func (b *BytesChunk) Bytes() ([]byte, error) {
@@ -108,23 +183,61 @@ func (b *BytesChunk) Bytes() ([]byte, error) {
 	// We store chunk length as uint32 which allows chunks to be up to 4GiB
 
 	dataTimestampChunkLen := make([]byte, 4)
-	binary.BigEndian.PutUint32(dataTimestampChunkLen, uint32(len(dataTimestampChunk)))
+	if b.ic != nil {
+		binary.BigEndian.PutUint32(dataTimestampChunkLen, uint32(len(dataTimestampChunk))|bytesInfoFlag)
+	} else {
+		binary.BigEndian.PutUint32(dataTimestampChunkLen, uint32(len(dataTimestampChunk)))
+	}
 
 	dataValueChunkLen := make([]byte, 4)
 	binary.BigEndian.PutUint32(dataValueChunkLen, uint32(len(dataValueChunk)))
 
+	var dataInfoChunkLen, dataInfoChunk []byte
+	if b.ic != nil {
+		dataInfoChunk = b.ic.b
+		dataInfoChunkLen = make([]byte, 4)
+		binary.BigEndian.PutUint32(dataInfoChunkLen, uint32(len(dataInfoChunk)))
+	}
+
 	// TODO: Probably better with copy()
 
-	data := make([]byte, 0, 2+2*4+len(dataTimestampChunk)+len(dataValueChunk)) // two 32 bits of length for each chunks size and the chunks themselves
+	data := make([]byte, 0, bytesDictHeaderSize+2+3*4+len(dataTimestampChunk)+len(dataValueChunk)+len(dataInfoChunk)) // three 32 bits of length for each chunks size and the chunks themselves
+	switch {
+	case b.dict != nil || b.framed:
+		data = data[:bytesDictHeaderSize]
+		binary.BigEndian.PutUint32(data, b.dictID())
+	case b.comp != nil:
+		data = append(data, byte(b.comp.Codec), byte(b.comp.Level))
+		if b.comp.Dedup {
+			data = appendUint16(data, b.vc.deduped)
+		}
+	}
 	data = append(data, dataNumSamples...)
 	data = append(data, dataTimestampChunkLen...)
 	data = append(data, dataValueChunkLen...)
+	data = append(data, dataInfoChunkLen...)
 	data = append(data, dataTimestampChunk...)
 	data = append(data, dataValueChunk...)
+	data = append(data, dataInfoChunk...)
 	return data, nil
 }
 
 func (b *BytesChunk) Encoding() Encoding {
+	if b.framed {
+		return EncBytesFramed
+	}
+	if b.dict != nil {
+		return EncBytesDict
+	}
+	if b.comp != nil {
+		if b.comp.Delta {
+			return EncBytesDelta
+		}
+		if b.comp.Dedup {
+			return EncBytesDedup
+		}
+		return EncBytesCodec
+	}
 	return EncBytes
 }
 
@@ -138,6 +251,9 @@ func (b *BytesChunk) NumSamples() int {
 func (b *BytesChunk) Compact() {
 	b.tc.Compact()
 	b.vc.Compact()
+	if b.ic != nil {
+		b.ic.Compact()
+	}
 }
 
 func (b *BytesChunk) Appender() (Appender, error) {
@@ -150,18 +266,49 @@ func (b *BytesChunk) Appender() (Appender, error) {
 		return nil, err
 	}
 
-	return &BytesAppender{
-		ta: tapp,
-		va: vapp,
-	}, nil
+	a := &BytesAppender{
+		ta:    tapp,
+		va:    vapp,
+		ic:    b.ic,
+		delta: b.delta(),
+	}
+	if a.delta && b.NumSamples() > 0 {
+		// The next delta is against the content of the last value of the chunk.
+		it := b.Iterator(nil).(*BytesTimestampValuesIterator)
+		for it.Next() {
+		}
+		if err := it.Err(); err != nil {
+			return nil, err
+		}
+		a.prev = append(a.prev, it.content...)
+	}
+	return a, nil
+}
+
+// delta returns whether the values of the chunk are stored as deltas.
+func (b *BytesChunk) delta() bool {
+	return b.comp != nil && b.comp.Delta
 }
 
 type BytesAppender struct {
 	ta *timestampAppender
 	va *valueAppender
+	ic *infoChunk
+
+	// delta appends values as deltas against prev, the content of the last value.
+	delta bool
+	prev  []byte
 }
 
 func (b *BytesAppender) Append(t int64, v []byte) {
+	if b.ic != nil {
+		b.ic.append(NewSampleInfo(v))
+	}
+	if b.delta {
+		d, content := appendValueDelta(nil, b.prev, v)
+		b.prev = append(b.prev[:0], content...)
+		v = d
+	}
 	// Both Appenders implement the Appender interface.
 	// As both only care about one parameter we simply pass the zero value as the other.
 	b.va.Append(0, v)
@@ -172,19 +319,36 @@ func (b *BytesChunk) Iterator(iterator Iterator) Iterator {
 	if iterator != nil {
 		if it, ok := iterator.(*BytesTimestampOnlyIterator); ok {
 			it.tIt = b.tc.Iterator(nil)
+			it.iIt = nil
+			if b.ic != nil {
+				it.iIt = b.ic.iterator()
+			}
+			return it
+		}
+		if it, ok := iterator.(*BytesStreamingIterator); ok {
+			it.reset(b)
 			return it
 		}
 	}
 
 	return &BytesTimestampValuesIterator{
-		tIt: b.tc.Iterator(nil),
-		vIt: b.vc.Iterator(nil),
+		tIt:   b.tc.Iterator(nil),
+		vIt:   b.vc.Iterator(nil),
+		delta: b.delta(),
 	}
 }
 
 type BytesTimestampValuesIterator struct {
 	tIt *timestampsIterator
 	vIt *valueIterator
+	// delta rebuilds every value from the content of the previous one and the delta read by vIt.
+	delta   bool
+	content []byte
+	// reuse rebuilds contents into spare, which holds the content before the previous one,
+	// and gzipped values into gz.
+	reuse bool
+	spare []byte
+	gz    []byte
 
 	numRead uint16
 	err     error
@@ -204,7 +368,30 @@ func (it *BytesTimestampValuesIterator) Next() bool {
 
 	if it.tIt.Next() && it.vIt.Next() {
 		it.t, _ = it.tIt.At()
-		_, it.v = it.vIt.At()
+		_, v := it.vIt.At()
+		if it.delta {
+			var dst, gz []byte
+			if it.reuse {
+				dst, gz = it.spare[:0], it.gz[:0]
+			}
+			content, value, gzipped, err := applyValueDelta(dst, gz, it.content, v)
+			if err != nil {
+				it.err = errors.Wrapf(err, "apply delta of sample %d", it.numRead)
+				return false
+			}
+			if it.reuse {
+				it.spare = it.content
+				if gzipped {
+					it.gz = value
+				}
+				if len(value) == 0 {
+					// Empty values are nil like in all other iterators.
+					value = nil
+				}
+			}
+			it.content, v = content, value
+		}
+		it.v = v
 		it.numRead++
 		return true
 	}
@@ -216,26 +403,49 @@ func (it *BytesTimestampValuesIterator) Seek(t int64) bool {
 	if it.err != nil {
 		return false
 	}
-
-	for t > it.t || it.numRead == 0 {
-		if !it.Next() {
-			return false
+	if it.numRead > 0 && t <= it.t {
+		return true
+	}
+	if it.delta {
+		// Every value is needed to rebuild the next one.
+		for it.Next() {
+			if it.t >= t {
+				return true
+			}
 		}
+		return false
+	}
+
+	// Only walk the timestamps and position the values at the same sample afterwards,
+	// so that values of framed chunks in between are never decompressed.
+	if !it.tIt.Seek(t) {
+		it.err = it.tIt.err
+		return false
+	}
+	if !it.vIt.seekIndex(it.tIt.numRead - 1) {
+		it.err = it.vIt.err
+		return false
 	}
+	it.t, _ = it.tIt.At()
+	_, it.v = it.vIt.At()
+	it.numRead = it.tIt.numRead
 	return true
 }
 
 func (it *BytesTimestampValuesIterator) At() (int64, []byte) {
-	var (
-		t int64
-		v []byte
-	)
-	t, _ = it.tIt.At()
-	_, v = it.vIt.At()
-	return t, v
+	return it.t, it.v
+}
+
+// AtInfo returns the current timestamp and the info of the current value,
+// which is computed from the value.
+func (it *BytesTimestampValuesIterator) AtInfo() (int64, SampleInfo, bool) {
+	return it.t, NewSampleInfo(it.v), true
 }
 
 func (it *BytesTimestampValuesIterator) Err() error {
+	if it.err != nil {
+		return it.err
+	}
 	if err := it.tIt.Err(); err != nil {
 		return err
 	}
@@ -245,22 +455,105 @@ func (it *BytesTimestampValuesIterator) Err() error {
 	return nil
 }
 
+// decodeBuffers holds the buffers BytesStreamingIterators decompress values into.
+var decodeBuffers = sync.Pool{New: func() interface{} { return new([]byte) }}
+
+// BytesStreamingIterator iterates over the samples of chunks without copying
+// their values. Values are sub-slices of the chunk or of a pooled buffer the
+// chunk is decompressed into, so they are only valid until the next call of
+// Next or Seek and must not be modified.
+//
+// Pass the iterator to Chunk.Iterator to iterate over a chunk, which reuses its
+// buffer for every chunk. Close returns the buffer to the pool.
+type BytesStreamingIterator struct {
+	BytesTimestampValuesIterator
+	buf *[]byte
+	r   bytes.Reader
+}
+
+func (it *BytesStreamingIterator) reset(b *BytesChunk) {
+	if it.buf == nil {
+		it.buf = decodeBuffers.Get().(*[]byte)
+	} else {
+		it.keepBuffer()
+	}
+	it.BytesTimestampValuesIterator = BytesTimestampValuesIterator{
+		tIt:   b.tc.Iterator(nil),
+		vIt:   b.vc.iterator((*it.buf)[:0], true),
+		delta: b.delta(),
+		reuse: true,
+		spare: it.spare,
+		gz:    it.gz,
+	}
+}
+
+// keepBuffer keeps the buffer the values iterator may have grown.
+func (it *BytesStreamingIterator) keepBuffer() {
+	if it.vIt != nil && cap(it.vIt.buf) > cap(*it.buf) {
+		*it.buf = it.vIt.buf[:0]
+	}
+}
+
+// AtReader returns a reader over the current value.
+func (it *BytesStreamingIterator) AtReader() io.Reader {
+	it.r.Reset(it.v)
+	return &it.r
+}
+
+// Close returns the decode buffer to the pool. The iterator must not be used
+// afterwards until it is passed to Chunk.Iterator again.
+func (it *BytesStreamingIterator) Close() {
+	if it.buf == nil {
+		return
+	}
+	it.keepBuffer()
+	decodeBuffers.Put(it.buf)
+	it.buf = nil
+	it.BytesTimestampValuesIterator = BytesTimestampValuesIterator{}
+}
+
+// BytesTimestampOnlyIterator iterates over the timestamps of the samples of
+// chunks without reading their values. The values it returns are nil.
 type BytesTimestampOnlyIterator struct {
 	tIt *timestampsIterator
+	// iIt is nil for chunks that do not store the infos of their values.
+	iIt *infoIterator
 }
 
 func (it *BytesTimestampOnlyIterator) Next() bool {
-	return it.tIt.Next()
+	if !it.tIt.Next() {
+		return false
+	}
+	return it.iIt == nil || it.iIt.Next()
 }
 
 func (it *BytesTimestampOnlyIterator) Seek(t int64) bool {
-	return it.tIt.Seek(t)
+	if !it.tIt.Seek(t) {
+		return false
+	}
+	return it.iIt == nil || it.iIt.seekIndex(it.tIt.numRead-1)
 }
 
 func (it *BytesTimestampOnlyIterator) At() (int64, []byte) {
 	return it.tIt.At()
 }
 
+// AtInfo returns the current timestamp and the info of the current value
+// as stored in the chunk. ok is false if the chunk does not store infos.
+func (it *BytesTimestampOnlyIterator) AtInfo() (int64, SampleInfo, bool) {
+	t, _ := it.tIt.At()
+	if it.iIt == nil {
+		return t, SampleInfo{}, false
+	}
+	return t, it.iIt.info, true
+}
+
 func (it *BytesTimestampOnlyIterator) Err() error {
-	return it.tIt.Err()
+	if err := it.tIt.Err(); err != nil {
+		return err
+	}
+	if it.iIt != nil {
+		return it.iIt.err
+	}
+	return nil
 }
@@ -3,6 +3,8 @@ package chunkenc
 import (
 	"encoding/binary"
 	"fmt"
+	"io/ioutil"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -59,19 +61,71 @@ func TestBytesChunk_Appender(t *testing.T) {
 
 	require.Len(t, c.tc.b, 10)
 	require.Len(t, c.vc.b, 80)
+	require.Len(t, c.ic.b, 90)
 	require.Len(t, c.b, 0) // Isn't populated yet
 
 	bytes, err := c.Bytes()
 	require.NoError(t, err)
-	require.Len(t, bytes, 48) // 2 (numSamples) + 2*4 (two chunk length) + 10+28 (chunks)
+	require.Len(t, bytes, 142) // 2 (numSamples) + 3*4 (three chunk length) + 10+28+90 (chunks)
 
 	numSamples := binary.BigEndian.Uint16(bytes[0:])
 	tLen := binary.BigEndian.Uint32(bytes[2:])
 	vLen := binary.BigEndian.Uint32(bytes[6:])
+	iLen := binary.BigEndian.Uint32(bytes[10:])
 
 	require.Equal(t, uint16(total), numSamples)
-	require.Equal(t, uint32(10), tLen)
+	require.Equal(t, uint32(10)|bytesInfoFlag, tLen)
 	require.Equal(t, uint32(28), vLen)
+	require.Equal(t, uint32(90), iLen)
+}
+
+func TestBytesChunk_SampleInfo(t *testing.T) {
+	values := [][]byte{[]byte("a"), []byte("conprof"), nil, []byte("conprof")}
+	for _, c := range []*BytesChunk{NewBytesChunk(), NewBytesCodecChunk(Compression{Delta: true})} {
+		app, err := c.Appender()
+		require.NoError(t, err)
+		for i, v := range values {
+			app.Append(int64(i*10), v)
+		}
+		b, err := c.Bytes()
+		require.NoError(t, err)
+		loaded, err := FromData(c.Encoding(), b)
+		require.NoError(t, err)
+
+		// The timestamp only iterator returns the stored infos, the full iterator computes them.
+		for _, it := range []Iterator{loaded.Iterator(&BytesTimestampOnlyIterator{}), loaded.Iterator(nil)} {
+			for i, v := range values {
+				require.True(t, it.Next())
+				ts, info, ok := AtInfo(it)
+				require.True(t, ok)
+				require.Equal(t, int64(i*10), ts)
+				require.Equal(t, NewSampleInfo(v), info)
+			}
+			require.False(t, it.Next())
+			require.NoError(t, it.Err())
+		}
+
+		it := loaded.Iterator(&BytesTimestampOnlyIterator{})
+		require.True(t, it.Seek(25))
+		ts, info, ok := AtInfo(it)
+		require.True(t, ok)
+		require.Equal(t, int64(30), ts)
+		require.Equal(t, NewSampleInfo(values[3]), info)
+	}
+	require.NotEqual(t, NewSampleInfo([]byte("a")).Hash, NewSampleInfo([]byte("b")).Hash)
+
+	// Chunks written without infos do not know them without reading values.
+	c := NewBytesChunk()
+	c.ic = nil
+	app, err := c.Appender()
+	require.NoError(t, err)
+	app.Append(1, []byte("conprof"))
+	b, err := c.Bytes()
+	require.NoError(t, err)
+	it := LoadBytesChunk(b).Iterator(&BytesTimestampOnlyIterator{})
+	require.True(t, it.Next())
+	_, _, ok := AtInfo(it)
+	require.False(t, ok)
 }
 
 func BenchmarkBytesChunk_Appender(b *testing.B) {
@@ -87,6 +141,34 @@ func BenchmarkBytesChunk_Appender(b *testing.B) {
 	}
 }
 
+func BenchmarkBytesChunk_Iterator(b *testing.B) {
+	c := NewBytesChunk()
+	app, _ := c.Appender()
+	for i, v := range profileLike(100) {
+		app.Append(int64(i), v)
+	}
+	cb, _ := c.Bytes()
+	c = LoadBytesChunk(cb)
+
+	for _, tc := range []struct {
+		name string
+		it   func() Iterator
+	}{
+		{name: "copy", it: func() Iterator { return nil }},
+		{name: "streaming", it: func() Iterator { return &BytesStreamingIterator{} }},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			it := tc.it()
+			for i := 0; i < b.N; i++ {
+				it = c.Iterator(it)
+				for it.Next() {
+				}
+			}
+		})
+	}
+}
+
 func TestBytesChunk_Iterator(t *testing.T) {
 	c := NewBytesChunk()
 	app, err := c.Appender()
@@ -138,6 +220,69 @@ func TestBytesChunk_IteratorImmutable(t *testing.T) {
 	}
 }
 
+func TestBytesStreamingIterator(t *testing.T) {
+	values := profileLike(20)
+	values[3] = nil
+	values[7] = values[5]
+
+	for _, newChunk := range []func() *BytesChunk{
+		NewBytesChunk,
+		func() *BytesChunk { return NewBytesCodecChunk(Compression{Codec: CodecSnappy}) },
+		func() *BytesChunk { return NewBytesCodecChunk(Compression{Codec: CodecNone}) },
+		func() *BytesChunk { return NewBytesDeltaChunk(Compression{}) },
+		func() *BytesChunk { return NewBytesDedupChunk(Compression{}) },
+		func() *BytesChunk { return NewBytesFramedChunk(nil) },
+	} {
+		c := newChunk()
+		t.Run(c.Encoding().String(), func(t *testing.T) {
+			app, err := c.Appender()
+			require.NoError(t, err)
+			for i, v := range values {
+				app.Append(int64(i), v)
+			}
+			b, err := c.Bytes()
+			require.NoError(t, err)
+			chk, err := NewPool().Get(c.Encoding(), b)
+			require.NoError(t, err)
+			loaded := chk.(*BytesChunk)
+			compressed := append([]byte{}, loaded.vc.compressed...)
+
+			// Concurrent iterators over the same chunk never write to it.
+			var wg sync.WaitGroup
+			for g := 0; g < 4; g++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					it := &BytesStreamingIterator{}
+					defer it.Close()
+					for round := 0; round < 2; round++ {
+						i := 0
+						for it := chk.Iterator(it).(*BytesStreamingIterator); it.Next(); i++ {
+							ts, v := it.At()
+							require.Equal(t, int64(i), ts)
+							require.Equal(t, values[i], v)
+							r, err := ioutil.ReadAll(it.AtReader())
+							require.NoError(t, err)
+							require.Equal(t, string(values[i]), string(r))
+						}
+						require.NoError(t, it.Err())
+						require.Equal(t, len(values), i)
+					}
+				}()
+			}
+			wg.Wait()
+			require.Empty(t, loaded.vc.b)
+			require.Equal(t, compressed, loaded.vc.compressed)
+
+			it := chk.Iterator(&BytesStreamingIterator{})
+			require.True(t, it.Seek(12))
+			ts, v := it.At()
+			require.Equal(t, int64(12), ts)
+			require.Equal(t, values[12], v)
+		})
+	}
+}
+
 func TestBytesTimestampValuesIterator_Seek(t *testing.T) {
 	c := NewBytesChunk()
 	app, err := c.Appender()
@@ -240,3 +385,100 @@ func BenchmarkBytesTimestampOnlyIterator_Seek(b *testing.B) {
 		}
 	}
 }
+
+func TestBytesFramedChunk(t *testing.T) {
+	var values [][]byte
+	for i := 0; i < 100; i++ {
+		values = append(values, []byte(fmt.Sprintf("conprof-%d", i)))
+	}
+	values[42] = nil
+
+	dict, err := TrainDictionary(profileLike(100), 16*1024)
+	require.NoError(t, err)
+
+	for _, d := range []*Dictionary{nil, dict} {
+		c := NewBytesFramedChunk(d)
+		app, err := c.Appender()
+		require.NoError(t, err)
+		for i, v := range values {
+			app.Append(int64(i*10), v)
+		}
+		require.Equal(t, EncBytesFramed, c.Encoding())
+
+		b, err := c.Bytes()
+		require.NoError(t, err)
+
+		c, err = LoadBytesFramedChunk(b, d)
+		require.NoError(t, err)
+		require.Equal(t, len(values), c.NumSamples())
+
+		it := c.Iterator(nil)
+		for i, v := range values {
+			require.True(t, it.Next())
+			ts, val := it.At()
+			require.Equal(t, int64(i*10), ts)
+			require.Equal(t, v, val)
+		}
+		require.False(t, it.Next())
+		require.NoError(t, it.Err())
+
+		it = c.Iterator(nil)
+		require.True(t, it.Seek(415))
+		ts, val := it.At()
+		require.Equal(t, int64(420), ts)
+		require.Equal(t, []byte(nil), val)
+
+		// Seeking backwards has no effect.
+		require.True(t, it.Seek(100))
+		ts, _ = it.At()
+		require.Equal(t, int64(420), ts)
+
+		require.True(t, it.Next())
+		ts, val = it.At()
+		require.Equal(t, int64(430), ts)
+		require.Equal(t, "conprof-43", string(val))
+
+		require.True(t, it.Seek(990))
+		ts, val = it.At()
+		require.Equal(t, int64(990), ts)
+		require.Equal(t, "conprof-99", string(val))
+		require.False(t, it.Seek(991))
+		require.NoError(t, it.Err())
+	}
+
+	// The offsets of values beyond 16383 do not fit into uint16.
+	c := NewBytesFramedChunk(nil)
+	app, err := c.Appender()
+	require.NoError(t, err)
+	const many = 20000
+	for i := 0; i < many; i++ {
+		app.Append(int64(i), []byte(fmt.Sprintf("conprof-%d", i)))
+	}
+	b, err := c.Bytes()
+	require.NoError(t, err)
+	c, err = LoadBytesFramedChunk(b, nil)
+	require.NoError(t, err)
+	it := c.Iterator(nil)
+	for i := 0; i < many; i++ {
+		require.True(t, it.Seek(int64(i)))
+		ts, val := it.At()
+		require.Equal(t, int64(i), ts)
+		require.Equal(t, fmt.Sprintf("conprof-%d", i), string(val))
+	}
+	require.False(t, it.Next())
+	require.NoError(t, it.Err())
+
+	// Framed chunks with dictionary can only be loaded with it.
+	c = NewBytesFramedChunk(dict)
+	app, err = c.Appender()
+	require.NoError(t, err)
+	app.Append(1, []byte("conprof"))
+	b, err = c.Bytes()
+	require.NoError(t, err)
+
+	_, err = NewPool().Get(EncBytesFramed, b)
+	require.Equal(t, &MissingDictionaryErr{ID: dict.ID()}, err)
+	chk, err := NewDictionaryPool(nil, dict).Get(EncBytesFramed, b)
+	require.NoError(t, err)
+	require.Equal(t, EncBytesFramed, chk.Encoding())
+}
@@ -35,6 +35,18 @@ func (e Encoding) String() string {
 		return "Timestamps"
 	case EncValues:
 		return "Values"
+	case EncBytesDict:
+		return "BytesDict"
+	case EncBytesFramed:
+		return "BytesFramed"
+	case EncBytesCodec:
+		return "BytesCodec"
+	case EncBytesDelta:
+		return "BytesDelta"
+	case EncPprof:
+		return "Pprof"
+	case EncBytesDedup:
+		return "BytesDedup"
 	default:
 		return "<unknown>"
 	}
@@ -47,6 +59,12 @@ const (
 	EncTimestamps
 	EncValues
 	EncXOR
+	EncBytesDict
+	EncBytesFramed
+	EncBytesCodec
+	EncBytesDelta
+	EncPprof
+	EncBytesDedup
 )
 
 // Chunk holds a sequence of sample pairs that can be iterated over and appended to.
@@ -81,6 +99,12 @@ type Appender interface {
 	Append(int64, []byte)
 }
 
+// FloatAppender adds numeric sample pairs to a chunk with EncXOR encoding.
+type FloatAppender interface {
+	Appender
+	AppendFloat(int64, float64)
+}
+
 // Iterator is a simple iterator that can only get the next value.
 // Iterator iterates over the samples of a time series, in timestamp-increasing order.
 type Iterator interface {
@@ -99,6 +123,32 @@ type Iterator interface {
 	Err() error
 }
 
+// FloatIterator iterates over numeric samples. Its At method returns the values
+// encoded with EncodeFloat.
+type FloatIterator interface {
+	Iterator
+	// AtFloat returns the current timestamp/value pair.
+	AtFloat() (int64, float64)
+}
+
+// SizeIterator iterates over samples whose values are not read. AtSize
+// returns the uncompressed size of the values instead.
+type SizeIterator interface {
+	Iterator
+	// AtSize returns the current timestamp and the size of the value.
+	AtSize() (int64, int)
+}
+
+// AtSize returns the current timestamp of it and the size of the current value.
+// Iterators that do not implement SizeIterator return the length of their value.
+func AtSize(it Iterator) (int64, int) {
+	if sit, ok := it.(SizeIterator); ok {
+		return sit.AtSize()
+	}
+	t, v := it.At()
+	return t, len(v)
+}
+
 // NewNopIterator returns a new chunk iterator that does not hold any data.
 func NewNopIterator() Iterator {
 	return nopIterator{}
@@ -136,17 +186,24 @@ func NewPool() Pool {
 func (p *pool) Get(e Encoding, b []byte) (Chunk, error) {
 	switch e {
 	case EncXOR:
-		panic("nothing should be using XOR encoding")
-	//	c := p.xor.Get().(*XORChunk)
-	//	c.b.stream = b
-	//	c.b.count = 0
-	//	return c, nil
-
+		return LoadXORChunk(b), nil
 	// needs new case for our new encoding
 	// c.immutable needs to be set = true
 	// (need to double check also where else this Pool is used to see if this immutable thing is safe to do)
 	case EncBytes:
 		return LoadBytesChunk(b), nil
+	case EncBytesDict:
+		return nil, missingDictionary(b)
+	case EncBytesFramed:
+		return LoadBytesFramedChunk(b, nil)
+	case EncBytesCodec:
+		return LoadBytesCodecChunk(b)
+	case EncBytesDelta:
+		return LoadBytesDeltaChunk(b)
+	case EncPprof:
+		return LoadPprofChunk(b)
+	case EncBytesDedup:
+		return LoadBytesDedupChunk(b)
 	}
 	return nil, errors.Errorf("invalid chunk encoding %q", e)
 }
@@ -154,17 +211,7 @@ func (p *pool) Get(e Encoding, b []byte) (Chunk, error) {
 func (p *pool) Put(c Chunk) error {
 	switch c.Encoding() {
 	case EncXOR:
-		panic("nothing should be using XOR encoding")
-	//	xc, ok := c.(*XORChunk)
-	//	// This may happen often with wrapped chunks. Nothing we can really do about
-	//	// it but returning an error would cause a lot of allocations again. Thus,
-	//	// we just skip it.
-	//	if !ok {
-	//		return nil
-	//	}
-	//	xc.b.stream = nil
-	//	xc.b.count = 0
-	//	p.xor.Put(c)
+		// XOR chunks are rare next to profiles and not pooled.
 	case EncBytes:
 		xc, ok := c.(*BytesChunk)
 		// This may happen often with wrapped chunks. Nothing we can really do about
@@ -175,6 +222,8 @@ func (p *pool) Put(c Chunk) error {
 		}
 		xc.b = nil
 		p.xor.Put(c)
+	case EncBytesDict, EncBytesFramed, EncBytesCodec, EncBytesDelta, EncPprof, EncBytesDedup:
+		// Chunks with a header are not pooled.
 	// needs new case for new encoding
 	// needs to reset chunk.immutable = false
 	default:
@@ -189,10 +238,21 @@ func (p *pool) Put(c Chunk) error {
 func FromData(e Encoding, d []byte) (Chunk, error) {
 	switch e {
 	case EncXOR:
-		panic("nothing should be using XOR encoding")
-	//	return &XORChunk{b: bstream{count: 0, stream: d}}, nil
+		return LoadXORChunk(d), nil
 	case EncBytes:
 		return LoadBytesChunk(d), nil
+	case EncBytesDict:
+		return nil, missingDictionary(d)
+	case EncBytesFramed:
+		return LoadBytesFramedChunk(d, nil)
+	case EncBytesCodec:
+		return LoadBytesCodecChunk(d)
+	case EncBytesDelta:
+		return LoadBytesDeltaChunk(d)
+	case EncPprof:
+		return LoadPprofChunk(d)
+	case EncBytesDedup:
+		return LoadBytesDedupChunk(d)
 	}
 	return nil, errors.Errorf("invalid chunk encoding %q", e)
 }
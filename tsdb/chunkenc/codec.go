@@ -0,0 +1,243 @@
+// Copyright 2021 The Conprof Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunkenc
+
+import (
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// Codec identifies the compression of the values of chunks with EncBytesCodec encoding.
+type Codec uint8
+
+// The available value codecs.
+const (
+	CodecZstd Codec = iota
+	// CodecNone stores values uncompressed. It suits payloads that are
+	// compressed already, such as gzipped pprof profiles.
+	CodecNone
+	CodecSnappy
+	CodecS2
+)
+
+func (c Codec) String() string {
+	switch c {
+	case CodecZstd:
+		return "zstd"
+	case CodecNone:
+		return "none"
+	case CodecSnappy:
+		return "snappy"
+	case CodecS2:
+		return "s2"
+	default:
+		return "<unknown>"
+	}
+}
+
+// Compression configures how the values of a chunk are compressed.
+// The zero value compresses with zstd at its fastest level, like EncBytes chunks.
+type Compression struct {
+	Codec Codec
+	// Level is the zstd encoder level. 0 uses zstd.SpeedFastest.
+	// It must be 0 for all other codecs.
+	Level zstd.EncoderLevel
+	// Delta stores values as deltas against their predecessors before
+	// compressing them, see NewBytesDeltaChunk.
+	Delta bool
+	// Dedup stores values that are identical to an earlier value of the chunk
+	// as references to it, see NewBytesDedupChunk. It cannot be combined with Delta.
+	Dedup bool
+}
+
+// Validate returns an error if the compression cannot be used for chunks.
+func (c Compression) Validate() error {
+	switch c.Codec {
+	case CodecZstd:
+		if c.Level < 0 || c.Level > zstd.SpeedBestCompression {
+			return errors.Errorf("invalid zstd level %d", c.Level)
+		}
+	case CodecNone, CodecSnappy, CodecS2:
+		if c.Level != 0 {
+			return errors.Errorf("codec %s has no levels", c.Codec)
+		}
+	default:
+		return errors.Errorf("unknown codec %d", c.Codec)
+	}
+	if c.Delta && c.Dedup {
+		return errors.New("delta and dedup cannot be combined")
+	}
+	return nil
+}
+
+// effective returns c with the level that is actually used for encoding.
+func (c Compression) effective() Compression {
+	if c.Codec == CodecZstd && c.Level == 0 {
+		c.Level = zstd.SpeedFastest
+	}
+	return c
+}
+
+func (c Compression) encode(src []byte) []byte {
+	switch c.Codec {
+	case CodecNone:
+		return src
+	case CodecSnappy:
+		return snappy.Encode(nil, src)
+	case CodecS2:
+		return s2.Encode(nil, src)
+	default:
+		return zstdEncoder(c.effective().Level).EncodeAll(src, nil)
+	}
+}
+
+// decode decompresses src into dst if it is large enough, or a new slice otherwise.
+// Uncompressed values are returned as src.
+func (c Compression) decode(dst, src []byte) ([]byte, error) {
+	switch c.Codec {
+	case CodecNone:
+		return src, nil
+	case CodecSnappy:
+		return snappy.Decode(dst[:cap(dst)], src)
+	case CodecS2:
+		return s2.Decode(dst[:cap(dst)], src)
+	case CodecZstd:
+		return zstdDecoder.DecodeAll(src, dst[:0])
+	default:
+		return nil, errors.Errorf("unknown codec %d", c.Codec)
+	}
+}
+
+// zstdEncoders holds one lazily created encoder per level, as creating them is expensive.
+var zstdEncoders [zstd.SpeedBestCompression + 1]struct {
+	once sync.Once
+	enc  *zstd.Encoder
+}
+
+func zstdEncoder(l zstd.EncoderLevel) *zstd.Encoder {
+	e := &zstdEncoders[l]
+	e.once.Do(func() {
+		// The level was validated so creating the encoder cannot fail.
+		e.enc, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(l), zstd.WithEncoderConcurrency(1))
+	})
+	return e.enc
+}
+
+// codecHeaderSize is the size of the codec and level that prefix the regular
+// BytesChunk layout in chunks with EncBytesCodec encoding.
+const codecHeaderSize = 2
+
+// NewBytesCodecChunk returns a new BytesChunk whose values are compressed as configured.
+// The compression must be valid, see Compression.Validate.
+func NewBytesCodecChunk(comp Compression) *BytesChunk {
+	comp = comp.effective()
+	c := NewBytesChunk()
+	c.comp = &comp
+	c.vc.comp = &comp
+	return c
+}
+
+// LoadBytesCodecChunk loads a chunk with EncBytesCodec encoding.
+// Use LoadBytesDeltaChunk for chunks with EncBytesDelta encoding, which share its layout.
+func LoadBytesCodecChunk(b []byte) (*BytesChunk, error) {
+	return loadBytesCodecChunk(b, 0)
+}
+
+// loadBytesCodecChunk loads a chunk that starts with the codec header,
+// followed by extra bytes of header and the regular BytesChunk layout.
+func loadBytesCodecChunk(b []byte, extra int) (*BytesChunk, error) {
+	if len(b) < codecHeaderSize+extra {
+		return nil, errors.New("codec chunk too short")
+	}
+	comp := Compression{Codec: Codec(b[0]), Level: zstd.EncoderLevel(b[1])}
+	if err := comp.Validate(); err != nil {
+		return nil, err
+	}
+	c := loadBytesChunk(b, codecHeaderSize+extra)
+	c.comp = &comp
+	c.vc.comp = &comp
+	return c, nil
+}
+
+// CompressedWith returns whether the values of c are compressed with comp,
+// so that recompressing the chunk would not change it.
+func CompressedWith(c Chunk, comp Compression) bool {
+	cc, ok := CompressionOf(c)
+	return ok && cc == comp.effective()
+}
+
+// Compression returns how the values of the chunk are compressed and whether the
+// chunk records it, which only chunks with EncBytesCodec encoding do.
+func (b *BytesChunk) Compression() (Compression, bool) {
+	if b.comp == nil {
+		return Compression{}, false
+	}
+	return *b.comp, true
+}
+
+// NewChunkLike returns a new chunk with the encoding, compression and dictionary of c.
+// Chunks that wrap another chunk, such as those of the head, expose it with an
+// Unwrap method. All other chunks result in an EncBytes chunk.
+func NewChunkLike(c Chunk) Chunk {
+	switch c := unwrap(c).(type) {
+	case *XORChunk:
+		return NewXORChunk()
+	case *PprofChunk:
+		return NewPprofChunk()
+	case *BytesChunk:
+		switch {
+		case c.framed:
+			return NewBytesFramedChunk(c.dict)
+		case c.dict != nil:
+			return NewBytesDictChunk(c.dict)
+		case c.comp != nil:
+			return NewBytesCodecChunk(*c.comp)
+		}
+	}
+	return NewBytesChunk()
+}
+
+// unwrap returns the innermost chunk wrapped by c.
+func unwrap(c Chunk) Chunk {
+	for {
+		w, ok := c.(interface{ Unwrap() Chunk })
+		if !ok {
+			return c
+		}
+		c = w.Unwrap()
+	}
+}
+
+// NumDeduped returns the number of values of c that are stored as references
+// to identical earlier values. It is 0 for all chunks but EncBytesDedup ones.
+func NumDeduped(c Chunk) int {
+	bc, ok := unwrap(c).(*BytesChunk)
+	if !ok {
+		return 0
+	}
+	return int(bc.vc.deduped)
+}
+
+// CompressionOf returns the compression of c if it records it, see BytesChunk.Compression.
+func CompressionOf(c Chunk) (Compression, bool) {
+	bc, ok := unwrap(c).(*BytesChunk)
+	if !ok {
+		return Compression{}, false
+	}
+	return bc.Compression()
+}
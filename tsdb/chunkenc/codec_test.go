@@ -0,0 +1,82 @@
+// Copyright 2021 The Conprof Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunkenc
+
+import (
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBytesCodecChunk(t *testing.T) {
+	values := profileLike(12)
+	values[3] = nil
+
+	for _, comp := range []Compression{
+		{},
+		{Codec: CodecZstd, Level: zstd.SpeedBestCompression},
+		{Codec: CodecNone},
+		{Codec: CodecSnappy},
+		{Codec: CodecS2},
+	} {
+		t.Run(comp.Codec.String(), func(t *testing.T) {
+			require.NoError(t, comp.Validate())
+
+			c := NewBytesCodecChunk(comp)
+			app, err := c.Appender()
+			require.NoError(t, err)
+			for i, v := range values {
+				app.Append(int64(i), v)
+			}
+			require.Equal(t, EncBytesCodec, c.Encoding())
+			require.True(t, CompressedWith(c, comp))
+
+			b, err := c.Bytes()
+			require.NoError(t, err)
+
+			chk, err := NewPool().Get(EncBytesCodec, b)
+			require.NoError(t, err)
+			require.Equal(t, EncBytesCodec, chk.Encoding())
+			require.Equal(t, len(values), chk.NumSamples())
+			require.True(t, CompressedWith(chk, comp))
+			require.False(t, CompressedWith(chk, Compression{Codec: CodecS2 - comp.Codec}))
+
+			it := chk.Iterator(nil)
+			for i, v := range values {
+				require.True(t, it.Next())
+				ts, val := it.At()
+				require.Equal(t, int64(i), ts)
+				require.Equal(t, v, val)
+			}
+			require.False(t, it.Next())
+			require.NoError(t, it.Err())
+
+			// Loaded chunks serialize to the same bytes.
+			rb, err := chk.Bytes()
+			require.NoError(t, err)
+			require.Equal(t, b, rb)
+		})
+	}
+}
+
+func TestCompression_Validate(t *testing.T) {
+	require.NoError(t, Compression{Codec: CodecZstd, Level: zstd.SpeedBetterCompression}.Validate())
+	require.Error(t, Compression{Codec: CodecZstd, Level: zstd.SpeedBestCompression + 1}.Validate())
+	require.Error(t, Compression{Codec: CodecSnappy, Level: zstd.SpeedFastest}.Validate())
+	require.Error(t, Compression{Codec: CodecS2 + 1}.Validate())
+
+	_, err := LoadBytesCodecChunk([]byte{byte(CodecS2 + 1), 0})
+	require.Error(t, err)
+}
@@ -0,0 +1,117 @@
+// Copyright 2021 The Conprof Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunkenc
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/pkg/errors"
+)
+
+// Chunks with EncBytesDedup encoding store values that are identical to an
+// earlier value of the chunk as a reference to its sample. Idle goroutine
+// profiles and mutex or block profiles without contention are often identical.
+//
+// The codec header is followed by the number of referencing samples, then the
+// regular BytesChunk layout. Every value starts with a uvarint whose lowest bit
+// tells references from values. References hold the index of the referenced
+// sample in the remaining bits, values their length followed by the value.
+//
+// ┌──────────────┬──────────────┬──────────────────┬─────────────────────┐
+// │ codec <1b>   │ level <1b>   │ deduped <2b>     │ BytesChunk layout   │
+// └──────────────┴──────────────┴──────────────────┴─────────────────────┘
+//
+// ┌────────────────────────┐   ┌────────────────────────┬────────────────┐
+// │ index<<1 | 1 <uvarint> │   │ len<<1 <uvarint>       │ bytes <len>    │
+// └────────────────────────┘   └────────────────────────┴────────────────┘
+//        reference                              value
+
+// dedupHeaderSize is the size of the number of referencing samples after the codec header.
+const dedupHeaderSize = 2
+
+// NewBytesDedupChunk returns a new BytesChunk that stores repeated values as
+// references to their first occurrence, compressed as configured.
+func NewBytesDedupChunk(comp Compression) *BytesChunk {
+	comp.Dedup = true
+	return NewBytesCodecChunk(comp)
+}
+
+// LoadBytesDedupChunk loads a chunk with EncBytesDedup encoding.
+func LoadBytesDedupChunk(b []byte) (*BytesChunk, error) {
+	c, err := loadBytesCodecChunk(b, dedupHeaderSize)
+	if err != nil {
+		return nil, err
+	}
+	c.comp.Dedup = true
+	c.vc.deduped = binary.BigEndian.Uint16(b[codecHeaderSize:])
+	return c, nil
+}
+
+// dedupEntry locates a value that was appended in full to a valueChunk.
+type dedupEntry struct {
+	idx    uint16
+	off, n int
+}
+
+// dedupIndex finds the values of a valueChunk by their hash.
+type dedupIndex map[uint64][]dedupEntry
+
+// lookup returns the sample index of the value in b that equals v.
+func (d dedupIndex) lookup(b []byte, h uint64, v []byte) (uint16, bool) {
+	for _, e := range d[h] {
+		if e.n == len(v) && bytes.Equal(b[e.off:e.off+e.n], v) {
+			return e.idx, true
+		}
+	}
+	return 0, false
+}
+
+// buildDedupIndex indexes the values already appended to c. It returns the
+// uncompressed values the index refers to without modifying c, which may be
+// shared with readers.
+func (c *valueChunk) buildDedupIndex() (dedupIndex, []byte, error) {
+	d := dedupIndex{}
+	if c.num == 0 {
+		return d, c.b, nil
+	}
+	vals := c.b
+	if len(vals) == 0 && len(c.compressed) != 0 {
+		var err error
+		if vals, err = c.decompress(nil); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	b := vals
+	for i := uint16(0); i < c.num; i++ {
+		h, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, nil, errors.Errorf("invalid header of sample %d", i)
+		}
+		b = b[n:]
+		if h&1 == 1 {
+			continue
+		}
+		l := h >> 1
+		if l > uint64(len(b)) {
+			return nil, nil, errors.Errorf("sample %d has %d bytes, %d left", i, l, len(b))
+		}
+		hash := xxhash.Sum64(b[:l])
+		d[hash] = append(d[hash], dedupEntry{idx: i, off: len(vals) - len(b), n: int(l)})
+		b = b[l:]
+	}
+	return d, vals, nil
+}
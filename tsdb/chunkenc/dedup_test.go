@@ -0,0 +1,107 @@
+// Copyright 2021 The Conprof Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunkenc
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBytesDedupChunk(t *testing.T) {
+	idle := []byte(strings.Repeat("goroutine profile: total 4\n", 100))
+	values := profileLike(12)
+	for _, i := range []int{1, 2, 5, 9, 10} {
+		values[i] = idle
+	}
+	values[7] = nil
+	values[11] = nil
+
+	c := NewBytesDedupChunk(Compression{Codec: CodecNone})
+	plain := NewBytesCodecChunk(Compression{Codec: CodecNone})
+	app, err := c.Appender()
+	require.NoError(t, err)
+	plainApp, err := plain.Appender()
+	require.NoError(t, err)
+	for i, v := range values[:6] {
+		app.Append(int64(i), v)
+		plainApp.Append(int64(i), v)
+	}
+	// Appenders index the values appended before them.
+	app, err = c.Appender()
+	require.NoError(t, err)
+	for i, v := range values[6:] {
+		app.Append(int64(i+6), v)
+		plainApp.Append(int64(i+6), v)
+	}
+	require.Equal(t, EncBytesDedup, c.Encoding())
+	require.Equal(t, 5, NumDeduped(c))
+	require.Equal(t, 0, NumDeduped(plain))
+	require.True(t, CompressedWith(c, Compression{Codec: CodecNone, Dedup: true}))
+
+	b, err := c.Bytes()
+	require.NoError(t, err)
+	plainBytes, err := plain.Bytes()
+	require.NoError(t, err)
+	require.Less(t, len(b), len(plainBytes)-3*len(idle))
+
+	chk, err := NewPool().Get(EncBytesDedup, b)
+	require.NoError(t, err)
+	require.Equal(t, EncBytesDedup, chk.Encoding())
+	require.Equal(t, 5, NumDeduped(chk))
+
+	it := chk.Iterator(nil)
+	for i, v := range values {
+		require.True(t, it.Next())
+		ts, val := it.At()
+		require.Equal(t, int64(i), ts)
+		require.Equal(t, v, val)
+	}
+	require.False(t, it.Next())
+	require.NoError(t, it.Err())
+
+	it = chk.Iterator(nil)
+	require.True(t, it.Seek(10))
+	ts, val := it.At()
+	require.Equal(t, int64(10), ts)
+	require.Equal(t, idle, val)
+	require.NoError(t, it.Err())
+
+	require.Equal(t, EncBytesDedup, NewChunkLike(chk).Encoding())
+	require.Error(t, Compression{Delta: true, Dedup: true}.Validate())
+
+	// Appenders index loaded chunks without modifying them before appending.
+	orig := append([]byte{}, b...)
+	bc := chk.(*BytesChunk)
+	_, err = chk.Appender()
+	require.NoError(t, err)
+	require.Empty(t, bc.vc.b)
+	require.NotEmpty(t, bc.vc.compressed)
+	require.Equal(t, orig, b)
+
+	app, err = chk.Appender()
+	require.NoError(t, err)
+	app.Append(12, idle)
+	require.Equal(t, 6, NumDeduped(chk))
+	it = chk.Iterator(nil)
+	for i, v := range append(values, idle) {
+		require.True(t, it.Next())
+		ts, val := it.At()
+		require.Equal(t, int64(i), ts)
+		require.Equal(t, v, val)
+	}
+	require.False(t, it.Next())
+	require.NoError(t, it.Err())
+}
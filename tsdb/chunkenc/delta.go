@@ -0,0 +1,320 @@
+// Copyright 2021 The Conprof Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunkenc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io/ioutil"
+	"sync"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/pkg/errors"
+)
+
+// Chunks with EncBytesDelta encoding store every value as a delta against the
+// value before it, the first one against an empty value. Consecutive profiles
+// of a series mostly share their functions, locations and mappings, so the
+// deltas are small and compress well.
+//
+// A delta is a sequence of operations that build the value. Each starts with
+// a uvarint of the operation's length shifted left by one, whose lowest bit
+// tells copies from inserts. Copies are followed by the uvarint offset of the
+// copied bytes in the previous value, inserts by the inserted bytes.
+//
+// ┌────────────────────────┬──────────────────┐   ┌────────────────────────┬────────────────┐
+// │ len<<1 | 1 <uvarint>   │ offset <uvarint> │   │ len<<1 <uvarint>       │ bytes <len>    │
+// └────────────────────────┴──────────────────┘   └────────────────────────┴────────────────┘
+//                    copy                                           insert
+//
+// Every delta starts with a byte of its mode. Gzipped values, like pprof
+// profiles, hardly share bytes with their predecessors even if their content
+// does. If gzipping their content again results in the exact same value, the
+// delta is computed on the content and values are gzipped again when read.
+// Their deltas hold the xxhash of the value after the mode. Gzip
+// implementations may change, so values that do not match it when they are
+// read are returned as their content, which is the same profile uncompressed.
+// The content of a value is the source of the next delta.
+//
+// ┌─────────────┬──────────────────────────────┬────────────────┐
+// │ mode <1b>   │ hash <8b>, if gzipped        │ delta <bytes>  │
+// └─────────────┴──────────────────────────────┴────────────────┘
+
+// The modes of deltas.
+const (
+	// deltaRaw deltas build the value itself.
+	deltaRaw byte = iota
+	// deltaGzipBestSpeed and deltaGzipDefault deltas build the content of a
+	// value that is gzipped with gzip.BestSpeed, as runtime/pprof does, or
+	// gzip.DefaultCompression, as github.com/google/pprof/profile does.
+	deltaGzipBestSpeed
+	deltaGzipDefault
+)
+
+// deltaGzipLevels are the gzip levels of the delta modes.
+var deltaGzipLevels = [...]int{
+	deltaGzipBestSpeed: gzip.BestSpeed,
+	deltaGzipDefault:   gzip.DefaultCompression,
+}
+
+// deltaGzipWriters pool the gzip writers of every delta mode.
+var deltaGzipWriters [len(deltaGzipLevels)]sync.Pool
+
+// deltaBlockSize is the size of the blocks of the previous value that are
+// indexed to find copies. Shorter matches are inserted.
+const deltaBlockSize = 32
+
+// deltaHashBase is the base of the rolling hash over blocks.
+const deltaHashBase = 16777619
+
+// deltaHashPow is deltaHashBase^(deltaBlockSize-1), the factor of the byte
+// that leaves the rolling hash.
+var deltaHashPow = func() uint32 {
+	p := uint32(1)
+	for i := 0; i < deltaBlockSize-1; i++ {
+		p *= deltaHashBase
+	}
+	return p
+}()
+
+func deltaHash(b []byte) uint32 {
+	var h uint32
+	for _, c := range b[:deltaBlockSize] {
+		h = h*deltaHashBase + uint32(c)
+	}
+	return h
+}
+
+// appendDelta appends the delta that builds target from src to dst.
+func appendDelta(dst, src, target []byte) []byte {
+	if len(src) < deltaBlockSize || len(target) < deltaBlockSize {
+		return appendDeltaInsert(dst, target)
+	}
+
+	index := make(map[uint32]int, len(src)/deltaBlockSize)
+	for i := 0; i+deltaBlockSize <= len(src); i += deltaBlockSize {
+		h := deltaHash(src[i:])
+		if _, ok := index[h]; !ok {
+			index[h] = i
+		}
+	}
+
+	var (
+		lit = 0 // Start of the bytes that have to be inserted.
+		i   = 0
+		h   = deltaHash(target)
+	)
+	for i+deltaBlockSize <= len(target) {
+		if off, ok := index[h]; ok && bytes.Equal(src[off:off+deltaBlockSize], target[i:i+deltaBlockSize]) {
+			// Extend the match backwards into the pending insert and forwards as far as possible.
+			for off > 0 && i > lit && src[off-1] == target[i-1] {
+				off--
+				i--
+			}
+			n := deltaBlockSize
+			for off+n < len(src) && i+n < len(target) && src[off+n] == target[i+n] {
+				n++
+			}
+			dst = appendDeltaInsert(dst, target[lit:i])
+			dst = appendDeltaCopy(dst, off, n)
+
+			i += n
+			lit = i
+			if i+deltaBlockSize <= len(target) {
+				h = deltaHash(target[i:])
+			}
+			continue
+		}
+		if i+deltaBlockSize < len(target) {
+			h = (h-uint32(target[i])*deltaHashPow)*deltaHashBase + uint32(target[i+deltaBlockSize])
+		}
+		i++
+	}
+	return appendDeltaInsert(dst, target[lit:])
+}
+
+func appendDeltaInsert(dst, b []byte) []byte {
+	if len(b) == 0 {
+		return dst
+	}
+	dst = appendUvarint(dst, uint64(len(b))<<1)
+	return append(dst, b...)
+}
+
+func appendDeltaCopy(dst []byte, off, n int) []byte {
+	dst = appendUvarint(dst, uint64(n)<<1|1)
+	return appendUvarint(dst, uint64(off))
+}
+
+// applyDelta appends the value built by applying delta to src to dst.
+// dst must not overlap src.
+func applyDelta(dst, src, delta []byte) ([]byte, error) {
+	target := dst
+	for len(delta) > 0 {
+		op, n := binary.Uvarint(delta)
+		if n <= 0 {
+			return nil, errors.New("invalid delta operation")
+		}
+		delta = delta[n:]
+		l := op >> 1
+
+		if op&1 == 0 {
+			if l > uint64(len(delta)) {
+				return nil, errors.Errorf("delta inserts %d bytes, %d left", l, len(delta))
+			}
+			target = append(target, delta[:l]...)
+			delta = delta[l:]
+			continue
+		}
+
+		off, n := binary.Uvarint(delta)
+		if n <= 0 {
+			return nil, errors.New("invalid delta copy offset")
+		}
+		delta = delta[n:]
+		if off > uint64(len(src)) || l > uint64(len(src))-off {
+			return nil, errors.Errorf("delta copies %d bytes at %d of %d", l, off, len(src))
+		}
+		target = append(target, src[off:off+l]...)
+	}
+	return target, nil
+}
+
+// deltaHashSize is the size of the hash of gzipped values in their deltas.
+const deltaHashSize = 8
+
+// appendValueDelta appends the delta that builds v from the content of the
+// previous value to dst. It returns the delta and the content of v.
+func appendValueDelta(dst, prev, v []byte) ([]byte, []byte) {
+	content, mode := deltaContent(v)
+	dst = append(dst, mode)
+	if mode != deltaRaw {
+		var h [deltaHashSize]byte
+		binary.BigEndian.PutUint64(h[:], xxhash.Sum64(v))
+		dst = append(dst, h[:]...)
+	}
+	return appendDelta(dst, prev, content), content
+}
+
+// applyValueDelta rebuilds a value from the content of the previous value and
+// its delta. It appends the content of the value to dst, which must not overlap
+// prev, and gzips it into gz if the value is gzipped. Otherwise, or if gzipping
+// does not result in the original value, the content is the value and gzipped
+// is false.
+func applyValueDelta(dst, gz, prev, delta []byte) (content, v []byte, gzipped bool, err error) {
+	if len(delta) == 0 {
+		return nil, nil, false, errors.New("delta without mode")
+	}
+	mode := delta[0]
+	if int(mode) >= len(deltaGzipLevels) {
+		return nil, nil, false, errors.Errorf("unknown delta mode %d", mode)
+	}
+	delta = delta[1:]
+	var hash uint64
+	if mode != deltaRaw {
+		if len(delta) < deltaHashSize {
+			return nil, nil, false, errors.New("delta without hash")
+		}
+		hash = binary.BigEndian.Uint64(delta)
+		delta = delta[deltaHashSize:]
+	}
+	content, err = applyDelta(dst, prev, delta)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if mode == deltaRaw {
+		return content, content, false, nil
+	}
+	v, err = gzipContent(gz, content, mode)
+	if err != nil {
+		return nil, nil, false, errors.Wrap(err, "gzip value")
+	}
+	if xxhash.Sum64(v) != hash {
+		return content, content, false, nil
+	}
+	return content, v, true, nil
+}
+
+// deltaContent returns the content of v and the mode of its delta.
+func deltaContent(v []byte) ([]byte, byte) {
+	if len(v) < 10 || v[0] != 0x1f || v[1] != 0x8b {
+		return v, deltaRaw
+	}
+	// Go's gzip writer flags BestSpeed with 4 in the XFL header byte and
+	// leaves it 0 for the levels in between.
+	var mode byte
+	switch v[8] {
+	case 4:
+		mode = deltaGzipBestSpeed
+	case 0:
+		mode = deltaGzipDefault
+	default:
+		return v, deltaRaw
+	}
+	r, err := gzip.NewReader(bytes.NewReader(v))
+	if err != nil {
+		return v, deltaRaw
+	}
+	r.Multistream(false)
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return v, deltaRaw
+	}
+	// Values written differently, e.g. with a header name, are stored as they are.
+	if gz, err := gzipContent(nil, content, mode); err != nil || !bytes.Equal(gz, v) {
+		return v, deltaRaw
+	}
+	return content, mode
+}
+
+// gzipContent appends content gzipped at the level of the delta mode to dst.
+func gzipContent(dst, content []byte, mode byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	w, ok := deltaGzipWriters[mode].Get().(*gzip.Writer)
+	if ok {
+		w.Reset(buf)
+	} else {
+		var err error
+		if w, err = gzip.NewWriterLevel(buf, deltaGzipLevels[mode]); err != nil {
+			return nil, err
+		}
+	}
+	defer deltaGzipWriters[mode].Put(w)
+
+	if _, err := w.Write(content); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// NewBytesDeltaChunk returns a new BytesChunk that stores its values as deltas
+// against their predecessors, compressed as configured.
+func NewBytesDeltaChunk(comp Compression) *BytesChunk {
+	comp.Delta = true
+	return NewBytesCodecChunk(comp)
+}
+
+// LoadBytesDeltaChunk loads a chunk with EncBytesDelta encoding.
+func LoadBytesDeltaChunk(b []byte) (*BytesChunk, error) {
+	c, err := LoadBytesCodecChunk(b)
+	if err != nil {
+		return nil, err
+	}
+	c.comp.Delta = true
+	return c, nil
+}
@@ -0,0 +1,247 @@
+// Copyright 2021 The Conprof Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunkenc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"runtime"
+	"runtime/pprof"
+	"testing"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDelta(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	random := func(n int) []byte {
+		b := make([]byte, n)
+		r.Read(b)
+		return b
+	}
+	mutate := func(b []byte) []byte {
+		b = append([]byte{}, b...)
+		for i := 0; i < 10; i++ {
+			b[r.Intn(len(b))] = byte(r.Intn(256))
+		}
+		return append(b[:len(b)/2], append(random(100), b[len(b)/2:]...)...)
+	}
+
+	base := random(64 * 1024)
+	for _, tc := range []struct {
+		name        string
+		src, target []byte
+	}{
+		{name: "empty"},
+		{name: "from empty", target: base},
+		{name: "to empty", src: base},
+		{name: "short", src: []byte("abc"), target: []byte("abd")},
+		{name: "equal", src: base, target: base},
+		{name: "mutated", src: base, target: mutate(base)},
+		{name: "unrelated", src: base, target: random(1000)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			d := appendDelta(nil, tc.src, tc.target)
+			got, err := applyDelta(nil, tc.src, d)
+			require.NoError(t, err)
+			require.Equal(t, len(tc.target), len(got))
+			require.Equal(t, string(tc.target), string(got))
+		})
+	}
+
+	require.Less(t, len(appendDelta(nil, base, mutate(base))), 1024)
+
+	_, err := applyDelta(nil, []byte("abc"), appendDeltaCopy(nil, 2, 2))
+	require.Error(t, err)
+	_, err = applyDelta(nil, nil, []byte{10, 'a'})
+	require.Error(t, err)
+}
+
+func TestBytesDeltaChunk(t *testing.T) {
+	values := profileLike(12)
+	values[4] = nil
+
+	c := NewBytesDeltaChunk(Compression{})
+	plain := NewBytesCodecChunk(Compression{})
+	app, err := c.Appender()
+	require.NoError(t, err)
+	plainApp, err := plain.Appender()
+	require.NoError(t, err)
+	for i, v := range values[:6] {
+		app.Append(int64(i), v)
+		plainApp.Append(int64(i), v)
+	}
+	// Appenders continue from the last value of the chunk.
+	app, err = c.Appender()
+	require.NoError(t, err)
+	for i, v := range values[6:] {
+		app.Append(int64(i+6), v)
+		plainApp.Append(int64(i+6), v)
+	}
+	require.Equal(t, EncBytesDelta, c.Encoding())
+	require.True(t, CompressedWith(c, Compression{Delta: true}))
+	require.False(t, CompressedWith(c, Compression{}))
+
+	b, err := c.Bytes()
+	require.NoError(t, err)
+	plainBytes, err := plain.Bytes()
+	require.NoError(t, err)
+	require.Less(t, len(b), len(plainBytes))
+
+	chk, err := NewPool().Get(EncBytesDelta, b)
+	require.NoError(t, err)
+	require.Equal(t, EncBytesDelta, chk.Encoding())
+
+	it := chk.Iterator(nil)
+	for i, v := range values {
+		require.True(t, it.Next())
+		ts, val := it.At()
+		require.Equal(t, int64(i), ts)
+		require.Equal(t, v, val)
+	}
+	require.False(t, it.Next())
+	require.NoError(t, it.Err())
+
+	// Seeking rebuilds the skipped values.
+	it = chk.Iterator(nil)
+	require.True(t, it.Seek(9))
+	ts, val := it.At()
+	require.Equal(t, int64(9), ts)
+	require.Equal(t, values[9], val)
+	require.False(t, it.Seek(12))
+	require.NoError(t, it.Err())
+
+	// Chunks re-encoded from delta chunks keep storing deltas.
+	require.Equal(t, EncBytesDelta, NewChunkLike(chk).Encoding())
+}
+
+func TestBytesDeltaChunk_GzippedProfiles(t *testing.T) {
+	// Heap profiles as written by runtime/pprof, with allocations in between.
+	var (
+		heap [][]byte
+		keep [][]byte
+	)
+	for i := 0; i < 12; i++ {
+		keep = append(keep, make([]byte, 1<<(10+i%8)))
+		runtime.GC()
+		var buf bytes.Buffer
+		require.NoError(t, pprof.Lookup("heap").WriteTo(&buf, 0))
+		heap = append(heap, buf.Bytes())
+	}
+	runtime.KeepAlive(keep)
+
+	// Profiles as written by github.com/google/pprof/profile.
+	var written [][]byte
+	for i := 0; i < 12; i++ {
+		var buf bytes.Buffer
+		require.NoError(t, testProfile(i).Write(&buf))
+		written = append(written, buf.Bytes())
+	}
+
+	for _, tc := range []struct {
+		name   string
+		values [][]byte
+		mode   byte
+	}{
+		{name: "runtime", values: heap, mode: deltaGzipBestSpeed},
+		{name: "profile", values: written, mode: deltaGzipDefault},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, mode := deltaContent(tc.values[0])
+			require.Equal(t, tc.mode, mode)
+
+			c := NewBytesDeltaChunk(Compression{})
+			plain := NewBytesCodecChunk(Compression{})
+			app, err := c.Appender()
+			require.NoError(t, err)
+			plainApp, err := plain.Appender()
+			require.NoError(t, err)
+			for i, v := range tc.values[:6] {
+				app.Append(int64(i), v)
+				plainApp.Append(int64(i), v)
+			}
+			// Appenders continue from the content of the last value.
+			app, err = c.Appender()
+			require.NoError(t, err)
+			for i, v := range tc.values[6:] {
+				app.Append(int64(i+6), v)
+				plainApp.Append(int64(i+6), v)
+			}
+
+			b, err := c.Bytes()
+			require.NoError(t, err)
+			plainBytes, err := plain.Bytes()
+			require.NoError(t, err)
+			require.Less(t, len(b), len(plainBytes)/2)
+
+			chk, err := NewPool().Get(EncBytesDelta, b)
+			require.NoError(t, err)
+			for _, it := range []Iterator{chk.Iterator(nil), chk.Iterator(&BytesStreamingIterator{})} {
+				for i, v := range tc.values {
+					require.True(t, it.Next())
+					ts, val := it.At()
+					require.Equal(t, int64(i), ts)
+					require.Equal(t, v, val)
+				}
+				require.False(t, it.Next())
+				require.NoError(t, it.Err())
+			}
+		})
+	}
+}
+
+func TestBytesDeltaChunk_GzipMismatch(t *testing.T) {
+	var values [][]byte
+	for i := 0; i < 3; i++ {
+		var buf bytes.Buffer
+		require.NoError(t, testProfile(i).Write(&buf))
+		values = append(values, buf.Bytes())
+	}
+
+	c := NewBytesDeltaChunk(Compression{Codec: CodecNone})
+	app, err := c.Appender()
+	require.NoError(t, err)
+	for i, v := range values {
+		app.Append(int64(i), v)
+	}
+	b, err := c.Bytes()
+	require.NoError(t, err)
+
+	// Alter the hash of the second value, as if gzip produced different
+	// bytes than when it was written.
+	var hash [deltaHashSize]byte
+	binary.BigEndian.PutUint64(hash[:], xxhash.Sum64(values[1]))
+	i := bytes.Index(b, hash[:])
+	require.Greater(t, i, 0)
+	b = append([]byte(nil), b...)
+	b[i] ^= 0xff
+
+	content, _ := deltaContent(values[1])
+	expected := [][]byte{values[0], content, values[2]}
+
+	chk, err := NewPool().Get(EncBytesDelta, b)
+	require.NoError(t, err)
+	for _, it := range []Iterator{chk.Iterator(nil), chk.Iterator(&BytesStreamingIterator{})} {
+		for i, v := range expected {
+			require.True(t, it.Next())
+			ts, val := it.At()
+			require.Equal(t, int64(i), ts)
+			require.Equal(t, v, val)
+		}
+		require.False(t, it.Next())
+		require.NoError(t, it.Err())
+	}
+}
@@ -0,0 +1,230 @@
+// Copyright 2021 The Conprof Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunkenc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// dictionaryLevel is the zstd level dictionaries are trained for and
+// dictionary chunks are compressed with. Dictionary chunks are only written
+// during compaction so we can afford a slower level than for head chunks.
+const dictionaryLevel = zstd.SpeedDefault
+
+// Dictionary is a zstd dictionary shared by the value chunks of a block.
+// It is safe for concurrent use.
+type Dictionary struct {
+	id  uint32
+	b   []byte
+	enc *zstd.Encoder
+	dec *zstd.Decoder
+}
+
+// NewDictionary loads a zstd dictionary in the format produced by
+// TrainDictionary or the reference zstd implementation.
+func NewDictionary(b []byte) (*Dictionary, error) {
+	h, err := zstd.InspectDictionary(b)
+	if err != nil {
+		return nil, errors.Wrap(err, "inspect dictionary")
+	}
+	if h.ID() == 0 {
+		return nil, errors.New("dictionary without ID")
+	}
+
+	enc, err := zstd.NewWriter(nil,
+		zstd.WithEncoderDict(b),
+		zstd.WithEncoderLevel(dictionaryLevel),
+		zstd.WithEncoderConcurrency(1),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "create dictionary encoder")
+	}
+	dec, err := zstd.NewReader(nil, zstd.WithDecoderDicts(b), zstd.WithDecoderConcurrency(0))
+	if err != nil {
+		return nil, errors.Wrap(err, "create dictionary decoder")
+	}
+
+	return &Dictionary{id: h.ID(), b: b, enc: enc, dec: dec}, nil
+}
+
+// TrainDictionary trains a dictionary of at most maxSize bytes from the given
+// sample values. The dictionary ID is derived from its content.
+func TrainDictionary(samples [][]byte, maxSize int) (d *Dictionary, err error) {
+	defer func() {
+		// BuildDict panics on samples that leave no literals to build tables from.
+		if r := recover(); r != nil {
+			d, err = nil, errors.Errorf("build dictionary: %v", r)
+		}
+	}()
+
+	var history []byte
+	for _, s := range samples {
+		if len(history)+len(s) > maxSize {
+			s = s[:maxSize-len(history)]
+		}
+		history = append(history, s...)
+		if len(history) == maxSize {
+			break
+		}
+	}
+
+	id := crc32.Checksum(history, castagnoliTable)
+	if id == 0 {
+		id = 1
+	}
+
+	b, err := zstd.BuildDict(zstd.BuildDictOptions{
+		ID:       id,
+		Contents: samples,
+		History:  history,
+		// The default repeat offsets as defined by the zstd format.
+		Offsets: [3]int{1, 4, 8},
+		Level:   dictionaryLevel,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "build dictionary")
+	}
+	return NewDictionary(b)
+}
+
+// ID returns the ID of the dictionary that is referenced by chunks compressed with it.
+func (d *Dictionary) ID() uint32 {
+	return d.id
+}
+
+// Bytes returns the serialized dictionary.
+func (d *Dictionary) Bytes() []byte {
+	return d.b
+}
+
+// castagnoliTable is used to derive dictionary IDs.
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// bytesDictHeaderSize is the size of the dictionary ID that prefixes the
+// regular BytesChunk layout in chunks with EncBytesDict and EncBytesFramed encoding.
+// Framed chunks without dictionary use the ID 0.
+const bytesDictHeaderSize = 4
+
+// dictID returns the ID of the chunk's dictionary or 0 if it has none.
+func (b *BytesChunk) dictID() uint32 {
+	if b.dict == nil {
+		return 0
+	}
+	return b.dict.ID()
+}
+
+// NewBytesDictChunk returns a new BytesChunk whose values are compressed with the given dictionary.
+func NewBytesDictChunk(d *Dictionary) *BytesChunk {
+	c := NewBytesChunk()
+	c.dict = d
+	c.vc.dict = d
+	return c
+}
+
+// LoadBytesDictChunk loads a chunk with EncBytesDict encoding using the given dictionary.
+func LoadBytesDictChunk(b []byte, d *Dictionary) (*BytesChunk, error) {
+	id, err := DictionaryID(b)
+	if err != nil {
+		return nil, err
+	}
+	if id != d.ID() {
+		return nil, errors.Errorf("chunk references dictionary %d, got %d", id, d.ID())
+	}
+	c := loadBytesChunk(b, bytesDictHeaderSize)
+	c.dict = d
+	c.vc.dict = d
+	return c, nil
+}
+
+// UsesDictionary returns whether the values of c are compressed with a
+// dictionary, which then has to be stored along with the chunk.
+func UsesDictionary(c Chunk) bool {
+	bc, ok := unwrap(c).(*BytesChunk)
+	return ok && bc.dict != nil
+}
+
+// DictionaryID returns the ID of the dictionary referenced by a chunk with
+// EncBytesDict or EncBytesFramed encoding. It returns 0 if there is none.
+func DictionaryID(b []byte) (uint32, error) {
+	if len(b) < bytesDictHeaderSize {
+		return 0, errors.New("dictionary chunk too short")
+	}
+	return binary.BigEndian.Uint32(b[:bytesDictHeaderSize]), nil
+}
+
+// MissingDictionaryErr is returned when loading a chunk that references a
+// dictionary the pool does not know, e.g. with a pool created with NewPool.
+// Blocks read their chunks with the dictionaries stored along with them.
+type MissingDictionaryErr struct {
+	ID uint32
+}
+
+func (e *MissingDictionaryErr) Error() string {
+	return fmt.Sprintf("chunk references dictionary %d, which was not loaded, use a pool created with NewDictionaryPool", e.ID)
+}
+
+// missingDictionary returns the error for loading the dictionary chunk b
+// without its dictionary.
+func missingDictionary(b []byte) error {
+	id, err := DictionaryID(b)
+	if err != nil {
+		return err
+	}
+	return &MissingDictionaryErr{ID: id}
+}
+
+// dictionaryPool wraps a Pool and resolves chunks that reference a dictionary.
+type dictionaryPool struct {
+	Pool
+	dicts map[uint32]*Dictionary
+}
+
+// NewDictionaryPool returns a Pool that resolves chunks referencing a dictionary
+// against the given dictionaries. All other chunks are handled by p.
+func NewDictionaryPool(p Pool, dicts ...*Dictionary) Pool {
+	if p == nil {
+		p = NewPool()
+	}
+	m := make(map[uint32]*Dictionary, len(dicts))
+	for _, d := range dicts {
+		m[d.ID()] = d
+	}
+	return &dictionaryPool{Pool: p, dicts: m}
+}
+
+func (p *dictionaryPool) Get(e Encoding, b []byte) (Chunk, error) {
+	if e != EncBytesDict && e != EncBytesFramed {
+		return p.Pool.Get(e, b)
+	}
+	id, err := DictionaryID(b)
+	if err != nil {
+		return nil, err
+	}
+	if id == 0 {
+		return p.Pool.Get(e, b)
+	}
+	d, ok := p.dicts[id]
+	if !ok {
+		return nil, &MissingDictionaryErr{ID: id}
+	}
+	if e == EncBytesFramed {
+		return LoadBytesFramedChunk(b, d)
+	}
+	return LoadBytesDictChunk(b, d)
+}
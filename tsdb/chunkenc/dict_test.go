@@ -0,0 +1,100 @@
+// Copyright 2021 The Conprof Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunkenc
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// profileLike returns values sharing most of their content like pprof payloads of a series do.
+func profileLike(n int) [][]byte {
+	var shared strings.Builder
+	for i := 0; i < 200; i++ {
+		fmt.Fprintf(&shared, "github.com/conprof/db/tsdb.(*Head).function%d\n", i)
+	}
+	values := make([][]byte, 0, n)
+	for i := 0; i < n; i++ {
+		values = append(values, []byte(fmt.Sprintf("sample-%d\n%s%d", i, shared.String(), i*7)))
+	}
+	return values
+}
+
+func TestBytesDictChunk(t *testing.T) {
+	values := profileLike(100)
+
+	dict, err := TrainDictionary(values, 16*1024)
+	require.NoError(t, err)
+	require.NotZero(t, dict.ID())
+
+	c := NewBytesDictChunk(dict)
+	plain := NewBytesChunk()
+	app, err := c.Appender()
+	require.NoError(t, err)
+	plainApp, err := plain.Appender()
+	require.NoError(t, err)
+	for i, v := range values[:12] {
+		app.Append(int64(i), v)
+		plainApp.Append(int64(i), v)
+	}
+	require.Equal(t, EncBytesDict, c.Encoding())
+
+	b, err := c.Bytes()
+	require.NoError(t, err)
+	plainBytes, err := plain.Bytes()
+	require.NoError(t, err)
+	require.Less(t, len(b), len(plainBytes))
+
+	id, err := DictionaryID(b)
+	require.NoError(t, err)
+	require.Equal(t, dict.ID(), id)
+
+	// Without the dictionary the error names it.
+	missing := &MissingDictionaryErr{ID: dict.ID()}
+	_, err = NewPool().Get(EncBytesDict, b)
+	require.Equal(t, missing, err)
+	_, err = FromData(EncBytesDict, b)
+	require.Equal(t, missing, err)
+	_, err = NewDictionaryPool(nil).Get(EncBytesDict, b)
+	require.Equal(t, missing, err)
+	require.Contains(t, err.Error(), fmt.Sprintf("dictionary %d", dict.ID()))
+
+	// The dictionary is resolved transparently from its serialized form.
+	loaded, err := NewDictionary(dict.Bytes())
+	require.NoError(t, err)
+	p := NewDictionaryPool(nil, loaded)
+	chk, err := p.Get(EncBytesDict, b)
+	require.NoError(t, err)
+	require.Equal(t, EncBytesDict, chk.Encoding())
+	require.Equal(t, 12, chk.NumSamples())
+
+	it := chk.Iterator(nil)
+	for i, v := range values[:12] {
+		require.True(t, it.Next())
+		ts, val := it.At()
+		require.Equal(t, int64(i), ts)
+		require.Equal(t, v, val)
+	}
+	require.False(t, it.Next())
+	require.NoError(t, it.Err())
+	require.NoError(t, p.Put(chk))
+
+	// Chunks without dictionary are still handled by the wrapped pool.
+	chk, err = p.Get(EncBytes, plainBytes)
+	require.NoError(t, err)
+	require.Equal(t, EncBytes, chk.Encoding())
+}
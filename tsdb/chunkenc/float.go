@@ -0,0 +1,101 @@
+// Copyright 2021 The Conprof Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunkenc
+
+import (
+	"encoding/binary"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+// FloatSize is the size of a numeric value encoded with EncodeFloat.
+const FloatSize = 8
+
+// EncodeFloat returns v as the byte value of a numeric sample. It is the value
+// that byte-valued iterators return for samples of EncXOR chunks.
+func EncodeFloat(v float64) []byte {
+	return AppendFloat(make([]byte, 0, FloatSize), v)
+}
+
+// AppendFloat appends v encoded as with EncodeFloat to b.
+func AppendFloat(b []byte, v float64) []byte {
+	return appendUint64(b, math.Float64bits(v))
+}
+
+// DecodeFloat returns the numeric value encoded in b with EncodeFloat. It
+// returns NaN if b is not a numeric value.
+func DecodeFloat(b []byte) float64 {
+	if len(b) != FloatSize {
+		return math.NaN()
+	}
+	return math.Float64frombits(binary.BigEndian.Uint64(b))
+}
+
+// NewFloatIterator returns an iterator over the numeric samples of it. It
+// returns it unchanged if it is a FloatIterator, otherwise values are decoded
+// with DecodeFloat. The iterator fails on values that are not numeric, for
+// example when it iterates over profiles.
+//
+// Iterators of queriers wrap the iterators of chunks, so this is how their
+// numeric samples are read without conversion to bytes by the caller.
+func NewFloatIterator(it Iterator) FloatIterator {
+	if fit, ok := it.(FloatIterator); ok {
+		return fit
+	}
+	return &floatIterator{Iterator: it}
+}
+
+type floatIterator struct {
+	Iterator
+
+	t   int64
+	v   float64
+	err error
+}
+
+func (it *floatIterator) Next() bool {
+	if it.err != nil || !it.Iterator.Next() {
+		return false
+	}
+	return it.decode()
+}
+
+func (it *floatIterator) Seek(t int64) bool {
+	if it.err != nil || !it.Iterator.Seek(t) {
+		return false
+	}
+	return it.decode()
+}
+
+func (it *floatIterator) decode() bool {
+	t, b := it.Iterator.At()
+	if len(b) != FloatSize {
+		it.err = errors.Errorf("sample at %d has a %d byte value, not a numeric one", t, len(b))
+		return false
+	}
+	it.t, it.v = t, DecodeFloat(b)
+	return true
+}
+
+func (it *floatIterator) AtFloat() (int64, float64) {
+	return it.t, it.v
+}
+
+func (it *floatIterator) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+	return it.Iterator.Err()
+}
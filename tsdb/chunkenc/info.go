@@ -0,0 +1,120 @@
+// Copyright 2021 The Conprof Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunkenc
+
+import (
+	"encoding/binary"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/pkg/errors"
+)
+
+// SampleInfo describes the value of a sample.
+type SampleInfo struct {
+	// Size is the length of the uncompressed value.
+	Size int
+	// Hash is the xxhash64 of the uncompressed value.
+	Hash uint64
+}
+
+// NewSampleInfo returns the info of a value.
+func NewSampleInfo(v []byte) SampleInfo {
+	return SampleInfo{Size: len(v), Hash: xxhash.Sum64(v)}
+}
+
+// InfoIterator is an iterator that knows the infos of the values of its samples.
+// Iterators over timestamps only, see BytesTimestampOnlyIterator, return them
+// without reading the values if the chunk stores them.
+type InfoIterator interface {
+	Iterator
+	// AtInfo returns the current timestamp and the info of the current value.
+	// ok is false if the info is not known without reading the value.
+	AtInfo() (t int64, info SampleInfo, ok bool)
+}
+
+// AtInfo returns the current timestamp of it and the info of the current value.
+// The info is computed from the value for iterators that do not implement InfoIterator.
+func AtInfo(it Iterator) (int64, SampleInfo, bool) {
+	if iit, ok := it.(InfoIterator); ok {
+		return iit.AtInfo()
+	}
+	t, v := it.At()
+	return t, NewSampleInfo(v), true
+}
+
+// HasSampleInfo returns whether c stores the infos of its values, which
+// BytesTimestampOnlyIterators then return without reading the values.
+func HasSampleInfo(c Chunk) bool {
+	b, ok := unwrap(c).(*BytesChunk)
+	return ok && b.ic != nil
+}
+
+// infoChunk holds the infos of the values of a BytesChunk, one per sample.
+// Every info is stored as the size as uvarint followed by the 8 byte hash.
+type infoChunk struct {
+	b []byte
+}
+
+func newInfoChunk() *infoChunk {
+	return &infoChunk{b: make([]byte, 0, 32)}
+}
+
+func (c *infoChunk) append(info SampleInfo) {
+	c.b = appendUvarint(c.b, uint64(info.Size))
+	c.b = appendUint64(c.b, info.Hash)
+}
+
+func (c *infoChunk) Compact() {
+	if l := len(c.b); cap(c.b) > l+chunkCompactCapacityThreshold {
+		buf := make([]byte, l)
+		copy(buf, c.b)
+		c.b = buf
+	}
+}
+
+func (c *infoChunk) iterator() *infoIterator {
+	return &infoIterator{b: c.b}
+}
+
+type infoIterator struct {
+	b       []byte
+	numRead uint16
+	info    SampleInfo
+	err     error
+}
+
+func (it *infoIterator) Next() bool {
+	if it.err != nil || len(it.b) == 0 {
+		return false
+	}
+	size, n := binary.Uvarint(it.b)
+	if n <= 0 || len(it.b) < n+8 {
+		it.err = errors.Errorf("corrupted info of sample %d", it.numRead)
+		return false
+	}
+	it.info = SampleInfo{Size: int(size), Hash: binary.BigEndian.Uint64(it.b[n:])}
+	it.b = it.b[n+8:]
+	it.numRead++
+	return true
+}
+
+// seekIndex advances the iterator to the info of the i-th sample.
+func (it *infoIterator) seekIndex(i uint16) bool {
+	for it.numRead <= i {
+		if !it.Next() {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,862 @@
+// Copyright 2021 The Conprof Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunkenc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+
+	"github.com/google/pprof/profile"
+	"github.com/pkg/errors"
+)
+
+// PprofChunk stores pprof profiles in their parsed form. The strings, mappings,
+// functions and locations of all profiles in the chunk are kept in shared tables,
+// so every profile only stores its samples and a few header fields.
+// Iterators serialize the profiles again as gzipped pprof.
+//
+// Values that are not pprof profiles are stored as they are.
+//
+// ┌──────────┬─────────────────────┬─────────────────┬──────────────────┬────────────┬────────┬─────────┐
+// │ num <2b> │ timestamps len <4b> │ tables len <4b> │ records len <4b> │ timestamps │ tables │ records │
+// └──────────┴─────────────────────┴─────────────────┴──────────────────┴────────────┴────────┴─────────┘
+//
+// The tables are zstd compressed. The records are stored like the values of a
+// BytesChunk, one per profile.
+type PprofChunk struct {
+	b   []byte
+	num uint16
+
+	tc *timestampChunk
+	vc *valueChunk
+
+	// tables are decoded from compressedTables on first use if the chunk was loaded.
+	tables           *pprofTables
+	compressedTables []byte
+}
+
+// pprofHeaderSize is the size of the number of samples and the three section lengths.
+const pprofHeaderSize = 2 + 3*4
+
+// pprofCompression compresses the tables and records of pprof chunks.
+var pprofCompression = Compression{}.effective()
+
+// NewPprofChunk returns a new, empty PprofChunk.
+func NewPprofChunk() *PprofChunk {
+	c := &PprofChunk{
+		tc:     newTimestampChunk(),
+		vc:     newValueChunk(),
+		tables: newPprofTables(),
+	}
+	c.vc.comp = &pprofCompression
+	return c
+}
+
+// LoadPprofChunk loads a chunk with EncPprof encoding.
+func LoadPprofChunk(b []byte) (*PprofChunk, error) {
+	if len(b) < pprofHeaderSize {
+		return nil, errors.New("pprof chunk too short")
+	}
+	num := binary.BigEndian.Uint16(b[0:2])
+	tsLen := int(binary.BigEndian.Uint32(b[2:6]))
+	tablesLen := int(binary.BigEndian.Uint32(b[6:10]))
+	recordsLen := int(binary.BigEndian.Uint32(b[10:14]))
+	if len(b) < pprofHeaderSize+tsLen+tablesLen+recordsLen {
+		return nil, errors.Errorf("pprof chunk of %d bytes too short for its sections", len(b))
+	}
+
+	tsStart := pprofHeaderSize
+	tablesStart := tsStart + tsLen
+	recordsStart := tablesStart + tablesLen
+	return &PprofChunk{
+		b:                b,
+		num:              num,
+		tc:               &timestampChunk{b: b[tsStart:tablesStart], num: num},
+		vc:               &valueChunk{compressed: b[recordsStart : recordsStart+recordsLen], num: num, comp: &pprofCompression},
+		compressedTables: b[tablesStart:recordsStart],
+	}, nil
+}
+
+func (c *PprofChunk) Bytes() ([]byte, error) {
+	if len(c.b) > 0 {
+		return c.b, nil
+	}
+
+	ts, err := c.tc.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	tables := pprofCompression.encode(c.tables.bytes())
+	records, err := c.vc.Bytes()
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, pprofHeaderSize, pprofHeaderSize+len(ts)+len(tables)+len(records))
+	binary.BigEndian.PutUint16(b[0:2], c.tc.num)
+	binary.BigEndian.PutUint32(b[2:6], uint32(len(ts)))
+	binary.BigEndian.PutUint32(b[6:10], uint32(len(tables)))
+	binary.BigEndian.PutUint32(b[10:14], uint32(len(records)))
+	b = append(b, ts...)
+	b = append(b, tables...)
+	return append(b, records...), nil
+}
+
+func (c *PprofChunk) Encoding() Encoding {
+	return EncPprof
+}
+
+func (c *PprofChunk) NumSamples() int {
+	if len(c.b) == 0 {
+		return int(c.tc.num)
+	}
+	return int(c.num)
+}
+
+func (c *PprofChunk) Compact() {
+	c.tc.Compact()
+	c.vc.Compact()
+}
+
+// loadTables decodes the tables of a loaded chunk and keeps them for appending.
+func (c *PprofChunk) loadTables() (*pprofTables, error) {
+	if c.tables != nil {
+		return c.tables, nil
+	}
+	t, err := c.decodeTables()
+	if err != nil {
+		return nil, err
+	}
+	c.tables = t
+	return t, nil
+}
+
+// readTables returns the tables for an iterator without modifying the chunk,
+// so that concurrent iterators and appenders are safe. Loaded chunks decode
+// their tables for every iterator. Profiles are decoded from the tables only,
+// so copying them is enough to not see later appends.
+func (c *PprofChunk) readTables() (*pprofTables, error) {
+	if c.tables == nil {
+		return c.decodeTables()
+	}
+	return &pprofTables{
+		strings:   c.tables.strings,
+		mappings:  c.tables.mappings,
+		functions: c.tables.functions,
+		locations: c.tables.locations,
+	}, nil
+}
+
+func (c *PprofChunk) decodeTables() (*pprofTables, error) {
+	b, err := pprofCompression.decode(nil, c.compressedTables)
+	if err != nil {
+		return nil, errors.Wrap(err, "decompress tables")
+	}
+	t, err := decodePprofTables(b)
+	return t, errors.Wrap(err, "decode tables")
+}
+
+func (c *PprofChunk) Appender() (Appender, error) {
+	tables, err := c.loadTables()
+	if err != nil {
+		return nil, err
+	}
+	tapp, err := c.tc.Appender()
+	if err != nil {
+		return nil, err
+	}
+	vapp, err := c.vc.Appender()
+	if err != nil {
+		return nil, err
+	}
+	return &pprofAppender{tables: tables, ta: tapp, va: vapp}, nil
+}
+
+type pprofAppender struct {
+	tables *pprofTables
+	ta     *timestampAppender
+	va     *valueAppender
+}
+
+// Kinds of records.
+const (
+	pprofRecordRaw byte = iota
+	pprofRecordProfile
+)
+
+func (a *pprofAppender) Append(t int64, v []byte) {
+	var rec []byte
+	// Random bytes may parse as a profile, but not as one with sample types.
+	if p, err := profile.ParseData(v); err == nil && len(p.SampleType) > 0 {
+		rec = a.tables.appendProfile([]byte{pprofRecordProfile}, p)
+	} else {
+		rec = append([]byte{pprofRecordRaw}, v...)
+	}
+	a.va.Append(0, rec)
+	a.ta.Append(t, nil)
+}
+
+func (c *PprofChunk) Iterator(it Iterator) Iterator {
+	if it, ok := it.(*BytesTimestampOnlyIterator); ok {
+		it.tIt = c.tc.Iterator(nil)
+		it.iIt = nil
+		return it
+	}
+	pit := &PprofIterator{
+		tIt: c.tc.Iterator(nil),
+		vIt: c.vc.Iterator(nil),
+	}
+	pit.tables, pit.err = c.readTables()
+	return pit
+}
+
+// PprofIterator iterates over the samples of a PprofChunk.
+// Its values are serialized lazily, so callers that only need the parsed
+// profiles should use AtProfile.
+type PprofIterator struct {
+	tables *pprofTables
+	tIt    *timestampsIterator
+	vIt    *valueIterator
+
+	t   int64
+	rec []byte
+	v   []byte
+	err error
+}
+
+func (it *PprofIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	if !it.tIt.Next() || !it.vIt.Next() {
+		if err := it.tIt.Err(); err != nil {
+			it.err = err
+		} else if err := it.vIt.Err(); err != nil {
+			it.err = err
+		}
+		return false
+	}
+	it.t, _ = it.tIt.At()
+	_, it.rec = it.vIt.At()
+	it.v = nil
+	return true
+}
+
+func (it *PprofIterator) Seek(t int64) bool {
+	if it.err != nil {
+		return false
+	}
+	if it.tIt.numRead > 0 && t <= it.t {
+		return true
+	}
+	if !it.tIt.Seek(t) {
+		it.err = it.tIt.Err()
+		return false
+	}
+	if !it.vIt.seekIndex(it.tIt.numRead - 1) {
+		it.err = it.vIt.Err()
+		return false
+	}
+	it.t, _ = it.tIt.At()
+	_, it.rec = it.vIt.At()
+	it.v = nil
+	return true
+}
+
+// At returns the current timestamp and profile serialized as gzipped pprof.
+// If the profile cannot be decoded the value is nil and Err returns the error.
+func (it *PprofIterator) At() (int64, []byte) {
+	if it.v != nil || len(it.rec) == 0 {
+		return it.t, it.v
+	}
+	if it.rec[0] == pprofRecordRaw {
+		if len(it.rec) > 1 {
+			it.v = it.rec[1:]
+		}
+		return it.t, it.v
+	}
+
+	p, err := it.AtProfile()
+	if err != nil {
+		it.err = err
+		return it.t, nil
+	}
+	var buf bytes.Buffer
+	if err := p.Write(&buf); err != nil {
+		it.err = err
+		return it.t, nil
+	}
+	it.v = buf.Bytes()
+	return it.t, it.v
+}
+
+// AtProfile returns the current timestamp and the parsed profile.
+// It returns an error if the value is not a pprof profile.
+func (it *PprofIterator) AtProfile() (*profile.Profile, error) {
+	if len(it.rec) == 0 || it.rec[0] != pprofRecordProfile {
+		return nil, errors.New("value is not a pprof profile")
+	}
+	p, err := it.tables.decodeProfile(it.rec[1:])
+	return p, errors.Wrap(err, "decode profile")
+}
+
+func (it *PprofIterator) Err() error {
+	return it.err
+}
+
+// pprofTables holds the strings, mappings, functions and locations shared by
+// the profiles of a chunk. Profiles reference them by index.
+type pprofTables struct {
+	strings   []string
+	mappings  []pprofMapping
+	functions []pprofFunction
+	// locations are stored encoded as they are variable in size.
+	locations [][]byte
+
+	stringIdx   map[string]uint64
+	mappingIdx  map[pprofMapping]uint64
+	functionIdx map[pprofFunction]uint64
+	locationIdx map[string]uint64
+}
+
+type pprofMapping struct {
+	start, limit, offset uint64
+	file, buildID        uint64
+	flags                byte
+}
+
+// Flags of pprofMapping.
+const (
+	pprofHasFunctions byte = 1 << iota
+	pprofHasFilenames
+	pprofHasLineNumbers
+	pprofHasInlineFrames
+)
+
+type pprofFunction struct {
+	name, systemName, filename uint64
+	startLine                  int64
+}
+
+func newPprofTables() *pprofTables {
+	return &pprofTables{
+		stringIdx:   map[string]uint64{},
+		mappingIdx:  map[pprofMapping]uint64{},
+		functionIdx: map[pprofFunction]uint64{},
+		locationIdx: map[string]uint64{},
+	}
+}
+
+func (t *pprofTables) string(s string) uint64 {
+	i, ok := t.stringIdx[s]
+	if !ok {
+		i = uint64(len(t.strings))
+		t.strings = append(t.strings, s)
+		t.stringIdx[s] = i
+	}
+	return i
+}
+
+func (t *pprofTables) mapping(m *profile.Mapping) uint64 {
+	pm := pprofMapping{
+		start:   m.Start,
+		limit:   m.Limit,
+		offset:  m.Offset,
+		file:    t.string(m.File),
+		buildID: t.string(m.BuildID),
+	}
+	for _, f := range []struct {
+		set  bool
+		flag byte
+	}{
+		{m.HasFunctions, pprofHasFunctions},
+		{m.HasFilenames, pprofHasFilenames},
+		{m.HasLineNumbers, pprofHasLineNumbers},
+		{m.HasInlineFrames, pprofHasInlineFrames},
+	} {
+		if f.set {
+			pm.flags |= f.flag
+		}
+	}
+	i, ok := t.mappingIdx[pm]
+	if !ok {
+		i = uint64(len(t.mappings))
+		t.mappings = append(t.mappings, pm)
+		t.mappingIdx[pm] = i
+	}
+	return i
+}
+
+func (t *pprofTables) function(f *profile.Function) uint64 {
+	pf := pprofFunction{
+		name:       t.string(f.Name),
+		systemName: t.string(f.SystemName),
+		filename:   t.string(f.Filename),
+		startLine:  f.StartLine,
+	}
+	i, ok := t.functionIdx[pf]
+	if !ok {
+		i = uint64(len(t.functions))
+		t.functions = append(t.functions, pf)
+		t.functionIdx[pf] = i
+	}
+	return i
+}
+
+// location interns a location. It is encoded as the index of its mapping plus
+// one or zero without mapping, its address, whether it is folded and its lines.
+func (t *pprofTables) location(l *profile.Location) uint64 {
+	var b []byte
+	if l.Mapping != nil {
+		b = appendUvarint(b, t.mapping(l.Mapping)+1)
+	} else {
+		b = appendUvarint(b, 0)
+	}
+	b = appendUvarint(b, l.Address)
+	if l.IsFolded {
+		b = append(b, 1)
+	} else {
+		b = append(b, 0)
+	}
+	b = appendUvarint(b, uint64(len(l.Line)))
+	for _, line := range l.Line {
+		var f uint64
+		if line.Function != nil {
+			f = t.function(line.Function) + 1
+		}
+		b = appendUvarint(b, f)
+		b = appendVarint(b, line.Line)
+	}
+
+	i, ok := t.locationIdx[string(b)]
+	if !ok {
+		i = uint64(len(t.locations))
+		t.locations = append(t.locations, b)
+		t.locationIdx[string(b)] = i
+	}
+	return i
+}
+
+// appendProfile interns the profile's mappings, functions and locations and
+// appends the record of everything else to b.
+func (t *pprofTables) appendProfile(b []byte, p *profile.Profile) []byte {
+	b = appendUvarint(b, uint64(len(p.SampleType)))
+	for _, st := range p.SampleType {
+		b = appendUvarint(b, t.string(st.Type))
+		b = appendUvarint(b, t.string(st.Unit))
+	}
+	b = appendUvarint(b, t.string(p.DefaultSampleType))
+	if p.PeriodType != nil {
+		b = append(b, 1)
+		b = appendUvarint(b, t.string(p.PeriodType.Type))
+		b = appendUvarint(b, t.string(p.PeriodType.Unit))
+	} else {
+		b = append(b, 0)
+	}
+	b = appendVarint(b, p.Period)
+	b = appendVarint(b, p.TimeNanos)
+	b = appendVarint(b, p.DurationNanos)
+	b = appendUvarint(b, t.string(p.DropFrames))
+	b = appendUvarint(b, t.string(p.KeepFrames))
+	b = appendUvarint(b, uint64(len(p.Comments)))
+	for _, c := range p.Comments {
+		b = appendUvarint(b, t.string(c))
+	}
+
+	// Mappings without locations are kept as well.
+	b = appendUvarint(b, uint64(len(p.Mapping)))
+	for _, m := range p.Mapping {
+		b = appendUvarint(b, t.mapping(m))
+	}
+
+	b = appendUvarint(b, uint64(len(p.Sample)))
+	for _, s := range p.Sample {
+		b = appendUvarint(b, uint64(len(s.Location)))
+		for _, l := range s.Location {
+			b = appendUvarint(b, t.location(l))
+		}
+		b = appendUvarint(b, uint64(len(s.Value)))
+		for _, v := range s.Value {
+			b = appendVarint(b, v)
+		}
+		b = t.appendStringsMap(b, s.Label)
+		b = t.appendStringsMap(b, s.NumUnit)
+		b = appendUvarint(b, uint64(len(s.NumLabel)))
+		for _, k := range sortedKeys(s.NumLabel) {
+			b = appendUvarint(b, t.string(k))
+			b = appendUvarint(b, uint64(len(s.NumLabel[k])))
+			for _, v := range s.NumLabel[k] {
+				b = appendVarint(b, v)
+			}
+		}
+	}
+	return b
+}
+
+func (t *pprofTables) appendStringsMap(b []byte, m map[string][]string) []byte {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	b = appendUvarint(b, uint64(len(keys)))
+	for _, k := range keys {
+		b = appendUvarint(b, t.string(k))
+		b = appendUvarint(b, uint64(len(m[k])))
+		for _, v := range m[k] {
+			b = appendUvarint(b, t.string(v))
+		}
+	}
+	return b
+}
+
+func sortedKeys(m map[string][]int64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// pprofDecoder reads the varints of encoded tables and records.
+// The first error is kept and all subsequent reads return zero values.
+type pprofDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *pprofDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.err = errors.New("invalid uvarint")
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *pprofDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.err = errors.New("invalid varint")
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *pprofDecoder) byte() byte {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.b) == 0 {
+		d.err = errors.New("unexpected end of data")
+		return 0
+	}
+	c := d.b[0]
+	d.b = d.b[1:]
+	return c
+}
+
+func (d *pprofDecoder) bytes(n uint64) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n > uint64(len(d.b)) {
+		d.err = errors.Errorf("%d bytes expected, %d left", n, len(d.b))
+		return nil
+	}
+	b := d.b[:n]
+	d.b = d.b[n:]
+	return b
+}
+
+// count reads a number of entries that are at least min bytes in size each,
+// so corrupted counts cannot cause huge allocations.
+func (d *pprofDecoder) count(min int) int {
+	n := d.uvarint()
+	if d.err == nil && n > uint64(len(d.b)/min) {
+		d.err = errors.Errorf("count %d exceeds the remaining %d bytes", n, len(d.b))
+		return 0
+	}
+	return int(n)
+}
+
+// bytes returns the tables encoded as the strings, mappings, functions and
+// locations, each prefixed with their number.
+func (t *pprofTables) bytes() []byte {
+	var b []byte
+	b = appendUvarint(b, uint64(len(t.strings)))
+	for _, s := range t.strings {
+		b = appendUvarint(b, uint64(len(s)))
+		b = append(b, s...)
+	}
+	b = appendUvarint(b, uint64(len(t.mappings)))
+	for _, m := range t.mappings {
+		b = appendUvarint(b, m.start)
+		b = appendUvarint(b, m.limit)
+		b = appendUvarint(b, m.offset)
+		b = appendUvarint(b, m.file)
+		b = appendUvarint(b, m.buildID)
+		b = append(b, m.flags)
+	}
+	b = appendUvarint(b, uint64(len(t.functions)))
+	for _, f := range t.functions {
+		b = appendUvarint(b, f.name)
+		b = appendUvarint(b, f.systemName)
+		b = appendUvarint(b, f.filename)
+		b = appendVarint(b, f.startLine)
+	}
+	b = appendUvarint(b, uint64(len(t.locations)))
+	for _, l := range t.locations {
+		b = appendUvarint(b, uint64(len(l)))
+		b = append(b, l...)
+	}
+	return b
+}
+
+func decodePprofTables(b []byte) (*pprofTables, error) {
+	t := newPprofTables()
+	d := &pprofDecoder{b: b}
+
+	for n := d.count(1); n > 0; n-- {
+		t.string(string(d.bytes(d.uvarint())))
+	}
+	for n := d.count(6); n > 0; n-- {
+		m := pprofMapping{
+			start:   d.uvarint(),
+			limit:   d.uvarint(),
+			offset:  d.uvarint(),
+			file:    d.uvarint(),
+			buildID: d.uvarint(),
+			flags:   d.byte(),
+		}
+		t.mappingIdx[m] = uint64(len(t.mappings))
+		t.mappings = append(t.mappings, m)
+	}
+	for n := d.count(4); n > 0; n-- {
+		f := pprofFunction{
+			name:       d.uvarint(),
+			systemName: d.uvarint(),
+			filename:   d.uvarint(),
+			startLine:  d.varint(),
+		}
+		t.functionIdx[f] = uint64(len(t.functions))
+		t.functions = append(t.functions, f)
+	}
+	for n := d.count(1); n > 0; n-- {
+		l := d.bytes(d.uvarint())
+		t.locationIdx[string(l)] = uint64(len(t.locations))
+		t.locations = append(t.locations, l)
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return t, nil
+}
+
+// pprofProfileDecoder builds a profile from a record. Mappings, functions and
+// locations are created once per profile and get their table index plus one as ID.
+type pprofProfileDecoder struct {
+	pprofDecoder
+	t *pprofTables
+	p *profile.Profile
+
+	mappings  map[uint64]*profile.Mapping
+	functions map[uint64]*profile.Function
+	locations map[uint64]*profile.Location
+}
+
+func (d *pprofProfileDecoder) string() string {
+	i := d.uvarint()
+	if d.err == nil && i >= uint64(len(d.t.strings)) {
+		d.err = errors.Errorf("invalid string %d", i)
+	}
+	if d.err != nil {
+		return ""
+	}
+	return d.t.strings[i]
+}
+
+func (d *pprofProfileDecoder) mapping(i uint64) *profile.Mapping {
+	if m, ok := d.mappings[i]; ok {
+		return m
+	}
+	if i >= uint64(len(d.t.mappings)) {
+		d.err = errors.Errorf("invalid mapping %d", i)
+		return nil
+	}
+	pm := d.t.mappings[i]
+	m := &profile.Mapping{
+		ID:              i + 1,
+		Start:           pm.start,
+		Limit:           pm.limit,
+		Offset:          pm.offset,
+		File:            d.tableString(pm.file),
+		BuildID:         d.tableString(pm.buildID),
+		HasFunctions:    pm.flags&pprofHasFunctions != 0,
+		HasFilenames:    pm.flags&pprofHasFilenames != 0,
+		HasLineNumbers:  pm.flags&pprofHasLineNumbers != 0,
+		HasInlineFrames: pm.flags&pprofHasInlineFrames != 0,
+	}
+	d.mappings[i] = m
+	d.p.Mapping = append(d.p.Mapping, m)
+	return m
+}
+
+func (d *pprofProfileDecoder) tableString(i uint64) string {
+	if i >= uint64(len(d.t.strings)) {
+		d.err = errors.Errorf("invalid string %d", i)
+		return ""
+	}
+	return d.t.strings[i]
+}
+
+func (d *pprofProfileDecoder) function(i uint64) *profile.Function {
+	if f, ok := d.functions[i]; ok {
+		return f
+	}
+	if i >= uint64(len(d.t.functions)) {
+		d.err = errors.Errorf("invalid function %d", i)
+		return nil
+	}
+	pf := d.t.functions[i]
+	f := &profile.Function{
+		ID:         i + 1,
+		Name:       d.tableString(pf.name),
+		SystemName: d.tableString(pf.systemName),
+		Filename:   d.tableString(pf.filename),
+		StartLine:  pf.startLine,
+	}
+	d.functions[i] = f
+	d.p.Function = append(d.p.Function, f)
+	return f
+}
+
+func (d *pprofProfileDecoder) location(i uint64) *profile.Location {
+	if l, ok := d.locations[i]; ok {
+		return l
+	}
+	if i >= uint64(len(d.t.locations)) {
+		d.err = errors.Errorf("invalid location %d", i)
+		return nil
+	}
+	ld := &pprofDecoder{b: d.t.locations[i]}
+	l := &profile.Location{ID: i + 1}
+	if m := ld.uvarint(); m > 0 {
+		l.Mapping = d.mapping(m - 1)
+	}
+	l.Address = ld.uvarint()
+	l.IsFolded = ld.byte() == 1
+	for n := ld.count(2); n > 0; n-- {
+		var line profile.Line
+		if f := ld.uvarint(); f > 0 {
+			line.Function = d.function(f - 1)
+		}
+		line.Line = ld.varint()
+		l.Line = append(l.Line, line)
+	}
+	if ld.err != nil {
+		d.err = errors.Wrapf(ld.err, "location %d", i)
+		return nil
+	}
+	d.locations[i] = l
+	d.p.Location = append(d.p.Location, l)
+	return l
+}
+
+func (d *pprofProfileDecoder) stringsMap() map[string][]string {
+	n := d.count(2)
+	if n == 0 {
+		return nil
+	}
+	m := make(map[string][]string, n)
+	for ; n > 0; n-- {
+		k := d.string()
+		vs := make([]string, d.count(1))
+		for i := range vs {
+			vs[i] = d.string()
+		}
+		m[k] = vs
+	}
+	return m
+}
+
+func (t *pprofTables) decodeProfile(rec []byte) (*profile.Profile, error) {
+	p := &profile.Profile{}
+	d := &pprofProfileDecoder{
+		pprofDecoder: pprofDecoder{b: rec},
+		t:            t,
+		p:            p,
+		mappings:     map[uint64]*profile.Mapping{},
+		functions:    map[uint64]*profile.Function{},
+		locations:    map[uint64]*profile.Location{},
+	}
+
+	for n := d.count(2); n > 0; n-- {
+		p.SampleType = append(p.SampleType, &profile.ValueType{Type: d.string(), Unit: d.string()})
+	}
+	p.DefaultSampleType = d.string()
+	if d.byte() == 1 {
+		p.PeriodType = &profile.ValueType{Type: d.string(), Unit: d.string()}
+	}
+	p.Period = d.varint()
+	p.TimeNanos = d.varint()
+	p.DurationNanos = d.varint()
+	p.DropFrames = d.string()
+	p.KeepFrames = d.string()
+	for n := d.count(1); n > 0; n-- {
+		p.Comments = append(p.Comments, d.string())
+	}
+	for n := d.count(1); n > 0; n-- {
+		d.mapping(d.uvarint())
+	}
+
+	for n := d.count(4); n > 0 && d.err == nil; n-- {
+		s := &profile.Sample{}
+		for n := d.count(1); n > 0; n-- {
+			s.Location = append(s.Location, d.location(d.uvarint()))
+		}
+		for n := d.count(1); n > 0; n-- {
+			s.Value = append(s.Value, d.varint())
+		}
+		s.Label = d.stringsMap()
+		s.NumUnit = d.stringsMap()
+		if n := d.count(2); n > 0 {
+			s.NumLabel = make(map[string][]int64, n)
+			for ; n > 0; n-- {
+				k := d.string()
+				vs := make([]int64, d.count(1))
+				for i := range vs {
+					vs[i] = d.varint()
+				}
+				s.NumLabel[k] = vs
+			}
+		}
+		p.Sample = append(p.Sample, s)
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return p, nil
+}
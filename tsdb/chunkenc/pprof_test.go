@@ -0,0 +1,201 @@
+// Copyright 2021 The Conprof Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunkenc
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/google/pprof/profile"
+	"github.com/stretchr/testify/require"
+)
+
+// testProfile returns a heap profile whose sample values depend on i.
+func testProfile(i int) *profile.Profile {
+	m := &profile.Mapping{ID: 1, Start: 0x400000, Limit: 0x800000, File: "/bin/app", BuildID: "abc", HasFunctions: true}
+	p := &profile.Profile{
+		SampleType: []*profile.ValueType{
+			{Type: "alloc_objects", Unit: "count"},
+			{Type: "alloc_space", Unit: "bytes"},
+		},
+		DefaultSampleType: "alloc_space",
+		PeriodType:        &profile.ValueType{Type: "space", Unit: "bytes"},
+		Period:            524288,
+		TimeNanos:         int64(i) * 1e9,
+		DurationNanos:     1e9,
+		Comments:          []string{"test"},
+		Mapping:           []*profile.Mapping{m},
+	}
+	for f := 0; f < 50; f++ {
+		p.Function = append(p.Function, &profile.Function{
+			ID:       uint64(f + 1),
+			Name:     fmt.Sprintf("github.com/conprof/db/tsdb.function%d", f),
+			Filename: "tsdb/head.go",
+		})
+		p.Location = append(p.Location, &profile.Location{
+			ID:      uint64(f + 1),
+			Mapping: m,
+			Address: 0x400000 + uint64(f)*16,
+			Line:    []profile.Line{{Function: p.Function[f], Line: int64(f * 10)}},
+		})
+	}
+	for s := 0; s < 40; s++ {
+		sample := &profile.Sample{
+			Location: []*profile.Location{p.Location[s], p.Location[s+5], p.Location[s+10]},
+			Value:    []int64{int64(s + i), int64((s + i) * 1024)},
+		}
+		if s%2 == 0 {
+			sample.Label = map[string][]string{"span": {"a", "b"}}
+			sample.NumLabel = map[string][]int64{"bytes": {int64(s)}}
+			sample.NumUnit = map[string][]string{"bytes": {"bytes"}}
+		}
+		p.Sample = append(p.Sample, sample)
+	}
+	return p
+}
+
+// summarizeProfile describes a profile independently of its IDs and order.
+func summarizeProfile(p *profile.Profile) []string {
+	var sum []string
+	for _, st := range p.SampleType {
+		sum = append(sum, "type "+st.Type+"/"+st.Unit)
+	}
+	sum = append(sum, fmt.Sprintf("default %s period %v %d time %d duration %d comments %v",
+		p.DefaultSampleType, *p.PeriodType, p.Period, p.TimeNanos, p.DurationNanos, p.Comments))
+	for _, s := range p.Sample {
+		var stack []string
+		for _, l := range s.Location {
+			for _, line := range l.Line {
+				stack = append(stack, fmt.Sprintf("%s:%d@%x(%s)", line.Function.Name, line.Line, l.Address, l.Mapping.File))
+			}
+		}
+		sum = append(sum, fmt.Sprintf("%s %v %v %v %v", strings.Join(stack, ";"), s.Value, s.Label, s.NumLabel, s.NumUnit))
+	}
+	sort.Strings(sum)
+	return sum
+}
+
+func TestPprofChunk(t *testing.T) {
+	var values [][]byte
+	for i := 0; i < 10; i++ {
+		var buf bytes.Buffer
+		require.NoError(t, testProfile(i).Write(&buf))
+		values = append(values, buf.Bytes())
+	}
+	// Values that are not profiles are kept as they are.
+	values[3] = []byte("not a profile")
+	values[6] = nil
+
+	c := NewPprofChunk()
+	plain := NewBytesChunk()
+	app, err := c.Appender()
+	require.NoError(t, err)
+	plainApp, err := plain.Appender()
+	require.NoError(t, err)
+	for i, v := range values {
+		app.Append(int64(i), v)
+		plainApp.Append(int64(i), v)
+	}
+	require.Equal(t, EncPprof, c.Encoding())
+	require.Equal(t, len(values), c.NumSamples())
+
+	b, err := c.Bytes()
+	require.NoError(t, err)
+	plainBytes, err := plain.Bytes()
+	require.NoError(t, err)
+	require.Less(t, len(b), len(plainBytes))
+
+	chk, err := NewPool().Get(EncPprof, b)
+	require.NoError(t, err)
+	require.Equal(t, len(values), chk.NumSamples())
+
+	it := chk.Iterator(nil)
+	for i, v := range values {
+		require.True(t, it.Next())
+		ts, val := it.At()
+		require.Equal(t, int64(i), ts)
+		if i == 3 || i == 6 {
+			require.Equal(t, v, val)
+			_, err := it.(*PprofIterator).AtProfile()
+			require.Error(t, err)
+			continue
+		}
+
+		got, err := profile.ParseData(val)
+		require.NoError(t, err)
+		require.Equal(t, summarizeProfile(testProfile(i)), summarizeProfile(got))
+
+		p, err := it.(*PprofIterator).AtProfile()
+		require.NoError(t, err)
+		require.NoError(t, p.CheckValid())
+		require.Equal(t, summarizeProfile(testProfile(i)), summarizeProfile(p))
+	}
+	require.False(t, it.Next())
+	require.NoError(t, it.Err())
+
+	it = chk.Iterator(nil)
+	require.True(t, it.Seek(7))
+	ts, val := it.At()
+	require.Equal(t, int64(7), ts)
+	got, err := profile.ParseData(val)
+	require.NoError(t, err)
+	require.Equal(t, summarizeProfile(testProfile(7)), summarizeProfile(got))
+	require.False(t, it.Seek(10))
+	require.NoError(t, it.Err())
+
+	// Timestamps are read without decoding any profile.
+	tit := chk.Iterator(&BytesTimestampOnlyIterator{})
+	for i := range values {
+		require.True(t, tit.Next())
+		ts, _ := tit.At()
+		require.Equal(t, int64(i), ts)
+	}
+	require.False(t, tit.Next())
+
+	// Iterators do not keep the tables on the chunk, appenders of loaded chunks continue with them.
+	require.Nil(t, chk.(*PprofChunk).tables)
+	_, err = chk.(*PprofChunk).Appender()
+	require.NoError(t, err)
+	require.NotNil(t, chk.(*PprofChunk).tables)
+	require.Equal(t, EncPprof, NewChunkLike(chk).Encoding())
+}
+
+func TestLoadPprofChunk_Corrupted(t *testing.T) {
+	_, err := LoadPprofChunk([]byte{0, 1})
+	require.Error(t, err)
+
+	c := NewPprofChunk()
+	app, err := c.Appender()
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	require.NoError(t, testProfile(0).Write(&buf))
+	app.Append(0, buf.Bytes())
+	b, err := c.Bytes()
+	require.NoError(t, err)
+
+	_, err = LoadPprofChunk(b[:len(b)-1])
+	require.Error(t, err)
+
+	// Corrupted tables are reported by the iterator.
+	corrupted := append([]byte{}, b...)
+	corrupted[pprofHeaderSize+3] ^= 0xff
+	chk, err := LoadPprofChunk(corrupted)
+	require.NoError(t, err)
+	it := chk.Iterator(nil)
+	require.False(t, it.Next())
+	require.Error(t, it.Err())
+}
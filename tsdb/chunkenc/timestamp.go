@@ -55,14 +55,12 @@ type timestampChunk struct {
 	num uint16
 }
 
-// newTimestampChunk returns a new chunk with Timestamp encoding of the given size.
+// newTimestampChunk returns a new chunk with Timestamp encoding.
 func newTimestampChunk() *timestampChunk {
-	// Each chunk holds around 120 samples.
-	// 2 bytes are used for the Samples count.
-	// All timestamps occupy around 130-150 bytes leaving 4850bytes for the samples.
-	// This is around 40bytes per sample.
-	// If the appended samples require more space can increase this array size.
-	b := make([]byte, 0, 5000)
+	// Double-delta encoded timestamps of regularly collected profiles take
+	// one to two bytes each, so this is enough for a dozen samples.
+	// Chunks holding more samples grow the slice when appending.
+	b := make([]byte, 0, 32)
 	return &timestampChunk{b: b, num: 0}
 }
 
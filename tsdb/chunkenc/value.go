@@ -18,7 +18,9 @@ import (
 	"encoding/binary"
 	"io"
 
+	"github.com/cespare/xxhash/v2"
 	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
 )
 
 // zstdFrameMagic is the magic beginning of all zstd compressed frames.
@@ -33,10 +35,22 @@ type valueChunk struct {
 	compressed []byte // only read once into b to decompress
 	b          []byte // appended to by Appender and decompressed to by Iterator if compressed before
 	num        uint16
+
+	// dict compresses the values with a shared dictionary if set.
+	dict *Dictionary
+	// framed values are compressed one by one, see framedValues.
+	framed bool
+	// comp compresses the values with the configured codec if set.
+	comp *Compression
+	// deduped counts the values stored as references if comp.Dedup is set.
+	deduped uint16
 }
 
+// newValueChunk returns an empty valueChunk. Profiles range from a few
+// kilobytes to megabytes, so no buffer is preallocated for the values.
+// The size of chunks is bounded by whoever cuts them instead, e.g. the head.
 func newValueChunk() *valueChunk {
-	return &valueChunk{b: make([]byte, 0, 5000)}
+	return &valueChunk{}
 }
 
 func (c *valueChunk) Bytes() ([]byte, error) {
@@ -49,7 +63,20 @@ func (c *valueChunk) Bytes() ([]byte, error) {
 	}
 
 	// All samples of the chunk are uncompressed in c.b
-	// Before we return these []byte we compress them with zstd.
+	// Before we return these []byte we compress them, with zstd unless configured otherwise.
+	if c.framed {
+		c.compressed = c.frame()
+		return c.compressed, nil
+	}
+	if c.dict != nil {
+		c.compressed = c.dict.enc.EncodeAll(c.b, nil)
+		return c.compressed, nil
+	}
+	if c.comp != nil {
+		c.compressed = c.comp.encode(c.b)
+		return c.compressed, nil
+	}
+
 	compressed := &bytes.Buffer{}
 	encoder, err := zstd.NewWriter(compressed, zstd.WithEncoderLevel(zstd.SpeedFastest))
 	if err != nil {
@@ -85,19 +112,44 @@ func (c *valueChunk) Compact() {
 }
 
 func (c *valueChunk) Appender() (*valueAppender, error) {
-	return &valueAppender{
+	a := &valueAppender{
 		c: c,
-	}, nil
+	}
+	if c.dedup() {
+		d, vals, err := c.buildDedupIndex()
+		if err != nil {
+			return nil, errors.Wrap(err, "index values")
+		}
+		a.dedup = d
+		if len(c.b) == 0 {
+			a.vals = vals
+		}
+	}
+	return a, nil
+}
+
+// dedup returns whether repeated values are stored as references, see EncBytesDedup.
+func (c *valueChunk) dedup() bool {
+	return c.comp != nil && c.comp.Dedup
 }
 
 type valueAppender struct {
 	c *valueChunk
+	// dedup indexes the values of the chunk if repeated values are stored as references.
+	dedup dedupIndex
+	// vals are the decompressed values of a compressed chunk, which replace
+	// its compressed values on the first append.
+	vals []byte
 }
 
 func (a *valueAppender) Append(_ int64, v []byte) {
 	if len(v) == 0 {
 		v = []byte(" ")
 	}
+	if a.dedup != nil {
+		a.appendDedup(v)
+		return
+	}
 
 	buf := make([]byte, binary.MaxVarintLen64)
 	size := buf[:binary.PutUvarint(buf, uint64(len(v)))]
@@ -110,47 +162,97 @@ func (a *valueAppender) Append(_ int64, v []byte) {
 	}
 }
 
-func (c *valueChunk) Iterator(it Iterator) *valueIterator {
-	if valueIter, ok := it.(*valueIterator); ok {
-		//TODO: valueIter.Reset(c.b)
-		return valueIter
+func (a *valueAppender) appendDedup(v []byte) {
+	if a.vals != nil {
+		// Never append to values that may alias the compressed ones.
+		a.c.b = a.vals[:len(a.vals):len(a.vals)]
+		a.vals = nil
+	}
+	h := xxhash.Sum64(v)
+	if idx, ok := a.dedup.lookup(a.c.b, h, v); ok {
+		a.c.b = appendUvarint(a.c.b, uint64(idx)<<1|1)
+		a.c.deduped++
+	} else {
+		a.c.b = appendUvarint(a.c.b, uint64(len(v))<<1)
+		a.dedup[h] = append(a.dedup[h], dedupEntry{idx: a.c.num, off: len(a.c.b), n: len(v)})
+		a.c.b = append(a.c.b, v...)
 	}
+	a.c.num++
+	a.c.compressed = nil // invalidate compressed bytes after append happened
+}
 
+// Iterator returns an iterator over the values of the chunk. Its values can be retained.
+// The chunk is never modified, so iterators over the same chunk can be used concurrently.
+func (c *valueChunk) Iterator(_ Iterator) *valueIterator {
+	return c.iterator(nil, false)
+}
+
+// iterator returns an iterator that decompresses the values into buf.
+// If reuse is set, framed values are decompressed into the same buffer one
+// after another, so values are only valid until the next one is read.
+func (c *valueChunk) iterator(buf []byte, reuse bool) *valueIterator {
 	vit := &valueIterator{
 		numTotal: c.num,
+		dedup:    c.dedup(),
+		reuse:    reuse,
+		buf:      buf,
 	}
 
-	// If we haven't decompressed and compressed bytes start with zstd magic number.
-	if len(c.b) == 0 && len(c.compressed) != 0 && bytes.HasPrefix(c.compressed, zstdFrameMagic) {
-		dec, err := zstd.NewReader(nil)
+	// Framed values are decompressed one by one when iterated.
+	if len(c.b) == 0 && len(c.compressed) != 0 && c.framed {
+		fv, err := newFramedValues(c.compressed, c.num, c.dict)
 		if err != nil {
 			vit.err = err
 			return vit
 		}
-		defer dec.Close()
-		err = dec.Reset(bytes.NewBuffer(c.compressed))
+		vit.fv = fv
+		return vit
+	}
+
+	b := c.b
+	// If we haven't decompressed and the codec is known or compressed bytes start with zstd magic number.
+	if len(c.b) == 0 && len(c.compressed) != 0 && (c.comp != nil || bytes.HasPrefix(c.compressed, zstdFrameMagic)) {
+		d, err := c.decompress(buf)
 		if err != nil {
 			vit.err = err
 			return vit
 		}
-		out := &bytes.Buffer{}
-		_, err = io.Copy(out, dec)
-		if err != nil {
-			vit.err = err
-			return vit
+		b = d
+		if c.comp == nil || c.comp.Codec != CodecNone {
+			// Uncompressed values are read from the chunk itself, which must never be written to.
+			vit.buf = d
 		}
-		c.b = out.Bytes()
-		c.compressed = nil
 	}
-
-	vit.br = bytes.NewReader(c.b)
+	// Values are sub-slices of b. Capping it keeps appends to them from
+	// overwriting values that are appended to the chunk later.
+	vit.b = b[:len(b):len(b)]
 	return vit
 }
 
+// decompress decompresses the values into dst if it is large enough.
+func (c *valueChunk) decompress(dst []byte) ([]byte, error) {
+	if c.comp != nil {
+		return c.comp.decode(dst, c.compressed)
+	}
+	if c.dict != nil {
+		return c.dict.dec.DecodeAll(c.compressed, dst[:0])
+	}
+	return zstdDecoder.DecodeAll(c.compressed, dst[:0])
+}
+
 type valueIterator struct {
-	br       *bytes.Reader
+	// b holds the uncompressed values, off is the offset of the next one.
+	b        []byte
+	off      int
+	fv       *framedValues
 	numTotal uint16
 	err      error
+	// dedup resolves references to earlier values, which are kept in seen.
+	dedup bool
+	seen  [][]byte
+	// reuse decompresses every framed value into buf, see valueChunk.iterator.
+	reuse bool
+	buf   []byte
 
 	v       []byte
 	numRead uint16
@@ -161,17 +263,32 @@ func (it *valueIterator) Next() bool {
 		return false
 	}
 
-	sampleLen, err := binary.ReadUvarint(it.br)
-	if err != nil {
-		it.err = err
-		return false
-	}
-
-	it.v = make([]byte, sampleLen)
-	_, err = it.br.Read(it.v)
-	if err != nil {
-		it.err = err
-		return false
+	if it.fv != nil {
+		var dst []byte
+		if it.reuse {
+			dst = it.buf[:0]
+		}
+		v, err := it.fv.at(it.numRead, dst)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		if it.reuse {
+			it.buf = v
+		}
+		it.v = v
+	} else if it.dedup {
+		if !it.nextDedup() {
+			return false
+		}
+	} else {
+		l, ok := it.uvarint()
+		if !ok {
+			return false
+		}
+		if it.v, ok = it.value(l); !ok {
+			return false
+		}
 	}
 
 	if bytes.Equal(it.v, []byte(" ")) {
@@ -182,12 +299,87 @@ func (it *valueIterator) Next() bool {
 	return true
 }
 
+func (it *valueIterator) nextDedup() bool {
+	h, ok := it.uvarint()
+	if !ok {
+		return false
+	}
+	if h&1 == 1 {
+		idx := h >> 1
+		if idx >= uint64(len(it.seen)) {
+			it.err = errors.Errorf("sample %d references later sample %d", it.numRead, idx)
+			return false
+		}
+		it.v = it.seen[idx]
+	} else if it.v, ok = it.value(h >> 1); !ok {
+		return false
+	}
+	it.seen = append(it.seen, it.v)
+	return true
+}
+
+// uvarint reads the uvarint that precedes the next value.
+func (it *valueIterator) uvarint() (uint64, bool) {
+	x, n := binary.Uvarint(it.b[it.off:])
+	if n <= 0 {
+		it.err = errors.Errorf("invalid length of sample %d", it.numRead)
+		return 0, false
+	}
+	it.off += n
+	return x, true
+}
+
+// value returns the next l bytes without copying them.
+func (it *valueIterator) value(l uint64) ([]byte, bool) {
+	if l > uint64(len(it.b)-it.off) {
+		it.err = errors.Errorf("sample %d has %d bytes, %d left", it.numRead, l, len(it.b)-it.off)
+		return nil, false
+	}
+	end := it.off + int(l)
+	v := it.b[it.off:end:end]
+	it.off = end
+	return v, true
+}
+
+// Seek is not supported as values carry no timestamps.
+// BytesTimestampValuesIterator seeks the timestamps and then uses seekIndex.
 func (it *valueIterator) Seek(_ int64) bool {
-	// TODO:
-	// This is interesting. We don't know anything about timestamps here.
-	// We could somehow translate timestamp to index?
-	// We don't need this at all?
-	panic("implement me")
+	it.err = errors.New("values cannot be sought by timestamp")
+	return false
+}
+
+// seekIndex advances the iterator to the i-th sample of the chunk.
+// Framed values are not decompressed for the skipped samples.
+func (it *valueIterator) seekIndex(i uint16) bool {
+	if it.err != nil || i >= it.numTotal {
+		return false
+	}
+	if it.numRead > 0 && it.numRead-1 >= i {
+		return true
+	}
+	if it.fv != nil {
+		it.numRead = i
+		return it.Next()
+	}
+	if it.dedup {
+		// References need the values before them.
+		for it.numRead <= i {
+			if !it.Next() {
+				return false
+			}
+		}
+		return true
+	}
+	for ; it.numRead < i; it.numRead++ {
+		l, ok := it.uvarint()
+		if !ok {
+			return false
+		}
+		if _, ok := it.value(l); !ok {
+			return false
+		}
+	}
+	return it.Next()
 }
 
 func (it *valueIterator) At() (int64, []byte) {
@@ -198,3 +390,73 @@ func (it *valueIterator) At() (int64, []byte) {
 func (it *valueIterator) Err() error {
 	return it.err
 }
+
+// The framed value layout trades compression ratio for random access.
+// It starts with the end offset of every frame as a 32 bit integer,
+// followed by the frames. Each frame holds a single zstd compressed value.
+//
+// ┌──────────────────┬─────┬──────────────────┬─────────┬─────┬─────────┐
+// │ end offset 0 <4b>│ ... │ end offset n <4b>│ frame 0 │ ... │ frame n │
+// └──────────────────┴─────┴──────────────────┴─────────┴─────┴─────────┘
+const frameOffsetSize = 4
+
+// The options of both are static so creating them cannot fail.
+// zstdDecoder is shared with the zstd codec, see Compression.
+var (
+	frameEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+	zstdDecoder, _  = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+)
+
+// frame compresses every value in c.b into its own frame.
+func (c *valueChunk) frame() []byte {
+	enc := frameEncoder
+	if c.dict != nil {
+		enc = c.dict.enc
+	}
+
+	b := make([]byte, int(c.num)*frameOffsetSize, int(c.num)*frameOffsetSize+len(c.b))
+	br := bytes.NewReader(c.b)
+	for i := 0; i < int(c.num); i++ {
+		// The values were written by the appender, so they can be read without errors.
+		l, _ := binary.ReadUvarint(br)
+		start := len(c.b) - br.Len()
+		b = enc.EncodeAll(c.b[start:start+int(l)], b)
+		_, _ = br.Seek(int64(l), io.SeekCurrent)
+		binary.BigEndian.PutUint32(b[i*frameOffsetSize:], uint32(len(b)-int(c.num)*frameOffsetSize))
+	}
+	return b
+}
+
+// framedValues gives random access to the values of the framed layout.
+type framedValues struct {
+	offsets []byte
+	frames  []byte
+	dec     *zstd.Decoder
+}
+
+func newFramedValues(b []byte, num uint16, d *Dictionary) (*framedValues, error) {
+	n := int(num) * frameOffsetSize
+	if len(b) < n {
+		return nil, errors.Errorf("framed values too short for %d offsets", num)
+	}
+	fv := &framedValues{offsets: b[:n], frames: b[n:], dec: zstdDecoder}
+	if d != nil {
+		fv.dec = d.dec
+	}
+	return fv, nil
+}
+
+// at decompresses the i-th value into dst.
+func (fv *framedValues) at(i uint16, dst []byte) ([]byte, error) {
+	// The offsets of chunks with more than 16383 values overflow uint16.
+	n := int(i)
+	var start uint32
+	if n > 0 {
+		start = binary.BigEndian.Uint32(fv.offsets[(n-1)*frameOffsetSize:])
+	}
+	end := binary.BigEndian.Uint32(fv.offsets[n*frameOffsetSize:])
+	if start > end || int(end) > len(fv.frames) {
+		return nil, errors.Errorf("invalid offsets %d-%d of value %d", start, end, i)
+	}
+	return fv.dec.DecodeAll(fv.frames[start:end], dst)
+}
@@ -1,6 +1,7 @@
 package chunkenc
 
 import (
+	"fmt"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -33,3 +34,34 @@ func TestValueChunk(t *testing.T) {
 		require.Equal(t, []byte("conprof"), v)
 	}
 }
+
+func TestValueIterator_seekIndex(t *testing.T) {
+	c := newValueChunk()
+	app, err := c.Appender()
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		app.Append(0, []byte(fmt.Sprintf("conprof-%d", i)))
+	}
+
+	it := c.Iterator(nil)
+	require.True(t, it.seekIndex(3))
+	_, v := it.At()
+	require.Equal(t, "conprof-3", string(v))
+
+	// Seeking backwards has no effect.
+	require.True(t, it.seekIndex(1))
+	_, v = it.At()
+	require.Equal(t, "conprof-3", string(v))
+
+	require.True(t, it.Next())
+	_, v = it.At()
+	require.Equal(t, "conprof-4", string(v))
+
+	require.True(t, it.seekIndex(9))
+	require.False(t, it.seekIndex(10))
+	require.NoError(t, it.Err())
+
+	// Values have no timestamps to seek.
+	require.False(t, it.Seek(0))
+	require.Error(t, it.Err())
+}
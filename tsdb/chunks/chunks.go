@@ -15,6 +15,7 @@ package chunks
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"hash"
@@ -28,6 +29,7 @@ import (
 	"github.com/conprof/db/tsdb/chunkenc"
 	tsdb_errors "github.com/conprof/db/tsdb/errors"
 	"github.com/conprof/db/tsdb/fileutil"
+	"github.com/oklog/ulid"
 	"github.com/pkg/errors"
 )
 
@@ -431,6 +433,45 @@ func (b realByteSlice) Range(start, end int) []byte {
 	return b[start:end]
 }
 
+// ChunkCorruptionErr is returned when the data of a chunk does not match its checksum.
+// Readers set the fields they know, users of the readers may fill in the rest.
+type ChunkCorruptionErr struct {
+	// Block is the ULID of the block holding the chunk. It is zero for chunks of the head.
+	Block ulid.ULID
+	// Series is the reference of the series the chunk belongs to, 0 if unknown.
+	Series uint64
+	// Ref is the reference the chunk was read with.
+	Ref uint64
+	Err error
+}
+
+func (e *ChunkCorruptionErr) Error() string {
+	msg := fmt.Sprintf("corrupted chunk %d", e.Ref)
+	if e.Series != 0 {
+		msg += fmt.Sprintf(" of series %d", e.Series)
+	}
+	if e.Block != (ulid.ULID{}) {
+		msg += fmt.Sprintf(" in block %s", e.Block)
+	}
+	return errors.Wrap(e.Err, msg).Error()
+}
+
+func (e *ChunkCorruptionErr) Unwrap() error {
+	return e.Err
+}
+
+// verifyChecksum returns an error if the CRC32 of b is not sum.
+func verifyChecksum(b, sum []byte) error {
+	h := newCRC32()
+	if _, err := h.Write(b); err != nil {
+		return err
+	}
+	if act := h.Sum(nil); !bytes.Equal(act, sum) {
+		return errors.Errorf("checksum mismatch expected:%x, actual:%x", sum, act)
+	}
+	return nil
+}
+
 // Reader implements a ChunkReader for a serialized byte stream
 // of series data.
 type Reader struct {
@@ -440,10 +481,18 @@ type Reader struct {
 	cs   []io.Closer // Closers for resources behind the byte slices.
 	size int64       // The total size of bytes in the reader.
 	pool chunkenc.Pool
+	opts ReaderOptions
+}
+
+// ReaderOptions configures a Reader.
+type ReaderOptions struct {
+	// VerifyChecksums checks the CRC32 of every chunk before it is loaded.
+	// Chunks that do not match it are reported with a ChunkCorruptionErr.
+	VerifyChecksums bool
 }
 
-func newReader(bs []ByteSlice, cs []io.Closer, pool chunkenc.Pool) (*Reader, error) {
-	cr := Reader{pool: pool, bs: bs, cs: cs}
+func newReader(bs []ByteSlice, cs []io.Closer, pool chunkenc.Pool, opts ReaderOptions) (*Reader, error) {
+	cr := Reader{pool: pool, bs: bs, cs: cs, opts: opts}
 	for i, b := range cr.bs {
 		if b.Len() < SegmentHeaderSize {
 			return nil, errors.Wrapf(errInvalidSize, "invalid segment header in segment %d", i)
@@ -465,6 +514,11 @@ func newReader(bs []ByteSlice, cs []io.Closer, pool chunkenc.Pool) (*Reader, err
 // NewDirReader returns a new Reader against sequentially numbered files in the
 // given directory.
 func NewDirReader(dir string, pool chunkenc.Pool) (*Reader, error) {
+	return NewDirReaderWithOptions(dir, pool, ReaderOptions{})
+}
+
+// NewDirReaderWithOptions is like NewDirReader but allows to configure the Reader.
+func NewDirReaderWithOptions(dir string, pool chunkenc.Pool, opts ReaderOptions) (*Reader, error) {
 	files, err := sequenceFiles(dir)
 	if err != nil {
 		return nil, err
@@ -489,7 +543,7 @@ func NewDirReader(dir string, pool chunkenc.Pool) (*Reader, error) {
 		bs = append(bs, realByteSlice(f.Bytes()))
 	}
 
-	reader, err := newReader(bs, cs, pool)
+	reader, err := newReader(bs, cs, pool, opts)
 	if err != nil {
 		return nil, tsdb_errors.NewMulti(
 			err,
@@ -517,7 +571,6 @@ func (s *Reader) Chunk(ref uint64) (chunkenc.Chunk, error) {
 		// Get the lower 4 bytes.
 		// These contain the segment offset where the data for this chunk starts.
 		chkStart = int((ref << 32) >> 32)
-		//chkCRC32 = newCRC32()
 	)
 
 	if sgmIndex >= len(s.bs) {
@@ -546,14 +599,11 @@ func (s *Reader) Chunk(ref uint64) (chunkenc.Chunk, error) {
 		return nil, errors.Errorf("segment doesn't include enough bytes to read the chunk - required:%v, available:%v", chkEnd, sgmBytes.Len())
 	}
 
-	//sum := sgmBytes.Range(chkDataEnd, chkEnd)
-	//if _, err := chkCRC32.Write(sgmBytes.Range(chkEncStart, chkDataEnd)); err != nil {
-	//	return nil, err
-	//}
-
-	//if act := chkCRC32.Sum(nil); !bytes.Equal(act, sum) {
-	//	return nil, errors.Errorf("checksum mismatch expected:%x, actual:%x", sum, act)
-	//}
+	if s.opts.VerifyChecksums {
+		if err := verifyChecksum(sgmBytes.Range(chkEncStart, chkDataEnd), sgmBytes.Range(chkDataEnd, chkEnd)); err != nil {
+			return nil, &ChunkCorruptionErr{Ref: ref, Err: err}
+		}
+	}
 
 	chkData := sgmBytes.Range(chkDataStart, chkDataEnd)
 	chkEnc := sgmBytes.Range(chkEncStart, chkEncStart+ChunkEncodingSize)[0]
@@ -14,8 +14,13 @@
 package chunks
 
 import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/conprof/db/tsdb/chunkenc"
 	"github.com/stretchr/testify/require"
 )
 
@@ -26,3 +31,44 @@ func TestReaderWithInvalidBuffer(t *testing.T) {
 	_, err := r.Chunk(0)
 	require.Error(t, err)
 }
+
+func TestReader_VerifyChecksums(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_verify_checksums")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	w, err := NewWriter(dir)
+	require.NoError(t, err)
+	chks := []Meta{{Chunk: randomChunk(t)}, {Chunk: randomChunk(t)}}
+	require.NoError(t, w.WriteChunks(chks...))
+	require.NoError(t, w.Close())
+
+	// Flip the last byte of the first chunk's data.
+	fn := filepath.Join(dir, "000001")
+	b, err := ioutil.ReadFile(fn)
+	require.NoError(t, err)
+	b[int(chks[1].Ref&0xffffffff)-5] ^= 0xff
+	require.NoError(t, ioutil.WriteFile(fn, b, 0o666))
+
+	r, err := NewDirReader(dir, nil)
+	require.NoError(t, err)
+	_, err = r.Chunk(chks[0].Ref)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+
+	r, err = NewDirReaderWithOptions(dir, nil, ReaderOptions{VerifyChecksums: true})
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, r.Close())
+	}()
+	_, err = r.Chunk(chks[0].Ref)
+	var cerr *ChunkCorruptionErr
+	require.True(t, errors.As(err, &cerr))
+	require.Equal(t, chks[0].Ref, cerr.Ref)
+
+	chk, err := r.Chunk(chks[1].Ref)
+	require.NoError(t, err)
+	require.Equal(t, chunkenc.EncBytes, chk.Encoding())
+}
@@ -0,0 +1,110 @@
+// Copyright 2021 The Conprof Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunks
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/conprof/db/tsdb/chunkenc"
+	"github.com/conprof/db/tsdb/encoding"
+	tsdb_errors "github.com/conprof/db/tsdb/errors"
+	"github.com/pkg/errors"
+)
+
+// DictionariesFilename is the name of the file next to a block's chunks
+// directory holding the dictionaries referenced by its chunks.
+const DictionariesFilename = "dictionaries"
+
+const (
+	// MagicDictionaries is 4 bytes at the head of a dictionaries file.
+	MagicDictionaries = 0x0D1C7A05
+
+	dictionariesFormatV1    = 1
+	dictionariesHeaderSize  = 5
+	dictionariesTrailerSize = crc32.Size
+)
+
+// WriteDictionaries writes the given dictionaries to the dictionaries file in dir
+// and returns its size.
+func WriteDictionaries(dir string, dicts ...*chunkenc.Dictionary) (int64, error) {
+	buf := encoding.Encbuf{}
+	buf.PutBE32(MagicDictionaries)
+	buf.PutByte(dictionariesFormatV1)
+	buf.PutUvarint(len(dicts))
+	for _, d := range dicts {
+		buf.PutUvarintBytes(d.Bytes())
+	}
+	// The checksum covers everything after the magic number.
+	buf.PutBE32(crc32.Checksum(buf.Get()[4:], castagnoliTable))
+
+	f, err := os.Create(filepath.Join(dir, DictionariesFilename))
+	if err != nil {
+		return 0, err
+	}
+	if _, err := f.Write(buf.Get()); err != nil {
+		return 0, tsdb_errors.NewMulti(err, f.Close()).Err()
+	}
+	if err := f.Sync(); err != nil {
+		return 0, tsdb_errors.NewMulti(err, f.Close()).Err()
+	}
+	return int64(buf.Len()), f.Close()
+}
+
+// ReadDictionaries reads the dictionaries file in dir and returns the
+// dictionaries it holds together with the file size.
+// Blocks without a dictionaries file return no dictionaries.
+func ReadDictionaries(dir string) ([]*chunkenc.Dictionary, int64, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, DictionariesFilename))
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+
+	if len(b) < dictionariesHeaderSize+dictionariesTrailerSize {
+		return nil, 0, errors.Wrap(encoding.ErrInvalidSize, "dictionaries header")
+	}
+	d := &encoding.Decbuf{B: b[:len(b)-dictionariesTrailerSize]}
+	if mg := d.Be32(); mg != MagicDictionaries {
+		return nil, 0, fmt.Errorf("invalid magic number %x", mg)
+	}
+	if crc32.Checksum(d.Get(), castagnoliTable) != binary.BigEndian.Uint32(b[len(b)-dictionariesTrailerSize:]) {
+		return nil, 0, errors.New("checksum did not match")
+	}
+	if v := d.Byte(); v != dictionariesFormatV1 {
+		return nil, 0, errors.Errorf("invalid dictionaries format version %d", v)
+	}
+
+	dicts := make([]*chunkenc.Dictionary, d.Uvarint())
+	for i := range dicts {
+		raw := d.UvarintBytes()
+		if d.Err() != nil {
+			break
+		}
+		dict, err := chunkenc.NewDictionary(raw)
+		if err != nil {
+			return nil, 0, errors.Wrapf(err, "load dictionary %d", i)
+		}
+		dicts[i] = dict
+	}
+	if d.Err() != nil {
+		return nil, 0, errors.Wrap(d.Err(), "decode dictionaries")
+	}
+	return dicts, int64(len(b)), nil
+}
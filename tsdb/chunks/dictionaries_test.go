@@ -0,0 +1,65 @@
+// Copyright 2021 The Conprof Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunks
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/conprof/db/tsdb/chunkenc"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteReadDictionaries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_dictionaries")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	// Blocks without dictionaries have no file.
+	dicts, size, err := ReadDictionaries(dir)
+	require.NoError(t, err)
+	require.Empty(t, dicts)
+	require.Equal(t, int64(0), size)
+
+	var samples [][]byte
+	for i := 0; i < 100; i++ {
+		samples = append(samples, []byte(fmt.Sprintf("main.main\nruntime.goexit\nruntime.mallocgc %d\nruntime.newobject %d", i, i*3)))
+	}
+	dict, err := chunkenc.TrainDictionary(samples, 4096)
+	require.NoError(t, err)
+
+	written, err := WriteDictionaries(dir, dict)
+	require.NoError(t, err)
+
+	dicts, size, err = ReadDictionaries(dir)
+	require.NoError(t, err)
+	require.Equal(t, written, size)
+	require.Len(t, dicts, 1)
+	require.Equal(t, dict.ID(), dicts[0].ID())
+	require.Equal(t, dict.Bytes(), dicts[0].Bytes())
+
+	// Corrupt the file and expect the checksum to catch it.
+	path := filepath.Join(dir, DictionariesFilename)
+	b, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	b[10] ^= 0xff
+	require.NoError(t, ioutil.WriteFile(path, b, 0666))
+	_, _, err = ReadDictionaries(dir)
+	require.Error(t, err)
+}
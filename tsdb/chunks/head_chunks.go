@@ -475,7 +475,6 @@ func (cdm *ChunkDiskMapper) Chunk(ref uint64) (chunkenc.Chunk, error) {
 		// These contain the head chunk file offset where the chunk starts.
 		// We skip the series ref and the mint/maxt beforehand.
 		chkStart = int((ref<<32)>>32) + SeriesRefSize + (2 * MintMaxtSize)
-		chkCRC32 = newCRC32()
 	)
 
 	if cdm.closed {
@@ -541,20 +540,22 @@ func (cdm *ChunkDiskMapper) Chunk(ref uint64) (chunkenc.Chunk, error) {
 		}
 	}
 
-	// Check the CRC.
-	sum := mmapFile.byteSlice.Range(chkDataEnd, chkDataEnd+CRCSize)
-	if _, err := chkCRC32.Write(mmapFile.byteSlice.Range(chkStart-(SeriesRefSize+2*MintMaxtSize), chkDataEnd)); err != nil {
+	// Check the CRC. Unlike file level corruption, a mismatch only affects
+	// this chunk, so it is reported with the chunk and its series.
+	if chkDataEnd+CRCSize > mmapFile.byteSlice.Len() {
 		return nil, &CorruptionErr{
 			Dir:       cdm.dir.Name(),
 			FileIndex: sgmIndex,
-			Err:       err,
+			Err:       errors.Errorf("head chunk file doesn't include enough bytes to read the chunk checksum - required:%v, available:%v", chkDataEnd+CRCSize, mmapFile.byteSlice.Len()),
 		}
 	}
-	if act := chkCRC32.Sum(nil); !bytes.Equal(act, sum) {
-		return nil, &CorruptionErr{
-			Dir:       cdm.dir.Name(),
-			FileIndex: sgmIndex,
-			Err:       errors.Errorf("checksum mismatch expected:%x, actual:%x", sum, act),
+	metaStart := chkStart - (SeriesRefSize + 2*MintMaxtSize)
+	sum := mmapFile.byteSlice.Range(chkDataEnd, chkDataEnd+CRCSize)
+	if err := verifyChecksum(mmapFile.byteSlice.Range(metaStart, chkDataEnd), sum); err != nil {
+		return nil, &ChunkCorruptionErr{
+			Series: binary.BigEndian.Uint64(mmapFile.byteSlice.Range(metaStart, metaStart+SeriesRefSize)),
+			Ref:    ref,
+			Err:    errors.Wrapf(err, "head chunk file %s", segmentFile(cdm.dir.Name(), sgmIndex)),
 		}
 	}
 
@@ -575,7 +576,7 @@ func (cdm *ChunkDiskMapper) Chunk(ref uint64) (chunkenc.Chunk, error) {
 // and runs the provided function on each chunk. It returns on the first error encountered.
 // NOTE: This method needs to be called at least once after creating ChunkDiskMapper
 // to set the maxt of all the file.
-func (cdm *ChunkDiskMapper) IterateAllChunks(f func(seriesRef, chunkRef uint64, mint, maxt int64, numSamples uint16) error) (err error) {
+func (cdm *ChunkDiskMapper) IterateAllChunks(f func(seriesRef, chunkRef uint64, mint, maxt int64, numSamples uint16, enc chunkenc.Encoding) error) (err error) {
 	cdm.writePathMtx.Lock()
 	defer cdm.writePathMtx.Unlock()
 
@@ -636,7 +637,8 @@ func (cdm *ChunkDiskMapper) IterateAllChunks(f func(seriesRef, chunkRef uint64,
 				break
 			}
 
-			idx += ChunkEncodingSize // Skip encoding.
+			enc := chunkenc.Encoding(mmapFile.byteSlice.Range(idx, idx+ChunkEncodingSize)[0])
+			idx += ChunkEncodingSize
 			dataLen, n := binary.Uvarint(mmapFile.byteSlice.Range(idx, idx+MaxChunkLengthFieldSize))
 			idx += n
 
@@ -671,7 +673,7 @@ func (cdm *ChunkDiskMapper) IterateAllChunks(f func(seriesRef, chunkRef uint64,
 				mmapFile.maxt = maxt
 			}
 
-			if err := f(seriesRef, chunkRef, mint, maxt, numSamples); err != nil {
+			if err := f(seriesRef, chunkRef, mint, maxt, numSamples, enc); err != nil {
 				if cerr, ok := err.(*CorruptionErr); ok {
 					cerr.Dir = cdm.dir.Name()
 					cerr.FileIndex = segID
@@ -144,7 +144,7 @@ func TestChunkDiskMapper_WriteChunk_Chunk_IterateChunks(t *testing.T) {
 	require.NoError(t, err)
 
 	idx := 0
-	err = hrw.IterateAllChunks(func(seriesRef, chunkRef uint64, mint, maxt int64, numSamples uint16) error {
+	err = hrw.IterateAllChunks(func(seriesRef, chunkRef uint64, mint, maxt int64, numSamples uint16, enc chunkenc.Encoding) error {
 		t.Helper()
 
 		expData := expectedData[idx]
@@ -153,6 +153,7 @@ func TestChunkDiskMapper_WriteChunk_Chunk_IterateChunks(t *testing.T) {
 		require.Equal(t, expData.maxt, maxt)
 		require.Equal(t, expData.maxt, maxt)
 		require.Equal(t, expData.numSamples, numSamples)
+		require.Equal(t, expData.chunk.Encoding(), enc)
 
 		actChunk, err := hrw.Chunk(expData.chunkRef)
 		require.NoError(t, err)
@@ -238,7 +239,7 @@ func TestChunkDiskMapper_Truncate(t *testing.T) {
 	require.NoError(t, err)
 
 	require.False(t, hrw.fileMaxtSet)
-	require.NoError(t, hrw.IterateAllChunks(func(_, _ uint64, _, _ int64, _ uint16) error { return nil }))
+	require.NoError(t, hrw.IterateAllChunks(func(_, _ uint64, _, _ int64, _ uint16, _ chunkenc.Encoding) error { return nil }))
 	require.True(t, hrw.fileMaxtSet)
 
 	verifyFiles([]int{3, 4, 5, 6, 7, 8})
@@ -352,7 +353,7 @@ func TestHeadReadWriter_TruncateAfterFailedIterateChunks(t *testing.T) {
 	require.NoError(t, err)
 
 	// Forcefully failing IterateAllChunks.
-	require.Error(t, hrw.IterateAllChunks(func(_, _ uint64, _, _ int64, _ uint16) error {
+	require.Error(t, hrw.IterateAllChunks(func(_, _ uint64, _, _ int64, _ uint16, _ chunkenc.Encoding) error {
 		return errors.New("random error")
 	}))
 
@@ -408,7 +409,7 @@ func TestHeadReadWriter_ReadRepairOnEmptyLastFile(t *testing.T) {
 	hrw, err = NewChunkDiskMapper(dir, chunkenc.NewPool(), DefaultWriteBufferSize)
 	require.NoError(t, err)
 	require.False(t, hrw.fileMaxtSet)
-	require.NoError(t, hrw.IterateAllChunks(func(_, _ uint64, _, _ int64, _ uint16) error { return nil }))
+	require.NoError(t, hrw.IterateAllChunks(func(_, _ uint64, _, _ int64, _ uint16, _ chunkenc.Encoding) error { return nil }))
 	require.True(t, hrw.fileMaxtSet)
 
 	// Removed from memory.
@@ -429,6 +430,38 @@ func TestHeadReadWriter_ReadRepairOnEmptyLastFile(t *testing.T) {
 
 }
 
+func TestChunkDiskMapper_Chunk_Corrupted(t *testing.T) {
+	hrw := testChunkDiskMapper(t)
+	defer func() {
+		require.NoError(t, hrw.Close())
+	}()
+
+	seriesRef, chkRef, _, _, chk := createChunk(t, 0, hrw)
+	require.NoError(t, hrw.CutNewFile())
+
+	// Flip the last byte of the chunk's data, right before its checksum.
+	cBytes, err := chk.Bytes()
+	require.NoError(t, err)
+	var buf [binary.MaxVarintLen32]byte
+	off := int64(chkRef&0xffffffff) + SeriesRefSize + 2*MintMaxtSize + ChunkEncodingSize +
+		int64(binary.PutUvarint(buf[:], uint64(len(cBytes)))) + int64(len(cBytes)) - 1
+	f, err := os.OpenFile(segmentFile(hrw.dir.Name(), 1), os.O_RDWR, 0o666)
+	require.NoError(t, err)
+	b := make([]byte, 1)
+	_, err = f.ReadAt(b, off)
+	require.NoError(t, err)
+	b[0] ^= 0xff
+	_, err = f.WriteAt(b, off)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	_, err = hrw.Chunk(chkRef)
+	var cerr *ChunkCorruptionErr
+	require.True(t, errors.As(err, &cerr))
+	require.Equal(t, seriesRef, cerr.Series)
+	require.Equal(t, chkRef, cerr.Ref)
+}
+
 func testChunkDiskMapper(t *testing.T) *ChunkDiskMapper {
 	tmpdir, err := ioutil.TempDir("", "data")
 	require.NoError(t, err)
@@ -439,7 +472,7 @@ func testChunkDiskMapper(t *testing.T) *ChunkDiskMapper {
 	hrw, err := NewChunkDiskMapper(tmpdir, chunkenc.NewPool(), DefaultWriteBufferSize)
 	require.NoError(t, err)
 	require.False(t, hrw.fileMaxtSet)
-	require.NoError(t, hrw.IterateAllChunks(func(_, _ uint64, _, _ int64, _ uint16) error { return nil }))
+	require.NoError(t, hrw.IterateAllChunks(func(_, _ uint64, _, _ int64, _ uint16, _ chunkenc.Encoding) error { return nil }))
 	require.True(t, hrw.fileMaxtSet)
 	return hrw
 }
@@ -16,6 +16,8 @@ package tsdb
 import (
 	"context"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"math"
@@ -80,6 +82,46 @@ type LeveledCompactor struct {
 	ranges    []int64
 	chunkPool chunkenc.Pool
 	ctx       context.Context
+	opts      LeveledCompactorOptions
+}
+
+// LeveledCompactorOptions are the optional settings of a LeveledCompactor.
+// Chunks with EncPprof or EncXOR encoding are never recoded.
+type LeveledCompactorOptions struct {
+	// DictionarySize is the maximum size in bytes of the zstd dictionary that is
+	// trained from the values of every written block and shared by its chunks.
+	// 0 disables dictionary compression.
+	DictionarySize int
+
+	// RandomAccessChunks writes chunks whose values are compressed one by one,
+	// so single profiles can be read without decompressing the whole chunk.
+	RandomAccessChunks bool
+
+	// ChunkCompression recompresses the values of written chunks unless they are
+	// compressed this way already. nil keeps the compression of the source chunks.
+	// It is ignored if a dictionary is used or RandomAccessChunks is set.
+	ChunkCompression *chunkenc.Compression
+
+	// DeduplicateChunks writes chunks of a block with identical samples only once.
+	// The series of all copies reference the same chunk. Values repeated within
+	// a chunk are stored as references, see chunkenc.NewBytesDedupChunk.
+	DeduplicateChunks bool
+
+	// Downsampling are the levels at which the samples of old blocks are thinned out,
+	// sorted by age. Blocks are rewritten when they reach the age of a level and
+	// record their resolution in their meta. Compacted blocks have the lowest
+	// resolution of their parents. No samples are dropped without levels.
+	Downsampling []DownsamplingLevel
+
+	// ProfileStats records the value sizes of the profiles of written blocks in
+	// their BlockStats. This decompresses every value once more.
+	ProfileStats bool
+	// ProfileStatsLabel is the label by whose values the sizes are broken down,
+	// e.g. job or __name__. Empty disables the breakdown.
+	ProfileStatsLabel string
+	// ProfileStatsTopValues is the number of label values with the most bytes
+	// that are recorded. 0 records DefaultProfileStatsTopValues.
+	ProfileStatsTopValues int
 }
 
 type compactorMetrics struct {
@@ -90,6 +132,9 @@ type compactorMetrics struct {
 	chunkSize         prometheus.Histogram
 	chunkSamples      prometheus.Histogram
 	chunkRange        prometheus.Histogram
+	dedupedSamples    prometheus.Counter
+	dedupedChunks     prometheus.Counter
+	downsampled       prometheus.Counter
 }
 
 func newCompactorMetrics(r prometheus.Registerer) *compactorMetrics {
@@ -127,6 +172,18 @@ func newCompactorMetrics(r prometheus.Registerer) *compactorMetrics {
 		Help:    "Final time range of chunks on their first compaction",
 		Buckets: prometheus.ExponentialBuckets(100, 4, 10),
 	})
+	m.dedupedSamples = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prometheus_tsdb_compaction_deduplicated_samples_total",
+		Help: "Total number of samples written by compactions as references to identical values of their chunk.",
+	})
+	m.dedupedChunks = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prometheus_tsdb_compaction_deduplicated_chunks_total",
+		Help: "Total number of chunks not written by compactions as an identical chunk was written before.",
+	})
+	m.downsampled = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prometheus_tsdb_compaction_downsampled_samples_total",
+		Help: "Total number of samples dropped by compactions to downsample blocks.",
+	})
 
 	if r != nil {
 		r.MustRegister(
@@ -137,6 +194,9 @@ func newCompactorMetrics(r prometheus.Registerer) *compactorMetrics {
 			m.chunkRange,
 			m.chunkSamples,
 			m.chunkSize,
+			m.dedupedSamples,
+			m.dedupedChunks,
+			m.downsampled,
 		)
 	}
 	return m
@@ -144,6 +204,11 @@ func newCompactorMetrics(r prometheus.Registerer) *compactorMetrics {
 
 // NewLeveledCompactor returns a LeveledCompactor.
 func NewLeveledCompactor(ctx context.Context, r prometheus.Registerer, l log.Logger, ranges []int64, pool chunkenc.Pool) (*LeveledCompactor, error) {
+	return NewLeveledCompactorWithOptions(ctx, r, l, ranges, pool, LeveledCompactorOptions{})
+}
+
+// NewLeveledCompactorWithOptions returns a LeveledCompactor configured with the given options.
+func NewLeveledCompactorWithOptions(ctx context.Context, r prometheus.Registerer, l log.Logger, ranges []int64, pool chunkenc.Pool, opts LeveledCompactorOptions) (*LeveledCompactor, error) {
 	if len(ranges) == 0 {
 		return nil, errors.Errorf("at least one range must be provided")
 	}
@@ -153,12 +218,21 @@ func NewLeveledCompactor(ctx context.Context, r prometheus.Registerer, l log.Log
 	if l == nil {
 		l = log.NewNopLogger()
 	}
+	if opts.ChunkCompression != nil {
+		if err := opts.ChunkCompression.Validate(); err != nil {
+			return nil, errors.Wrap(err, "invalid chunk compression")
+		}
+	}
+	if err := validateDownsampling(opts.Downsampling); err != nil {
+		return nil, err
+	}
 	return &LeveledCompactor{
 		ranges:    ranges,
 		chunkPool: pool,
 		logger:    l,
 		metrics:   newCompactorMetrics(r),
 		ctx:       ctx,
+		opts:      opts,
 	}, nil
 }
 
@@ -197,6 +271,12 @@ func (c *LeveledCompactor) plan(dms []dirMeta) ([]string, error) {
 	if len(res) > 0 {
 		return res, nil
 	}
+	newest := int64(math.MinInt64)
+	for _, dm := range dms {
+		if dm.meta.MaxTime > newest {
+			newest = dm.meta.MaxTime
+		}
+	}
 	// No overlapping blocks, do compaction the usual way.
 	// We do not include a recently created block with max(minTime), so the block which was just created from WAL.
 	// This gives users a window of a full block size to piece-wise backup new data without having to care about data overlap.
@@ -209,6 +289,11 @@ func (c *LeveledCompactor) plan(dms []dirMeta) ([]string, error) {
 		return res, nil
 	}
 
+	// Downsample blocks on their own once they are old enough.
+	if res := c.selectDownsampleDir(dms, newest); len(res) > 0 {
+		return res, nil
+	}
+
 	// Compact any blocks with big enough time range that have >5% tombstones.
 	for i := len(dms) - 1; i >= 0; i-- {
 		meta := dms[i].meta
@@ -354,6 +439,9 @@ func CompactBlockMetas(uid ulid.ULID, blocks ...*BlockMeta) *BlockMeta {
 		if b.Compaction.Level > res.Compaction.Level {
 			res.Compaction.Level = b.Compaction.Level
 		}
+		if b.Resolution > res.Resolution {
+			res.Resolution = b.Resolution
+		}
 		for _, s := range b.Compaction.Sources {
 			sources[s] = struct{}{}
 		}
@@ -422,6 +510,15 @@ func (c *LeveledCompactor) Compact(dest string, dirs []string, open []*Block) (u
 	uid = ulid.MustNew(ulid.Now(), rand.Reader)
 
 	meta := CompactBlockMetas(uid, metas...)
+	if len(c.opts.Downsampling) > 0 {
+		newest, err := newestMaxTime(dest)
+		if err != nil {
+			return uid, errors.Wrap(err, "find newest block")
+		}
+		if res := c.resolution(newest - meta.MaxTime); res > meta.Resolution {
+			meta.Resolution = res
+		}
+	}
 	err = c.write(dest, meta, blocks...)
 	if err == nil {
 		if meta.Stats.NumSamples == 0 {
@@ -486,6 +583,8 @@ func (c *LeveledCompactor) Write(dest string, b BlockReader, mint, maxt int64, p
 		meta.Compaction.Parents = []BlockDesc{
 			{ULID: parent.ULID, MinTime: parent.MinTime, MaxTime: parent.MaxTime},
 		}
+		// Rewritten blocks keep their resolution.
+		meta.Resolution = parent.Resolution
 	}
 
 	err := c.write(dest, meta, b)
@@ -585,7 +684,8 @@ func (c *LeveledCompactor) write(dest string, meta *BlockMeta, blocks ...BlockRe
 	}
 	closers = append(closers, indexw)
 
-	if err := c.populateBlock(blocks, meta, indexw, chunkw); err != nil {
+	dict, err := c.populateBlock(blocks, meta, indexw, chunkw)
+	if err != nil {
 		return errors.Wrap(err, "populate block")
 	}
 
@@ -617,6 +717,12 @@ func (c *LeveledCompactor) write(dest string, meta *BlockMeta, blocks ...BlockRe
 		return errors.Wrap(err, "write merged meta")
 	}
 
+	if dict != nil {
+		if _, err := chunks.WriteDictionaries(tmp, dict); err != nil {
+			return errors.Wrap(err, "write dictionaries")
+		}
+	}
+
 	// Create an empty tombstones file.
 	if _, err := tombstones.WriteFile(c.logger, tmp, tombstones.NewMemTombstones()); err != nil {
 		return errors.Wrap(err, "write new tombstones file")
@@ -652,17 +758,25 @@ func (c *LeveledCompactor) write(dest string, meta *BlockMeta, blocks ...BlockRe
 
 // populateBlock fills the index and chunk writers with new data gathered as the union
 // of the provided blocks. It returns meta information for the new block.
+// If dictionary compression is enabled, the chunks are compressed with a dictionary
+// trained from the blocks' values, which is returned to be persisted with the block.
+// Chunks are recoded with per value compression if random access chunks are enabled.
+// Without a new dictionary, chunks compressed with one of the blocks' dictionaries
+// are recoded as the new block does not carry those over.
+// Series are downsampled to the resolution of the meta if any block has a higher one.
 // It expects sorted blocks input by mint.
-func (c *LeveledCompactor) populateBlock(blocks []BlockReader, meta *BlockMeta, indexw IndexWriter, chunkw ChunkWriter) (err error) {
+func (c *LeveledCompactor) populateBlock(blocks []BlockReader, meta *BlockMeta, indexw IndexWriter, chunkw ChunkWriter) (dict *chunkenc.Dictionary, err error) {
 	if len(blocks) == 0 {
-		return errors.New("cannot populate block from no readers")
+		return nil, errors.New("cannot populate block from no readers")
 	}
 
 	var (
 		sets        []storage.ChunkSeriesSet
+		dictSets    []storage.ChunkSeriesSet
 		symbols     index.StringIter
 		closers     []io.Closer
 		overlapping bool
+		downsample  bool
 	)
 	defer func() {
 		errs := tsdb_errors.NewMulti(err)
@@ -678,10 +792,13 @@ func (c *LeveledCompactor) populateBlock(blocks []BlockReader, meta *BlockMeta,
 	for i, b := range blocks {
 		select {
 		case <-c.ctx.Done():
-			return c.ctx.Err()
+			return nil, c.ctx.Err()
 		default:
 		}
 
+		if b.Meta().Resolution < meta.Resolution {
+			downsample = true
+		}
 		if !overlapping {
 			if i > 0 && b.Meta().MinTime < globalMaxt {
 				c.metrics.overlappingBlocks.Inc()
@@ -693,33 +810,53 @@ func (c *LeveledCompactor) populateBlock(blocks []BlockReader, meta *BlockMeta,
 			}
 		}
 
-		indexr, err := b.Index()
-		if err != nil {
-			return errors.Wrapf(err, "open index reader for block %+v", b.Meta())
+		readers := []BlockReader{b}
+		if rh, ok := b.(*RangeHead); ok && rh.head.hasOutOfOrder(rh.mint) {
+			// Late samples of the head are kept apart from its chunks
+			// and have to be merged into their series.
+			readers = append(readers, newOutOfOrderRangeHead(rh.head, rh.mint, rh.maxt))
 		}
-		closers = append(closers, indexr)
+		var syms index.StringIter
+		for _, r := range readers {
+			indexr, err := r.Index()
+			if err != nil {
+				return nil, errors.Wrapf(err, "open index reader for block %+v", b.Meta())
+			}
+			closers = append(closers, indexr)
 
-		chunkr, err := b.Chunks()
-		if err != nil {
-			return errors.Wrapf(err, "open chunk reader for block %+v", b.Meta())
-		}
-		closers = append(closers, chunkr)
+			chunkr, err := r.Chunks()
+			if err != nil {
+				return nil, errors.Wrapf(err, "open chunk reader for block %+v", b.Meta())
+			}
+			closers = append(closers, chunkr)
 
-		tombsr, err := b.Tombstones()
-		if err != nil {
-			return errors.Wrapf(err, "open tombstone reader for block %+v", b.Meta())
-		}
-		closers = append(closers, tombsr)
+			tombsr, err := r.Tombstones()
+			if err != nil {
+				return nil, errors.Wrapf(err, "open tombstone reader for block %+v", b.Meta())
+			}
+			closers = append(closers, tombsr)
 
-		k, v := index.AllPostingsKey()
-		all, err := indexr.Postings(k, v)
-		if err != nil {
-			return err
+			k, v := index.AllPostingsKey()
+			all, err := indexr.Postings(k, v)
+			if err != nil {
+				return nil, err
+			}
+			all = indexr.SortedPostings(all)
+			// Blocks meta is half open: [min, max), so subtract 1 to ensure we don't hold samples with exact meta.MaxTime timestamp.
+			sets = append(sets, newBlockChunkSeriesSet(indexr, chunkr, tombsr, all, meta.MinTime, meta.MaxTime-1, storage.ProjectionFull, seriesLimits{}))
+			if c.opts.DictionarySize > 0 {
+				// Training needs a separate pass over the block's values.
+				all, err := indexr.Postings(k, v)
+				if err != nil {
+					return nil, err
+				}
+				dictSets = append(dictSets, newBlockChunkSeriesSet(indexr, chunkr, tombsr, indexr.SortedPostings(all), meta.MinTime, meta.MaxTime-1, storage.ProjectionFull, seriesLimits{}))
+			}
+			if syms == nil {
+				// The late samples have the symbols of the head.
+				syms = indexr.Symbols()
+			}
 		}
-		all = indexr.SortedPostings(all)
-		// Blocks meta is half open: [min, max), so subtract 1 to ensure we don't hold samples with exact meta.MaxTime timestamp.
-		sets = append(sets, newBlockChunkSeriesSet(indexr, chunkr, tombsr, all, meta.MinTime, meta.MaxTime-1))
-		syms := indexr.Symbols()
 		if i == 0 {
 			symbols = syms
 			continue
@@ -729,17 +866,34 @@ func (c *LeveledCompactor) populateBlock(blocks []BlockReader, meta *BlockMeta,
 
 	for symbols.Next() {
 		if err := indexw.AddSymbol(symbols.At()); err != nil {
-			return errors.Wrap(err, "add symbol")
+			return nil, errors.Wrap(err, "add symbol")
 		}
 	}
 	if symbols.Err() != nil {
-		return errors.Wrap(symbols.Err(), "next symbol")
+		return nil, errors.Wrap(symbols.Err(), "next symbol")
+	}
+
+	if len(dictSets) > 0 {
+		d, err := c.trainDictionary(dictSets)
+		if err != nil {
+			// The block is still written, just without a dictionary.
+			level.Warn(c.logger).Log("msg", "Failed to train chunk dictionary", "ulid", meta.ULID, "err", err)
+		}
+		dict = d
 	}
 
 	var (
-		ref  = uint64(0)
-		chks []chunks.Meta
+		ref     = uint64(0)
+		chks    []chunks.Meta
+		deduper *chunkDeduper
+		stats   *profileStats
 	)
+	if c.opts.DeduplicateChunks {
+		deduper = newChunkDeduper(c.chunkPool)
+	}
+	if c.opts.ProfileStats {
+		stats = newProfileStats(c.opts.ProfileStatsLabel, c.opts.ProfileStatsTopValues)
+	}
 
 	set := sets[0]
 	if len(sets) > 1 {
@@ -751,7 +905,7 @@ func (c *LeveledCompactor) populateBlock(blocks []BlockReader, meta *BlockMeta,
 	for set.Next() {
 		select {
 		case <-c.ctx.Done():
-			return c.ctx.Err()
+			return nil, c.ctx.Err()
 		default:
 		}
 		s := set.At()
@@ -763,7 +917,7 @@ func (c *LeveledCompactor) populateBlock(blocks []BlockReader, meta *BlockMeta,
 			chks = append(chks, chksIter.At())
 		}
 		if chksIter.Err() != nil {
-			return errors.Wrap(chksIter.Err(), "chunk iter")
+			return nil, errors.Wrap(chksIter.Err(), "chunk iter")
 		}
 
 		// Skip the series with all deleted chunks.
@@ -771,29 +925,326 @@ func (c *LeveledCompactor) populateBlock(blocks []BlockReader, meta *BlockMeta,
 			continue
 		}
 
-		if err := chunkw.WriteChunks(chks...); err != nil {
-			return errors.Wrap(err, "write chunks")
+		if downsample {
+			var (
+				n   int
+				err error
+			)
+			chks, n, err = downsampleChunks(chks, meta.Resolution)
+			if err != nil {
+				return nil, errors.Wrap(err, "downsample chunks")
+			}
+			c.metrics.downsampled.Add(float64(n))
+		}
+
+		for i := range chks {
+			var newChunk chunkenc.Chunk
+			switch {
+			case chks[i].Chunk.Encoding() == chunkenc.EncPprof:
+				// Their shared tables already deduplicate most of the profiles.
+				continue
+			case chks[i].Chunk.Encoding() == chunkenc.EncXOR:
+				// Numeric samples are not profiles.
+				continue
+			case c.opts.RandomAccessChunks:
+				newChunk = chunkenc.NewBytesFramedChunk(dict)
+			case dict != nil:
+				newChunk = chunkenc.NewBytesDictChunk(dict)
+			case c.opts.ChunkCompression != nil:
+				if chunkenc.CompressedWith(chks[i].Chunk, *c.opts.ChunkCompression) {
+					continue
+				}
+				newChunk = chunkenc.NewBytesCodecChunk(*c.opts.ChunkCompression)
+			case chunkenc.UsesDictionary(chks[i].Chunk):
+				// The dictionary of the source block is not written to the new one.
+				newChunk = chunkenc.NewBytesChunk()
+			default:
+				continue
+			}
+			chk, err := recodeChunk(chks[i].Chunk, newChunk)
+			if err != nil {
+				return nil, errors.Wrap(err, "recode chunk")
+			}
+			if err := c.chunkPool.Put(chks[i].Chunk); err != nil {
+				return nil, errors.Wrap(err, "put chunk")
+			}
+			chks[i].Chunk = chk
+		}
+
+		dedupedSamples := 0
+		if deduper != nil {
+			n, samples, err := deduper.write(chunkw, chks)
+			if err != nil {
+				return nil, errors.Wrap(err, "write chunks")
+			}
+			meta.Stats.NumDedupedChunks += uint64(n)
+			c.metrics.dedupedChunks.Add(float64(n))
+			dedupedSamples = samples
+		} else {
+			if err := chunkw.WriteChunks(chks...); err != nil {
+				return nil, errors.Wrap(err, "write chunks")
+			}
+			for _, chk := range chks {
+				dedupedSamples += chunkenc.NumDeduped(chk.Chunk)
+			}
 		}
 		if err := indexw.AddSeries(ref, s.Labels(), chks...); err != nil {
-			return errors.Wrap(err, "add series")
+			return nil, errors.Wrap(err, "add series")
 		}
 
 		meta.Stats.NumChunks += uint64(len(chks))
 		meta.Stats.NumSeries++
+		meta.Stats.NumDedupedSamples += uint64(dedupedSamples)
+		c.metrics.dedupedSamples.Add(float64(dedupedSamples))
 		for _, chk := range chks {
 			meta.Stats.NumSamples += uint64(chk.Chunk.NumSamples())
 		}
+		if stats != nil {
+			var written []bool
+			if deduper != nil {
+				written = deduper.written
+			}
+			if err := stats.add(s.Labels(), chks, written); err != nil {
+				return nil, errors.Wrap(err, "profile stats")
+			}
+		}
 
 		for _, chk := range chks {
 			if err := c.chunkPool.Put(chk.Chunk); err != nil {
-				return errors.Wrap(err, "put chunk")
+				return nil, errors.Wrap(err, "put chunk")
 			}
 		}
 		ref++
 	}
 	if set.Err() != nil {
-		return errors.Wrap(set.Err(), "iterate compaction set")
+		return nil, errors.Wrap(set.Err(), "iterate compaction set")
 	}
+	if stats != nil {
+		stats.apply(&meta.Stats)
+	}
+
+	return dict, nil
+}
+
+// chunkDeduper deduplicates the chunks of a block by their payloads, the
+// timestamps and values of their samples. Chunks with the same payload are
+// written only once, whatever their encoding, and the metas of all copies
+// reference the chunk that was written first. Byte chunks that repeat values
+// are recoded to store the repetitions as references to the first occurrence,
+// see chunkenc.NewBytesDedupChunk. Payloads are compared by a sha256 of their
+// values, as the 64 bit hashes of sample infos may collide and silently make a
+// chunk reference the data of another.
+type chunkDeduper struct {
+	pool chunkenc.Pool
+	refs map[[sha256.Size]byte]dedupedChunk
+
+	hashes [][sha256.Size]byte
+	unique []chunks.Meta
+	infos  map[chunkenc.SampleInfo]struct{}
+	// written reports for the chunks of the last write whether they were written.
+	written []bool
+}
+
+func newChunkDeduper(pool chunkenc.Pool) *chunkDeduper {
+	return &chunkDeduper{
+		pool:  pool,
+		refs:  map[[sha256.Size]byte]dedupedChunk{},
+		infos: map[chunkenc.SampleInfo]struct{}{},
+	}
+}
+
+// dedupedChunk is a written chunk and the number of its samples that are
+// references, which all copies of the chunk share.
+type dedupedChunk struct {
+	ref     uint64
+	deduped int
+}
+
+// write writes the chunks that were not written before and sets the references of all.
+// It returns how many chunks were not written and how many samples of all chunks
+// are stored as references.
+func (d *chunkDeduper) write(w ChunkWriter, chks []chunks.Meta) (dedupedChunks, dedupedSamples int, err error) {
+	d.hashes, d.unique, d.written = d.hashes[:0], d.unique[:0], d.written[:0]
+	// dupOf holds the index in unique of the chunks that are copies of a chunk of the same batch.
+	dupOf := make([]int, len(chks))
+	for i := range chks {
+		dupOf[i] = -1
+		sum, repeated, err := d.payloadKey(chks[i].Chunk)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		d.written = append(d.written, false)
+		if c, ok := d.refs[sum]; ok {
+			chks[i].Ref = c.ref
+			dedupedSamples += c.deduped
+			continue
+		}
+		for j, hj := range d.hashes {
+			if hj == sum {
+				dupOf[i] = j
+				break
+			}
+		}
+		if dupOf[i] >= 0 {
+			continue
+		}
+		if repeated {
+			if err := d.recode(&chks[i]); err != nil {
+				return 0, 0, errors.Wrap(err, "recode chunk")
+			}
+		}
+		d.written[i] = true
+		dupOf[i] = len(d.unique)
+		d.hashes = append(d.hashes, sum)
+		d.unique = append(d.unique, chks[i])
+	}
+	if len(d.unique) > 0 {
+		if err := w.WriteChunks(d.unique...); err != nil {
+			return 0, 0, err
+		}
+	}
+	for j, sum := range d.hashes {
+		d.refs[sum] = dedupedChunk{ref: d.unique[j].Ref, deduped: chunkenc.NumDeduped(d.unique[j].Chunk)}
+	}
+	for i, j := range dupOf {
+		if j >= 0 {
+			chks[i].Ref = d.unique[j].Ref
+			dedupedSamples += d.refs[d.hashes[j]].deduped
+		}
+	}
+	return len(chks) - len(d.unique), dedupedSamples, nil
+}
 
+// payloadKey returns the key of the payload of c and whether c could store
+// repeated values as references but does not.
+func (d *chunkDeduper) payloadKey(c chunkenc.Chunk) (key [sha256.Size]byte, repeated bool, err error) {
+	h := sha256.New()
+	switch c.Encoding() {
+	case chunkenc.EncBytes, chunkenc.EncBytesDict, chunkenc.EncBytesFramed,
+		chunkenc.EncBytesCodec, chunkenc.EncBytesDelta, chunkenc.EncBytesDedup:
+	default:
+		// Numeric samples and pprof chunks are compared by their bytes.
+		b, err := c.Bytes()
+		if err != nil {
+			return key, false, err
+		}
+		_, _ = h.Write([]byte{byte(c.Encoding())})
+		_, _ = h.Write(b)
+		h.Sum(key[:0])
+		return key, false, nil
+	}
+
+	comp, _ := chunkenc.CompressionOf(c)
+	dedupable := (c.Encoding() == chunkenc.EncBytes || c.Encoding() == chunkenc.EncBytesCodec) && !comp.Delta
+	for k := range d.infos {
+		delete(d.infos, k)
+	}
+
+	var buf [2 * binary.MaxVarintLen64]byte
+	_, _ = h.Write([]byte{byte(chunkenc.EncBytes)})
+	it := c.Iterator(nil)
+	for it.Next() {
+		t, v := it.At()
+		n := binary.PutVarint(buf[:], t)
+		n += binary.PutUvarint(buf[n:], uint64(len(v)))
+		_, _ = h.Write(buf[:n])
+		_, _ = h.Write(v)
+
+		// Appending to dedup chunks compares the values, so colliding
+		// infos only cause a needless recode.
+		if dedupable && len(v) > 0 {
+			info := chunkenc.NewSampleInfo(v)
+			if _, ok := d.infos[info]; ok {
+				repeated = true
+			}
+			d.infos[info] = struct{}{}
+		}
+	}
+	if it.Err() != nil {
+		return key, false, it.Err()
+	}
+	h.Sum(key[:0])
+	return key, repeated, nil
+}
+
+// recode recodes the chunk of m to store repeated values as references.
+func (d *chunkDeduper) recode(m *chunks.Meta) error {
+	comp, _ := chunkenc.CompressionOf(m.Chunk)
+	chk, err := recodeChunk(m.Chunk, chunkenc.NewBytesDedupChunk(comp))
+	if err != nil {
+		return err
+	}
+	if err := d.pool.Put(m.Chunk); err != nil {
+		return errors.Wrap(err, "put chunk")
+	}
+	m.Chunk = chk
 	return nil
 }
+
+// Bounds of the values sampled to train a block's dictionary.
+const (
+	dictionarySamplesPerSeries = 4
+	// zstd recommends training on about 100 times the dictionary size.
+	dictionaryTrainingRatio = 100
+)
+
+// trainDictionary trains a dictionary from the values of the given series.
+// It samples the first values of every series until enough data is gathered.
+func (c *LeveledCompactor) trainDictionary(sets []storage.ChunkSeriesSet) (*chunkenc.Dictionary, error) {
+	var (
+		samples [][]byte
+		size    int
+		budget  = c.opts.DictionarySize * dictionaryTrainingRatio
+	)
+	for _, set := range sets {
+		for size < budget && set.Next() {
+			chksIter := set.At().Iterator()
+			if !chksIter.Next() {
+				if chksIter.Err() != nil {
+					return nil, errors.Wrap(chksIter.Err(), "chunk iter")
+				}
+				continue
+			}
+			chk := chksIter.At().Chunk
+			if chk.Encoding() == chunkenc.EncXOR {
+				continue
+			}
+			it := chk.Iterator(nil)
+			for i := 0; i < dictionarySamplesPerSeries && it.Next(); i++ {
+				_, v := it.At()
+				if len(v) == 0 {
+					continue
+				}
+				samples = append(samples, v)
+				size += len(v)
+			}
+			if it.Err() != nil {
+				return nil, errors.Wrap(it.Err(), "iterate chunk")
+			}
+		}
+		if set.Err() != nil {
+			return nil, errors.Wrap(set.Err(), "iterate series")
+		}
+	}
+	if len(samples) == 0 {
+		return nil, nil
+	}
+	return chunkenc.TrainDictionary(samples, c.opts.DictionarySize)
+}
+
+// recodeChunk appends all samples of from to the empty chunk to and returns it.
+func recodeChunk(from, to chunkenc.Chunk) (chunkenc.Chunk, error) {
+	app, err := to.Appender()
+	if err != nil {
+		return nil, err
+	}
+	it := from.Iterator(nil)
+	for it.Next() {
+		app.Append(it.At())
+	}
+	if it.Err() != nil {
+		return nil, it.Err()
+	}
+	return to, nil
+}
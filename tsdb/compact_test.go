@@ -21,15 +21,21 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/conprof/db/storage"
 	"github.com/conprof/db/tsdb/chunkenc"
 	"github.com/conprof/db/tsdb/chunks"
 	"github.com/conprof/db/tsdb/fileutil"
 	"github.com/conprof/db/tsdb/tombstones"
+	"github.com/conprof/db/tsdb/tsdbutil"
 	"github.com/go-kit/kit/log"
+	"github.com/klauspost/compress/zstd"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 	prom_testutil "github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/stretchr/testify/require"
@@ -952,7 +958,7 @@ func TestCompaction_populateBlock(t *testing.T) {
 			}
 
 			iw := &mockIndexWriter{}
-			err = c.populateBlock(blocks, meta, iw, nopChunkWriter{})
+			_, err = c.populateBlock(blocks, meta, iw, nopChunkWriter{})
 			if tc.expErr != nil {
 				require.Error(t, err)
 				require.Equal(t, tc.expErr.Error(), err.Error())
@@ -1093,7 +1099,7 @@ func BenchmarkCompactionFromHead(b *testing.B) {
 			defer func() {
 				require.NoError(b, os.RemoveAll(chunkDir))
 			}()
-			h, err := NewHead(nil, nil, nil, 1000, chunkDir, nil, chunks.DefaultWriteBufferSize, DefaultStripeSize, nil)
+			h, err := NewHead(nil, nil, nil, &HeadOptions{ChunkRange: 1000, ChunkDirRoot: chunkDir})
 			require.NoError(b, err)
 			for ln := 0; ln < labelNames; ln++ {
 				app := h.Appender(context.Background())
@@ -1308,3 +1314,520 @@ func TestDeleteCompactionBlockAfterFailedReload(t *testing.T) {
 		})
 	}
 }
+
+func TestCompactionChunkEncodings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_compaction_chunk_encodings")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	var function strings.Builder
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(&function, "github.com/conprof/db/tsdb.(*LeveledCompactor).function%d\n", i)
+	}
+	var (
+		series   []storage.Series
+		expected = map[string][]tsdbutil.Sample{}
+	)
+	for i := 0; i < 10; i++ {
+		var samples []tsdbutil.Sample
+		for ts := int64(0); ts < 50; ts++ {
+			samples = append(samples, sample{t: ts, v: []byte(fmt.Sprintf("%d-%d\n%s", i, ts, function.String()))})
+		}
+		lset := labels.FromStrings("a", strconv.Itoa(i))
+		series = append(series, storage.NewListSeries(lset, samples))
+		expected[lset.String()] = samples
+	}
+	head := createHead(t, nil, series, filepath.Join(dir, "head"))
+	defer func() {
+		require.NoError(t, head.Close())
+	}()
+
+	sizes := map[string]int64{}
+	for _, tc := range []struct {
+		name     string
+		opts     LeveledCompactorOptions
+		encoding chunkenc.Encoding
+	}{
+		{name: "default", encoding: chunkenc.EncBytes},
+		{name: "recompressed", opts: LeveledCompactorOptions{ChunkCompression: &chunkenc.Compression{Level: zstd.SpeedBestCompression}}, encoding: chunkenc.EncBytesCodec},
+		{name: "uncompressed", opts: LeveledCompactorOptions{ChunkCompression: &chunkenc.Compression{Codec: chunkenc.CodecNone}}, encoding: chunkenc.EncBytesCodec},
+		{name: "dictionary", opts: LeveledCompactorOptions{DictionarySize: 16 * 1024}, encoding: chunkenc.EncBytesDict},
+		{name: "random access", opts: LeveledCompactorOptions{RandomAccessChunks: true}, encoding: chunkenc.EncBytesFramed},
+		{name: "random access with dictionary", opts: LeveledCompactorOptions{DictionarySize: 16 * 1024, RandomAccessChunks: true}, encoding: chunkenc.EncBytesFramed},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := NewLeveledCompactorWithOptions(context.Background(), nil, log.NewNopLogger(), []int64{1000}, nil, tc.opts)
+			require.NoError(t, err)
+			id, err := c.Write(dir, head, head.MinTime(), head.MaxTime()+1, nil)
+			require.NoError(t, err)
+
+			block, err := OpenBlock(nil, filepath.Join(dir, id.String()), nil)
+			require.NoError(t, err)
+			defer func() {
+				require.NoError(t, block.Close())
+			}()
+			sizes[tc.name] = block.numBytesChunks
+
+			_, err = os.Stat(filepath.Join(block.Dir(), chunks.DictionariesFilename))
+			require.Equal(t, tc.opts.DictionarySize == 0, os.IsNotExist(err))
+
+			chunkr, err := block.Chunks()
+			require.NoError(t, err)
+			indexr, err := block.Index()
+			require.NoError(t, err)
+			p, err := indexr.Postings("a", "0")
+			require.NoError(t, err)
+			require.True(t, p.Next())
+			var (
+				lset labels.Labels
+				chks []chunks.Meta
+			)
+			require.NoError(t, indexr.Series(p.At(), &lset, &chks))
+			for _, meta := range chks {
+				chk, err := chunkr.Chunk(meta.Ref)
+				require.NoError(t, err)
+				require.Equal(t, tc.encoding, chk.Encoding())
+				if tc.opts.ChunkCompression != nil {
+					require.True(t, chunkenc.CompressedWith(chk, *tc.opts.ChunkCompression))
+				}
+			}
+			require.NoError(t, chunkr.Close())
+			require.NoError(t, indexr.Close())
+
+			q, err := NewBlockQuerier(block, head.MinTime(), head.MaxTime())
+			require.NoError(t, err)
+			require.Equal(t, expected, query(t, q, labels.MustNewMatcher(labels.MatchRegexp, "a", ".+")))
+		})
+	}
+	require.Less(t, sizes["dictionary"], sizes["default"])
+	require.Less(t, sizes["recompressed"], sizes["default"])
+	require.Less(t, sizes["default"], sizes["uncompressed"])
+	require.Less(t, sizes["random access with dictionary"], sizes["random access"])
+}
+
+func TestCompactionDictionaryBlocksWithoutDictionary(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_compaction_dictionary_blocks")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	var function strings.Builder
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(&function, "github.com/conprof/db/tsdb.(*LeveledCompactor).function%d\n", i)
+	}
+	var (
+		series   []storage.Series
+		expected = map[string][]tsdbutil.Sample{}
+	)
+	for i := 0; i < 10; i++ {
+		var samples []tsdbutil.Sample
+		for ts := int64(0); ts < 50; ts++ {
+			samples = append(samples, sample{t: ts, v: []byte(fmt.Sprintf("%d-%d\n%s", i, ts, function.String()))})
+		}
+		lset := labels.FromStrings("a", strconv.Itoa(i))
+		series = append(series, storage.NewListSeries(lset, samples))
+		expected[lset.String()] = samples
+	}
+	head := createHead(t, nil, series, filepath.Join(dir, "head"))
+	defer func() {
+		require.NoError(t, head.Close())
+	}()
+
+	for _, src := range []struct {
+		name string
+		opts LeveledCompactorOptions
+	}{
+		{name: "dictionary", opts: LeveledCompactorOptions{DictionarySize: 16 * 1024}},
+		{name: "random access with dictionary", opts: LeveledCompactorOptions{DictionarySize: 16 * 1024, RandomAccessChunks: true}},
+	} {
+		for _, tc := range []struct {
+			name string
+			opts LeveledCompactorOptions
+		}{
+			{name: "disabled"},
+			// Dictionaries of less than 8 bytes cannot be trained.
+			{name: "training fails", opts: LeveledCompactorOptions{DictionarySize: 4}},
+			{name: "recompressed", opts: LeveledCompactorOptions{ChunkCompression: &chunkenc.Compression{Codec: chunkenc.CodecNone}}},
+		} {
+			t.Run(src.name+"/"+tc.name, func(t *testing.T) {
+				c, err := NewLeveledCompactorWithOptions(context.Background(), nil, log.NewNopLogger(), []int64{1000}, nil, src.opts)
+				require.NoError(t, err)
+				srcID, err := c.Write(dir, head, head.MinTime(), head.MaxTime()+1, nil)
+				require.NoError(t, err)
+				_, err = os.Stat(filepath.Join(dir, srcID.String(), chunks.DictionariesFilename))
+				require.NoError(t, err)
+
+				c, err = NewLeveledCompactorWithOptions(context.Background(), nil, log.NewNopLogger(), []int64{1000}, nil, tc.opts)
+				require.NoError(t, err)
+				id, err := c.Compact(dir, []string{filepath.Join(dir, srcID.String())}, nil)
+				require.NoError(t, err)
+
+				_, err = os.Stat(filepath.Join(dir, id.String(), chunks.DictionariesFilename))
+				require.True(t, os.IsNotExist(err))
+
+				block, err := OpenBlock(nil, filepath.Join(dir, id.String()), nil)
+				require.NoError(t, err)
+				defer func() {
+					require.NoError(t, block.Close())
+				}()
+				q, err := NewBlockQuerier(block, head.MinTime(), head.MaxTime())
+				require.NoError(t, err)
+				require.Equal(t, expected, query(t, q, labels.MustNewMatcher(labels.MatchRegexp, "a", ".+")))
+			})
+		}
+	}
+}
+
+func TestCompactionDeduplication(t *testing.T) {
+	for name, comp := range map[string]*chunkenc.Compression{
+		// Repeated values are deduplicated by the head already.
+		"dedup": {Dedup: true},
+		// Chunks that repeat values are recoded when they are written.
+		"plain": nil,
+		"none":  {Codec: chunkenc.CodecNone},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "test_compaction_deduplication")
+			require.NoError(t, err)
+			defer func() {
+				require.NoError(t, os.RemoveAll(dir))
+			}()
+
+			head, err := NewHead(nil, nil, nil, &HeadOptions{
+				ChunkRange:       1000,
+				ChunkDirRoot:     filepath.Join(dir, "head"),
+				ChunkCompression: comp,
+			})
+			require.NoError(t, err)
+			defer func() {
+				require.NoError(t, head.Close())
+			}()
+
+			idle := []byte(strings.Repeat("goroutine profile: total 4\n", 100))
+			expected := map[string][]tsdbutil.Sample{}
+			app := head.Appender(context.Background())
+			for i := 0; i < 4; i++ {
+				lset := labels.FromStrings("a", strconv.Itoa(i))
+				for ts := int64(0); ts < 30; ts++ {
+					// The first three series are identical, the last one only repeats every other value.
+					v := idle
+					if i == 3 && ts%2 == 0 {
+						v = []byte(fmt.Sprintf("busy-%d", ts))
+					}
+					_, err := app.Add(lset, ts, v)
+					require.NoError(t, err)
+					expected[lset.String()] = append(expected[lset.String()], sample{t: ts, v: v})
+				}
+			}
+			require.NoError(t, app.Commit())
+
+			reg := prometheus.NewRegistry()
+			c, err := NewLeveledCompactorWithOptions(context.Background(), reg, log.NewNopLogger(), []int64{1000}, nil, LeveledCompactorOptions{DeduplicateChunks: true})
+			require.NoError(t, err)
+			id, err := c.Write(dir, head, head.MinTime(), head.MaxTime()+1, nil)
+			require.NoError(t, err)
+
+			block, err := OpenBlock(nil, filepath.Join(dir, id.String()), nil)
+			require.NoError(t, err)
+			defer func() {
+				require.NoError(t, block.Close())
+			}()
+
+			stats := block.Meta().Stats
+			require.Equal(t, stats.NumChunks/4*2, stats.NumDedupedChunks)
+			// Every idle value but the first of a chunk is a reference.
+			require.Equal(t, uint64(4*30-int(stats.NumChunks)-15), stats.NumDedupedSamples)
+			require.Equal(t, float64(stats.NumDedupedChunks), prom_testutil.ToFloat64(c.metrics.dedupedChunks))
+			require.Equal(t, float64(stats.NumDedupedSamples), prom_testutil.ToFloat64(c.metrics.dedupedSamples))
+
+			indexr, err := block.Index()
+			require.NoError(t, err)
+			chunkr, err := block.Chunks()
+			require.NoError(t, err)
+			refs := func(name string) []uint64 {
+				p, err := indexr.Postings("a", name)
+				require.NoError(t, err)
+				require.True(t, p.Next())
+				var (
+					lset labels.Labels
+					chks []chunks.Meta
+					refs []uint64
+				)
+				require.NoError(t, indexr.Series(p.At(), &lset, &chks))
+				for _, chk := range chks {
+					refs = append(refs, chk.Ref)
+					c, err := chunkr.Chunk(chk.Ref)
+					require.NoError(t, err)
+					require.Equal(t, chunkenc.EncBytesDedup, c.Encoding())
+				}
+				return refs
+			}
+			require.Equal(t, refs("0"), refs("1"))
+			require.Equal(t, refs("0"), refs("2"))
+			require.NotEqual(t, refs("0"), refs("3"))
+			require.NoError(t, chunkr.Close())
+			require.NoError(t, indexr.Close())
+
+			q, err := NewBlockQuerier(block, head.MinTime(), head.MaxTime())
+			require.NoError(t, err)
+			require.Equal(t, expected, query(t, q, labels.MustNewMatcher(labels.MatchRegexp, "a", ".+")))
+		})
+	}
+}
+
+func TestChunkDeduperCollidingInfos(t *testing.T) {
+	chunk := func(v string) []byte {
+		c := chunkenc.NewBytesChunk()
+		app, err := c.Appender()
+		require.NoError(t, err)
+		app.Append(1, []byte(v))
+		b, err := c.Bytes()
+		require.NoError(t, err)
+		return b
+	}
+	a, b := chunk("conprof-a"), chunk("conprof-b")
+	// Forge the hash of the info of b, which is stored last, to be the one of a.
+	copy(b[len(b)-8:], a[len(a)-8:])
+
+	var chks []chunks.Meta
+	for _, data := range [][]byte{a, b} {
+		c, err := chunkenc.FromData(chunkenc.EncBytes, data)
+		require.NoError(t, err)
+		chks = append(chks, chunks.Meta{Chunk: c, MinTime: 1, MaxTime: 1})
+	}
+	_, infoA, _ := chunkenc.AtInfo(nextSample(t, chks[0].Chunk.Iterator(&chunkenc.BytesTimestampOnlyIterator{})))
+	_, infoB, _ := chunkenc.AtInfo(nextSample(t, chks[1].Chunk.Iterator(&chunkenc.BytesTimestampOnlyIterator{})))
+	require.Equal(t, infoA, infoB)
+
+	d := newChunkDeduper(chunkenc.NewPool())
+	n, _, err := d.write(nopChunkWriter{}, chks[:1])
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+	n, _, err = d.write(nopChunkWriter{}, chks[1:])
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+	require.Equal(t, []bool{true}, d.written)
+}
+
+func nextSample(t *testing.T, it chunkenc.Iterator) chunkenc.Iterator {
+	require.True(t, it.Next())
+	return it
+}
+
+func TestCompactionDownsampling(t *testing.T) {
+	_, err := NewLeveledCompactorWithOptions(context.Background(), nil, nil, []int64{1000}, nil, LeveledCompactorOptions{
+		Downsampling: []DownsamplingLevel{{Age: 2000, Resolution: 100}, {Age: 1000, Resolution: 500}},
+	})
+	require.Error(t, err)
+
+	dir, err := ioutil.TempDir("", "test_compaction_downsampling")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	// Four blocks of two series with a sample every 10ms.
+	for b := int64(0); b < 4; b++ {
+		var series []storage.Series
+		for i := 0; i < 2; i++ {
+			var samples []tsdbutil.Sample
+			for ts := b * 1000; ts < (b+1)*1000; ts += 10 {
+				samples = append(samples, sample{t: ts, v: []byte(fmt.Sprintf("%d-%d", i, ts))})
+			}
+			series = append(series, storage.NewListSeries(labels.FromStrings("a", strconv.Itoa(i)), samples))
+		}
+		createBlock(t, dir, series)
+	}
+
+	opts := DefaultOptions()
+	opts.MinBlockDuration = 1000
+	opts.MaxBlockDuration = 1000
+	opts.RetentionDuration = 0
+	opts.Downsampling = []DownsamplingLevel{{Age: 2000, Resolution: 100}, {Age: 3000, Resolution: 500}}
+	db, err := Open(dir, nil, nil, opts)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	db.DisableCompactions()
+	require.NoError(t, db.Compact())
+
+	// The newest block ends at 3991, so the first block is 3000 old and the second 2000.
+	blocks := db.Blocks()
+	require.Equal(t, 4, len(blocks))
+	var resolutions []int64
+	for _, b := range blocks {
+		resolutions = append(resolutions, b.Meta().Resolution)
+	}
+	require.Equal(t, []int64{500, 100, 0, 0}, resolutions)
+	require.Equal(t, uint64(2*2), blocks[0].Meta().Stats.NumSamples)
+	require.Equal(t, uint64(2*10), blocks[1].Meta().Stats.NumSamples)
+	require.Equal(t, float64(2*(100-2)+2*(100-10)), prom_testutil.ToFloat64(db.compactor.(*LeveledCompactor).metrics.downsampled))
+
+	// The first sample of every interval is kept.
+	q, err := db.Querier(context.Background(), 0, 1999)
+	require.NoError(t, err)
+	res := query(t, q, labels.MustNewMatcher(labels.MatchEqual, "a", "0"))
+	var ts []int64
+	for _, s := range res[`{a="0"}`] {
+		ts = append(ts, s.T())
+	}
+	require.Equal(t, []int64{0, 500, 1000, 1100, 1200, 1300, 1400, 1500, 1600, 1700, 1800, 1900}, ts)
+	require.Equal(t, []byte("0-1100"), res[`{a="0"}`][3].V())
+
+	// Downsampled blocks are not planned again.
+	plan, err := db.compactor.Plan(dir)
+	require.NoError(t, err)
+	require.Empty(t, plan)
+}
+
+func TestDownsampleChunks(t *testing.T) {
+	var values [][]byte
+	for i := 0; i < 100; i++ {
+		var b strings.Builder
+		for j := 0; j < 100; j++ {
+			fmt.Fprintf(&b, "github.com/conprof/db/tsdb.(*Head).function%d\n", (i+j)%120)
+		}
+		values = append(values, []byte(b.String()))
+	}
+	dict, err := chunkenc.TrainDictionary(values, 4096)
+	require.NoError(t, err)
+
+	for _, chk := range []chunkenc.Chunk{
+		chunkenc.NewBytesChunk(),
+		chunkenc.NewBytesDictChunk(dict),
+		chunkenc.NewBytesFramedChunk(dict),
+		chunkenc.NewBytesFramedChunk(nil),
+		chunkenc.NewBytesCodecChunk(chunkenc.Compression{Codec: chunkenc.CodecZstd, Level: zstd.SpeedBestCompression}),
+		chunkenc.NewBytesCodecChunk(chunkenc.Compression{Codec: chunkenc.CodecS2}),
+		chunkenc.NewBytesDeltaChunk(chunkenc.Compression{Codec: chunkenc.CodecSnappy}),
+		chunkenc.NewBytesDedupChunk(chunkenc.Compression{Codec: chunkenc.CodecNone}),
+	} {
+		chk := chk
+		t.Run(chk.Encoding().String(), func(t *testing.T) {
+			app, err := chk.Appender()
+			require.NoError(t, err)
+			var expected []tsdbutil.Sample
+			for i := 0; i < 10; i++ {
+				v := values[i%3]
+				app.Append(int64(i*10), v)
+				if i%5 == 0 {
+					expected = append(expected, sample{t: int64(i * 10), v: v})
+				}
+			}
+
+			res, dropped, err := downsampleChunks([]chunks.Meta{{Chunk: chk, MinTime: 0, MaxTime: 90}}, 50)
+			require.NoError(t, err)
+			require.Equal(t, 8, dropped)
+			require.Equal(t, 1, len(res))
+			require.Equal(t, int64(0), res[0].MinTime)
+			require.Equal(t, int64(50), res[0].MaxTime)
+
+			// The downsampled chunk is encoded and compressed like the original.
+			require.Equal(t, chk.Encoding(), res[0].Chunk.Encoding())
+			comp, ok := chunkenc.CompressionOf(chk)
+			downsampledComp, downsampledOk := chunkenc.CompressionOf(res[0].Chunk)
+			require.Equal(t, ok, downsampledOk)
+			require.Equal(t, comp, downsampledComp)
+			require.Equal(t, chunkenc.UsesDictionary(chk), chunkenc.UsesDictionary(res[0].Chunk))
+
+			var got []tsdbutil.Sample
+			it := res[0].Chunk.Iterator(nil)
+			for it.Next() {
+				ts, v := it.At()
+				got = append(got, sample{t: ts, v: v})
+			}
+			require.NoError(t, it.Err())
+			require.Equal(t, expected, got)
+		})
+	}
+}
+
+func TestCompactionProfileStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_compaction_profile_stats")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	// Three jobs whose profiles have 10, 20 and 30 bytes.
+	var (
+		series  []storage.Series
+		samples []tsdbutil.Sample
+	)
+	for i, job := range []string{"a", "b", "c"} {
+		samples = nil
+		for ts := int64(0); ts < 10; ts++ {
+			samples = append(samples, sample{t: ts, v: []byte(strings.Repeat(strconv.Itoa(int(ts)), (i+1)*10))})
+		}
+		series = append(series, storage.NewListSeries(labels.FromStrings("job", job), samples))
+	}
+	head := createHead(t, nil, series, filepath.Join(dir, "chunks"))
+	defer func() {
+		require.NoError(t, head.Close())
+	}()
+
+	c, err := NewLeveledCompactorWithOptions(context.Background(), nil, log.NewNopLogger(), []int64{1000}, nil, LeveledCompactorOptions{
+		ProfileStats:          true,
+		ProfileStatsLabel:     "job",
+		ProfileStatsTopValues: 2,
+	})
+	require.NoError(t, err)
+	id, err := c.Write(dir, head, head.MinTime(), head.MaxTime()+1, nil)
+	require.NoError(t, err)
+
+	meta, _, err := readMetaFile(filepath.Join(dir, id.String()))
+	require.NoError(t, err)
+	stats := meta.Stats
+	require.Equal(t, uint64(10*(10+20+30)), stats.ValueBytes)
+	require.Equal(t, uint64(10), stats.MinValueBytes)
+	require.Equal(t, uint64(20), stats.AvgValueBytes)
+	require.Equal(t, uint64(30), stats.MaxValueBytes)
+	require.Greater(t, stats.ChunkBytes, uint64(0))
+	require.Equal(t, "job", stats.TopLabel)
+	require.Equal(t, 2, len(stats.TopLabelValues))
+	require.Equal(t, LabelValueSize{Value: "c", NumProfiles: 10, ValueBytes: 300, ChunkBytes: stats.TopLabelValues[0].ChunkBytes}, stats.TopLabelValues[0])
+	require.Equal(t, "b", stats.TopLabelValues[1].Value)
+	require.Equal(t, uint64(200), stats.TopLabelValues[1].ValueBytes)
+
+	// Without the option no sizes are recorded.
+	c, err = NewLeveledCompactorWithOptions(context.Background(), nil, log.NewNopLogger(), []int64{1000}, nil, LeveledCompactorOptions{})
+	require.NoError(t, err)
+	id, err = c.Write(dir, head, head.MinTime(), head.MaxTime()+1, nil)
+	require.NoError(t, err)
+	meta, _, err = readMetaFile(filepath.Join(dir, id.String()))
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), meta.Stats.ValueBytes)
+	require.Empty(t, meta.Stats.TopLabelValues)
+
+	// Copies of chunks that are not written only count towards the value bytes.
+	copies := createHead(t, nil, []storage.Series{
+		series[2],
+		storage.NewListSeries(labels.FromStrings("instance", "copy", "job", "c"), samples),
+	}, filepath.Join(dir, "copies"))
+	defer func() {
+		require.NoError(t, copies.Close())
+	}()
+	var copiesStats []BlockStats
+	for _, dedup := range []bool{false, true} {
+		c, err = NewLeveledCompactorWithOptions(context.Background(), nil, log.NewNopLogger(), []int64{1000}, nil, LeveledCompactorOptions{
+			ProfileStats:      true,
+			ProfileStatsLabel: "job",
+			DeduplicateChunks: dedup,
+		})
+		require.NoError(t, err)
+		id, err = c.Write(dir, copies, copies.MinTime(), copies.MaxTime()+1, nil)
+		require.NoError(t, err)
+		meta, _, err = readMetaFile(filepath.Join(dir, id.String()))
+		require.NoError(t, err)
+		copiesStats = append(copiesStats, meta.Stats)
+	}
+	require.Equal(t, uint64(1), copiesStats[1].NumDedupedChunks)
+	require.Equal(t, uint64(2*300), copiesStats[0].ValueBytes)
+	require.Equal(t, copiesStats[0].ValueBytes, copiesStats[1].ValueBytes)
+	require.Equal(t, copiesStats[0].ChunkBytes, 2*copiesStats[1].ChunkBytes)
+	require.Equal(t, copiesStats[1].ChunkBytes, copiesStats[1].TopLabelValues[0].ChunkBytes)
+}
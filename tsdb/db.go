@@ -36,6 +36,7 @@ import (
 	"github.com/conprof/db/tsdb/wal"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
+	"github.com/google/pprof/profile"
 	"github.com/oklog/ulid"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
@@ -79,6 +80,9 @@ func DefaultOptions() *Options {
 		WALCompression:            false,
 		StripeSize:                DefaultStripeSize,
 		HeadChunksWriteBufferSize: chunks.DefaultWriteBufferSize,
+		SamplesPerChunk:           DefaultSamplesPerChunk,
+		ChunkBytes:                DefaultChunkBytes,
+		BlockProfileStatsLabel:    labels.MetricName,
 	}
 }
 
@@ -129,10 +133,112 @@ type Options struct {
 	// HeadChunksWriteBufferSize configures the write buffer size used by the head chunks mapper.
 	HeadChunksWriteBufferSize int
 
+	// SamplesPerChunk is the maximum number of samples of a head chunk.
+	// Chunks are also cut evenly across the chunk range with about as many samples.
+	// 0 uses DefaultSamplesPerChunk, a negative value disables the limit.
+	SamplesPerChunk int
+
+	// ChunkBytes is the maximum size in bytes of the uncompressed values in a head chunk.
+	// A chunk is cut as soon as either this or the SamplesPerChunk limit is hit.
+	// 0 uses DefaultChunkBytes, a negative value disables the limit.
+	ChunkBytes int
+
+	// ChunkCompression configures how the values of head chunks are compressed
+	// and records it in the chunks. nil writes EncBytes chunks, compressed with
+	// zstd at its fastest level, that versions and remote read clients without
+	// support for the other codecs can read. Setting Delta stores consecutive
+	// profiles of a series as deltas against each other, see chunkenc.EncBytesDelta.
+	ChunkCompression *chunkenc.Compression
+
+	// PprofChunks stores pprof profiles in their parsed form in head chunks.
+	// Their strings, mappings, functions and locations are shared by all
+	// profiles of a chunk. Compaction keeps such chunks as they are.
+	// It cannot be combined with ChunkCompression.
+	PprofChunks bool
+
+	// OutOfOrderTimeWindow is how far behind the newest sample of the head late
+	// profiles, e.g. from agents with clock skew or batch uploads, are still accepted.
+	// They are buffered per series and merged into the series when the head is compacted.
+	// It must not exceed half the MinBlockDuration. 0 rejects all late samples
+	// with storage.ErrOutOfOrderSample. Late numeric samples are always rejected.
+	OutOfOrderTimeWindow int64
+
+	// MaxHeadSeries limits the number of series in the head. Appending a sample
+	// that would create a new series beyond it fails with storage.ErrTooManySeries.
+	// 0 disables the limit.
+	MaxHeadSeries int
+
+	// MaxNewSeriesPerCommit limits the number of series a single appender may
+	// create, e.g. to stop a target that labels every profile uniquely.
+	// Beyond it appends fail with storage.ErrTooManyNewSeries. 0 disables the limit.
+	MaxNewSeriesPerCommit int
+
+	// MaxSampleBytes is the maximum size of an appended profile. Larger profiles
+	// are rejected with storage.ErrSampleTooLarge. 0 disables the limit.
+	MaxSampleBytes int
+
+	// MaxIngestionBytesPerSecond limits the rate of appended profile bytes, with
+	// bursts of up to one second. Appends beyond it fail with
+	// storage.ErrIngestionRateLimited. 0 disables the limit.
+	// All limits apply per DB, and so per tenant of a MultiTenantDB.
+	MaxIngestionBytesPerSecond int64
+
+	// CompactionChunkCompression recompresses the values of chunks when blocks are compacted,
+	// e.g. to a higher zstd level for longer ranges that are rarely written but kept for long.
+	// Chunks already compressed this way are not touched. nil keeps the compression of the head.
+	// It has no effect if ChunkDictionarySize or RandomAccessChunks is set.
+	CompactionChunkCompression *chunkenc.Compression
+
+	// ChunkDictionarySize is the maximum size in bytes of the zstd dictionary trained
+	// for every compacted block. Chunks of such blocks compress their values with the
+	// shared dictionary. 0 disables dictionary compression.
+	ChunkDictionarySize int
+
+	// RandomAccessChunks compresses the values of compacted chunks one by one.
+	// This makes reading single profiles out of long ranges cheaper at the cost
+	// of a worse compression ratio.
+	RandomAccessChunks bool
+
+	// DeduplicateChunks writes chunks of different series with identical samples
+	// only once when blocks are compacted. Chunks that repeat values are recoded
+	// to the EncBytesDedup encoding, see chunkenc.Compression.
+	DeduplicateChunks bool
+
+	// VerifyChunkChecksums checks the CRC32 of the chunks of blocks when they
+	// are read, so that queries report corrupted chunks with a
+	// chunks.ChunkCorruptionErr instead of returning garbage profiles.
+	// Chunks of the head are always verified.
+	VerifyChunkChecksums bool
+
+	// Downsampling thins out the profiles of blocks as they age, e.g. to keep all
+	// profiles for 2 days, then one per series per 5 minutes and after 30 days one
+	// per hour. The retention still deletes whole blocks. Levels must be sorted by
+	// age and every level must have a lower resolution, see DownsamplingLevel.
+	Downsampling []DownsamplingLevel
+
+	// BlockProfileStats records the total, minimum, average and maximum size of
+	// the profiles of every written block in its meta.json, for capacity planning.
+	// Chunks without sample infos are read in full to get the sizes of their
+	// profiles, which slows down compactions, so it is disabled by default.
+	BlockProfileStats bool
+	// BlockProfileStatsLabel additionally records the sizes of the values of this
+	// label with the most bytes, e.g. job or __name__.
+	BlockProfileStatsLabel string
+	// BlockProfileStatsTopValues is the number of label values recorded.
+	// 0 records DefaultProfileStatsTopValues.
+	BlockProfileStatsTopValues int
+
 	// SeriesLifecycleCallback specifies a list of callbacks that will be called during a lifecycle of a series.
 	// It is always a no-op in Prometheus and mainly meant for external users who import TSDB.
 	SeriesLifecycleCallback SeriesLifecycleCallback
 
+	// RetentionRules delete the samples of the series matching a rule when they
+	// are older than the duration of the rule, e.g. to keep goroutine profiles
+	// for a shorter time than all others. They are applied to blocks after
+	// compactions, in order, by rewriting the blocks with matching samples.
+	// Durations are measured like the RetentionDuration.
+	RetentionRules []RetentionRule
+
 	// BlocksToDelete is a function which returns the blocks which can be deleted.
 	// It is always the default time and size based retention in Prometheus and
 	// mainly meant for external users who import TSDB.
@@ -190,6 +296,7 @@ type dbMetrics struct {
 	tombCleanTimer       prometheus.Histogram
 	blocksBytes          prometheus.Gauge
 	maxBytes             prometheus.Gauge
+	ruleReclaimedBytes   *prometheus.CounterVec
 }
 
 func newDBMetrics(db *DB, r prometheus.Registerer) *dbMetrics {
@@ -267,6 +374,10 @@ func newDBMetrics(db *DB, r prometheus.Registerer) *dbMetrics {
 		Name: "prometheus_tsdb_size_retentions_total",
 		Help: "The number of times that blocks were deleted because the maximum number of bytes was exceeded.",
 	})
+	m.ruleReclaimedBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "prometheus_tsdb_retention_rule_reclaimed_bytes_total",
+		Help: "The number of block bytes reclaimed by deleting samples that fell out of a retention rule.",
+	}, []string{"rule"})
 
 	if r != nil {
 		r.MustRegister(
@@ -283,6 +394,7 @@ func newDBMetrics(db *DB, r prometheus.Registerer) *dbMetrics {
 			m.tombCleanTimer,
 			m.blocksBytes,
 			m.maxBytes,
+			m.ruleReclaimedBytes,
 		)
 	}
 	return m
@@ -335,7 +447,7 @@ func (db *DBReadOnly) FlushWAL(dir string) (returnErr error) {
 	if err != nil {
 		return err
 	}
-	head, err := NewHead(nil, db.logger, w, DefaultBlockDuration, db.dir, nil, chunks.DefaultWriteBufferSize, DefaultStripeSize, nil)
+	head, err := NewHead(nil, db.logger, w, &HeadOptions{ChunkRange: DefaultBlockDuration, ChunkDirRoot: db.dir})
 	if err != nil {
 		return err
 	}
@@ -388,7 +500,7 @@ func (db *DBReadOnly) loadDataAsQueryable(maxt int64) (storage.SampleAndChunkQue
 		blocks[i] = b
 	}
 
-	head, err := NewHead(nil, db.logger, nil, DefaultBlockDuration, db.dir, nil, chunks.DefaultWriteBufferSize, DefaultStripeSize, nil)
+	head, err := NewHead(nil, db.logger, nil, &HeadOptions{ChunkRange: DefaultBlockDuration, ChunkDirRoot: db.dir})
 	if err != nil {
 		return nil, err
 	}
@@ -406,7 +518,7 @@ func (db *DBReadOnly) loadDataAsQueryable(maxt int64) (storage.SampleAndChunkQue
 		if err != nil {
 			return nil, err
 		}
-		head, err = NewHead(nil, db.logger, w, DefaultBlockDuration, db.dir, nil, chunks.DefaultWriteBufferSize, DefaultStripeSize, nil)
+		head, err = NewHead(nil, db.logger, w, &HeadOptions{ChunkRange: DefaultBlockDuration, ChunkDirRoot: db.dir})
 		if err != nil {
 			return nil, err
 		}
@@ -449,6 +561,12 @@ func (db *DBReadOnly) ChunkQuerier(ctx context.Context, mint, maxt int64) (stora
 	return q.ChunkQuerier(ctx, mint, maxt)
 }
 
+// DiffProfiles returns the difference of the merged profiles of the comparison and
+// the base selection, see storage.DiffProfiles.
+func (db *DBReadOnly) DiffProfiles(ctx context.Context, base, comparison storage.ProfileSelection) (*profile.Profile, storage.Warnings, error) {
+	return storage.DiffProfiles(ctx, db, base, comparison)
+}
+
 // Blocks returns a slice of block readers for persisted blocks.
 func (db *DBReadOnly) Blocks() ([]BlockReader, error) {
 	select {
@@ -456,7 +574,7 @@ func (db *DBReadOnly) Blocks() ([]BlockReader, error) {
 		return nil, ErrClosed
 	default:
 	}
-	loadable, corrupted, err := openBlocks(db.logger, db.dir, nil, nil)
+	loadable, corrupted, err := openBlocks(db.logger, db.dir, nil, nil, BlockOptions{})
 	if err != nil {
 		return nil, err
 	}
@@ -557,6 +675,9 @@ func validateOpts(opts *Options, rngs []int64) (*Options, []int64) {
 }
 
 func open(dir string, l log.Logger, r prometheus.Registerer, opts *Options, rngs []int64) (_ *DB, returnedErr error) {
+	if err := validateRetentionRules(opts.RetentionRules); err != nil {
+		return nil, err
+	}
 	if err := os.MkdirAll(dir, 0777); err != nil {
 		return nil, err
 	}
@@ -630,7 +751,17 @@ func open(dir string, l log.Logger, r prometheus.Registerer, opts *Options, rngs
 
 	var err error
 	ctx, cancel := context.WithCancel(context.Background())
-	db.compactor, err = NewLeveledCompactor(ctx, r, l, rngs, db.chunkPool)
+	db.compactor, err = NewLeveledCompactorWithOptions(ctx, r, l, rngs, db.chunkPool, LeveledCompactorOptions{
+		DictionarySize:     opts.ChunkDictionarySize,
+		RandomAccessChunks: opts.RandomAccessChunks,
+		ChunkCompression:   opts.CompactionChunkCompression,
+		DeduplicateChunks:  opts.DeduplicateChunks,
+		Downsampling:       opts.Downsampling,
+
+		ProfileStats:          opts.BlockProfileStats,
+		ProfileStatsLabel:     opts.BlockProfileStatsLabel,
+		ProfileStatsTopValues: opts.BlockProfileStatsTopValues,
+	})
 	if err != nil {
 		cancel()
 		return nil, errors.Wrap(err, "create leveled compactor")
@@ -651,7 +782,24 @@ func open(dir string, l log.Logger, r prometheus.Registerer, opts *Options, rngs
 		}
 	}
 
-	db.head, err = NewHead(r, l, wlog, rngs[0], dir, db.chunkPool, opts.HeadChunksWriteBufferSize, opts.StripeSize, opts.SeriesLifecycleCallback)
+	db.head, err = NewHead(r, l, wlog, &HeadOptions{
+		ChunkRange:           rngs[0],
+		ChunkDirRoot:         dir,
+		ChunkPool:            db.chunkPool,
+		ChunkWriteBufferSize: opts.HeadChunksWriteBufferSize,
+		StripeSize:           opts.StripeSize,
+		SeriesCallback:       opts.SeriesLifecycleCallback,
+		SamplesPerChunk:      opts.SamplesPerChunk,
+		ChunkBytes:           opts.ChunkBytes,
+		ChunkCompression:     opts.ChunkCompression,
+		PprofChunks:          opts.PprofChunks,
+		OutOfOrderTimeWindow: opts.OutOfOrderTimeWindow,
+
+		MaxSeries:                  opts.MaxHeadSeries,
+		MaxNewSeriesPerCommit:      opts.MaxNewSeriesPerCommit,
+		MaxSampleBytes:             opts.MaxSampleBytes,
+		MaxIngestionBytesPerSecond: opts.MaxIngestionBytesPerSecond,
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -790,7 +938,15 @@ func (a dbAppender) Commit() error {
 // which will also delete the blocks that fall out of the retention window.
 // Old blocks are only deleted on reloadBlocks based on the new block's parent information.
 // See DB.reloadBlocks documentation for further information.
-func (db *DB) Compact() (returnErr error) {
+// Afterwards the retention rules are applied to the blocks.
+func (db *DB) Compact() error {
+	if err := db.compact(); err != nil {
+		return err
+	}
+	return errors.Wrap(db.applyRetentionRules(), "apply retention rules")
+}
+
+func (db *DB) compact() (returnErr error) {
 	db.cmtx.Lock()
 	defer db.cmtx.Unlock()
 	defer func() {
@@ -956,7 +1112,7 @@ func (db *DB) reloadBlocks() (err error) {
 		db.metrics.reloads.Inc()
 	}()
 
-	loadable, corrupted, err := openBlocks(db.logger, db.dir, db.blocks, db.chunkPool)
+	loadable, corrupted, err := openBlocks(db.logger, db.dir, db.blocks, db.chunkPool, BlockOptions{VerifyChunkChecksums: db.opts.VerifyChunkChecksums})
 	if err != nil {
 		return err
 	}
@@ -1046,7 +1202,7 @@ func (db *DB) reloadBlocks() (err error) {
 	return nil
 }
 
-func openBlocks(l log.Logger, dir string, loaded []*Block, chunkPool chunkenc.Pool) (blocks []*Block, corrupted map[ulid.ULID]error, err error) {
+func openBlocks(l log.Logger, dir string, loaded []*Block, chunkPool chunkenc.Pool, opts BlockOptions) (blocks []*Block, corrupted map[ulid.ULID]error, err error) {
 	bDirs, err := blockDirs(dir)
 	if err != nil {
 		return nil, nil, errors.Wrap(err, "find blocks")
@@ -1063,7 +1219,7 @@ func openBlocks(l log.Logger, dir string, loaded []*Block, chunkPool chunkenc.Po
 		// See if we already have the block in memory or open it otherwise.
 		block, open := getBlock(loaded, meta.ULID)
 		if !open {
-			block, err = OpenBlock(l, bDir, chunkPool)
+			block, err = OpenBlockWithOptions(l, bDir, chunkPool, opts)
 			if err != nil {
 				corrupted[meta.ULID] = err
 				continue
@@ -1426,6 +1582,9 @@ func (db *DB) Querier(_ context.Context, mint, maxt int64) (storage.Querier, err
 	}
 	if maxt >= db.head.MinTime() {
 		blocks = append(blocks, NewRangeHead(db.head, mint, maxt))
+		if db.head.hasOutOfOrder(mint) {
+			blocks = append(blocks, newOutOfOrderRangeHead(db.head, mint, maxt))
+		}
 	}
 
 	blockQueriers := make([]storage.Querier, 0, len(blocks))
@@ -1459,6 +1618,9 @@ func (db *DB) ChunkQuerier(_ context.Context, mint, maxt int64) (storage.ChunkQu
 	}
 	if maxt >= db.head.MinTime() {
 		blocks = append(blocks, NewRangeHead(db.head, mint, maxt))
+		if db.head.hasOutOfOrder(mint) {
+			blocks = append(blocks, newOutOfOrderRangeHead(db.head, mint, maxt))
+		}
 	}
 
 	blockQueriers := make([]storage.ChunkQuerier, 0, len(blocks))
@@ -1479,6 +1641,12 @@ func (db *DB) ChunkQuerier(_ context.Context, mint, maxt int64) (storage.ChunkQu
 	return storage.NewMergeChunkQuerier(blockQueriers, nil, storage.NewCompactingChunkSeriesMerger(storage.ChainedSeriesMerge)), nil
 }
 
+// DiffProfiles returns the difference of the merged profiles of the comparison and
+// the base selection, see storage.DiffProfiles.
+func (db *DB) DiffProfiles(ctx context.Context, base, comparison storage.ProfileSelection) (*profile.Profile, storage.Warnings, error) {
+	return storage.DiffProfiles(ctx, db, base, comparison)
+}
+
 func rangeForTimestamp(t int64, width int64) (maxt int64) {
 	return (t/width)*width + width
 }
@@ -1514,7 +1682,18 @@ func (db *DB) CleanTombstones() (err error) {
 	start := time.Now()
 	defer db.metrics.tombCleanTimer.Observe(time.Since(start).Seconds())
 
-	newUIDs := []ulid.ULID{}
+	db.mtx.RLock()
+	blocks := db.blocks[:]
+	db.mtx.RUnlock()
+
+	_, err = db.cleanTombstones(blocks)
+	return err
+}
+
+// cleanTombstones rewrites the given blocks without their tombstones and
+// reloads the blocks. It returns the ULIDs of the new blocks.
+// The caller must hold db.cmtx.
+func (db *DB) cleanTombstones(blocks []*Block) (newUIDs []ulid.ULID, err error) {
 	defer func() {
 		// If any error is caused, we need to delete all the new directory created.
 		if err != nil {
@@ -1527,23 +1706,19 @@ func (db *DB) CleanTombstones() (err error) {
 		}
 	}()
 
-	db.mtx.RLock()
-	blocks := db.blocks[:]
-	db.mtx.RUnlock()
-
 	for _, b := range blocks {
 		if uid, er := b.CleanTombstones(db.Dir(), db.compactor); er != nil {
 			err = errors.Wrapf(er, "clean tombstones: %s", b.Dir())
-			return err
+			return newUIDs, err
 		} else if uid != nil { // New block was created.
 			newUIDs = append(newUIDs, *uid)
 		}
 	}
 
 	if err := db.reloadBlocks(); err != nil {
-		return errors.Wrap(err, "reload blocks")
+		return newUIDs, errors.Wrap(err, "reload blocks")
 	}
-	return nil
+	return newUIDs, nil
 }
 
 func isBlockDir(fi os.FileInfo) bool {
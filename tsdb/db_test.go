@@ -35,6 +35,7 @@ import (
 	"time"
 
 	"github.com/conprof/db/storage"
+	"github.com/conprof/db/tsdb/chunkenc"
 	"github.com/conprof/db/tsdb/chunks"
 	"github.com/conprof/db/tsdb/fileutil"
 	"github.com/conprof/db/tsdb/index"
@@ -43,6 +44,7 @@ import (
 	"github.com/conprof/db/tsdb/tsdbutil"
 	"github.com/conprof/db/tsdb/wal"
 	"github.com/go-kit/kit/log"
+	"github.com/google/pprof/profile"
 	"github.com/oklog/ulid"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
@@ -1294,6 +1296,72 @@ func TestTimeRetention(t *testing.T) {
 //	require.Equal(t, expBlocks[len(expBlocks)-1].MaxTime, actBlocks[len(actBlocks)-1].meta.MaxTime, "maxT mismatch of the last block")
 //}
 
+func TestRetentionRules(t *testing.T) {
+	opts := DefaultOptions()
+	opts.RetentionRules = []RetentionRule{{Duration: 1000}}
+	_, err := Open("", nil, nil, opts)
+	require.Error(t, err)
+
+	goroutine := labels.MustNewMatcher(labels.MatchEqual, "__name__", "goroutine")
+	opts.RetentionRules = []RetentionRule{{Matchers: []*labels.Matcher{goroutine}, Duration: 1500}}
+	db := openTestDB(t, opts, []int64{1000})
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	db.DisableCompactions()
+
+	// The oldest block only holds goroutine profiles.
+	for b := int64(0); b < 3; b++ {
+		var series []storage.Series
+		for _, name := range []string{"goroutine", "cpu"} {
+			if b == 0 && name == "cpu" {
+				continue
+			}
+			var samples []tsdbutil.Sample
+			for ts := b * 1000; ts < (b+1)*1000; ts += 10 {
+				samples = append(samples, sample{t: ts, v: []byte(fmt.Sprintf("%s-%d", name, ts))})
+			}
+			series = append(series, storage.NewListSeries(labels.FromStrings("__name__", name), samples))
+		}
+		createBlock(t, db.Dir(), series)
+	}
+	require.NoError(t, db.reloadBlocks())
+	require.Equal(t, 3, len(db.Blocks()))
+
+	// Deleted samples the rule extends are rewritten as well.
+	require.NoError(t, db.Delete(1000, 1100, goroutine))
+	require.Equal(t, uint64(1), db.Blocks()[1].Meta().Stats.NumTombstones)
+
+	// The newest block ends at 2991, so goroutine profiles before 1491 are deleted.
+	require.NoError(t, db.Compact())
+	blocks := db.Blocks()
+	require.Equal(t, 2, len(blocks))
+	for _, b := range blocks {
+		require.Equal(t, uint64(0), b.Meta().Stats.NumTombstones)
+	}
+	require.Greater(t, prom_testutil.ToFloat64(db.metrics.ruleReclaimedBytes.WithLabelValues(`{__name__="goroutine"}`)), 0.0)
+
+	q, err := db.Querier(context.Background(), 0, 3000)
+	require.NoError(t, err)
+	res := query(t, q, labels.MustNewMatcher(labels.MatchRegexp, "__name__", ".+"))
+	require.Equal(t, 150, len(res[`{__name__="goroutine"}`]))
+	require.Equal(t, int64(1500), res[`{__name__="goroutine"}`][0].T())
+	require.Equal(t, 200, len(res[`{__name__="cpu"}`]))
+	require.Equal(t, int64(1000), res[`{__name__="cpu"}`][0].T())
+
+	// Blocks are not rewritten again if nothing is deleted.
+	require.NoError(t, db.Compact())
+	require.Equal(t, blocks, db.Blocks())
+
+	// Nor if they have tombstones the rule did not add.
+	reclaimed := prom_testutil.ToFloat64(db.metrics.ruleReclaimedBytes.WithLabelValues(`{__name__="goroutine"}`))
+	require.NoError(t, db.Delete(2000, 2100, labels.MustNewMatcher(labels.MatchEqual, "__name__", "cpu")))
+	require.NoError(t, db.applyRetentionRules())
+	require.Equal(t, blocks, db.Blocks())
+	require.Equal(t, uint64(1), blocks[1].Meta().Stats.NumTombstones)
+	require.Equal(t, reclaimed, prom_testutil.ToFloat64(db.metrics.ruleReclaimedBytes.WithLabelValues(`{__name__="goroutine"}`)))
+}
+
 func TestSizeRetentionMetric(t *testing.T) {
 	cases := []struct {
 		maxBytes    int64
@@ -1502,6 +1570,133 @@ func TestOverlappingBlocksDetectsAllOverlaps(t *testing.T) {
 	}, OverlappingBlocks(nc1))
 }
 
+func TestDB_FloatSeriesCompaction(t *testing.T) {
+	opts := DefaultOptions()
+	opts.ChunkDictionarySize = 1024
+	opts.CompactionChunkCompression = &chunkenc.Compression{Codec: chunkenc.CodecZstd}
+	db := openTestDB(t, opts, []int64{1000})
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	cpu := labels.FromStrings("__name__", "cpu_nanoseconds")
+	heap := labels.FromStrings("__name__", "heap")
+	app := db.Appender(context.Background())
+	for i := int64(0); i < 30; i++ {
+		_, err := app.AddFloat(cpu, i*100, float64(i)/3)
+		require.NoError(t, err)
+		_, err = app.Add(heap, i*100, []byte(fmt.Sprintf("heap profile %d", i)))
+		require.NoError(t, err)
+	}
+	require.NoError(t, app.Commit())
+	require.NoError(t, db.Compact())
+	require.NotEmpty(t, db.Blocks())
+
+	q, err := db.Querier(context.Background(), 0, 999)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, q.Close())
+	}()
+	ss := q.Select(false, nil, labels.MustNewMatcher(labels.MatchEqual, "__name__", "cpu_nanoseconds"))
+	require.True(t, ss.Next())
+	it := chunkenc.NewFloatIterator(ss.At().Iterator())
+	for i := int64(0); i < 10; i++ {
+		require.True(t, it.Next())
+		ts, v := it.AtFloat()
+		require.Equal(t, i*100, ts)
+		require.Equal(t, float64(i)/3, v)
+	}
+	require.False(t, it.Next())
+	require.NoError(t, it.Err())
+	require.False(t, ss.Next())
+	require.NoError(t, ss.Err())
+
+	cq, err := db.ChunkQuerier(context.Background(), 0, 999)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, cq.Close())
+	}()
+	css := cq.Select(false, nil, labels.MustNewMatcher(labels.MatchEqual, "__name__", "cpu_nanoseconds"))
+	require.True(t, css.Next())
+	chks := css.At().Iterator()
+	for chks.Next() {
+		require.Equal(t, chunkenc.EncXOR, chks.At().Chunk.Encoding())
+	}
+	require.NoError(t, chks.Err())
+}
+
+func TestDB_OutOfOrderSamples(t *testing.T) {
+	opts := DefaultOptions()
+	opts.OutOfOrderTimeWindow = 400
+	db := openTestDB(t, opts, []int64{1000})
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	heap := labels.FromStrings("__name__", "heap")
+	app := db.Appender(context.Background())
+	for ts := int64(0); ts <= 1000; ts += 200 {
+		_, err := app.Add(heap, ts, []byte(fmt.Sprintf("heap %d", ts)))
+		require.NoError(t, err)
+	}
+	require.NoError(t, app.Commit())
+	app = db.Appender(context.Background())
+	for _, ts := range []int64{900, 700} {
+		_, err := app.Add(heap, ts, []byte(fmt.Sprintf("heap %d", ts)))
+		require.NoError(t, err)
+	}
+	require.NoError(t, app.Commit())
+
+	expected := func(maxt int64) []tsdbutil.Sample {
+		var smpls []tsdbutil.Sample
+		for _, ts := range []int64{0, 200, 400, 600, 700, 800, 900, 1000} {
+			if ts <= maxt {
+				smpls = append(smpls, sample{t: ts, v: []byte(fmt.Sprintf("heap %d", ts))})
+			}
+		}
+		return smpls
+	}
+	matcher := labels.MustNewMatcher(labels.MatchEqual, "__name__", "heap")
+
+	// Late samples are merged into their series by queries.
+	q, err := db.Querier(context.Background(), 0, 1000)
+	require.NoError(t, err)
+	require.Equal(t, map[string][]tsdbutil.Sample{heap.String(): expected(1000)}, query(t, q, matcher))
+
+	cq, err := db.ChunkQuerier(context.Background(), 0, 1000)
+	require.NoError(t, err)
+	css := cq.Select(false, nil, matcher)
+	require.True(t, css.Next())
+	var got []tsdbutil.Sample
+	it := css.At().Iterator()
+	for it.Next() {
+		chkIt := it.At().Chunk.Iterator(nil)
+		for chkIt.Next() {
+			ts, v := chkIt.At()
+			got = append(got, sample{t: ts, v: v})
+		}
+		require.NoError(t, chkIt.Err())
+	}
+	require.NoError(t, it.Err())
+	require.False(t, css.Next())
+	require.Equal(t, expected(1000), got)
+	require.NoError(t, cq.Close())
+
+	// And into the series of the block when the head is compacted.
+	app = db.Appender(context.Background())
+	_, err = app.Add(heap, 2400, []byte("heap 2400"))
+	require.NoError(t, err)
+	require.NoError(t, app.Commit())
+	require.NoError(t, db.Compact())
+	require.Len(t, db.Blocks(), 1)
+	require.Equal(t, uint64(7), db.Blocks()[0].Meta().Stats.NumSamples)
+	require.False(t, db.head.hasOutOfOrder(0))
+
+	q, err = db.Querier(context.Background(), 0, 999)
+	require.NoError(t, err)
+	require.Equal(t, map[string][]tsdbutil.Sample{heap.String(): expected(999)}, query(t, q, matcher))
+}
+
 // Regression test for https://github.com/prometheus/tsdb/issues/347
 func TestChunkAtBlockBoundary(t *testing.T) {
 	db := openTestDB(t, nil, nil)
@@ -3106,3 +3301,70 @@ func TestReadingNewlyAppendedDataToPreviousDB(t *testing.T) {
 		testutil.Equals(t, true, sampleEqual(expectedSample, seriesSamples[i]), "Unexpected sample")
 	}
 }
+
+func TestDB_DiffProfiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_diff_profiles")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	value := func(fn string, v int64) []byte {
+		f := &profile.Function{ID: 1, Name: fn}
+		loc := &profile.Location{ID: 1, Line: []profile.Line{{Function: f}}}
+		p := &profile.Profile{
+			SampleType: []*profile.ValueType{{Type: "alloc_space", Unit: "bytes"}},
+			Sample:     []*profile.Sample{{Location: []*profile.Location{loc}, Value: []int64{v}}},
+			Location:   []*profile.Location{loc},
+			Function:   []*profile.Function{f},
+		}
+		var buf bytes.Buffer
+		require.NoError(t, p.Write(&buf))
+		return buf.Bytes()
+	}
+	diff := func(p *profile.Profile) map[string]int64 {
+		res := map[string]int64{}
+		for _, s := range p.Sample {
+			res[s.Location[0].Line[0].Function.Name] += s.Value[0]
+		}
+		return res
+	}
+
+	// The base profiles are in a block, the comparison profiles in the head.
+	var base []tsdbutil.Sample
+	for ts := int64(0); ts < 10; ts++ {
+		base = append(base, sample{t: ts, v: value("encode", 10)})
+	}
+	createBlock(t, dir, []storage.Series{storage.NewListSeries(labels.FromStrings("__name__", "heap", "job", "a"), base)})
+
+	db, err := Open(dir, nil, nil, nil)
+	require.NoError(t, err)
+	app := db.Appender(context.Background())
+	for ts := int64(100); ts < 110; ts++ {
+		_, err := app.Add(labels.FromStrings("__name__", "heap", "job", "a"), ts, value("encode", 5))
+		require.NoError(t, err)
+		_, err = app.Add(labels.FromStrings("__name__", "heap", "job", "b"), ts, value("decode", 1))
+		require.NoError(t, err)
+	}
+	require.NoError(t, app.Commit())
+
+	ms := []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "job", "a")}
+	baseSel := storage.ProfileSelection{Start: 0, End: 9, Matchers: ms}
+	cmpSel := storage.ProfileSelection{Start: 100, End: 109, Matchers: ms}
+	expected := map[string]int64{"encode": 10*5 - 10*10}
+
+	p, ws, err := db.DiffProfiles(context.Background(), baseSel, cmpSel)
+	require.NoError(t, err)
+	require.Empty(t, ws)
+	require.Equal(t, expected, diff(p))
+	require.NoError(t, db.Close())
+
+	dbReadOnly, err := OpenDBReadOnly(dir, nil)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, dbReadOnly.Close())
+	}()
+	p, _, err = dbReadOnly.DiffProfiles(context.Background(), baseSel, cmpSel)
+	require.NoError(t, err)
+	require.Equal(t, expected, diff(p))
+}
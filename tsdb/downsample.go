@@ -0,0 +1,145 @@
+// Copyright 2021 The Conprof Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"math"
+
+	"github.com/conprof/db/tsdb/chunkenc"
+	"github.com/conprof/db/tsdb/chunks"
+	"github.com/pkg/errors"
+)
+
+// DownsamplingLevel thins out the samples of blocks once they reach an age.
+// Of every series only the first sample of each aligned Resolution wide
+// interval is kept, e.g. one profile per 5 minutes.
+type DownsamplingLevel struct {
+	// Age after which blocks are downsampled. Like the retention, it is measured
+	// from the newest block to the end of the block, in the unit of the timestamps.
+	Age int64
+	// Resolution is the width of the intervals to keep one sample of.
+	Resolution int64
+}
+
+// validateDownsampling checks that levels are sorted by age and lower their resolution.
+func validateDownsampling(levels []DownsamplingLevel) error {
+	for i, l := range levels {
+		if l.Age <= 0 || l.Resolution <= 0 {
+			return errors.Errorf("invalid downsampling level %d: age and resolution must be positive", i)
+		}
+		if i > 0 && (l.Age <= levels[i-1].Age || l.Resolution <= levels[i-1].Resolution) {
+			return errors.Errorf("invalid downsampling level %d: levels must be sorted by age and resolution", i)
+		}
+	}
+	return nil
+}
+
+// resolution returns the resolution blocks of the given age are downsampled to.
+// It is 0 if the samples of such blocks are all kept.
+func (c *LeveledCompactor) resolution(age int64) int64 {
+	var res int64
+	for _, l := range c.opts.Downsampling {
+		if age < l.Age {
+			break
+		}
+		res = l.Resolution
+	}
+	return res
+}
+
+// selectDownsampleDir returns the oldest block that has to be downsampled
+// to a lower resolution, if any. dms must be sorted by MinTime.
+func (c *LeveledCompactor) selectDownsampleDir(dms []dirMeta, newest int64) []string {
+	for _, dm := range dms {
+		if dm.meta.Compaction.Failed {
+			continue
+		}
+		if c.resolution(newest-dm.meta.MaxTime) > dm.meta.Resolution {
+			return []string{dm.dir}
+		}
+	}
+	return nil
+}
+
+// newestMaxTime returns the highest MaxTime of the blocks in dir.
+func newestMaxTime(dir string) (int64, error) {
+	dirs, err := blockDirs(dir)
+	if err != nil {
+		return 0, err
+	}
+	newest := int64(math.MinInt64)
+	for _, d := range dirs {
+		meta, _, err := readMetaFile(d)
+		if err != nil {
+			return 0, err
+		}
+		if meta.MaxTime > newest {
+			newest = meta.MaxTime
+		}
+	}
+	return newest, nil
+}
+
+// downsampleChunks keeps the first sample of every resolution wide interval of
+// the series of the chunks, which must be sorted and must not overlap.
+// Chunks keep their encoding, compression and dictionary, see chunkenc.NewChunkLike,
+// and are dropped if none of their samples are kept.
+// It returns the downsampled chunks and the number of dropped samples.
+func downsampleChunks(chks []chunks.Meta, resolution int64) ([]chunks.Meta, int, error) {
+	var (
+		res     = chks[:0]
+		dropped int
+		last    = int64(math.MinInt64) // Start of the interval of the last kept sample.
+	)
+	for _, chk := range chks {
+		var (
+			newChunk chunkenc.Chunk
+			app      chunkenc.Appender
+			err      error
+			mint     int64
+			maxt     int64
+		)
+		it := chk.Chunk.Iterator(nil)
+		for it.Next() {
+			t, v := it.At()
+			interval := t - t%resolution
+			if t < 0 && t%resolution != 0 {
+				interval -= resolution
+			}
+			if interval == last {
+				dropped++
+				continue
+			}
+			last = interval
+
+			if newChunk == nil {
+				newChunk = chunkenc.NewChunkLike(chk.Chunk)
+				if app, err = newChunk.Appender(); err != nil {
+					return nil, 0, err
+				}
+				mint = t
+			}
+			app.Append(t, v)
+			maxt = t
+		}
+		if it.Err() != nil {
+			return nil, 0, it.Err()
+		}
+		if newChunk == nil {
+			continue
+		}
+		res = append(res, chunks.Meta{Chunk: newChunk, MinTime: mint, MaxTime: maxt})
+	}
+	return res, dropped, nil
+}
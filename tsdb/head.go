@@ -59,6 +59,8 @@ type Head struct {
 	minValidTime          atomic.Int64 // Mint allowed to be added to the head. It shouldn't be lower than the maxt of the last persisted block.
 	lastWALTruncationTime atomic.Int64
 	lastSeriesID          atomic.Uint64
+	// oooMaxTime is the highest timestamp of late samples that may still be in the head.
+	oooMaxTime atomic.Int64
 
 	metrics      *headMetrics
 	wal          *wal.WAL
@@ -92,6 +94,12 @@ type Head struct {
 	chunkDiskMapper *chunks.ChunkDiskMapper
 	// chunkDirRoot is the parent directory of the chunks directory.
 	chunkDirRoot string
+	// chunkOpts limits the size of head chunks.
+	chunkOpts chunkOpts
+	// oooTimeWindow is how far behind the max time of the head late samples are accepted.
+	oooTimeWindow int64
+	// limits restrict what appenders may add to the head.
+	limits headLimits
 
 	closedMtx sync.Mutex
 	closed    bool
@@ -110,6 +118,8 @@ type headMetrics struct {
 	samplesAppended          prometheus.Counter
 	outOfBoundSamples        prometheus.Counter
 	outOfOrderSamples        prometheus.Counter
+	oooSamplesAppended       prometheus.Counter
+	rejectedSamples          *prometheus.CounterVec
 	walTruncateDuration      prometheus.Summary
 	walCorruptionsTotal      prometheus.Counter
 	walTotalReplayDuration   prometheus.Gauge
@@ -186,6 +196,14 @@ func newHeadMetrics(h *Head, r prometheus.Registerer) *headMetrics {
 			Name: "prometheus_tsdb_out_of_order_samples_total",
 			Help: "Total number of out of order samples ingestion failed attempts.",
 		}),
+		oooSamplesAppended: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "prometheus_tsdb_head_out_of_order_samples_appended_total",
+			Help: "Total number of appended samples that were late but within the out-of-order time window.",
+		}),
+		rejectedSamples: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "prometheus_tsdb_head_rejected_samples_total",
+			Help: "Total number of samples rejected because of ingestion limits, by the limit that was hit.",
+		}, []string{"reason"}),
 		headTruncateFail: prometheus.NewCounter(prometheus.CounterOpts{
 			Name: "prometheus_tsdb_head_truncations_failed_total",
 			Help: "Total number of head truncations that failed.",
@@ -233,6 +251,8 @@ func newHeadMetrics(h *Head, r prometheus.Registerer) *headMetrics {
 			m.samplesAppended,
 			m.outOfBoundSamples,
 			m.outOfOrderSamples,
+			m.oooSamplesAppended,
+			m.rejectedSamples,
 			m.headTruncateFail,
 			m.headTruncateTotal,
 			m.checkpointDeleteFail,
@@ -291,24 +311,115 @@ func (h *Head) PostingsCardinalityStats(statsByLabelName string) *index.Postings
 	return h.cardinalityCache
 }
 
-// NewHead opens the head block in dir.
-// stripeSize sets the number of entries in the hash map, it must be a power of 2.
-// A larger stripeSize will allocate more memory up-front, but will increase performance when handling a large number of series.
-// A smaller stripeSize reduces the memory allocated, but can decrease performance with large number of series.
-func NewHead(r prometheus.Registerer, l log.Logger, wal *wal.WAL, chunkRange int64, chkDirRoot string, chkPool chunkenc.Pool, chkWriteBufferSize, stripeSize int, seriesCallback SeriesLifecycleCallback) (*Head, error) {
+// Default limits of head chunks.
+const (
+	// DefaultSamplesPerChunk keeps the number of profiles that have to be
+	// read to access any of them low.
+	DefaultSamplesPerChunk = 12
+	// DefaultChunkBytes keeps chunks of large profiles, such as CPU profiles
+	// of big services, from growing to many megabytes.
+	DefaultChunkBytes = 1 << 20
+)
+
+// HeadOptions are parameters for the Head block.
+// Zero values are replaced by their defaults, except for ChunkRange which is required.
+type HeadOptions struct {
+	ChunkRange int64
+	// ChunkDirRoot is the parent directory of the chunks directory.
+	ChunkDirRoot         string
+	ChunkPool            chunkenc.Pool
+	ChunkWriteBufferSize int
+	// StripeSize sets the number of entries in the hash map, it must be a power of 2.
+	// A larger StripeSize will allocate more memory up-front, but will increase performance when handling a large number of series.
+	// A smaller StripeSize reduces the memory allocated, but can decrease performance with large number of series.
+	StripeSize     int
+	SeriesCallback SeriesLifecycleCallback
+
+	// SamplesPerChunk is the maximum number of samples of a head chunk.
+	// Chunks are also cut evenly across the chunk range with about as many samples.
+	// ChunkBytes is the maximum size in bytes of the uncompressed values of a head chunk.
+	// A chunk is cut as soon as either limit is hit. A negative value disables the respective limit.
+	SamplesPerChunk int
+	ChunkBytes      int
+	// ChunkCompression configures how the values of head chunks are compressed.
+	// nil writes EncBytes chunks.
+	ChunkCompression *chunkenc.Compression
+	// PprofChunks writes chunks that store pprof profiles in their parsed form,
+	// see chunkenc.PprofChunk. It cannot be combined with ChunkCompression.
+	PprofChunks bool
+	// OutOfOrderTimeWindow is how far behind the max time of the head late
+	// profiles are still accepted. It must not exceed half the ChunkRange.
+	// 0 rejects all late samples.
+	OutOfOrderTimeWindow int64
+
+	// Ingestion limits of appenders. 0 disables the respective limit.
+	// MaxSeries is the maximum number of series in the head and
+	// MaxNewSeriesPerCommit the number of series an appender may create.
+	// MaxSampleBytes is the maximum size of a profile and
+	// MaxIngestionBytesPerSecond the rate at which profile bytes are accepted.
+	MaxSeries                  int
+	MaxNewSeriesPerCommit      int
+	MaxSampleBytes             int
+	MaxIngestionBytesPerSecond int64
+}
+
+// DefaultHeadOptions returns the default HeadOptions.
+func DefaultHeadOptions() *HeadOptions {
+	return &HeadOptions{
+		ChunkRange:           DefaultBlockDuration,
+		ChunkWriteBufferSize: chunks.DefaultWriteBufferSize,
+		StripeSize:           DefaultStripeSize,
+		SamplesPerChunk:      DefaultSamplesPerChunk,
+		ChunkBytes:           DefaultChunkBytes,
+	}
+}
+
+// NewHead opens the head block in opts.ChunkDirRoot.
+func NewHead(r prometheus.Registerer, l log.Logger, wal *wal.WAL, opts *HeadOptions) (*Head, error) {
 	if l == nil {
 		l = log.NewNopLogger()
 	}
-	if chunkRange < 1 {
-		return nil, errors.Errorf("invalid chunk range %d", chunkRange)
+	o := *opts
+	if o.ChunkRange < 1 {
+		return nil, errors.Errorf("invalid chunk range %d", o.ChunkRange)
+	}
+	if o.ChunkWriteBufferSize == 0 {
+		o.ChunkWriteBufferSize = chunks.DefaultWriteBufferSize
+	}
+	if o.StripeSize == 0 {
+		o.StripeSize = DefaultStripeSize
+	}
+	if o.SamplesPerChunk == 0 {
+		o.SamplesPerChunk = DefaultSamplesPerChunk
+	}
+	if o.ChunkBytes == 0 {
+		o.ChunkBytes = DefaultChunkBytes
 	}
+	if o.OutOfOrderTimeWindow < 0 || o.OutOfOrderTimeWindow > o.ChunkRange/2 {
+		return nil, errors.Errorf("invalid out-of-order time window %d for chunk range %d", o.OutOfOrderTimeWindow, o.ChunkRange)
+	}
+	if o.MaxSeries < 0 || o.MaxNewSeriesPerCommit < 0 || o.MaxSampleBytes < 0 || o.MaxIngestionBytesPerSecond < 0 {
+		return nil, errors.New("ingestion limits must not be negative")
+	}
+	if o.SamplesPerChunk < 0 && o.ChunkBytes < 0 {
+		return nil, errors.New("either the samples or the bytes per chunk must be limited")
+	}
+	if o.ChunkCompression != nil {
+		if o.PprofChunks {
+			return nil, errors.New("pprof chunks cannot be compressed differently")
+		}
+		if err := o.ChunkCompression.Validate(); err != nil {
+			return nil, errors.Wrap(err, "invalid chunk compression")
+		}
+	}
+	seriesCallback := o.SeriesCallback
 	if seriesCallback == nil {
 		seriesCallback = &noopSeriesLifecycleCallback{}
 	}
 	h := &Head{
 		wal:        wal,
 		logger:     l,
-		series:     newStripeSeries(stripeSize, seriesCallback),
+		series:     newStripeSeries(o.StripeSize, seriesCallback),
 		symbols:    map[string]struct{}{},
 		postings:   index.NewUnorderedMemPostings(),
 		tombstones: tombstones.NewMemTombstones(),
@@ -319,21 +430,38 @@ func NewHead(r prometheus.Registerer, l log.Logger, wal *wal.WAL, chunkRange int
 				return &memChunk{}
 			},
 		},
-		chunkDirRoot:   chkDirRoot,
+		chunkDirRoot:   o.ChunkDirRoot,
 		seriesCallback: seriesCallback,
+		chunkOpts: chunkOpts{
+			samples:     o.SamplesPerChunk,
+			bytes:       o.ChunkBytes,
+			compression: o.ChunkCompression,
+			pprof:       o.PprofChunks,
+		},
+		oooTimeWindow: o.OutOfOrderTimeWindow,
+		limits: headLimits{
+			maxSeries:             uint64(o.MaxSeries),
+			maxNewSeriesPerCommit: o.MaxNewSeriesPerCommit,
+			maxSampleBytes:        o.MaxSampleBytes,
+		},
+	}
+	if o.MaxIngestionBytesPerSecond > 0 {
+		h.limits.ingestion = newRateLimiter(o.MaxIngestionBytesPerSecond)
 	}
-	h.chunkRange.Store(chunkRange)
+	h.chunkRange.Store(o.ChunkRange)
 	h.minTime.Store(math.MaxInt64)
 	h.maxTime.Store(math.MinInt64)
 	h.lastWALTruncationTime.Store(math.MinInt64)
+	h.oooMaxTime.Store(math.MinInt64)
 	h.metrics = newHeadMetrics(h, r)
 
+	chkPool := o.ChunkPool
 	if chkPool == nil {
 		chkPool = chunkenc.NewPool()
 	}
 
 	var err error
-	h.chunkDiskMapper, err = chunks.NewChunkDiskMapper(mmappedChunksDir(chkDirRoot), chkPool, chkWriteBufferSize)
+	h.chunkDiskMapper, err = chunks.NewChunkDiskMapper(mmappedChunksDir(o.ChunkDirRoot), chkPool, o.ChunkWriteBufferSize)
 	if err != nil {
 		return nil, err
 	}
@@ -389,6 +517,9 @@ func (h *Head) processWALSamples(
 	return unknownRefs
 }
 
+// outOfOrderRefSamples are samples of an OutOfOrderSamples record.
+type outOfOrderRefSamples []record.RefSample
+
 func (h *Head) updateMinMaxTime(mint, maxt int64) {
 	for {
 		lt := h.MinTime()
@@ -410,6 +541,18 @@ func (h *Head) updateMinMaxTime(mint, maxt int64) {
 	}
 }
 
+func (h *Head) updateOutOfOrderMaxTime(maxt int64) {
+	for {
+		ht := h.oooMaxTime.Load()
+		if maxt <= ht {
+			break
+		}
+		if h.oooMaxTime.CAS(ht, maxt) {
+			break
+		}
+	}
+}
+
 func (h *Head) loadWAL(r *wal.Reader, multiRef map[uint64]uint64, mmappedChunks map[uint64][]*mmappedChunk) (err error) {
 	// Track number of samples that referenced a series we don't know about
 	// for error reporting.
@@ -439,6 +582,11 @@ func (h *Head) loadWAL(r *wal.Reader, multiRef map[uint64]uint64, mmappedChunks
 				return []record.RefSample{}
 			},
 		}
+		floatSamplesPool = sync.Pool{
+			New: func() interface{} {
+				return []record.RefFloatSample{}
+			},
+		}
 		tstonesPool = sync.Pool{
 			New: func() interface{} {
 				return []tombstones.Stone{}
@@ -500,6 +648,30 @@ func (h *Head) loadWAL(r *wal.Reader, multiRef map[uint64]uint64, mmappedChunks
 					return
 				}
 				decoded <- samples
+			case record.OutOfOrderSamples:
+				samples := samplesPool.Get().([]record.RefSample)[:0]
+				samples, err = dec.Samples(rec, samples)
+				if err != nil {
+					decodeErr = &wal.CorruptionErr{
+						Err:     errors.Wrap(err, "decode out-of-order samples"),
+						Segment: r.Segment(),
+						Offset:  r.Offset(),
+					}
+					return
+				}
+				decoded <- outOfOrderRefSamples(samples)
+			case record.FloatSamples:
+				samples := floatSamplesPool.Get().([]record.RefFloatSample)[:0]
+				samples, err = dec.FloatSamples(rec, samples)
+				if err != nil {
+					decodeErr = &wal.CorruptionErr{
+						Err:     errors.Wrap(err, "decode float samples"),
+						Segment: r.Segment(),
+						Offset:  r.Offset(),
+					}
+					return
+				}
+				decoded <- samples
 			case record.Tombstones:
 				tstones := tstonesPool.Get().([]tombstones.Stone)[:0]
 				tstones, err = dec.Tombstones(rec, tstones)
@@ -518,6 +690,39 @@ func (h *Head) loadWAL(r *wal.Reader, multiRef map[uint64]uint64, mmappedChunks
 		}
 	}()
 
+	// shardSamples passes samples on to the workers of their series.
+	shardSamples := func(samples []record.RefSample) {
+		// We split up the samples into chunks of 5000 samples or less.
+		// With O(300 * #cores) in-flight sample batches, large scrapes could otherwise
+		// cause thousands of very large in flight buffers occupying large amounts
+		// of unused memory.
+		for len(samples) > 0 {
+			m := 5000
+			if len(samples) < m {
+				m = len(samples)
+			}
+			for i := 0; i < n; i++ {
+				var buf []record.RefSample
+				select {
+				case buf = <-outputs[i]:
+				default:
+				}
+				shards[i] = buf[:0]
+			}
+			for _, sam := range samples[:m] {
+				if r, ok := multiRef[sam.Ref]; ok {
+					sam.Ref = r
+				}
+				mod := sam.Ref % uint64(n)
+				shards[mod] = append(shards[mod], sam)
+			}
+			for i := 0; i < n; i++ {
+				inputs[i] <- shards[i]
+			}
+			samples = samples[m:]
+		}
+	}
+
 Outer:
 	for d := range decoded {
 		switch v := d.(type) {
@@ -537,8 +742,11 @@ Outer:
 					h.metrics.chunks.Add(float64(len(series.mmappedChunks)))
 					h.metrics.chunksCreated.Add(float64(len(series.mmappedChunks)))
 
-					if len(series.mmappedChunks) > 0 {
+					if n := len(series.mmappedChunks); n > 0 {
 						h.updateMinMaxTime(series.minTime(), series.maxTime())
+						if series.mmappedChunks[n-1].enc == chunkenc.EncXOR {
+							series.valueType = valueTypeFloat
+						}
 					}
 				} else {
 					// TODO(codesome) Discard old samples and mmapped chunks and use mmap chunks for the new series ID.
@@ -555,39 +763,62 @@ Outer:
 			//nolint:staticcheck
 			seriesPool.Put(v)
 		case []record.RefSample:
-			samples := v
-			// We split up the samples into chunks of 5000 samples or less.
-			// With O(300 * #cores) in-flight sample batches, large scrapes could otherwise
-			// cause thousands of very large in flight buffers occupying large amounts
-			// of unused memory.
-			for len(samples) > 0 {
-				m := 5000
-				if len(samples) < m {
-					m = len(samples)
+			shardSamples(v)
+			//SA6002 safe to ignore and actually fixing it has some performance penalty.
+			//nolint:staticcheck
+			samplesPool.Put(v)
+		case []record.RefFloatSample:
+			samples := samplesPool.Get().([]record.RefSample)[:0]
+			for _, s := range v {
+				ref := s.Ref
+				if r, ok := multiRef[ref]; ok {
+					ref = r
 				}
-				for i := 0; i < n; i++ {
-					var buf []record.RefSample
-					select {
-					case buf = <-outputs[i]:
-					default:
-					}
-					shards[i] = buf[:0]
+				// Workers only read the value type of a series when cutting chunks
+				// for its samples, none of which were dispatched before.
+				if ms := h.series.getByID(ref); ms != nil && ms.valueType != valueTypeFloat {
+					ms.valueType = valueTypeFloat
 				}
-				for _, sam := range samples[:m] {
-					if r, ok := multiRef[sam.Ref]; ok {
-						sam.Ref = r
-					}
-					mod := sam.Ref % uint64(n)
-					shards[mod] = append(shards[mod], sam)
+				samples = append(samples, record.RefSample{Ref: s.Ref, T: s.T, V: chunkenc.EncodeFloat(s.V)})
+			}
+			shardSamples(samples)
+			//SA6002 safe to ignore and actually fixing it has some performance penalty.
+			//nolint:staticcheck
+			samplesPool.Put(samples)
+			//nolint:staticcheck
+			floatSamplesPool.Put(v)
+		case outOfOrderRefSamples:
+			// Late samples never make it into chunks before compaction,
+			// so they cannot be in the m-mapped chunks of their series.
+			minValidTime := h.minValidTime.Load()
+			mint, maxt := int64(math.MaxInt64), int64(math.MinInt64)
+			for _, s := range v {
+				if s.T < minValidTime {
+					continue
+				}
+				if r, ok := multiRef[s.Ref]; ok {
+					s.Ref = r
+				}
+				ms := h.series.getByID(s.Ref)
+				if ms == nil {
+					unknownRefs.Inc()
+					continue
+				}
+				ms.Lock()
+				ms.insertOutOfOrder(s.T, s.V)
+				ms.Unlock()
+				if s.T > maxt {
+					maxt = s.T
 				}
-				for i := 0; i < n; i++ {
-					inputs[i] <- shards[i]
+				if s.T < mint {
+					mint = s.T
 				}
-				samples = samples[m:]
 			}
+			h.updateMinMaxTime(mint, maxt)
+			h.updateOutOfOrderMaxTime(maxt)
 			//SA6002 safe to ignore and actually fixing it has some performance penalty.
 			//nolint:staticcheck
-			samplesPool.Put(v)
+			samplesPool.Put([]record.RefSample(v))
 		case []tombstones.Stone:
 			for _, s := range v {
 				for _, itv := range s.Intervals {
@@ -734,7 +965,7 @@ func (h *Head) Init(minValidTime int64) error {
 
 func (h *Head) loadMmappedChunks() (map[uint64][]*mmappedChunk, error) {
 	mmappedChunks := map[uint64][]*mmappedChunk{}
-	if err := h.chunkDiskMapper.IterateAllChunks(func(seriesRef, chunkRef uint64, mint, maxt int64, numSamples uint16) error {
+	if err := h.chunkDiskMapper.IterateAllChunks(func(seriesRef, chunkRef uint64, mint, maxt int64, numSamples uint16, enc chunkenc.Encoding) error {
 		if maxt < h.minValidTime.Load() {
 			return nil
 		}
@@ -753,6 +984,7 @@ func (h *Head) loadMmappedChunks() (map[uint64][]*mmappedChunk, error) {
 			minTime:    mint,
 			maxTime:    maxt,
 			numSamples: numSamples,
+			enc:        enc,
 		})
 		mmappedChunks[seriesRef] = slice
 		return nil
@@ -824,6 +1056,11 @@ func (h *Head) truncateMemory(mint int64) (err error) {
 	start := time.Now()
 
 	actualMint := h.gc()
+	// All late samples before mint are gone now. Late samples appended
+	// concurrently are at least at mint and fail the swap or raise it again.
+	if ht := h.oooMaxTime.Load(); ht < mint {
+		h.oooMaxTime.CAS(ht, math.MinInt64)
+	}
 	level.Info(h.logger).Log("msg", "Head GC completed", "duration", time.Since(start))
 	h.metrics.gcDuration.Observe(time.Since(start).Seconds())
 	if actualMint > h.minTime.Load() {
@@ -1037,6 +1274,23 @@ func (a *initAppender) AddFast(ref uint64, t int64, v []byte) error {
 	return a.app.AddFast(ref, t, v)
 }
 
+func (a *initAppender) AddFloat(lset labels.Labels, t int64, v float64) (uint64, error) {
+	if a.app != nil {
+		return a.app.AddFloat(lset, t, v)
+	}
+	a.head.initTime(t)
+	a.app = a.head.appender()
+
+	return a.app.AddFloat(lset, t, v)
+}
+
+func (a *initAppender) AddFloatFast(ref uint64, t int64, v float64) error {
+	if a.app == nil {
+		return storage.ErrNotFound
+	}
+	return a.app.AddFloatFast(ref, t, v)
+}
+
 func (a *initAppender) Commit() error {
 	if a.app == nil {
 		return nil
@@ -1069,9 +1323,14 @@ func (h *Head) appender() *headAppender {
 	appendID := h.iso.newAppendID()
 	cleanupAppendIDsBelow := h.iso.lowWatermark()
 
+	oooMinValidTime := int64(math.MaxInt64)
+	if h.oooTimeWindow > 0 {
+		oooMinValidTime = h.MaxTime() - h.oooTimeWindow
+	}
 	return &headAppender{
 		head:                  h,
 		minValidTime:          h.appendableMinValidTime(),
+		oooMinValidTime:       oooMinValidTime,
 		mint:                  math.MaxInt64,
 		maxt:                  math.MinInt64,
 		samples:               h.getAppendBuffer(),
@@ -1137,13 +1396,18 @@ func (h *Head) putBytesBuffer(b []byte) {
 }
 
 type headAppender struct {
-	head         *Head
-	minValidTime int64 // No samples below this timestamp are allowed.
-	mint, maxt   int64
+	head            *Head
+	minValidTime    int64 // No samples below this timestamp are allowed.
+	oooMinValidTime int64 // No late samples below this timestamp are allowed.
+	mint, maxt      int64
 
 	series       []record.RefSeries
 	samples      []record.RefSample
 	sampleSeries []*memSeries
+	floatSamples []record.RefFloatSample
+	floatSeries  []*memSeries
+	oooSamples   []record.RefSample // Late samples within the out-of-order time window.
+	oooSeries    []*memSeries
 
 	appendID, cleanupAppendIDsBelow uint64
 	closed                          bool
@@ -1154,21 +1418,102 @@ func (a *headAppender) Add(lset labels.Labels, t int64, v []byte) (uint64, error
 		a.head.metrics.outOfBoundSamples.Inc()
 		return 0, storage.ErrOutOfBounds
 	}
+	// Limit the sample before its series may be created.
+	if err := a.limitSample(len(v)); err != nil {
+		return 0, err
+	}
+
+	s, err := a.getOrCreate(lset)
+	if err != nil {
+		return 0, err
+	}
+	return s.ref, a.add(s.ref, t, v)
+}
+
+func (a *headAppender) AddFast(ref uint64, t int64, v []byte) error {
+	if err := a.limitSample(len(v)); err != nil {
+		return err
+	}
+	return a.add(ref, t, v)
+}
+
+func (a *headAppender) add(ref uint64, t int64, v []byte) error {
+	safeValue := make([]byte, len(v))
+	copy(safeValue, v)
+
+	s, late, err := a.appendable(ref, t, safeValue, valueTypeBytes)
+	if err != nil {
+		return err
+	}
+
+	if late {
+		a.oooSamples = append(a.oooSamples, record.RefSample{
+			Ref: ref,
+			T:   t,
+			V:   safeValue,
+		})
+		a.oooSeries = append(a.oooSeries, s)
+		return nil
+	}
+	a.samples = append(a.samples, record.RefSample{
+		Ref: ref,
+		T:   t,
+		V:   safeValue,
+	})
+	a.sampleSeries = append(a.sampleSeries, s)
+	return nil
+}
+
+func (a *headAppender) AddFloat(lset labels.Labels, t int64, v float64) (uint64, error) {
+	if t < a.minValidTime {
+		a.head.metrics.outOfBoundSamples.Inc()
+		return 0, storage.ErrOutOfBounds
+	}
+
+	s, err := a.getOrCreate(lset)
+	if err != nil {
+		return 0, err
+	}
+	return s.ref, a.AddFloatFast(s.ref, t, v)
+}
+
+func (a *headAppender) AddFloatFast(ref uint64, t int64, v float64) error {
+	// Late numeric samples are never accepted.
+	s, _, err := a.appendable(ref, t, chunkenc.EncodeFloat(v), valueTypeFloat)
+	if err != nil {
+		return err
+	}
 
+	a.floatSamples = append(a.floatSamples, record.RefFloatSample{
+		Ref: ref,
+		T:   t,
+		V:   v,
+	})
+	a.floatSeries = append(a.floatSeries, s)
+	return nil
+}
+
+// getOrCreate returns the series of lset and records it if it is new.
+func (a *headAppender) getOrCreate(lset labels.Labels) (*memSeries, error) {
 	// Ensure no empty labels have gotten through.
 	lset = lset.WithoutEmpty()
 
 	if len(lset) == 0 {
-		return 0, errors.Wrap(ErrInvalidSample, "empty labelset")
+		return nil, errors.Wrap(ErrInvalidSample, "empty labelset")
 	}
 
 	if l, dup := lset.HasDuplicateLabelNames(); dup {
-		return 0, errors.Wrap(ErrInvalidSample, fmt.Sprintf(`label name "%s" is not unique`, l))
+		return nil, errors.Wrap(ErrInvalidSample, fmt.Sprintf(`label name "%s" is not unique`, l))
 	}
 
-	s, created, err := a.head.getOrCreate(lset.Hash(), lset)
+	hash := lset.Hash()
+	if err := a.limitSeries(hash, lset); err != nil {
+		return nil, err
+	}
+
+	s, created, err := a.head.getOrCreate(hash, lset)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
 	if created {
@@ -1177,30 +1522,41 @@ func (a *headAppender) Add(lset labels.Labels, t int64, v []byte) (uint64, error
 			Labels: lset,
 		})
 	}
-	return s.ref, a.AddFast(s.ref, t, v)
+	return s, nil
 }
 
-func (a *headAppender) AddFast(ref uint64, t int64, v []byte) error {
-	safeValue := make([]byte, len(v))
-	copy(safeValue, v)
-
+// appendable returns the referenced series if the sample can be appended to
+// it and marks the series as pending commit. It also returns whether the
+// sample is late and goes into the out-of-order samples of the series.
+func (a *headAppender) appendable(ref uint64, t int64, v []byte, vt valueType) (*memSeries, bool, error) {
 	if t < a.minValidTime {
 		a.head.metrics.outOfBoundSamples.Inc()
-		return storage.ErrOutOfBounds
+		return nil, false, storage.ErrOutOfBounds
 	}
 
 	s := a.head.series.getByID(ref)
 	if s == nil {
-		return errors.Wrap(storage.ErrNotFound, "unknown series")
+		return nil, false, errors.Wrap(storage.ErrNotFound, "unknown series")
 	}
 	s.Lock()
-	if err := s.appendable(t, safeValue); err != nil {
+	late, err := s.appendable(t, v, vt, a.oooMinValidTime)
+	if err == nil && late {
+		// Late samples are kept apart from the chunks, so duplicates of
+		// in-order samples, even identical ones, would be stored twice.
+		var dup bool
+		dup, err = s.hasInOrderSample(t, a.head.chunkDiskMapper)
+		if err == nil && dup {
+			err = storage.ErrDuplicateSampleForTimestamp
+		}
+	}
+	if err != nil {
 		s.Unlock()
 		if err == storage.ErrOutOfOrderSample {
 			a.head.metrics.outOfOrderSamples.Inc()
 		}
-		return err
+		return nil, false, err
 	}
+	s.valueType = vt
 	s.pendingCommit = true
 	s.Unlock()
 
@@ -1210,14 +1566,7 @@ func (a *headAppender) AddFast(ref uint64, t int64, v []byte) error {
 	if t > a.maxt {
 		a.maxt = t
 	}
-
-	a.samples = append(a.samples, record.RefSample{
-		Ref: ref,
-		T:   t,
-		V:   safeValue,
-	})
-	a.sampleSeries = append(a.sampleSeries, s)
-	return nil
+	return s, late, nil
 }
 
 func (a *headAppender) log() error {
@@ -1247,6 +1596,22 @@ func (a *headAppender) log() error {
 			return errors.Wrap(err, "log samples")
 		}
 	}
+	if len(a.floatSamples) > 0 {
+		rec = enc.FloatSamples(a.floatSamples, buf)
+		buf = rec[:0]
+
+		if err := a.head.wal.Log(rec); err != nil {
+			return errors.Wrap(err, "log float samples")
+		}
+	}
+	if len(a.oooSamples) > 0 {
+		rec = enc.OutOfOrderSamples(a.oooSamples, buf)
+		buf = rec[:0]
+
+		if err := a.head.wal.Log(rec); err != nil {
+			return errors.Wrap(err, "log out-of-order samples")
+		}
+	}
 	return nil
 }
 
@@ -1266,25 +1631,36 @@ func (a *headAppender) Commit() (err error) {
 	defer a.head.putSeriesBuffer(a.sampleSeries)
 	defer a.head.iso.closeAppend(a.appendID)
 
-	total := len(a.samples)
-	var series *memSeries
+	total := len(a.samples) + len(a.floatSamples) + len(a.oooSamples)
 	for i, s := range a.samples {
-		series = a.sampleSeries[i]
+		if !a.commitSample(a.sampleSeries[i], s.T, s.V) {
+			total--
+		}
+	}
+	for i, s := range a.floatSamples {
+		if !a.commitSample(a.floatSeries[i], s.T, chunkenc.EncodeFloat(s.V)) {
+			total--
+		}
+	}
+	oooMaxt := int64(math.MinInt64)
+	for i, s := range a.oooSamples {
+		series := a.oooSeries[i]
 		series.Lock()
-		ok, chunkCreated := series.append(s.T, s.V, a.appendID, a.head.chunkDiskMapper)
-		series.cleanupAppendIDsBelow(a.cleanupAppendIDsBelow)
+		inserted := series.insertOutOfOrder(s.T, s.V)
 		series.pendingCommit = false
 		series.Unlock()
 
-		if !ok {
+		if !inserted {
+			// An identical late sample was appended before.
 			total--
-			a.head.metrics.outOfOrderSamples.Inc()
+			continue
 		}
-		if chunkCreated {
-			a.head.metrics.chunks.Inc()
-			a.head.metrics.chunksCreated.Inc()
+		a.head.metrics.oooSamplesAppended.Inc()
+		if s.T > oooMaxt {
+			oooMaxt = s.T
 		}
 	}
+	a.head.updateOutOfOrderMaxTime(oooMaxt)
 
 	a.head.metrics.samplesAppended.Add(float64(total))
 	a.head.updateMinMaxTime(a.mint, a.maxt)
@@ -1292,6 +1668,24 @@ func (a *headAppender) Commit() (err error) {
 	return nil
 }
 
+// commitSample appends a sample to its series and returns whether it was in order.
+func (a *headAppender) commitSample(series *memSeries, t int64, v []byte) bool {
+	series.Lock()
+	ok, chunkCreated := series.append(t, v, a.appendID, a.head.chunkDiskMapper)
+	series.cleanupAppendIDsBelow(a.cleanupAppendIDsBelow)
+	series.pendingCommit = false
+	series.Unlock()
+
+	if !ok {
+		a.head.metrics.outOfOrderSamples.Inc()
+	}
+	if chunkCreated {
+		a.head.metrics.chunks.Inc()
+		a.head.metrics.chunksCreated.Inc()
+	}
+	return ok
+}
+
 func (a *headAppender) Rollback() (err error) {
 	if a.closed {
 		return ErrAppenderClosed
@@ -1309,8 +1703,21 @@ func (a *headAppender) Rollback() (err error) {
 		series.pendingCommit = false
 		series.Unlock()
 	}
+	for _, series := range a.floatSeries {
+		series.Lock()
+		series.cleanupAppendIDsBelow(a.cleanupAppendIDsBelow)
+		series.pendingCommit = false
+		series.Unlock()
+	}
+	for _, series := range a.oooSeries {
+		series.Lock()
+		series.pendingCommit = false
+		series.Unlock()
+	}
 	a.head.putAppendBuffer(a.samples)
 	a.samples = nil
+	a.floatSamples = nil
+	a.oooSamples = nil
 
 	// Series are created in the head memory regardless of rollback. Thus we have
 	// to log them to the WAL in any case.
@@ -1583,6 +1990,11 @@ func (c *safeChunk) Iterator(reuseIter chunkenc.Iterator) chunkenc.Iterator {
 	return it
 }
 
+// Unwrap returns the underlying chunk, see chunkenc.NewChunkLike.
+func (c *safeChunk) Unwrap() chunkenc.Chunk {
+	return c.Chunk
+}
+
 type headIndexReader struct {
 	head       *Head
 	mint, maxt int64
@@ -1734,7 +2146,7 @@ func (h *Head) getOrCreate(hash uint64, lset labels.Labels) (*memSeries, bool, e
 }
 
 func (h *Head) getOrCreateWithID(id, hash uint64, lset labels.Labels) (*memSeries, bool, error) {
-	s := newMemSeries(lset, id, h.chunkRange.Load(), &h.memChunkPool)
+	s := newMemSeries(lset, id, h.chunkRange.Load(), h.chunkOpts, &h.memChunkPool)
 
 	s, created, err := h.series.getOrSet(hash, s)
 	if err != nil {
@@ -1858,9 +2270,13 @@ func (s *stripeSeries) gc(mint int64) (map[uint64]struct{}, int, int64) {
 			for _, series := range all {
 				series.Lock()
 				rmChunks += series.truncateChunksBefore(mint)
+				series.truncateOutOfOrderBefore(mint)
 
-				if len(series.mmappedChunks) > 0 || series.headChunk != nil || series.pendingCommit {
+				if len(series.mmappedChunks) > 0 || series.headChunk != nil || len(series.oooSamples) > 0 || series.pendingCommit {
 					seriesMint := series.minTime()
+					if len(series.oooSamples) > 0 && series.oooSamples[0].t < seriesMint {
+						seriesMint = series.oooSamples[0].t
+					}
 					if seriesMint < actualMint {
 						actualMint = seriesMint
 					}
@@ -1969,6 +2385,15 @@ func newSample(t int64, v []byte) tsdbutil.Sample { return sample{t, v} }
 func (s sample) T() int64                         { return s.t }
 func (s sample) V() []byte                        { return s.v }
 
+// valueType is the kind of samples a series holds.
+type valueType uint8
+
+const (
+	valueTypeUnknown valueType = iota
+	valueTypeBytes
+	valueTypeFloat
+)
+
 // memSeries is the in-memory representation of a series. None of its methods
 // are goroutine safe and it is the caller's responsibility to lock it.
 type memSeries struct {
@@ -1979,11 +2404,14 @@ type memSeries struct {
 	mmappedChunks []*mmappedChunk
 	headChunk     *memChunk
 	chunkRange    int64
+	chunkOpts     chunkOpts
 	firstChunkID  int
 
 	nextAt        int64 // Timestamp at which to cut the next chunk.
 	sampleBuf     [4]sample
-	pendingCommit bool // Whether there are samples waiting to be committed to this series.
+	pendingCommit bool      // Whether there are samples waiting to be committed to this series.
+	valueType     valueType // The kind of samples of the series, fixed by the first append.
+	oooSamples    []sample  // Late samples sorted by time, they are merged into the series on compaction.
 
 	app chunkenc.Appender // Current appender for the chunk.
 
@@ -1992,11 +2420,12 @@ type memSeries struct {
 	txs *txRing
 }
 
-func newMemSeries(lset labels.Labels, id uint64, chunkRange int64, memChunkPool *sync.Pool) *memSeries {
+func newMemSeries(lset labels.Labels, id uint64, chunkRange int64, chunkOpts chunkOpts, memChunkPool *sync.Pool) *memSeries {
 	s := &memSeries{
 		lset:         lset,
 		ref:          id,
 		chunkRange:   chunkRange,
+		chunkOpts:    chunkOpts,
 		nextAt:       math.MinInt64,
 		txs:          newTxRing(4),
 		memChunkPool: memChunkPool,
@@ -2025,8 +2454,14 @@ func (s *memSeries) maxTime() int64 {
 func (s *memSeries) cutNewHeadChunk(mint int64, chunkDiskMapper *chunks.ChunkDiskMapper) *memChunk {
 	s.mmapCurrentHeadChunk(chunkDiskMapper)
 
+	var chunk chunkenc.Chunk
+	if s.valueType == valueTypeFloat {
+		chunk = chunkenc.NewXORChunk()
+	} else {
+		chunk = s.chunkOpts.newChunk()
+	}
 	s.headChunk = &memChunk{
-		chunk:   chunkenc.NewBytesChunk(),
+		chunk:   chunk,
 		minTime: mint,
 		maxTime: math.MinInt64,
 	}
@@ -2058,30 +2493,49 @@ func (s *memSeries) mmapCurrentHeadChunk(chunkDiskMapper *chunks.ChunkDiskMapper
 	s.mmappedChunks = append(s.mmappedChunks, &mmappedChunk{
 		ref:        chunkRef,
 		numSamples: uint16(s.headChunk.chunk.NumSamples()),
+		enc:        s.headChunk.chunk.Encoding(),
 		minTime:    s.headChunk.minTime,
 		maxTime:    s.headChunk.maxTime,
 	})
 }
 
 // appendable checks whether the given sample is valid for appending to the series.
-func (s *memSeries) appendable(t int64, v []byte) error {
+// Late profiles at or after oooMint are valid too and it returns true for them.
+func (s *memSeries) appendable(t int64, v []byte, vt valueType, oooMint int64) (late bool, err error) {
+	if s.valueType != vt {
+		// Series without a value type hold profiles if they have any samples.
+		if s.valueType != valueTypeUnknown || (vt == valueTypeFloat && s.minTime() != math.MinInt64) {
+			return false, storage.ErrSampleTypeMismatch
+		}
+	}
+
 	c := s.head()
 	if c == nil {
-		return nil
+		// After a restart only the m-mapped chunks may be left.
+		if n := len(s.mmappedChunks); n == 0 || t > s.mmappedChunks[n-1].maxTime {
+			return false, nil
+		}
+	} else {
+		if t > c.maxTime {
+			return false, nil
+		}
+		// We are allowing exact duplicates as we can encounter them in valid cases
+		// like federation and erroring out at that time would be extremely noisy.
+		if t == c.maxTime {
+			if !bytes.Equal(s.sampleBuf[3].v, v) {
+				return false, storage.ErrDuplicateSampleForTimestamp
+			}
+			return false, nil
+		}
 	}
 
-	if t > c.maxTime {
-		return nil
-	}
-	if t < c.maxTime {
-		return storage.ErrOutOfOrderSample
+	if vt != valueTypeBytes || t < oooMint {
+		return false, storage.ErrOutOfOrderSample
 	}
-	// We are allowing exact duplicates as we can encounter them in valid cases
-	// like federation and erroring out at that time would be extremely noisy.
-	if !bytes.Equal(s.sampleBuf[3].v, v) {
-		return storage.ErrDuplicateSampleForTimestamp
+	if prev, ok := s.outOfOrderSample(t); ok && !bytes.Equal(prev, v) {
+		return false, storage.ErrDuplicateSampleForTimestamp
 	}
-	return nil
+	return true, nil
 }
 
 // chunk returns the chunk for the chunk id from memory or by m-mapping it from the disk.
@@ -2150,11 +2604,6 @@ func (s *memSeries) truncateChunksBefore(mint int64) (removed int) {
 // isolation for this append.)
 // It is unsafe to call this concurrently with s.iterator(...) without holding the series lock.
 func (s *memSeries) append(t int64, v []byte, appendID uint64, chunkDiskMapper *chunks.ChunkDiskMapper) (sampleInOrder, chunkCreated bool) {
-	// Based on Gorilla white papers this offers near-optimal compression ratio
-	// so anything bigger that this has diminishing returns and increases
-	// the time range within which we have to decompress all samples.
-	const samplesPerChunk = 12
-
 	c := s.head()
 
 	if c == nil {
@@ -2175,16 +2624,17 @@ func (s *memSeries) append(t int64, v []byte, appendID uint64, chunkDiskMapper *
 	// If we reach 25% of a chunk's desired sample count, set a definitive time
 	// at which to start the next chunk.
 	// At latest it must happen at the timestamp set when the chunk was cut.
-	if numSamples == samplesPerChunk/4 {
-		s.nextAt = computeChunkEndTime(c.minTime, c.maxTime, s.nextAt)
+	if q := s.chunkOpts.samples / 4; q > 0 && numSamples == q {
+		s.nextAt = computeChunkEndTime(c.minTime, t, s.nextAt)
 	}
-	if t >= s.nextAt {
+	if t >= s.nextAt || s.chunkOpts.full(numSamples, c.numBytes, len(v)) {
 		c = s.cutNewHeadChunk(t, chunkDiskMapper)
 		chunkCreated = true
 	}
 	s.app.Append(t, v)
 
 	c.maxTime = t
+	c.numBytes += len(v)
 
 	s.sampleBuf[0] = s.sampleBuf[1]
 	s.sampleBuf[1] = s.sampleBuf[2]
@@ -2198,6 +2648,46 @@ func (s *memSeries) append(t int64, v []byte, appendID uint64, chunkDiskMapper *
 	return true, chunkCreated
 }
 
+// chunkOpts limits the size of head chunks. Profiles vary from a few kilobytes
+// to megabytes in size, so chunks are limited in both samples and bytes.
+// Negative values disable the respective limit.
+type chunkOpts struct {
+	samples int
+	bytes   int
+	// compression of the values of new chunks, if set.
+	compression *chunkenc.Compression
+	// pprof creates chunks that store parsed pprof profiles.
+	pprof bool
+}
+
+func (o chunkOpts) newChunk() chunkenc.Chunk {
+	switch {
+	case o.pprof:
+		return chunkenc.NewPprofChunk()
+	case o.compression != nil:
+		return chunkenc.NewBytesCodecChunk(*o.compression)
+	default:
+		return chunkenc.NewBytesChunk()
+	}
+}
+
+// full returns whether a chunk with the given number of samples and bytes
+// must be cut before a value of n bytes is appended.
+func (o chunkOpts) full(samples, bytes, n int) bool {
+	if samples == 0 {
+		// A single value never gets split up across chunks.
+		return false
+	}
+	if samples >= math.MaxUint16 {
+		// Chunks cannot hold more samples.
+		return true
+	}
+	if o.samples > 0 && samples >= o.samples {
+		return true
+	}
+	return o.bytes > 0 && bytes+n > o.bytes
+}
+
 // cleanupAppendIDsBelow cleans up older appendIDs. Has to be called after
 // acquiring lock.
 func (s *memSeries) cleanupAppendIDsBelow(bound uint64) {
@@ -2205,10 +2695,15 @@ func (s *memSeries) cleanupAppendIDsBelow(bound uint64) {
 }
 
 // computeChunkEndTime estimates the end timestamp based the beginning of a
-// chunk, its current timestamp and the upper bound up to which we insert data.
-// It assumes that the time range is 1/4 full.
+// chunk, the timestamp of the sample after its first quarter and the upper
+// bound up to which we insert data. The number of chunks that fit into the
+// range is rounded up, so that evenly cut chunks do not hit the samples limit.
 func computeChunkEndTime(start, cur, max int64) int64 {
-	a := (max - start) / ((cur - start + 1) * 4)
+	n := (cur - start) * 4
+	if n <= 0 {
+		return max
+	}
+	a := (max - start + n - 1) / n
 	if a == 0 {
 		return max
 	}
@@ -2326,6 +2821,7 @@ func (s *memSeries) head() *memChunk {
 type memChunk struct {
 	chunk            chunkenc.Chunk
 	minTime, maxTime int64
+	numBytes         int // Size of the uncompressed values.
 }
 
 // OverlapsClosedInterval returns true if the chunk overlaps [mint, maxt].
@@ -2339,6 +2835,10 @@ type stopIterator struct {
 	i, stopAfter int
 }
 
+func (it *stopIterator) AtInfo() (int64, chunkenc.SampleInfo, bool) {
+	return chunkenc.AtInfo(it.Iterator)
+}
+
 func (it *stopIterator) Next() bool {
 	if it.i+1 >= it.stopAfter {
 		return false
@@ -2373,9 +2873,18 @@ func (it *memSafeIterator) At() (int64, []byte) {
 	return s.t, s.v
 }
 
+func (it *memSafeIterator) AtInfo() (int64, chunkenc.SampleInfo, bool) {
+	if it.total-it.i > 4 {
+		return chunkenc.AtInfo(it.Iterator)
+	}
+	s := it.buf[4-(it.total-it.i)]
+	return s.t, chunkenc.NewSampleInfo(s.v), true
+}
+
 type mmappedChunk struct {
 	ref              uint64
 	numSamples       uint16
+	enc              chunkenc.Encoding
 	minTime, maxTime int64
 }
 
@@ -21,7 +21,6 @@ import (
 	"strconv"
 	"testing"
 
-	"github.com/conprof/db/tsdb/chunks"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/atomic"
@@ -36,7 +35,7 @@ func BenchmarkHeadStripeSeriesCreate(b *testing.B) {
 		require.NoError(b, os.RemoveAll(chunkDir))
 	}()
 	// Put a series, select it. GC it and then access it.
-	h, err := NewHead(nil, nil, nil, 1000, chunkDir, nil, chunks.DefaultWriteBufferSize, DefaultStripeSize, nil)
+	h, err := NewHead(nil, nil, nil, &HeadOptions{ChunkRange: 1000, ChunkDirRoot: chunkDir})
 	require.NoError(b, err)
 	defer h.Close()
 
@@ -52,7 +51,7 @@ func BenchmarkHeadStripeSeriesCreateParallel(b *testing.B) {
 		require.NoError(b, os.RemoveAll(chunkDir))
 	}()
 	// Put a series, select it. GC it and then access it.
-	h, err := NewHead(nil, nil, nil, 1000, chunkDir, nil, chunks.DefaultWriteBufferSize, DefaultStripeSize, nil)
+	h, err := NewHead(nil, nil, nil, &HeadOptions{ChunkRange: 1000, ChunkDirRoot: chunkDir})
 	require.NoError(b, err)
 	defer h.Close()
 
@@ -72,7 +71,7 @@ func BenchmarkHeadAppender(b *testing.B) {
 
 	r := prometheus.NewRegistry()
 
-	h, err := NewHead(r, nil, nil, 100, chunkDir, nil, chunks.DefaultWriteBufferSize, DefaultStripeSize, nil)
+	h, err := NewHead(r, nil, nil, &HeadOptions{ChunkRange: 100, ChunkDirRoot: chunkDir})
 	require.NoError(b, err)
 	defer h.Close()
 
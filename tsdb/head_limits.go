@@ -0,0 +1,122 @@
+// Copyright 2021 The Conprof Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"sync"
+	"time"
+
+	"github.com/conprof/db/storage"
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+// Reasons of rejected samples, as reported by the
+// prometheus_tsdb_head_rejected_samples_total metric.
+const (
+	rejectSeriesLimit          = "series_limit"
+	rejectSeriesPerCommitLimit = "series_per_commit_limit"
+	rejectSampleSize           = "sample_size"
+	rejectIngestionRate        = "ingestion_rate"
+)
+
+// headLimits protect the head from clients that send too many series or too much data.
+// A zero value disables the respective limit.
+type headLimits struct {
+	maxSeries             uint64
+	maxNewSeriesPerCommit int
+	maxSampleBytes        int
+	ingestion             *rateLimiter
+}
+
+// limitSeries returns an error if the appender may not create the series of lset.
+// The series limit is approximate, as concurrent appenders may create
+// series at the same time.
+func (a *headAppender) limitSeries(hash uint64, lset labels.Labels) error {
+	lim := &a.head.limits
+	if lim.maxSeries == 0 && lim.maxNewSeriesPerCommit == 0 {
+		return nil
+	}
+	if a.head.series.getByHash(hash, lset) != nil {
+		return nil
+	}
+	if lim.maxSeries > 0 && a.head.NumSeries() >= lim.maxSeries {
+		a.head.metrics.rejectedSamples.WithLabelValues(rejectSeriesLimit).Inc()
+		return storage.ErrTooManySeries
+	}
+	if lim.maxNewSeriesPerCommit > 0 && len(a.series) >= lim.maxNewSeriesPerCommit {
+		a.head.metrics.rejectedSamples.WithLabelValues(rejectSeriesPerCommitLimit).Inc()
+		return storage.ErrTooManyNewSeries
+	}
+	return nil
+}
+
+// limitSample returns an error if a profile of the given size may not be appended.
+// The ingested bytes count against the rate limit even if the sample is
+// rejected later on or rolled back.
+func (a *headAppender) limitSample(size int) error {
+	lim := &a.head.limits
+	if lim.maxSampleBytes > 0 && size > lim.maxSampleBytes {
+		a.head.metrics.rejectedSamples.WithLabelValues(rejectSampleSize).Inc()
+		return storage.ErrSampleTooLarge
+	}
+	if lim.ingestion != nil && !lim.ingestion.allow(size) {
+		a.head.metrics.rejectedSamples.WithLabelValues(rejectIngestionRate).Inc()
+		return storage.ErrIngestionRateLimited
+	}
+	return nil
+}
+
+// rateLimiter is a token bucket that refills at rate tokens per second and holds
+// up to one second worth of tokens. Requests larger than that are allowed as soon
+// as the bucket is full and are paid back before further requests are allowed.
+type rateLimiter struct {
+	rate float64
+	now  func() time.Time
+
+	mtx    sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	return &rateLimiter{
+		rate:   float64(rate),
+		now:    time.Now,
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// allow takes n tokens from the bucket if there are enough of them.
+func (l *rateLimiter) allow(n int) bool {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	now := l.now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+
+	need := float64(n)
+	if need > l.rate {
+		need = l.rate
+	}
+	if l.tokens < need {
+		return false
+	}
+	l.tokens -= float64(n)
+	return true
+}
@@ -0,0 +1,236 @@
+// Copyright 2021 The Conprof Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/conprof/db/storage"
+	"github.com/conprof/db/tsdb/chunkenc"
+	"github.com/conprof/db/tsdb/chunks"
+	"github.com/conprof/db/tsdb/tombstones"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+// Late samples are kept apart from the chunks of their series, sorted by time.
+// Queries read them through an outOfOrderRangeHead that is merged with the head,
+// and compaction of the head merges them into the series of the new block.
+
+// insertOutOfOrder adds a late sample to the series.
+// It returns false if the series already holds a late sample with timestamp t.
+func (s *memSeries) insertOutOfOrder(t int64, v []byte) bool {
+	i := sort.Search(len(s.oooSamples), func(i int) bool { return s.oooSamples[i].t >= t })
+	if i < len(s.oooSamples) && s.oooSamples[i].t == t {
+		return false
+	}
+	s.oooSamples = append(s.oooSamples, sample{})
+	copy(s.oooSamples[i+1:], s.oooSamples[i:])
+	s.oooSamples[i] = sample{t: t, v: v}
+	return true
+}
+
+// outOfOrderSample returns the value of the late sample with timestamp t, if any.
+func (s *memSeries) outOfOrderSample(t int64) ([]byte, bool) {
+	i := sort.Search(len(s.oooSamples), func(i int) bool { return s.oooSamples[i].t >= t })
+	if i < len(s.oooSamples) && s.oooSamples[i].t == t {
+		return s.oooSamples[i].v, true
+	}
+	return nil, false
+}
+
+// hasInOrderSample returns whether the in-order chunks of the series hold a
+// sample with timestamp t.
+func (s *memSeries) hasInOrderSample(t int64, chunkDiskMapper *chunks.ChunkDiskMapper) (bool, error) {
+	var chks []chunkenc.Chunk
+	for _, mc := range s.mmappedChunks {
+		if t < mc.minTime || t > mc.maxTime {
+			continue
+		}
+		chk, err := chunkDiskMapper.Chunk(mc.ref)
+		if err != nil {
+			return false, errors.Wrap(err, "read m-mapped chunk")
+		}
+		chks = append(chks, chk)
+	}
+	if c := s.headChunk; c != nil && t >= c.minTime && t <= c.maxTime {
+		chks = append(chks, c.chunk)
+	}
+	for _, chk := range chks {
+		it := chk.Iterator(&chunkenc.BytesTimestampOnlyIterator{})
+		if it.Seek(t) {
+			if ts, _ := it.At(); ts == t {
+				return true, nil
+			}
+		}
+		if it.Err() != nil {
+			return false, it.Err()
+		}
+	}
+	return false, nil
+}
+
+// truncateOutOfOrderBefore removes all late samples before mint.
+func (s *memSeries) truncateOutOfOrderBefore(mint int64) {
+	i := sort.Search(len(s.oooSamples), func(i int) bool { return s.oooSamples[i].t >= mint })
+	if i == len(s.oooSamples) {
+		s.oooSamples = nil
+		return
+	}
+	// Readers copy the samples, so they can be moved in place.
+	s.oooSamples = append(s.oooSamples[:0], s.oooSamples[i:]...)
+}
+
+// outOfOrderRange returns a copy of the late samples within [mint, maxt].
+func (s *memSeries) outOfOrderRange(mint, maxt int64) []sample {
+	i := sort.Search(len(s.oooSamples), func(i int) bool { return s.oooSamples[i].t >= mint })
+	j := sort.Search(len(s.oooSamples), func(j int) bool { return s.oooSamples[j].t > maxt })
+	if i >= j {
+		return nil
+	}
+	return append([]sample(nil), s.oooSamples[i:j]...)
+}
+
+// hasOutOfOrder returns whether the head may hold late samples at or after mint.
+func (h *Head) hasOutOfOrder(mint int64) bool {
+	return mint <= h.oooMaxTime.Load()
+}
+
+// outOfOrderRangeHead reads the late samples of the head within [mint, maxt].
+// Its index holds all series of the head, but only those with late samples have chunks.
+// Late samples are not isolated from appends that are in progress.
+type outOfOrderRangeHead struct {
+	head       *Head
+	mint, maxt int64
+	chunks     *outOfOrderChunkReader
+}
+
+func newOutOfOrderRangeHead(head *Head, mint, maxt int64) *outOfOrderRangeHead {
+	return &outOfOrderRangeHead{
+		head:   head,
+		mint:   mint,
+		maxt:   maxt,
+		chunks: &outOfOrderChunkReader{chunks: map[uint64]chunkenc.Chunk{}},
+	}
+}
+
+func (h *outOfOrderRangeHead) Index() (IndexReader, error) {
+	return &outOfOrderIndexReader{
+		headIndexReader: h.head.indexRange(h.mint, h.maxt),
+		chunks:          h.chunks,
+	}, nil
+}
+
+func (h *outOfOrderRangeHead) Chunks() (ChunkReader, error) {
+	return h.chunks, nil
+}
+
+func (h *outOfOrderRangeHead) Tombstones() (tombstones.Reader, error) {
+	return h.head.tombstones, nil
+}
+
+func (h *outOfOrderRangeHead) Meta() BlockMeta {
+	return BlockMeta{
+		MinTime: h.mint,
+		MaxTime: h.maxt,
+		ULID:    h.head.Meta().ULID,
+		Stats: BlockStats{
+			NumSeries: h.head.NumSeries(),
+		},
+	}
+}
+
+// Size returns 0 as late samples are only kept in memory.
+func (h *outOfOrderRangeHead) Size() int64 {
+	return 0
+}
+
+// outOfOrderIndexReader builds chunks from the late samples of a series when
+// the series is looked up. Their references are only valid for its chunk reader.
+type outOfOrderIndexReader struct {
+	*headIndexReader
+	chunks *outOfOrderChunkReader
+}
+
+func (h *outOfOrderIndexReader) Series(ref uint64, lbls *labels.Labels, chks *[]chunks.Meta) error {
+	s := h.head.series.getByID(ref)
+	if s == nil {
+		h.head.metrics.seriesNotFound.Inc()
+		return storage.ErrNotFound
+	}
+	*lbls = append((*lbls)[:0], s.lset...)
+	*chks = (*chks)[:0]
+
+	s.Lock()
+	samples := s.outOfOrderRange(h.mint, h.maxt)
+	opts := s.chunkOpts
+	s.Unlock()
+
+	var (
+		c     chunkenc.Chunk
+		app   chunkenc.Appender
+		bytes int
+		err   error
+	)
+	for _, smpl := range samples {
+		if c == nil || opts.full(c.NumSamples(), bytes, len(smpl.v)) {
+			c = opts.newChunk()
+			if app, err = c.Appender(); err != nil {
+				return errors.Wrap(err, "create appender")
+			}
+			bytes = 0
+			*chks = append(*chks, chunks.Meta{
+				MinTime: smpl.t,
+				Ref:     h.chunks.add(c),
+			})
+		}
+		app.Append(smpl.t, smpl.v)
+		bytes += len(smpl.v)
+		(*chks)[len(*chks)-1].MaxTime = smpl.t
+	}
+	return nil
+}
+
+// outOfOrderChunkReader holds the chunks built by an outOfOrderIndexReader.
+type outOfOrderChunkReader struct {
+	mtx    sync.Mutex
+	chunks map[uint64]chunkenc.Chunk
+}
+
+func (cr *outOfOrderChunkReader) add(c chunkenc.Chunk) uint64 {
+	cr.mtx.Lock()
+	defer cr.mtx.Unlock()
+	ref := uint64(len(cr.chunks)) + 1
+	cr.chunks[ref] = c
+	return ref
+}
+
+func (cr *outOfOrderChunkReader) Chunk(ref uint64) (chunkenc.Chunk, error) {
+	cr.mtx.Lock()
+	defer cr.mtx.Unlock()
+	c, ok := cr.chunks[ref]
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+	return c, nil
+}
+
+// Close releases the chunks. Chunk must not be called after it.
+func (cr *outOfOrderChunkReader) Close() error {
+	cr.mtx.Lock()
+	cr.chunks = nil
+	cr.mtx.Unlock()
+	return nil
+}
@@ -14,6 +14,7 @@
 package tsdb
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io/ioutil"
@@ -23,8 +24,10 @@ import (
 	"path/filepath"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/conprof/db/storage"
 	"github.com/conprof/db/tsdb/chunkenc"
@@ -34,6 +37,7 @@ import (
 	"github.com/conprof/db/tsdb/tombstones"
 	"github.com/conprof/db/tsdb/tsdbutil"
 	"github.com/conprof/db/tsdb/wal"
+	"github.com/google/pprof/profile"
 	"github.com/pkg/errors"
 	prom_testutil "github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/require"
@@ -41,16 +45,18 @@ import (
 	"github.com/prometheus/prometheus/pkg/labels"
 )
 
+var defaultChunkOpts = chunkOpts{samples: DefaultSamplesPerChunk, bytes: DefaultChunkBytes}
+
 func newTestHead(t testing.TB, chunkRange int64, compressWAL bool) (*Head, *wal.WAL) {
 	dir, err := ioutil.TempDir("", "test")
 	require.NoError(t, err)
 	wlog, err := wal.NewSize(nil, nil, filepath.Join(dir, "wal"), 32768, compressWAL)
 	require.NoError(t, err)
 
-	h, err := NewHead(nil, nil, wlog, chunkRange, dir, nil, chunks.DefaultWriteBufferSize, DefaultStripeSize, nil)
+	h, err := NewHead(nil, nil, wlog, &HeadOptions{ChunkRange: chunkRange, ChunkDirRoot: dir})
 	require.NoError(t, err)
 
-	require.NoError(t, h.chunkDiskMapper.IterateAllChunks(func(_, _ uint64, _, _ int64, _ uint16) error { return nil }))
+	require.NoError(t, h.chunkDiskMapper.IterateAllChunks(func(_, _ uint64, _, _ int64, _ uint16, _ chunkenc.Encoding) error { return nil }))
 
 	t.Cleanup(func() {
 		require.NoError(t, os.RemoveAll(dir))
@@ -191,7 +197,7 @@ func BenchmarkLoadWAL(b *testing.B) {
 
 				// Load the WAL.
 				for i := 0; i < b.N; i++ {
-					h, err := NewHead(nil, nil, w, 1000, w.Dir(), nil, chunks.DefaultWriteBufferSize, DefaultStripeSize, nil)
+					h, err := NewHead(nil, nil, w, &HeadOptions{ChunkRange: 1000, ChunkDirRoot: w.Dir()})
 					require.NoError(b, err)
 					_ = h.Init(0)
 				}
@@ -302,7 +308,7 @@ func TestHead_WALMultiRef(t *testing.T) {
 	w, err = wal.New(nil, nil, w.Dir(), false)
 	require.NoError(t, err)
 
-	head, err = NewHead(nil, nil, w, 1000, w.Dir(), nil, chunks.DefaultWriteBufferSize, DefaultStripeSize, nil)
+	head, err = NewHead(nil, nil, w, &HeadOptions{ChunkRange: 1000, ChunkDirRoot: w.Dir()})
 	require.NoError(t, err)
 	require.NoError(t, head.Init(0))
 	defer func() {
@@ -433,7 +439,7 @@ func TestMemSeries_truncateChunks(t *testing.T) {
 		},
 	}
 
-	s := newMemSeries(labels.FromStrings("a", "b"), 1, 2000, &memChunkPool)
+	s := newMemSeries(labels.FromStrings("a", "b"), 1, 2000, defaultChunkOpts, &memChunkPool)
 
 	for i := 0; i < 4000; i += 5 {
 		ok, _ := s.append(int64(i), []byte(strconv.Itoa(i)), 0, chunkDiskMapper)
@@ -583,7 +589,7 @@ func TestHeadDeleteSimple(t *testing.T) {
 				// Compare the samples for both heads - before and after the reloadBlocks.
 				reloadedW, err := wal.New(nil, nil, w.Dir(), compress) // Use a new wal to ensure deleted samples are gone even after a reloadBlocks.
 				require.NoError(t, err)
-				reloadedHead, err := NewHead(nil, nil, reloadedW, 1000, reloadedW.Dir(), nil, chunks.DefaultWriteBufferSize, DefaultStripeSize, nil)
+				reloadedHead, err := NewHead(nil, nil, reloadedW, &HeadOptions{ChunkRange: 1000, ChunkDirRoot: reloadedW.Dir()})
 				require.NoError(t, err)
 				require.NoError(t, reloadedHead.Init(0))
 
@@ -932,10 +938,10 @@ func TestComputeChunkEndTime(t *testing.T) {
 			start: 100,
 			cur:   200,
 			max:   1000,
-			res:   550,
+			res:   400,
 		},
-		// Case where we fit floored 0 chunks. Must catch division by 0
-		// and default to maximum time.
+		// Case where less than a chunk fits. Rounds up to a single chunk
+		// up to the maximum time.
 		{
 			start: 0,
 			cur:   500,
@@ -947,7 +953,7 @@ func TestComputeChunkEndTime(t *testing.T) {
 			start: 100,
 			cur:   100,
 			max:   1000,
-			res:   104,
+			res:   1000,
 		},
 	}
 
@@ -972,7 +978,7 @@ func TestMemSeries_append(t *testing.T) {
 		require.NoError(t, chunkDiskMapper.Close())
 	}()
 
-	s := newMemSeries(labels.Labels{}, 1, 500, nil)
+	s := newMemSeries(labels.Labels{}, 1, 500, defaultChunkOpts, nil)
 
 	// Add first two samples at the very end of a chunk range and the next two
 	// on and after it.
@@ -1013,7 +1019,479 @@ func TestMemSeries_append(t *testing.T) {
 		chk, err := chunkDiskMapper.Chunk(c.ref)
 		require.NoError(t, err)
 		require.Greater(t, chk.NumSamples(), 10, "unexpected small chunk %d of length %d", i, chk.NumSamples())
+		require.LessOrEqual(t, chk.NumSamples(), DefaultSamplesPerChunk, "unexpected large chunk %d of length %d", i, chk.NumSamples())
+	}
+}
+
+func TestMemSeries_append_chunkBytes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "append_bytes")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+	chunkDiskMapper, err := chunks.NewChunkDiskMapper(dir, chunkenc.NewPool(), chunks.DefaultWriteBufferSize)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, chunkDiskMapper.Close())
+	}()
+
+	// Only cut on the size of the values.
+	s := newMemSeries(labels.Labels{}, 1, 10000, chunkOpts{samples: -1, bytes: 100}, nil)
+
+	v := make([]byte, 30)
+	for i := 0; i < 10; i++ {
+		ok, chunkCreated := s.append(int64(i), v, 0, chunkDiskMapper)
+		require.True(t, ok, "append failed")
+		require.Equal(t, i%3 == 0, chunkCreated, "sample %d", i)
+	}
+	require.Equal(t, 3, len(s.mmappedChunks))
+	for _, c := range s.mmappedChunks {
+		chk, err := chunkDiskMapper.Chunk(c.ref)
+		require.NoError(t, err)
+		require.Equal(t, 3, chk.NumSamples())
+	}
+
+	// A value larger than the limit gets a chunk of its own.
+	ok, chunkCreated := s.append(10, make([]byte, 200), 0, chunkDiskMapper)
+	require.True(t, ok, "append failed")
+	require.True(t, chunkCreated)
+	ok, chunkCreated = s.append(11, v, 0, chunkDiskMapper)
+	require.True(t, ok, "append failed")
+	require.True(t, chunkCreated)
+}
+
+func TestHead_ChunkCompression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_chunk_compression")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	_, err = NewHead(nil, nil, nil, &HeadOptions{ChunkRange: 1000, ChunkDirRoot: dir, ChunkCompression: &chunkenc.Compression{Codec: chunkenc.CodecS2 + 1}})
+	require.Error(t, err)
+
+	value := func(i int) []byte {
+		return []byte(strings.Repeat("runtime.mallocgc\n", 10) + strconv.Itoa(i))
+	}
+	for _, tc := range []struct {
+		comp     chunkenc.Compression
+		encoding chunkenc.Encoding
+	}{
+		{comp: chunkenc.Compression{Codec: chunkenc.CodecSnappy}, encoding: chunkenc.EncBytesCodec},
+		{comp: chunkenc.Compression{Delta: true}, encoding: chunkenc.EncBytesDelta},
+	} {
+		t.Run(tc.encoding.String(), func(t *testing.T) {
+			h, err := NewHead(nil, nil, nil, &HeadOptions{ChunkRange: 1000, ChunkDirRoot: filepath.Join(dir, tc.encoding.String()), ChunkCompression: &tc.comp})
+			require.NoError(t, err)
+			defer func() {
+				require.NoError(t, h.Close())
+			}()
+
+			app := h.Appender(context.Background())
+			for i := 0; i < 30; i++ {
+				_, err := app.Add(labels.FromStrings("a", "b"), int64(i), value(i))
+				require.NoError(t, err)
+			}
+			require.NoError(t, app.Commit())
+
+			s := h.series.getByHash(labels.FromStrings("a", "b").Hash(), labels.FromStrings("a", "b"))
+			require.NotEmpty(t, s.mmappedChunks)
+			for _, c := range s.mmappedChunks {
+				chk, err := h.chunkDiskMapper.Chunk(c.ref)
+				require.NoError(t, err)
+				require.Equal(t, tc.encoding, chk.Encoding())
+				require.True(t, chunkenc.CompressedWith(chk, tc.comp))
+			}
+			require.True(t, chunkenc.CompressedWith(s.headChunk.chunk, tc.comp))
+
+			q, err := NewBlockQuerier(h, 0, 29)
+			require.NoError(t, err)
+			ss := q.Select(false, nil, labels.MustNewMatcher(labels.MatchEqual, "a", "b"))
+			require.True(t, ss.Next())
+			it := ss.At().Iterator()
+			for i := 0; i < 30; i++ {
+				require.True(t, it.Next())
+				ts, v := it.At()
+				require.Equal(t, int64(i), ts)
+				require.Equal(t, value(i), v)
+			}
+			require.False(t, it.Next())
+			require.NoError(t, it.Err())
+			require.False(t, ss.Next())
+			require.NoError(t, q.Close())
+		})
+	}
+}
+
+func TestHead_PprofChunks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_pprof_chunks")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	_, err = NewHead(nil, nil, nil, &HeadOptions{ChunkRange: 1000, ChunkDirRoot: dir, PprofChunks: true, ChunkCompression: &chunkenc.Compression{}})
+	require.Error(t, err)
+
+	value := func(i int) []byte {
+		fn := &profile.Function{ID: 1, Name: "runtime.mallocgc"}
+		loc := &profile.Location{ID: 1, Line: []profile.Line{{Function: fn}}}
+		p := &profile.Profile{
+			SampleType: []*profile.ValueType{{Type: "alloc_space", Unit: "bytes"}},
+			Sample:     []*profile.Sample{{Location: []*profile.Location{loc}, Value: []int64{int64(i)}}},
+			Location:   []*profile.Location{loc},
+			Function:   []*profile.Function{fn},
+		}
+		var buf bytes.Buffer
+		require.NoError(t, p.Write(&buf))
+		return buf.Bytes()
+	}
+
+	h, err := NewHead(nil, nil, nil, &HeadOptions{ChunkRange: 1000, ChunkDirRoot: dir, PprofChunks: true})
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, h.Close())
+	}()
+
+	app := h.Appender(context.Background())
+	for i := 0; i < 30; i++ {
+		_, err := app.Add(labels.FromStrings("a", "b"), int64(i), value(i))
+		require.NoError(t, err)
+	}
+	require.NoError(t, app.Commit())
+
+	s := h.series.getByHash(labels.FromStrings("a", "b").Hash(), labels.FromStrings("a", "b"))
+	require.NotEmpty(t, s.mmappedChunks)
+	for _, c := range s.mmappedChunks {
+		chk, err := h.chunkDiskMapper.Chunk(c.ref)
+		require.NoError(t, err)
+		require.Equal(t, chunkenc.EncPprof, chk.Encoding())
+	}
+
+	q, err := NewBlockQuerier(h, 0, 29)
+	require.NoError(t, err)
+	ss := q.Select(false, nil, labels.MustNewMatcher(labels.MatchEqual, "a", "b"))
+	require.True(t, ss.Next())
+	it := ss.At().Iterator()
+	for i := 0; i < 30; i++ {
+		require.True(t, it.Next())
+		ts, v := it.At()
+		require.Equal(t, int64(i), ts)
+		p, err := profile.ParseData(v)
+		require.NoError(t, err)
+		require.Equal(t, []int64{int64(i)}, p.Sample[0].Value)
+		require.Equal(t, "runtime.mallocgc", p.Sample[0].Location[0].Line[0].Function.Name)
+	}
+	require.False(t, it.Next())
+	require.NoError(t, it.Err())
+	require.False(t, ss.Next())
+	require.NoError(t, q.Close())
+}
+
+func TestHead_FloatSamples(t *testing.T) {
+	head, w := newTestHead(t, 1000, false)
+
+	cpu := labels.FromStrings("__name__", "cpu_nanoseconds")
+	heap := labels.FromStrings("__name__", "heap")
+
+	app := head.Appender(context.Background())
+	ref, err := app.AddFloat(cpu, 0, 0.5)
+	require.NoError(t, err)
+	for i := 1; i < 25; i++ {
+		require.NoError(t, app.AddFloatFast(ref, int64(i*100), float64(i)+0.5))
+	}
+	_, err = app.Add(heap, 0, []byte("heap profile"))
+	require.NoError(t, err)
+
+	// A series holds either profiles or numeric samples.
+	_, err = app.Add(cpu, 2500, []byte("profile"))
+	require.Equal(t, storage.ErrSampleTypeMismatch, errors.Cause(err))
+	_, err = app.AddFloat(heap, 100, 1)
+	require.Equal(t, storage.ErrSampleTypeMismatch, errors.Cause(err))
+	require.NoError(t, app.Commit())
+
+	s := head.series.getByHash(cpu.Hash(), cpu)
+	require.Len(t, s.mmappedChunks, 2)
+	require.Equal(t, chunkenc.EncXOR, s.headChunk.chunk.Encoding())
+	for _, c := range s.mmappedChunks {
+		chk, err := head.chunkDiskMapper.Chunk(c.ref)
+		require.NoError(t, err)
+		require.Equal(t, chunkenc.EncXOR, chk.Encoding())
+	}
+
+	check := func(h *Head) {
+		q, err := NewBlockQuerier(h, 0, 2400)
+		require.NoError(t, err)
+		defer func() {
+			require.NoError(t, q.Close())
+		}()
+		ss := q.Select(false, nil, labels.MustNewMatcher(labels.MatchEqual, "__name__", "cpu_nanoseconds"))
+		require.True(t, ss.Next())
+		it := chunkenc.NewFloatIterator(ss.At().Iterator())
+		for i := 0; i < 25; i++ {
+			require.True(t, it.Next())
+			ts, v := it.AtFloat()
+			require.Equal(t, int64(i*100), ts)
+			require.Equal(t, float64(i)+0.5, v)
+		}
+		require.False(t, it.Next())
+		require.NoError(t, it.Err())
+		require.False(t, ss.Next())
+		require.NoError(t, ss.Err())
+	}
+	check(head)
+	require.NoError(t, head.Close())
+
+	// The value type of series is restored from the m-mapped chunks and the WAL.
+	w, err = wal.New(nil, nil, w.Dir(), false)
+	require.NoError(t, err)
+	head, err = NewHead(nil, nil, w, &HeadOptions{ChunkRange: 1000, ChunkDirRoot: filepath.Dir(w.Dir())})
+	require.NoError(t, err)
+	require.NoError(t, head.Init(0))
+	defer func() {
+		require.NoError(t, head.Close())
+	}()
+	check(head)
+	s = head.series.getByHash(cpu.Hash(), cpu)
+	require.Equal(t, chunkenc.EncXOR, s.headChunk.chunk.Encoding())
+
+	app = head.Appender(context.Background())
+	_, err = app.Add(cpu, 2500, []byte("profile"))
+	require.Equal(t, storage.ErrSampleTypeMismatch, errors.Cause(err))
+	_, err = app.AddFloat(heap, 2500, 1)
+	require.Equal(t, storage.ErrSampleTypeMismatch, errors.Cause(err))
+	_, err = app.AddFloat(cpu, 2500, 25.5)
+	require.NoError(t, err)
+	require.NoError(t, app.Commit())
+}
+
+func TestHead_OutOfOrderSamples(t *testing.T) {
+	head, w := newTestHead(t, 1000, false)
+	head.oooTimeWindow = 200
+
+	heap := labels.FromStrings("__name__", "heap")
+	cpu := labels.FromStrings("__name__", "cpu_nanoseconds")
+
+	app := head.Appender(context.Background())
+	for ts := int64(0); ts <= 600; ts += 100 {
+		_, err := app.Add(heap, ts, []byte(fmt.Sprintf("heap %d", ts)))
+		require.NoError(t, err)
+		_, err = app.AddFloat(cpu, ts, float64(ts))
+		require.NoError(t, err)
+	}
+	require.NoError(t, app.Commit())
+
+	app = head.Appender(context.Background())
+	_, err := app.Add(heap, 450, []byte("late"))
+	require.NoError(t, err)
+	// Samples further behind than the window and late numeric samples are rejected.
+	_, err = app.Add(heap, 350, []byte("too late"))
+	require.Equal(t, storage.ErrOutOfOrderSample, err)
+	_, err = app.AddFloat(cpu, 450, 1)
+	require.Equal(t, storage.ErrOutOfOrderSample, err)
+	require.NoError(t, app.Commit())
+
+	app = head.Appender(context.Background())
+	_, err = app.Add(heap, 450, []byte("other"))
+	require.Equal(t, storage.ErrDuplicateSampleForTimestamp, err)
+	_, err = app.Add(heap, 450, []byte("late"))
+	require.NoError(t, err)
+	require.NoError(t, app.Commit())
+
+	require.Equal(t, 1.0, prom_testutil.ToFloat64(head.metrics.oooSamplesAppended))
+	require.Equal(t, 2.0, prom_testutil.ToFloat64(head.metrics.outOfOrderSamples))
+
+	s := head.series.getByHash(heap.Hash(), heap)
+	require.Equal(t, []sample{{t: 450, v: []byte("late")}}, s.oooSamples)
+	require.Equal(t, 7, s.headChunk.chunk.NumSamples())
+	require.True(t, head.hasOutOfOrder(0))
+	require.NoError(t, head.Close())
+
+	// Late samples are restored from the WAL.
+	w, err = wal.New(nil, nil, w.Dir(), false)
+	require.NoError(t, err)
+	head, err = NewHead(nil, nil, w, &HeadOptions{ChunkRange: 1000, ChunkDirRoot: filepath.Dir(w.Dir()), OutOfOrderTimeWindow: 200})
+	require.NoError(t, err)
+	require.NoError(t, head.Init(0))
+	defer func() {
+		require.NoError(t, head.Close())
+	}()
+	s = head.series.getByHash(heap.Hash(), heap)
+	require.Equal(t, []sample{{t: 450, v: []byte("late")}}, s.oooSamples)
+	require.Equal(t, 7, s.headChunk.chunk.NumSamples())
+	require.True(t, head.hasOutOfOrder(0))
+
+	require.NoError(t, head.Truncate(500))
+	require.Empty(t, s.oooSamples)
+	require.False(t, head.hasOutOfOrder(0))
+}
+
+func TestHead_OutOfOrderDuplicatesInOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_ooo_duplicates")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	head, err := NewHead(nil, nil, nil, &HeadOptions{ChunkRange: 1000, ChunkDirRoot: dir, SamplesPerChunk: 4, OutOfOrderTimeWindow: 500})
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, head.Close())
+	}()
+
+	lset := labels.FromStrings("__name__", "heap")
+	app := head.Appender(context.Background())
+	for ts := int64(0); ts <= 600; ts += 100 {
+		_, err := app.Add(lset, ts, []byte(fmt.Sprintf("heap %d", ts)))
+		require.NoError(t, err)
 	}
+	require.NoError(t, app.Commit())
+	s := head.series.getByHash(lset.Hash(), lset)
+	require.Equal(t, 1, len(s.mmappedChunks))
+
+	// Late samples must not duplicate samples of the m-mapped or the head chunk,
+	// even if they are identical.
+	app = head.Appender(context.Background())
+	for _, ts := range []int64{100, 500} {
+		_, err = app.Add(lset, ts, []byte("other"))
+		require.Equal(t, storage.ErrDuplicateSampleForTimestamp, err)
+		_, err = app.Add(lset, ts, []byte(fmt.Sprintf("heap %d", ts)))
+		require.Equal(t, storage.ErrDuplicateSampleForTimestamp, err)
+	}
+	_, err = app.Add(lset, 450, []byte("late"))
+	require.NoError(t, err)
+	require.NoError(t, app.Commit())
+	require.Equal(t, []sample{{t: 450, v: []byte("late")}}, s.oooSamples)
+}
+
+func TestHead_OutOfOrderTimeWindow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_ooo_window")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	for _, window := range []int64{-1, 501} {
+		_, err := NewHead(nil, nil, nil, &HeadOptions{ChunkRange: 1000, ChunkDirRoot: dir, OutOfOrderTimeWindow: window})
+		require.Error(t, err)
+	}
+
+	// Without a window late samples are rejected, also if the series only has m-mapped chunks.
+	head, err := NewHead(nil, nil, nil, &HeadOptions{ChunkRange: 1000, ChunkDirRoot: dir})
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, head.Close())
+	}()
+	s, _, err := head.getOrCreate(1, labels.FromStrings("a", "1"))
+	require.NoError(t, err)
+	s.valueType = valueTypeBytes
+	s.mmappedChunks = []*mmappedChunk{{minTime: 0, maxTime: 100}}
+	_, err = s.appendable(50, []byte("late"), valueTypeBytes, math.MaxInt64)
+	require.Equal(t, storage.ErrOutOfOrderSample, err)
+	late, err := s.appendable(50, []byte("late"), valueTypeBytes, 0)
+	require.NoError(t, err)
+	require.True(t, late)
+	late, err = s.appendable(150, []byte("new"), valueTypeBytes, 0)
+	require.NoError(t, err)
+	require.False(t, late)
+}
+
+func TestHeadAppender_Limits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_limits")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	_, err = NewHead(nil, nil, nil, &HeadOptions{ChunkRange: 1000, ChunkDirRoot: dir, MaxSampleBytes: -1})
+	require.Error(t, err)
+
+	head, err := NewHead(nil, nil, nil, &HeadOptions{
+		ChunkRange:                 1000,
+		ChunkDirRoot:               dir,
+		MaxSeries:                  3,
+		MaxNewSeriesPerCommit:      2,
+		MaxSampleBytes:             4,
+		MaxIngestionBytesPerSecond: 10,
+	})
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, head.Close())
+	}()
+	now := time.Unix(0, 0)
+	head.limits.ingestion.now = func() time.Time { return now }
+	head.limits.ingestion.last = now
+	rejected := func(reason string) float64 {
+		return prom_testutil.ToFloat64(head.metrics.rejectedSamples.WithLabelValues(reason))
+	}
+
+	// Only two new series may be created per commit, but existing ones can still be appended to.
+	app := head.Appender(context.Background())
+	ref, err := app.Add(labels.FromStrings("a", "1"), 0, []byte("1"))
+	require.NoError(t, err)
+	_, err = app.Add(labels.FromStrings("a", "2"), 0, []byte("2"))
+	require.NoError(t, err)
+	_, err = app.Add(labels.FromStrings("a", "3"), 0, []byte("3"))
+	require.Equal(t, storage.ErrTooManyNewSeries, err)
+	require.NoError(t, app.AddFast(ref, 1, []byte("1")))
+	require.NoError(t, app.Commit())
+	require.Equal(t, 1.0, rejected(rejectSeriesPerCommitLimit))
+	require.Equal(t, uint64(2), head.NumSeries())
+
+	// Samples larger than the limit are rejected before their series is created.
+	app = head.Appender(context.Background())
+	_, err = app.Add(labels.FromStrings("a", "3"), 2, []byte("12345"))
+	require.Equal(t, storage.ErrSampleTooLarge, err)
+	require.Equal(t, storage.ErrSampleTooLarge, app.AddFast(ref, 2, []byte("12345")))
+	require.Equal(t, uint64(2), head.NumSeries())
+	require.Equal(t, 2.0, rejected(rejectSampleSize))
+
+	// 4 bytes of the burst of 10 bytes per second were used by the first commit.
+	_, err = app.Add(labels.FromStrings("a", "3"), 2, []byte("1234"))
+	require.NoError(t, err)
+	require.NoError(t, app.AddFast(ref, 2, []byte("12")))
+	require.Equal(t, storage.ErrIngestionRateLimited, app.AddFast(ref, 3, []byte("1")))
+	require.Equal(t, 1.0, rejected(rejectIngestionRate))
+	now = now.Add(500 * time.Millisecond)
+	require.NoError(t, app.AddFast(ref, 3, []byte("1234")))
+	require.NoError(t, app.Commit())
+
+	// The head holds the maximum number of series.
+	now = now.Add(time.Second)
+	app = head.Appender(context.Background())
+	_, err = app.Add(labels.FromStrings("a", "4"), 4, []byte("4"))
+	require.Equal(t, storage.ErrTooManySeries, err)
+	_, err = app.Add(labels.FromStrings("a", "3"), 4, []byte("4"))
+	require.NoError(t, err)
+	require.NoError(t, app.Commit())
+	require.Equal(t, 1.0, rejected(rejectSeriesLimit))
+	require.Equal(t, uint64(3), head.NumSeries())
+}
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := newRateLimiter(100)
+	l.now = func() time.Time { return now }
+	l.last = now
+
+	require.True(t, l.allow(60))
+	require.False(t, l.allow(50))
+	require.True(t, l.allow(40))
+	require.False(t, l.allow(1))
+
+	// Tokens are refilled up to one second worth.
+	now = now.Add(time.Hour)
+	require.True(t, l.allow(100))
+	require.False(t, l.allow(1))
+
+	// Requests larger than the burst need a full bucket and are paid back.
+	now = now.Add(500 * time.Millisecond)
+	require.False(t, l.allow(150))
+	now = now.Add(500 * time.Millisecond)
+	require.True(t, l.allow(150))
+	now = now.Add(time.Second)
+	require.False(t, l.allow(60))
+	require.True(t, l.allow(50))
 }
 
 func TestGCChunkAccess(t *testing.T) {
@@ -1268,7 +1746,7 @@ func TestWalRepair_DecodingError(t *testing.T) {
 						require.NoError(t, w.Log(test.rec))
 					}
 
-					h, err := NewHead(nil, nil, w, 1, w.Dir(), nil, chunks.DefaultWriteBufferSize, DefaultStripeSize, nil)
+					h, err := NewHead(nil, nil, w, &HeadOptions{ChunkRange: 1, ChunkDirRoot: w.Dir()})
 					require.NoError(t, err)
 					require.Equal(t, 0.0, prom_testutil.ToFloat64(h.metrics.walCorruptionsTotal))
 					initErr := h.Init(math.MinInt64)
@@ -1323,7 +1801,7 @@ func TestHeadReadWriterRepair(t *testing.T) {
 		w, err := wal.New(nil, nil, walDir, false)
 		require.NoError(t, err)
 
-		h, err := NewHead(nil, nil, w, chunkRange, dir, nil, chunks.DefaultWriteBufferSize, DefaultStripeSize, nil)
+		h, err := NewHead(nil, nil, w, &HeadOptions{ChunkRange: chunkRange, ChunkDirRoot: dir})
 		require.NoError(t, err)
 		require.Equal(t, 0.0, prom_testutil.ToFloat64(h.metrics.mmapChunkCorruptionTotal))
 		require.NoError(t, h.Init(math.MinInt64))
@@ -1557,7 +2035,7 @@ func TestMemSeriesIsolation(t *testing.T) {
 
 	wlog, err := wal.NewSize(nil, nil, w.Dir(), 32768, false)
 	require.NoError(t, err)
-	hb, err = NewHead(nil, nil, wlog, 1000, wlog.Dir(), nil, chunks.DefaultWriteBufferSize, DefaultStripeSize, nil)
+	hb, err = NewHead(nil, nil, wlog, &HeadOptions{ChunkRange: 1000, ChunkDirRoot: wlog.Dir()})
 	defer func() { require.NoError(t, hb.Close()) }()
 	require.NoError(t, err)
 	require.NoError(t, hb.Init(0))
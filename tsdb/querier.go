@@ -123,28 +123,25 @@ func NewBlockQuerier(b BlockReader, mint, maxt int64) (storage.Querier, error) {
 func (q *blockQuerier) Select(sortSeries bool, hints *storage.SelectHints, ms ...*labels.Matcher) storage.SeriesSet {
 	mint := q.mint
 	maxt := q.maxt
+	limits, err := newSeriesLimits(hints)
+	if err != nil {
+		return storage.ErrSeriesSet(err)
+	}
 	p, err := PostingsForMatchers(q.index, ms...)
 	if err != nil {
 		return storage.ErrSeriesSet(err)
 	}
-	if sortSeries {
+	if sortSeries || limits.paginated() {
 		p = q.index.SortedPostings(p)
 	}
 
+	projection := storage.ProjectionFull
 	if hints != nil {
 		mint = hints.Start
 		maxt = hints.End
-		if hints.Func == "series" {
-			// When you're only looking up metadata (for example series API), you don't need to load any chunks.
-			return newBlockSeriesSet(q.index, newNopChunkReader(), q.tombstones, p, mint, maxt)
-		}
-		if hints.Func == "timestamps" {
-			// When only querying timestamps we don't care about values.
-			return newBlockSeriesSet(q.index, newTimestampChunkReader(q.chunks), q.tombstones, p, mint, maxt)
-		}
+		projection = projectionOf(hints)
 	}
-
-	return newBlockSeriesSet(q.index, q.chunks, q.tombstones, p, mint, maxt)
+	return newBlockSeriesSet(q.index, q.chunks, q.tombstones, p, mint, maxt, projection, limits)
 }
 
 // blockChunkQuerier provides chunk querying access to a single block database.
@@ -164,18 +161,69 @@ func NewBlockChunkQuerier(b BlockReader, mint, maxt int64) (storage.ChunkQuerier
 func (q *blockChunkQuerier) Select(sortSeries bool, hints *storage.SelectHints, ms ...*labels.Matcher) storage.ChunkSeriesSet {
 	mint := q.mint
 	maxt := q.maxt
+	projection := storage.ProjectionFull
 	if hints != nil {
 		mint = hints.Start
 		maxt = hints.End
+		projection = projectionOf(hints)
+	}
+	limits, err := newSeriesLimits(hints)
+	if err != nil {
+		return storage.ErrChunkSeriesSet(err)
 	}
 	p, err := PostingsForMatchers(q.index, ms...)
 	if err != nil {
 		return storage.ErrChunkSeriesSet(err)
 	}
-	if sortSeries {
+	if sortSeries || limits.paginated() {
 		p = q.index.SortedPostings(p)
 	}
-	return newBlockChunkSeriesSet(q.index, q.chunks, q.tombstones, p, mint, maxt)
+	return newBlockChunkSeriesSet(q.index, q.chunks, q.tombstones, p, mint, maxt, projection, limits)
+}
+
+// projectionOf returns the projection of hints. The funcs "series" and
+// "timestamps", which selected them before projections were added, select
+// the matching projection if none is set.
+func projectionOf(hints *storage.SelectHints) storage.Projection {
+	if hints.Projection != storage.ProjectionFull {
+		return hints.Projection
+	}
+	switch hints.Func {
+	case "series":
+		return storage.ProjectionLabels
+	case "timestamps":
+		return storage.ProjectionTimestamps
+	}
+	return storage.ProjectionFull
+}
+
+// seriesLimits are the limits and the continuation of the SelectHints of a select.
+type seriesLimits struct {
+	limit       int
+	sampleLimit int
+	order       storage.Order
+	after       *storage.Continuation
+}
+
+func newSeriesLimits(hints *storage.SelectHints) (seriesLimits, error) {
+	if hints == nil {
+		return seriesLimits{}, nil
+	}
+	after, err := storage.ParseContinuationToken(hints.After)
+	if err != nil {
+		return seriesLimits{}, err
+	}
+	return seriesLimits{
+		limit:       hints.Limit,
+		sampleLimit: hints.SampleLimit,
+		order:       hints.Order,
+		after:       after,
+	}, nil
+}
+
+// paginated returns whether series have to be sorted by labels to apply the limits.
+func (l seriesLimits) paginated() bool {
+	return l.limit > 0 || l.after != nil
 }
 
 func findSetMatches(pattern string) []string {
@@ -382,6 +430,10 @@ type blockBaseSeriesSet struct {
 	chunks     ChunkReader
 	tombstones tombstones.Reader
 	mint, maxt int64
+	projection storage.Projection
+	limits     seriesLimits
+	// n is the number of series returned so far.
+	n int
 
 	currIterFn func() *populateWithDelGenericSeriesIterator
 	currLabels labels.Labels
@@ -392,6 +444,9 @@ type blockBaseSeriesSet struct {
 }
 
 func (b *blockBaseSeriesSet) Next() bool {
+	if b.limits.limit > 0 && b.n >= b.limits.limit {
+		return false
+	}
 	for b.p.Next() {
 		if err := b.index.Series(b.p.At(), &b.bufLbls, &b.bufChks); err != nil {
 			// Postings may be stale. Skip if no underlying series exists.
@@ -406,6 +461,20 @@ func (b *blockBaseSeriesSet) Next() bool {
 			continue
 		}
 
+		mint, maxt := b.mint, b.maxt
+		if after := b.limits.after; after != nil {
+			// Series are sorted by labels, skip those read before the continuation.
+			c := labels.Compare(b.bufLbls, after.Labels)
+			if c < 0 || c == 0 && !after.Partial {
+				continue
+			}
+			if c == 0 && b.limits.order == storage.OrderNewestFirst && after.T-1 < maxt {
+				maxt = after.T - 1
+			} else if c == 0 && b.limits.order != storage.OrderNewestFirst && after.T+1 > mint {
+				mint = after.T + 1
+			}
+		}
+
 		intervals, err := b.tombstones.Get(b.p.At())
 		if err != nil {
 			b.err = errors.Wrap(err, "get tombstones")
@@ -424,10 +493,10 @@ func (b *blockBaseSeriesSet) Next() bool {
 
 		// Prefilter chunks and pick those which are not entirely deleted or totally outside of the requested range.
 		for _, chk := range b.bufChks {
-			if chk.MaxTime < b.mint {
+			if chk.MaxTime < mint {
 				continue
 			}
-			if chk.MinTime > b.maxt {
+			if chk.MinTime > maxt {
 				continue
 			}
 
@@ -436,10 +505,10 @@ func (b *blockBaseSeriesSet) Next() bool {
 			}
 
 			// If still not entirely deleted, check if trim is needed based on requested time range.
-			if chk.MinTime < b.mint {
+			if chk.MinTime < mint {
 				trimFront = true
 			}
-			if chk.MaxTime > b.maxt {
+			if chk.MaxTime > maxt {
 				trimBack = true
 			}
 		}
@@ -449,23 +518,85 @@ func (b *blockBaseSeriesSet) Next() bool {
 		}
 
 		if trimFront {
-			intervals = intervals.Add(tombstones.Interval{Mint: math.MinInt64, Maxt: b.mint - 1})
+			intervals = intervals.Add(tombstones.Interval{Mint: math.MinInt64, Maxt: mint - 1})
 		}
 		if trimBack {
-			intervals = intervals.Add(tombstones.Interval{Mint: b.maxt + 1, Maxt: math.MaxInt64})
+			intervals = intervals.Add(tombstones.Interval{Mint: maxt + 1, Maxt: math.MaxInt64})
+		}
+
+		if b.limits.sampleLimit > 0 && b.projection != storage.ProjectionLabels {
+			var err error
+			chks, intervals, err = b.limitSamples(chks, intervals)
+			if err != nil {
+				b.err = err
+				return false
+			}
+			if len(chks) == 0 {
+				continue
+			}
 		}
 
 		b.currLabels = make(labels.Labels, len(b.bufLbls))
 		copy(b.currLabels, b.bufLbls)
 
+		series := b.p.At()
 		b.currIterFn = func() *populateWithDelGenericSeriesIterator {
-			return newPopulateWithDelGenericSeriesIterator(b.chunks, chks, intervals)
+			it := newPopulateWithDelGenericSeriesIterator(b.chunks, chks, intervals)
+			it.series = series
+			it.projection = b.projection
+			return it
 		}
+		b.n++
 		return true
 	}
 	return false
 }
 
+// limitSamples trims the chunks of a series to the first samples in the order
+// of the limits. The chunks are read to count their samples, using their
+// timestamps only, and the samples after the limit are deleted like tombstones.
+func (b *blockBaseSeriesSet) limitSamples(chks []chunks.Meta, intervals tombstones.Intervals) ([]chunks.Meta, tombstones.Intervals, error) {
+	var (
+		n       = b.limits.sampleLimit
+		newest  = b.limits.order == storage.OrderNewestFirst
+		it      = &DeletedIterator{}
+		reuse   = &chunkenc.BytesTimestampOnlyIterator{}
+		ts      []int64
+		counted int
+	)
+	for i := range chks {
+		if newest {
+			i = len(chks) - 1 - i
+		}
+		c, err := b.chunks.Chunk(chks[i].Ref)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "cannot populate chunk %d", chks[i].Ref)
+		}
+		it.Iter = c.Iterator(reuse)
+		it.Intervals = intervals
+		ts = ts[:0]
+		for it.Next() {
+			t, _ := it.At()
+			ts = append(ts, t)
+		}
+		if err := it.Err(); err != nil {
+			return nil, nil, errors.Wrapf(err, "iterate chunk %d", chks[i].Ref)
+		}
+		if counted+len(ts) < n {
+			counted += len(ts)
+			continue
+		}
+		// The limit is reached within this chunk.
+		if newest {
+			t := ts[len(ts)-(n-counted)]
+			return chks[i:], intervals.Add(tombstones.Interval{Mint: math.MinInt64, Maxt: t - 1}), nil
+		}
+		t := ts[n-counted-1]
+		return chks[:i+1], intervals.Add(tombstones.Interval{Mint: t + 1, Maxt: math.MaxInt64}), nil
+	}
+	return chks, intervals, nil
+}
+
 func (b *blockBaseSeriesSet) Err() error {
 	if b.err != nil {
 		return b.err
@@ -486,6 +617,10 @@ type populateWithDelGenericSeriesIterator struct {
 	chunks ChunkReader
 	// chks are expected to be sorted by minTime and should be related to the same, single series.
 	chks []chunks.Meta
+	// series is the reference of the series of chks, used to report corrupted chunks.
+	series uint64
+	// projection is applied to the chunks after they are trimmed or re-encoded.
+	projection storage.Projection
 
 	i         int
 	err       error
@@ -519,6 +654,10 @@ func (p *populateWithDelGenericSeriesIterator) next() bool {
 	p.currChkMeta = p.chks[p.i]
 
 	p.currChkMeta.Chunk, p.err = p.chunks.Chunk(p.currChkMeta.Ref)
+	var cerr *chunks.ChunkCorruptionErr
+	if errors.As(p.err, &cerr) && cerr.Series == 0 {
+		cerr.Series = p.series
+	}
 	if p.err != nil {
 		p.err = errors.Wrapf(p.err, "cannot populate chunk %d", p.currChkMeta.Ref)
 		return false
@@ -572,10 +711,14 @@ func (p *populateWithDelSeriesIterator) Next() bool {
 	}
 
 	for p.next() {
+		chk := projectChunk(p.currChkMeta.Chunk, p.projection)
 		if p.currDelIter != nil {
+			if chk != p.currChkMeta.Chunk {
+				p.bufIter.Iter = chk.Iterator(nil)
+			}
 			p.curr = p.currDelIter
 		} else {
-			p.curr = p.currChkMeta.Chunk.Iterator(nil)
+			p.curr = chk.Iterator(nil)
 		}
 		if p.curr.Next() {
 			return true
@@ -598,6 +741,8 @@ func (p *populateWithDelSeriesIterator) Seek(t int64) bool {
 
 func (p *populateWithDelSeriesIterator) At() (int64, []byte) { return p.curr.At() }
 
+func (p *populateWithDelSeriesIterator) AtSize() (int64, int) { return chunkenc.AtSize(p.curr) }
+
 func (p *populateWithDelSeriesIterator) Err() error {
 	if err := p.populateWithDelGenericSeriesIterator.Err(); err != nil {
 		return err
@@ -615,17 +760,18 @@ type populateWithDelChunkSeriesIterator struct {
 }
 
 func (p *populateWithDelChunkSeriesIterator) Next() bool {
-	if !p.next() {
+	if p.projection == storage.ProjectionLabels || !p.next() {
 		return false
 	}
 
 	p.curr = p.currChkMeta
 	if p.currDelIter == nil {
+		p.curr.Chunk = projectChunk(p.curr.Chunk, p.projection)
 		return true
 	}
 
 	// Re-encode the chunk if iterator is provider. This means that it has some samples to be deleted or chunk is opened.
-	newChunk := chunkenc.NewBytesChunk()
+	newChunk := chunkenc.NewChunkLike(p.currChkMeta.Chunk)
 	app, err := newChunk.Appender()
 	if err != nil {
 		p.err = err
@@ -656,7 +802,7 @@ func (p *populateWithDelChunkSeriesIterator) Next() bool {
 		return false
 	}
 
-	p.curr.Chunk = newChunk
+	p.curr.Chunk = projectChunk(newChunk, p.projection)
 	p.curr.MaxTime = t
 	return true
 }
@@ -670,7 +816,11 @@ type blockSeriesSet struct {
 	blockBaseSeriesSet
 }
 
-func newBlockSeriesSet(i IndexReader, c ChunkReader, t tombstones.Reader, p index.Postings, mint, maxt int64) storage.SeriesSet {
+func newBlockSeriesSet(i IndexReader, c ChunkReader, t tombstones.Reader, p index.Postings, mint, maxt int64, projection storage.Projection, limits seriesLimits) storage.SeriesSet {
+	if projection == storage.ProjectionLabels {
+		// When you're only looking up metadata (for example series API), you don't need to load any chunks.
+		c = newNopChunkReader()
+	}
 	return &blockSeriesSet{
 		blockBaseSeriesSet{
 			index:      i,
@@ -679,6 +829,8 @@ func newBlockSeriesSet(i IndexReader, c ChunkReader, t tombstones.Reader, p inde
 			p:          p,
 			mint:       mint,
 			maxt:       maxt,
+			projection: projection,
+			limits:     limits,
 			bufLbls:    make(labels.Labels, 0, 10),
 		},
 	}
@@ -702,7 +854,7 @@ type blockChunkSeriesSet struct {
 	blockBaseSeriesSet
 }
 
-func newBlockChunkSeriesSet(i IndexReader, c ChunkReader, t tombstones.Reader, p index.Postings, mint, maxt int64) storage.ChunkSeriesSet {
+func newBlockChunkSeriesSet(i IndexReader, c ChunkReader, t tombstones.Reader, p index.Postings, mint, maxt int64, projection storage.Projection, limits seriesLimits) storage.ChunkSeriesSet {
 	return &blockChunkSeriesSet{
 		blockBaseSeriesSet{
 			index:      i,
@@ -711,6 +863,8 @@ func newBlockChunkSeriesSet(i IndexReader, c ChunkReader, t tombstones.Reader, p
 			p:          p,
 			mint:       mint,
 			maxt:       maxt,
+			projection: projection,
+			limits:     limits,
 			bufLbls:    make(labels.Labels, 0, 10),
 		},
 	}
@@ -784,6 +938,10 @@ func (it *DeletedIterator) At() (int64, []byte) {
 	return it.Iter.At()
 }
 
+func (it *DeletedIterator) AtSize() (int64, int) {
+	return chunkenc.AtSize(it.Iter)
+}
+
 func (it *DeletedIterator) Seek(t int64) bool {
 	if it.Iter.Err() != nil {
 		return false
@@ -21,7 +21,6 @@ import (
 	"strconv"
 	"testing"
 
-	"github.com/conprof/db/tsdb/chunks"
 	"github.com/stretchr/testify/require"
 
 	"github.com/prometheus/prometheus/pkg/labels"
@@ -38,7 +37,7 @@ func BenchmarkPostingsForMatchers(b *testing.B) {
 	defer func() {
 		require.NoError(b, os.RemoveAll(chunkDir))
 	}()
-	h, err := NewHead(nil, nil, nil, 1000, chunkDir, nil, chunks.DefaultWriteBufferSize, DefaultStripeSize, nil)
+	h, err := NewHead(nil, nil, nil, &HeadOptions{ChunkRange: 1000, ChunkDirRoot: chunkDir})
 	require.NoError(b, err)
 	defer func() {
 		require.NoError(b, h.Close())
@@ -147,7 +146,7 @@ func BenchmarkQuerierSelect(b *testing.B) {
 	defer func() {
 		require.NoError(b, os.RemoveAll(chunkDir))
 	}()
-	h, err := NewHead(nil, nil, nil, 1000, chunkDir, nil, chunks.DefaultWriteBufferSize, DefaultStripeSize, nil)
+	h, err := NewHead(nil, nil, nil, &HeadOptions{ChunkRange: 1000, ChunkDirRoot: chunkDir})
 	require.NoError(b, err)
 	defer h.Close()
 	app := h.Appender(context.Background())
@@ -23,6 +23,7 @@ import (
 	"path/filepath"
 	"sort"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -406,7 +407,7 @@ func TestBlockQuerier_AgainstHeadWithOpenChunks(t *testing.T) {
 		},
 	} {
 		t.Run("", func(t *testing.T) {
-			h, err := NewHead(nil, nil, nil, 2*time.Hour.Milliseconds(), "", nil, chunks.DefaultWriteBufferSize, DefaultStripeSize, nil)
+			h, err := NewHead(nil, nil, nil, &HeadOptions{ChunkRange: 2 * time.Hour.Milliseconds()})
 			require.NoError(t, err)
 			defer h.Close()
 
@@ -1551,7 +1552,7 @@ func TestPostingsForMatchers(t *testing.T) {
 	defer func() {
 		require.NoError(t, os.RemoveAll(chunkDir))
 	}()
-	h, err := NewHead(nil, nil, nil, 1000, chunkDir, nil, chunks.DefaultWriteBufferSize, DefaultStripeSize, nil)
+	h, err := NewHead(nil, nil, nil, &HeadOptions{ChunkRange: 1000, ChunkDirRoot: chunkDir})
 	require.NoError(t, err)
 	defer func() {
 		require.NoError(t, h.Close())
@@ -2120,3 +2121,259 @@ func TestBlockBaseSeriesSet(t *testing.T) {
 		require.NoError(t, bcs.Err())
 	}
 }
+
+func TestQuerierProjection(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_projection")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	value := func(ts int64) []byte { return []byte(strings.Repeat("x", int(ts%7)+1)) }
+	lset := labels.FromStrings("a", "b")
+
+	// The older half of the samples is in a block, the newer half in the head.
+	var samples []tsdbutil.Sample
+	for ts := int64(0); ts < 100; ts++ {
+		samples = append(samples, sample{t: ts, v: value(ts)})
+	}
+	createBlock(t, dir, []storage.Series{storage.NewListSeries(lset, samples)})
+
+	db, err := Open(dir, nil, nil, nil)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	app := db.Appender(context.Background())
+	for ts := int64(100); ts < 150; ts++ {
+		_, err := app.Add(lset, ts, value(ts))
+		require.NoError(t, err)
+	}
+	require.NoError(t, app.Commit())
+	require.NoError(t, db.Delete(10, 19, labels.MustNewMatcher(labels.MatchEqual, "a", "b")))
+
+	var expTs []int64
+	for ts := int64(0); ts < 150; ts++ {
+		if ts < 10 || ts > 19 {
+			expTs = append(expTs, ts)
+		}
+	}
+
+	type result struct {
+		ts     []int64
+		values [][]byte
+		sizes  []int
+	}
+	collect := func(res *result, it chunkenc.Iterator) {
+		for it.Next() {
+			ts, v := it.At()
+			_, size := chunkenc.AtSize(it)
+			res.ts = append(res.ts, ts)
+			res.values = append(res.values, v)
+			res.sizes = append(res.sizes, size)
+		}
+		require.NoError(t, it.Err())
+	}
+
+	for _, tc := range []struct {
+		// fn is the legacy func that selects projection.
+		fn         string
+		projection storage.Projection
+	}{
+		{projection: storage.ProjectionFull},
+		{projection: storage.ProjectionLabels},
+		{projection: storage.ProjectionTimestamps},
+		{projection: storage.ProjectionTimestampsAndSizes},
+		{fn: "series", projection: storage.ProjectionLabels},
+		{fn: "timestamps", projection: storage.ProjectionTimestamps},
+		{fn: "rate", projection: storage.ProjectionFull},
+	} {
+		projection := tc.projection
+		t.Run(fmt.Sprintf("func=%s,projection=%d", tc.fn, projection), func(t *testing.T) {
+			hints := &storage.SelectHints{Start: 0, End: 200, Projection: projection}
+			if tc.fn != "" {
+				hints.Func, hints.Projection = tc.fn, storage.ProjectionFull
+			}
+
+			q, err := db.Querier(context.Background(), 0, 200)
+			require.NoError(t, err)
+			ss := q.Select(false, hints, labels.MustNewMatcher(labels.MatchEqual, "a", "b"))
+			require.True(t, ss.Next())
+			require.Equal(t, lset, ss.At().Labels())
+			var samples result
+			collect(&samples, ss.At().Iterator())
+			require.False(t, ss.Next())
+			require.NoError(t, ss.Err())
+			require.NoError(t, q.Close())
+
+			cq, err := db.ChunkQuerier(context.Background(), 0, 200)
+			require.NoError(t, err)
+			css := cq.Select(false, hints, labels.MustNewMatcher(labels.MatchEqual, "a", "b"))
+			require.True(t, css.Next())
+			require.Equal(t, lset, css.At().Labels())
+			var chks result
+			chkIt := css.At().Iterator()
+			for chkIt.Next() {
+				collect(&chks, chkIt.At().Chunk.Iterator(nil))
+			}
+			require.NoError(t, chkIt.Err())
+			require.False(t, css.Next())
+			require.NoError(t, css.Err())
+			require.NoError(t, cq.Close())
+
+			var exp result
+			if projection != storage.ProjectionLabels {
+				exp.ts = expTs
+				for _, ts := range expTs {
+					var v []byte
+					if projection == storage.ProjectionFull {
+						v = value(ts)
+					}
+					exp.values = append(exp.values, v)
+					size := len(v)
+					if projection == storage.ProjectionTimestampsAndSizes {
+						size = len(value(ts))
+					}
+					exp.sizes = append(exp.sizes, size)
+				}
+			}
+			require.Equal(t, exp, samples)
+			require.Equal(t, exp, chks)
+		})
+	}
+}
+
+func TestQuerierPagination(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_pagination")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(dir))
+	}()
+
+	// The older samples of every series are in a block, the newer ones in the head.
+	var series []storage.Series
+	for _, v := range []string{"1", "2", "3"} {
+		var samples []tsdbutil.Sample
+		for ts := int64(0); ts < 100; ts++ {
+			samples = append(samples, sample{t: ts, v: []byte(v)})
+		}
+		series = append(series, storage.NewListSeries(labels.FromStrings("a", v), samples))
+	}
+	createBlock(t, dir, series)
+
+	db, err := Open(dir, nil, nil, nil)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	app := db.Appender(context.Background())
+	for _, s := range series {
+		for ts := int64(100); ts < 150; ts++ {
+			_, err := app.Add(s.Labels(), ts, []byte(s.Labels().Get("a")))
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, app.Commit())
+	require.NoError(t, db.Delete(10, 19, labels.MustNewMatcher(labels.MatchEqual, "a", "1")))
+
+	rng := func(mint, maxt int64) []int64 {
+		var res []int64
+		for ts := mint; ts <= maxt; ts++ {
+			res = append(res, ts)
+		}
+		return res
+	}
+	after := func(v string, partial bool, ts int64) string {
+		return storage.Continuation{Labels: labels.FromStrings("a", v), Partial: partial, T: ts}.Token()
+	}
+
+	for _, tc := range []struct {
+		name  string
+		hints storage.SelectHints
+		exp   map[string][]int64
+	}{
+		{
+			name:  "series limit",
+			hints: storage.SelectHints{Limit: 2, Projection: storage.ProjectionLabels},
+			exp:   map[string][]int64{"1": nil, "2": nil},
+		},
+		{
+			name:  "series limit after series",
+			hints: storage.SelectHints{Limit: 2, Projection: storage.ProjectionLabels, After: after("2", false, 0)},
+			exp:   map[string][]int64{"3": nil},
+		},
+		{
+			name:  "oldest samples",
+			hints: storage.SelectHints{Limit: 1, SampleLimit: 15},
+			exp:   map[string][]int64{"1": append(rng(0, 9), rng(20, 24)...)},
+		},
+		{
+			name:  "newest samples",
+			hints: storage.SelectHints{SampleLimit: 5, Order: storage.OrderNewestFirst},
+			exp:   map[string][]int64{"1": rng(145, 149), "2": rng(145, 149), "3": rng(145, 149)},
+		},
+		{
+			name:  "newest samples after sample",
+			hints: storage.SelectHints{Limit: 2, SampleLimit: 5, Order: storage.OrderNewestFirst, After: after("2", true, 103)},
+			exp:   map[string][]int64{"2": rng(98, 102), "3": rng(145, 149)},
+		},
+		{
+			name:  "oldest samples after sample",
+			hints: storage.SelectHints{SampleLimit: 100, After: after("3", true, 97)},
+			exp:   map[string][]int64{"3": rng(98, 149)},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			hints := tc.hints
+			hints.Start, hints.End = 0, 200
+			matcher := labels.MustNewMatcher(labels.MatchRegexp, "a", ".+")
+
+			q, err := db.Querier(context.Background(), 0, 200)
+			require.NoError(t, err)
+			defer func() { require.NoError(t, q.Close()) }()
+			got := map[string][]int64{}
+			ss := q.Select(false, &hints, matcher)
+			for ss.Next() {
+				var ts []int64
+				it := ss.At().Iterator()
+				for it.Next() {
+					t, _ := it.At()
+					ts = append(ts, t)
+				}
+				require.NoError(t, it.Err())
+				got[ss.At().Labels().Get("a")] = ts
+			}
+			require.NoError(t, ss.Err())
+			require.Equal(t, tc.exp, got)
+
+			cq, err := db.ChunkQuerier(context.Background(), 0, 200)
+			require.NoError(t, err)
+			defer func() { require.NoError(t, cq.Close()) }()
+			got = map[string][]int64{}
+			css := cq.Select(false, &hints, matcher)
+			for css.Next() {
+				var ts []int64
+				chks := css.At().Iterator()
+				for chks.Next() {
+					it := chks.At().Chunk.Iterator(nil)
+					for it.Next() {
+						t, _ := it.At()
+						ts = append(ts, t)
+					}
+					require.NoError(t, it.Err())
+				}
+				require.NoError(t, chks.Err())
+				got[css.At().Labels().Get("a")] = ts
+			}
+			require.NoError(t, css.Err())
+			require.Equal(t, tc.exp, got)
+		})
+	}
+
+	q, err := db.Querier(context.Background(), 0, 200)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, q.Close()) }()
+	ss := q.Select(false, &storage.SelectHints{After: "!"})
+	require.False(t, ss.Next())
+	require.Error(t, ss.Err())
+}
@@ -15,6 +15,7 @@
 package record
 
 import (
+	"math"
 	"sort"
 
 	"github.com/conprof/db/tsdb/encoding"
@@ -36,6 +37,11 @@ const (
 	Samples Type = 2
 	// Tombstones is used to match WAL records of type Tombstones.
 	Tombstones Type = 3
+	// FloatSamples is used to match WAL records of type FloatSamples.
+	FloatSamples Type = 4
+	// OutOfOrderSamples is used to match WAL records of type OutOfOrderSamples.
+	// They hold late samples in the layout of Samples records.
+	OutOfOrderSamples Type = 5
 )
 
 var (
@@ -56,6 +62,14 @@ type RefSample struct {
 	V   []byte
 }
 
+// RefFloatSample is a timestamp/value pair of a numeric series associated with
+// a reference to the series.
+type RefFloatSample struct {
+	Ref uint64
+	T   int64
+	V   float64
+}
+
 // Decoder decodes series, sample, and tombstone records.
 // The zero value is ready to use.
 type Decoder struct {
@@ -68,7 +82,7 @@ func (d *Decoder) Type(rec []byte) Type {
 		return Unknown
 	}
 	switch t := Type(rec[0]); t {
-	case Series, Samples, Tombstones:
+	case Series, Samples, Tombstones, FloatSamples, OutOfOrderSamples:
 		return t
 	}
 	return Unknown
@@ -107,10 +121,11 @@ func (d *Decoder) Series(rec []byte, series []RefSeries) ([]RefSeries, error) {
 }
 
 // Samples appends samples in rec to the given slice.
+// It decodes both Samples and OutOfOrderSamples records.
 func (d *Decoder) Samples(rec []byte, samples []RefSample) ([]RefSample, error) {
 	dec := encoding.Decbuf{B: rec}
 
-	if Type(dec.Byte()) != Samples {
+	if t := Type(dec.Byte()); t != Samples && t != OutOfOrderSamples {
 		return nil, errors.New("invalid record type")
 	}
 	if dec.Len() == 0 {
@@ -144,6 +159,41 @@ func (d *Decoder) Samples(rec []byte, samples []RefSample) ([]RefSample, error)
 	return samples, nil
 }
 
+// FloatSamples appends float samples in rec to the given slice.
+func (d *Decoder) FloatSamples(rec []byte, samples []RefFloatSample) ([]RefFloatSample, error) {
+	dec := encoding.Decbuf{B: rec}
+
+	if Type(dec.Byte()) != FloatSamples {
+		return nil, errors.New("invalid record type")
+	}
+	if dec.Len() == 0 {
+		return samples, nil
+	}
+	var (
+		baseRef  = dec.Be64()
+		baseTime = dec.Be64int64()
+	)
+	for len(dec.B) > 0 && dec.Err() == nil {
+		dref := dec.Varint64()
+		dtime := dec.Varint64()
+		val := dec.Be64()
+
+		samples = append(samples, RefFloatSample{
+			Ref: uint64(int64(baseRef) + dref),
+			T:   baseTime + dtime,
+			V:   math.Float64frombits(val),
+		})
+	}
+
+	if dec.Err() != nil {
+		return nil, errors.Wrapf(dec.Err(), "decode error after %d samples", len(samples))
+	}
+	if len(dec.B) > 0 {
+		return nil, errors.Errorf("unexpected %d bytes left in entry", len(dec.B))
+	}
+	return samples, nil
+}
+
 // Tombstones appends tombstones in rec to the given slice.
 func (d *Decoder) Tombstones(rec []byte, tstones []tombstones.Stone) ([]tombstones.Stone, error) {
 	dec := encoding.Decbuf{B: rec}
@@ -192,8 +242,17 @@ func (e *Encoder) Series(series []RefSeries, b []byte) []byte {
 
 // Samples appends the encoded samples to b and returns the resulting slice.
 func (e *Encoder) Samples(samples []RefSample, b []byte) []byte {
+	return e.samples(Samples, samples, b)
+}
+
+// OutOfOrderSamples appends the encoded late samples to b and returns the resulting slice.
+func (e *Encoder) OutOfOrderSamples(samples []RefSample, b []byte) []byte {
+	return e.samples(OutOfOrderSamples, samples, b)
+}
+
+func (e *Encoder) samples(t Type, samples []RefSample, b []byte) []byte {
 	buf := encoding.Encbuf{B: b}
-	buf.PutByte(byte(Samples))
+	buf.PutByte(byte(t))
 
 	if len(samples) == 0 {
 		return buf.Get()
@@ -214,6 +273,30 @@ func (e *Encoder) Samples(samples []RefSample, b []byte) []byte {
 	return buf.Get()
 }
 
+// FloatSamples appends the encoded float samples to b and returns the resulting slice.
+func (e *Encoder) FloatSamples(samples []RefFloatSample, b []byte) []byte {
+	buf := encoding.Encbuf{B: b}
+	buf.PutByte(byte(FloatSamples))
+
+	if len(samples) == 0 {
+		return buf.Get()
+	}
+
+	// Store base timestamp and base reference number of first sample.
+	// All samples encode their timestamp and ref as delta to those.
+	first := samples[0]
+
+	buf.PutBE64(first.Ref)
+	buf.PutBE64int64(first.T)
+
+	for _, s := range samples {
+		buf.PutVarint64(int64(s.Ref) - int64(first.Ref))
+		buf.PutVarint64(s.T - first.T)
+		buf.PutBE64(math.Float64bits(s.V))
+	}
+	return buf.Get()
+}
+
 // Tombstones appends the encoded tombstones to b and returns the resulting slice.
 func (e *Encoder) Tombstones(tstones []tombstones.Stone, b []byte) []byte {
 	buf := encoding.Encbuf{B: b}
@@ -54,6 +54,19 @@ func TestRecord_EncodeDecode(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, samples, decSamples)
 
+	decSamples, err = dec.Samples(enc.OutOfOrderSamples(samples, nil), nil)
+	require.NoError(t, err)
+	require.Equal(t, samples, decSamples)
+
+	floatSamples := []RefFloatSample{
+		{Ref: 0, T: 12423423, V: 1.2345},
+		{Ref: 123, T: -1231, V: -123},
+		{Ref: 2, T: 0, V: 99999},
+	}
+	decFloatSamples, err := dec.FloatSamples(enc.FloatSamples(floatSamples, nil), nil)
+	require.NoError(t, err)
+	require.Equal(t, floatSamples, decFloatSamples)
+
 	// Intervals get split up into single entries. So we don't get back exactly
 	// what we put in.
 	tstones := []tombstones.Stone{
@@ -105,6 +118,16 @@ func TestRecord_Corrupted(t *testing.T) {
 		require.Equal(t, errors.Cause(err), encoding.ErrInvalidSize)
 	})
 
+	t.Run("Test corrupted float sample record", func(t *testing.T) {
+		samples := []RefFloatSample{
+			{Ref: 0, T: 12423423, V: 1.2345},
+		}
+
+		corrupted := enc.FloatSamples(samples, nil)[:8]
+		_, err := dec.FloatSamples(corrupted, nil)
+		require.Equal(t, errors.Cause(err), encoding.ErrInvalidSize)
+	})
+
 	t.Run("Test corrupted tombstone record", func(t *testing.T) {
 		tstones := []tombstones.Stone{
 			{Ref: 123, Intervals: tombstones.Intervals{
@@ -131,6 +154,13 @@ func TestRecord_Type(t *testing.T) {
 	recordType = dec.Type(enc.Samples(samples, nil))
 	require.Equal(t, Samples, recordType)
 
+	recordType = dec.Type(enc.OutOfOrderSamples(samples, nil))
+	require.Equal(t, OutOfOrderSamples, recordType)
+
+	floatSamples := []RefFloatSample{{Ref: 123, T: 12345, V: 1.2345}}
+	recordType = dec.Type(enc.FloatSamples(floatSamples, nil))
+	require.Equal(t, FloatSamples, recordType)
+
 	tstones := []tombstones.Stone{{Ref: 1, Intervals: tombstones.Intervals{{Mint: 1, Maxt: 2}}}}
 	recordType = dec.Type(enc.Tombstones(tstones, nil))
 	require.Equal(t, Tombstones, recordType)
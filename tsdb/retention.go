@@ -0,0 +1,154 @@
+// Copyright 2021 The Conprof Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"math"
+	"strings"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"golang.org/x/sync/errgroup"
+)
+
+// RetentionRule limits how long the samples of the series matching all of its
+// matchers are kept, e.g. {__name__="goroutine"} for 3 days.
+type RetentionRule struct {
+	Matchers []*labels.Matcher
+	// Duration of the samples to keep, in the unit of the timestamps.
+	Duration int64
+}
+
+// String returns the matchers of the rule as a selector.
+// It identifies the rule in metrics.
+func (r RetentionRule) String() string {
+	ms := make([]string, 0, len(r.Matchers))
+	for _, m := range r.Matchers {
+		ms = append(ms, m.String())
+	}
+	return "{" + strings.Join(ms, ",") + "}"
+}
+
+func validateRetentionRules(rules []RetentionRule) error {
+	for i, r := range rules {
+		if len(r.Matchers) == 0 {
+			return errors.Errorf("retention rule %d has no matchers", i)
+		}
+		if r.Duration <= 0 {
+			return errors.Errorf("retention rule %s has invalid duration %d", r, r.Duration)
+		}
+	}
+	return nil
+}
+
+// applyRetentionRules deletes the samples of the blocks that are beyond a retention rule.
+// Samples are marked deleted with tombstones and the affected blocks are rewritten
+// without them right away. The head is not affected, as it holds the newest samples.
+func (db *DB) applyRetentionRules() error {
+	for _, r := range db.opts.RetentionRules {
+		db.mtx.RLock()
+		blocks := db.blocks[:]
+		db.mtx.RUnlock()
+		if len(blocks) == 0 {
+			return nil
+		}
+
+		newest := int64(math.MinInt64)
+		for _, b := range blocks {
+			if b.Meta().MaxTime > newest {
+				newest = b.Meta().MaxTime
+			}
+		}
+		maxt := newest - r.Duration - 1
+
+		n, reclaimed, err := db.deleteFromBlocks(blocks, maxt, r.Matchers...)
+		if err != nil {
+			return errors.Wrapf(err, "delete samples of rule %s", r)
+		}
+		if n == 0 {
+			continue
+		}
+		if reclaimed > 0 {
+			db.metrics.ruleReclaimedBytes.WithLabelValues(r.String()).Add(float64(reclaimed))
+		}
+		level.Info(db.logger).Log("msg", "Deleted samples beyond retention rule", "rule", r, "maxt", maxt, "blocks", n, "reclaimed_bytes", reclaimed)
+	}
+	return nil
+}
+
+// deleteFromBlocks adds tombstones for the samples of the matching series up to maxt
+// and rewrites the blocks that got new tombstones without the deleted samples.
+// It returns the number of rewritten blocks and the bytes reclaimed by rewriting them.
+func (db *DB) deleteFromBlocks(blocks []*Block, maxt int64, ms ...*labels.Matcher) (int, int64, error) {
+	db.cmtx.Lock()
+	defer db.cmtx.Unlock()
+
+	var (
+		g     errgroup.Group
+		added = make([]bool, len(blocks))
+	)
+	for i, b := range blocks {
+		if b.OverlapsClosedInterval(math.MinInt64, maxt) {
+			g.Go(func(i int, b *Block) func() error {
+				return func() error {
+					var err error
+					added[i], err = b.delete(math.MinInt64, maxt, ms...)
+					return err
+				}
+			}(i, b))
+		}
+	}
+	if err := g.Wait(); err != nil {
+		return 0, 0, err
+	}
+
+	var deleted []*Block
+	for i, b := range blocks {
+		if added[i] {
+			deleted = append(deleted, b)
+		}
+	}
+	if len(deleted) == 0 {
+		return 0, 0, nil
+	}
+
+	before := blocksSize(deleted)
+	uids, err := db.cleanTombstones(deleted)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "clean tombstones")
+	}
+	rewritten := make(map[ulid.ULID]struct{}, len(uids))
+	for _, uid := range uids {
+		rewritten[uid] = struct{}{}
+	}
+	var after int64
+	db.mtx.RLock()
+	for _, b := range db.blocks {
+		if _, ok := rewritten[b.Meta().ULID]; ok {
+			after += b.Size()
+		}
+	}
+	db.mtx.RUnlock()
+	return len(deleted), before - after, nil
+}
+
+func blocksSize(blocks []*Block) int64 {
+	var size int64
+	for _, b := range blocks {
+		size += b.Size()
+	}
+	return size
+}
@@ -0,0 +1,378 @@
+// Copyright 2021 The Conprof Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"context"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+
+	"github.com/conprof/db/storage"
+	tsdb_errors "github.com/conprof/db/tsdb/errors"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+var (
+	// ErrNoTenant is returned if the context of a request to a MultiTenantDB has no tenant.
+	ErrNoTenant = errors.New("no tenant in context")
+	// ErrInvalidTenant is returned for tenant IDs that cannot be used as directory names.
+	ErrInvalidTenant = errors.New("invalid tenant ID")
+
+	tenantRe = regexp.MustCompile(`^[a-zA-Z0-9_\-.]+$`)
+)
+
+type tenantContextKey struct{}
+
+// WithTenant returns a context for requests of the tenant to a MultiTenantDB.
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantContextKey{}, tenant)
+}
+
+// TenantFromContext returns the tenant set with WithTenant.
+func TenantFromContext(ctx context.Context) (string, bool) {
+	tenant, ok := ctx.Value(tenantContextKey{}).(string)
+	return tenant, ok
+}
+
+func validateTenant(tenant string) error {
+	if !tenantRe.MatchString(tenant) || tenant == "." || tenant == ".." {
+		return errors.Wrapf(ErrInvalidTenant, "%q", tenant)
+	}
+	return nil
+}
+
+// MultiTenantOptions are the options of a MultiTenantDB.
+type MultiTenantOptions struct {
+	// Options of the DB of every tenant. nil uses DefaultOptions.
+	Options *Options
+
+	// TenantOptions returns the options of a single tenant, e.g. with its own
+	// RetentionDuration and MaxBytes. If it returns nil, Options are used.
+	// It is called whenever the DB of a tenant is opened.
+	TenantOptions func(tenant string) *Options
+}
+
+// MultiTenantDB isolates the data of tenants in a single process.
+// Every tenant has a DB with its own head, WAL and blocks in a subdirectory
+// named after the tenant, so retention and size limits apply per tenant.
+// The tenant of appenders and queriers is taken from their context, see WithTenant.
+type MultiTenantDB struct {
+	dir    string
+	logger log.Logger
+	reg    prometheus.Registerer
+	opts   *MultiTenantOptions
+
+	mtx     sync.RWMutex
+	tenants map[string]*tenantDB
+	closed  bool
+}
+
+type tenantDB struct {
+	*DB
+	reg *tenantRegisterer
+}
+
+// OpenMultiTenant opens or creates a MultiTenantDB in the given directory.
+// The DBs of all tenants found in it are opened, so that their retention is
+// enforced even if they are not written to anymore.
+// Metrics of the DBs are registered with a "tenant" label.
+func OpenMultiTenant(dir string, l log.Logger, r prometheus.Registerer, opts *MultiTenantOptions) (_ *MultiTenantDB, returnedErr error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	if l == nil {
+		l = log.NewNopLogger()
+	}
+	if opts == nil {
+		opts = &MultiTenantOptions{}
+	}
+	db := &MultiTenantDB{
+		dir:     dir,
+		logger:  l,
+		reg:     r,
+		opts:    opts,
+		tenants: map[string]*tenantDB{},
+	}
+	defer func() {
+		if returnedErr != nil {
+			returnedErr = tsdb_errors.NewMulti(returnedErr, db.Close()).Err()
+		}
+	}()
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if !f.IsDir() || validateTenant(f.Name()) != nil {
+			continue
+		}
+		if _, err := db.open(f.Name()); err != nil {
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+// open opens the DB of the tenant. It must be called with mtx held.
+func (db *MultiTenantDB) open(tenant string) (*tenantDB, error) {
+	opts := db.opts.Options
+	if db.opts.TenantOptions != nil {
+		if o := db.opts.TenantOptions(tenant); o != nil {
+			opts = o
+		}
+	}
+	if opts == nil {
+		opts = DefaultOptions()
+	} else {
+		// Options are shared by tenants and get defaulted when opening a DB.
+		o := *opts
+		opts = &o
+	}
+
+	var reg *tenantRegisterer
+	if db.reg != nil {
+		reg = &tenantRegisterer{Registerer: prometheus.WrapRegistererWith(prometheus.Labels{"tenant": tenant}, db.reg)}
+	}
+	tdb, err := Open(filepath.Join(db.dir, tenant), log.With(db.logger, "tenant", tenant), reg.registerer(), opts)
+	if err != nil {
+		reg.unregister()
+		return nil, errors.Wrapf(err, "open tenant %s", tenant)
+	}
+	t := &tenantDB{DB: tdb, reg: reg}
+	db.tenants[tenant] = t
+	return t, nil
+}
+
+// tenant returns the DB of the tenant of the context.
+// If create is false and the tenant has no DB, nil is returned.
+func (db *MultiTenantDB) tenant(ctx context.Context, create bool) (*DB, error) {
+	tenant, ok := TenantFromContext(ctx)
+	if !ok {
+		return nil, ErrNoTenant
+	}
+	if err := validateTenant(tenant); err != nil {
+		return nil, err
+	}
+
+	db.mtx.RLock()
+	t, ok := db.tenants[tenant]
+	closed := db.closed
+	db.mtx.RUnlock()
+	switch {
+	case closed:
+		return nil, errors.New("DB is closed")
+	case ok:
+		return t.DB, nil
+	case !create:
+		return nil, nil
+	}
+
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	if db.closed {
+		return nil, errors.New("DB is closed")
+	}
+	if t, ok := db.tenants[tenant]; ok {
+		return t.DB, nil
+	}
+	t, err := db.open(tenant)
+	if err != nil {
+		return nil, err
+	}
+	return t.DB, nil
+}
+
+// Tenant returns the DB of a tenant, e.g. to delete series or compact it.
+// The DB of a tenant that does not exist yet is created.
+// It must not be closed by the caller.
+func (db *MultiTenantDB) Tenant(tenant string) (*DB, error) {
+	return db.tenant(WithTenant(context.Background(), tenant), true)
+}
+
+// Tenants returns the IDs of all tenants, sorted.
+func (db *MultiTenantDB) Tenants() []string {
+	db.mtx.RLock()
+	defer db.mtx.RUnlock()
+
+	tenants := make([]string, 0, len(db.tenants))
+	for tenant := range db.tenants {
+		tenants = append(tenants, tenant)
+	}
+	sort.Strings(tenants)
+	return tenants
+}
+
+// Appender returns an appender against the DB of the tenant of the context.
+// The DB of the tenant is created on first use. If the tenant is missing or
+// its DB cannot be opened, all calls of the appender fail.
+func (db *MultiTenantDB) Appender(ctx context.Context) storage.Appender {
+	tdb, err := db.tenant(ctx, true)
+	if err != nil {
+		return errAppender{err: err}
+	}
+	return tdb.Appender(ctx)
+}
+
+// Querier returns a querier against the DB of the tenant of the context.
+// Tenants that have no DB yet have no data.
+func (db *MultiTenantDB) Querier(ctx context.Context, mint, maxt int64) (storage.Querier, error) {
+	tdb, err := db.tenant(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	if tdb == nil {
+		return storage.NoopQuerier(), nil
+	}
+	return tdb.Querier(ctx, mint, maxt)
+}
+
+// ChunkQuerier returns a chunk querier against the DB of the tenant of the context.
+// Tenants that have no DB yet have no data.
+func (db *MultiTenantDB) ChunkQuerier(ctx context.Context, mint, maxt int64) (storage.ChunkQuerier, error) {
+	tdb, err := db.tenant(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	if tdb == nil {
+		return storage.NoopChunkedQuerier(), nil
+	}
+	return tdb.ChunkQuerier(ctx, mint, maxt)
+}
+
+// StartTime returns the oldest timestamp stored by any tenant.
+// Without tenants it returns the start time of an empty DB.
+func (db *MultiTenantDB) StartTime() (int64, error) {
+	db.mtx.RLock()
+	defer db.mtx.RUnlock()
+
+	// Like an empty DB, which starts at the min time of its empty head.
+	start := int64(math.MaxInt64)
+	for _, t := range db.tenants {
+		s, err := t.StartTime()
+		if err != nil {
+			return 0, err
+		}
+		if s < start {
+			start = s
+		}
+	}
+	return start, nil
+}
+
+// DeleteTenant closes the DB of the tenant and deletes all of its data.
+// Appenders and queriers of the tenant must not be used anymore.
+func (db *MultiTenantDB) DeleteTenant(tenant string) error {
+	if err := validateTenant(tenant); err != nil {
+		return err
+	}
+
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+
+	if t, ok := db.tenants[tenant]; ok {
+		delete(db.tenants, tenant)
+		err := t.Close()
+		t.reg.unregister()
+		if err != nil {
+			return errors.Wrapf(err, "close tenant %s", tenant)
+		}
+	}
+	return os.RemoveAll(filepath.Join(db.dir, tenant))
+}
+
+// Close closes the DBs of all tenants.
+func (db *MultiTenantDB) Close() error {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+
+	errs := tsdb_errors.NewMulti()
+	for tenant, t := range db.tenants {
+		errs.Add(errors.Wrapf(t.Close(), "close tenant %s", tenant))
+		t.reg.unregister()
+	}
+	db.tenants = map[string]*tenantDB{}
+	db.closed = true
+	return errs.Err()
+}
+
+// tenantRegisterer remembers the collectors registered by the DB of a tenant,
+// so that they can be unregistered when the tenant is deleted and a new DB
+// of the tenant can register them again.
+type tenantRegisterer struct {
+	prometheus.Registerer
+
+	mtx        sync.Mutex
+	collectors []prometheus.Collector
+}
+
+// registerer returns r as a prometheus.Registerer that is nil if r is nil.
+func (r *tenantRegisterer) registerer() prometheus.Registerer {
+	if r == nil {
+		return nil
+	}
+	return r
+}
+
+func (r *tenantRegisterer) Register(c prometheus.Collector) error {
+	if err := r.Registerer.Register(c); err != nil {
+		return err
+	}
+	r.mtx.Lock()
+	r.collectors = append(r.collectors, c)
+	r.mtx.Unlock()
+	return nil
+}
+
+func (r *tenantRegisterer) MustRegister(cs ...prometheus.Collector) {
+	for _, c := range cs {
+		if err := r.Register(c); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func (r *tenantRegisterer) unregister() {
+	if r == nil {
+		return
+	}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	for _, c := range r.collectors {
+		r.Registerer.Unregister(c)
+	}
+	r.collectors = nil
+}
+
+// errAppender fails all appends with err.
+type errAppender struct {
+	err error
+}
+
+func (a errAppender) Add(labels.Labels, int64, []byte) (uint64, error) { return 0, a.err }
+func (a errAppender) AddFast(uint64, int64, []byte) error              { return a.err }
+func (a errAppender) AddFloat(labels.Labels, int64, float64) (uint64, error) {
+	return 0, a.err
+}
+func (a errAppender) AddFloatFast(uint64, int64, float64) error { return a.err }
+func (a errAppender) Commit() error                             { return a.err }
+func (a errAppender) Rollback() error                           { return nil }
@@ -0,0 +1,170 @@
+// Copyright 2021 The Conprof Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/conprof/db/storage"
+	"github.com/conprof/db/tsdb/tsdbutil"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	prom_testutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/stretchr/testify/require"
+)
+
+var _ storage.Storage = &MultiTenantDB{}
+
+func TestMultiTenantDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "multi_tenant")
+	require.NoError(t, err)
+	defer func() { require.NoError(t, os.RemoveAll(dir)) }()
+
+	opts := &MultiTenantOptions{
+		Options: DefaultOptions(),
+		TenantOptions: func(tenant string) *Options {
+			if tenant != "b" {
+				return nil
+			}
+			o := DefaultOptions()
+			o.MaxBytes = 1024
+			return o
+		},
+	}
+	reg := prometheus.NewRegistry()
+	db, err := OpenMultiTenant(dir, nil, reg, opts)
+	require.NoError(t, err)
+
+	ctxA := WithTenant(context.Background(), "a")
+	ctxB := WithTenant(context.Background(), "b")
+	lset := labels.FromStrings("__name__", "heap")
+
+	for i, ctx := range []context.Context{ctxA, ctxB, ctxB} {
+		app := db.Appender(ctx)
+		_, err := app.Add(lset, int64(i), []byte{byte(i)})
+		require.NoError(t, err)
+		require.NoError(t, app.Commit())
+	}
+	require.Equal(t, []string{"a", "b"}, db.Tenants())
+
+	// Options are applied per tenant and are not shared.
+	tdb, err := db.Tenant("a")
+	require.NoError(t, err)
+	require.Equal(t, int64(0), tdb.opts.MaxBytes)
+	tdb, err = db.Tenant("b")
+	require.NoError(t, err)
+	require.Equal(t, int64(1024), tdb.opts.MaxBytes)
+	require.Equal(t, filepath.Join(dir, "b"), tdb.Dir())
+
+	matcher := labels.MustNewMatcher(labels.MatchEqual, "__name__", "heap")
+	q, err := db.Querier(ctxA, 0, 10)
+	require.NoError(t, err)
+	require.Equal(t, map[string][]tsdbutil.Sample{
+		lset.String(): {sample{t: 0, v: []byte{0}}},
+	}, query(t, q, matcher))
+	q, err = db.Querier(ctxB, 0, 10)
+	require.NoError(t, err)
+	require.Equal(t, map[string][]tsdbutil.Sample{
+		lset.String(): {sample{t: 1, v: []byte{1}}, sample{t: 2, v: []byte{2}}},
+	}, query(t, q, matcher))
+
+	// Unknown tenants have no data and no DB is created for them.
+	q, err = db.Querier(WithTenant(context.Background(), "c"), 0, 10)
+	require.NoError(t, err)
+	require.Equal(t, map[string][]tsdbutil.Sample{}, query(t, q, matcher))
+	require.Equal(t, []string{"a", "b"}, db.Tenants())
+
+	// Metrics of the tenants are told apart by label.
+	require.Equal(t, 2.0, prom_testutil.ToFloat64(tdb.head.metrics.samplesAppended))
+	mfs, err := reg.Gather()
+	require.NoError(t, err)
+	require.NotEmpty(t, mfs)
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			tenant := ""
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "tenant" {
+					tenant = l.GetValue()
+				}
+			}
+			require.Contains(t, []string{"a", "b"}, tenant, mf.GetName())
+		}
+	}
+
+	// Requests without a valid tenant fail.
+	_, err = db.Appender(context.Background()).Add(lset, 0, nil)
+	require.Equal(t, ErrNoTenant, err)
+	_, err = db.Querier(context.Background(), 0, 10)
+	require.Equal(t, ErrNoTenant, err)
+	_, err = db.ChunkQuerier(WithTenant(context.Background(), "../a"), 0, 10)
+	require.Equal(t, ErrInvalidTenant, errors.Cause(err))
+
+	// Deleted tenants lose their data and can be recreated.
+	require.NoError(t, db.DeleteTenant("a"))
+	require.Equal(t, []string{"b"}, db.Tenants())
+	_, err = os.Stat(filepath.Join(dir, "a"))
+	require.True(t, os.IsNotExist(err))
+
+	app := db.Appender(ctxA)
+	_, err = app.Add(lset, 5, []byte{5})
+	require.NoError(t, err)
+	require.NoError(t, app.Commit())
+	require.NoError(t, db.Close())
+
+	// Existing tenants are opened again, with their data replayed from the WAL.
+	db, err = OpenMultiTenant(dir, nil, prometheus.NewRegistry(), opts)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+	require.Equal(t, []string{"a", "b"}, db.Tenants())
+
+	q, err = db.Querier(ctxA, 0, 10)
+	require.NoError(t, err)
+	require.Equal(t, map[string][]tsdbutil.Sample{
+		lset.String(): {sample{t: 5, v: []byte{5}}},
+	}, query(t, q, matcher))
+}
+
+func TestMultiTenantDB_StartTime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "multi_tenant_start")
+	require.NoError(t, err)
+	defer func() { require.NoError(t, os.RemoveAll(dir)) }()
+
+	empty := openTestDB(t, nil, nil)
+	defer func() { require.NoError(t, empty.Close()) }()
+	emptyStart, emptyErr := empty.StartTime()
+
+	db, err := OpenMultiTenant(dir, nil, nil, &MultiTenantOptions{Options: DefaultOptions()})
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+
+	// Without tenants it is as empty as a DB without samples.
+	start, err := db.StartTime()
+	require.Equal(t, emptyErr, err)
+	require.Equal(t, emptyStart, start)
+
+	for i, tenant := range []string{"a", "b"} {
+		app := db.Appender(WithTenant(context.Background(), tenant))
+		_, err := app.Add(labels.FromStrings("__name__", "heap"), int64(10-i), []byte{byte(i)})
+		require.NoError(t, err)
+		require.NoError(t, app.Commit())
+	}
+	start, err = db.StartTime()
+	require.NoError(t, err)
+	require.Equal(t, int64(9), start)
+}
@@ -1,37 +1,101 @@
 package tsdb
 
-import "github.com/conprof/db/tsdb/chunkenc"
+import (
+	"github.com/conprof/db/storage"
+	"github.com/conprof/db/tsdb/chunkenc"
+)
 
-type timestampChunkReader struct {
-	r ChunkReader
+// projectChunk returns a chunk whose iterators only return the parts of the
+// samples selected by the projection. Labels only projections do not read
+// chunks at all, see newNopChunkReader.
+func projectChunk(c chunkenc.Chunk, p storage.Projection) chunkenc.Chunk {
+	switch p {
+	case storage.ProjectionTimestamps:
+		return &TimestampChunk{c}
+	case storage.ProjectionTimestampsAndSizes:
+		return &sizeChunk{c}
+	}
+	return c
 }
 
-func newTimestampChunkReader(r ChunkReader) ChunkReader {
-	return timestampChunkReader{
-		r: r,
-	}
+// TimestampChunk only iterates over the timestamps of the samples of a chunk.
+type TimestampChunk struct {
+	chunkenc.Chunk
 }
 
-func (cr timestampChunkReader) Chunk(ref uint64) (chunkenc.Chunk, error) {
-	c, err := cr.r.Chunk(ref)
-	if err != nil {
-		return nil, err
-	}
-	return &TimestampChunk{c}, nil
+func (c *TimestampChunk) Iterator(_ chunkenc.Iterator) chunkenc.Iterator {
+	return timestampIterator{c.Chunk.Iterator(&chunkenc.BytesTimestampOnlyIterator{})}
 }
 
-func (cr timestampChunkReader) Close() error { return cr.r.Close() }
+// Unwrap returns the underlying chunk, see chunkenc.NewChunkLike.
+func (c *TimestampChunk) Unwrap() chunkenc.Chunk {
+	return c.Chunk
+}
 
-type TimestampChunk struct {
+// timestampIterator drops the values of chunks that do not support iterating
+// over timestamps only, and of the samples the head serves from its buffer.
+type timestampIterator struct {
+	chunkenc.Iterator
+}
+
+func (it timestampIterator) At() (int64, []byte) {
+	t, _ := it.Iterator.At()
+	return t, nil
+}
+
+// sizeChunk iterates over the timestamps of the samples of a chunk and the sizes of their values.
+type sizeChunk struct {
 	chunkenc.Chunk
 }
 
-func (c *TimestampChunk) Iterator(_ chunkenc.Iterator) chunkenc.Iterator {
-	return c.Chunk.Iterator(&chunkenc.BytesTimestampOnlyIterator{})
+func (c *sizeChunk) Iterator(reuse chunkenc.Iterator) chunkenc.Iterator {
+	it, ok := reuse.(*sizeIterator)
+	if !ok {
+		it = &sizeIterator{}
+	}
+	// Sizes are read from the infos of chunks that store them, so values are not read.
+	inner := it.Iterator
+	_, timestampsOnly := inner.(*chunkenc.BytesTimestampOnlyIterator)
+	it.infos = chunkenc.HasSampleInfo(c.Chunk)
+	switch {
+	case it.infos && !timestampsOnly:
+		inner = &chunkenc.BytesTimestampOnlyIterator{}
+	case !it.infos && timestampsOnly:
+		inner = nil
+	}
+	it.Iterator = c.Chunk.Iterator(inner)
+	return it
+}
+
+// Unwrap returns the underlying chunk, see chunkenc.NewChunkLike.
+func (c *sizeChunk) Unwrap() chunkenc.Chunk {
+	return c.Chunk
+}
+
+// sizeIterator returns the sizes of the values of an iterator instead of the values.
+type sizeIterator struct {
+	chunkenc.Iterator
+	// infos is set if the sizes are read from the infos of the samples
+	// rather than from their values.
+	infos bool
+}
+
+func (it *sizeIterator) At() (int64, []byte) {
+	t, _ := it.Iterator.At()
+	return t, nil
+}
+
+func (it *sizeIterator) AtSize() (int64, int) {
+	if it.infos {
+		t, info, _ := chunkenc.AtInfo(it.Iterator)
+		return t, info.Size
+	}
+	t, v := it.Iterator.At()
+	return t, len(v)
 }
 
 func ReencodeChunk(c chunkenc.Chunk, it chunkenc.Iterator) (chunkenc.Iterator, chunkenc.Chunk, error) {
-	newChunk := chunkenc.NewBytesChunk()
+	newChunk := chunkenc.NewChunkLike(c)
 	app, err := newChunk.Appender()
 	if err != nil {
 		return nil, nil, err
@@ -143,16 +143,17 @@ func Checkpoint(logger log.Logger, w *WAL, from, to int, keep func(id uint64) bo
 	r := NewReader(sgmReader)
 
 	var (
-		series  []record.RefSeries
-		samples []record.RefSample
-		tstones []tombstones.Stone
-		dec     record.Decoder
-		enc     record.Encoder
-		buf     []byte
-		recs    [][]byte
+		series       []record.RefSeries
+		samples      []record.RefSample
+		floatSamples []record.RefFloatSample
+		tstones      []tombstones.Stone
+		dec          record.Decoder
+		enc          record.Encoder
+		buf          []byte
+		recs         [][]byte
 	)
 	for r.Next() {
-		series, samples, tstones = series[:0], samples[:0], tstones[:0]
+		series, samples, floatSamples, tstones = series[:0], samples[:0], floatSamples[:0], tstones[:0]
 
 		// We don't reset the buffer since we batch up multiple records
 		// before writing them to the checkpoint.
@@ -179,7 +180,7 @@ func Checkpoint(logger log.Logger, w *WAL, from, to int, keep func(id uint64) bo
 			stats.TotalSeries += len(series)
 			stats.DroppedSeries += len(series) - len(repl)
 
-		case record.Samples:
+		case record.Samples, record.OutOfOrderSamples:
 			samples, err = dec.Samples(rec, samples)
 			if err != nil {
 				return nil, errors.Wrap(err, "decode samples")
@@ -192,11 +193,33 @@ func Checkpoint(logger log.Logger, w *WAL, from, to int, keep func(id uint64) bo
 				}
 			}
 			if len(repl) > 0 {
-				buf = enc.Samples(repl, buf)
+				if dec.Type(rec) == record.OutOfOrderSamples {
+					buf = enc.OutOfOrderSamples(repl, buf)
+				} else {
+					buf = enc.Samples(repl, buf)
+				}
 			}
 			stats.TotalSamples += len(samples)
 			stats.DroppedSamples += len(samples) - len(repl)
 
+		case record.FloatSamples:
+			floatSamples, err = dec.FloatSamples(rec, floatSamples)
+			if err != nil {
+				return nil, errors.Wrap(err, "decode float samples")
+			}
+			// Drop irrelevant samples in place.
+			repl := floatSamples[:0]
+			for _, s := range floatSamples {
+				if s.T >= mint {
+					repl = append(repl, s)
+				}
+			}
+			if len(repl) > 0 {
+				buf = enc.FloatSamples(repl, buf)
+			}
+			stats.TotalSamples += len(floatSamples)
+			stats.DroppedSamples += len(floatSamples) - len(repl)
+
 		case record.Tombstones:
 			tstones, err = dec.Tombstones(rec, tstones)
 			if err != nil {
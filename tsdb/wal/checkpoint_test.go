@@ -176,6 +176,15 @@ func TestCheckpoint(t *testing.T) {
 					{Ref: 3, T: last + 30000, V: []byte(strconv.Itoa(i))},
 				}, nil)
 				require.NoError(t, w.Log(b))
+				b = enc.FloatSamples([]record.RefFloatSample{
+					{Ref: 4, T: last, V: float64(i)},
+					{Ref: 5, T: last + 10000, V: float64(i)},
+				}, nil)
+				require.NoError(t, w.Log(b))
+				b = enc.OutOfOrderSamples([]record.RefSample{
+					{Ref: 2, T: last - 50, V: []byte(strconv.Itoa(i))},
+				}, nil)
+				require.NoError(t, w.Log(b))
 
 				last += 100
 			}
@@ -200,6 +209,7 @@ func TestCheckpoint(t *testing.T) {
 
 			var dec record.Decoder
 			var series []record.RefSeries
+			var floatSamples, oooSamples int
 			r := NewReader(sr)
 
 			for r.Next() {
@@ -215,9 +225,25 @@ func TestCheckpoint(t *testing.T) {
 					for _, s := range samples {
 						require.GreaterOrEqual(t, s.T, last/2, "sample with wrong timestamp")
 					}
+				case record.OutOfOrderSamples:
+					samples, err := dec.Samples(rec, nil)
+					require.NoError(t, err)
+					for _, s := range samples {
+						require.GreaterOrEqual(t, s.T, last/2, "sample with wrong timestamp")
+					}
+					oooSamples += len(samples)
+				case record.FloatSamples:
+					samples, err := dec.FloatSamples(rec, nil)
+					require.NoError(t, err)
+					for _, s := range samples {
+						require.GreaterOrEqual(t, s.T, last/2, "sample with wrong timestamp")
+					}
+					floatSamples += len(samples)
 				}
 			}
 			require.NoError(t, r.Err())
+			require.Greater(t, floatSamples, 0, "float samples dropped")
+			require.Greater(t, oooSamples, 0, "out-of-order samples dropped")
 			require.Equal(t, []record.RefSeries{
 				{Ref: 0, Labels: labels.FromStrings("a", "b", "c", "0")},
 				{Ref: 2, Labels: labels.FromStrings("a", "b", "c", "2")},